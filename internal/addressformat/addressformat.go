@@ -0,0 +1,91 @@
+// Package addressformat writes addresses the way the postal service of their
+// country expects them on a letter, e.g. the postal code before the city in
+// Germany and after the state in the US. Every format ends with the country
+// name in capitals, as for international mail.
+package addressformat
+
+import (
+	"html"
+	"server/internal/addressrules"
+	"server/internal/model"
+	"strings"
+)
+
+// Lines returns the lines of a in the convention of its country
+func Lines(a model.Address) []string {
+	code, known := addressrules.NormalizeCountry(a.Country)
+	tmpl, ok := templates[code]
+	if !ok {
+		tmpl = cityStateZip
+	}
+
+	fields := map[string]string{
+		"addr1": a.Addr_1,
+		"addr2": a.Addr_2,
+		"zip":   a.Zip,
+		"city":  a.City,
+		"state": a.State,
+	}
+	lines := []string{}
+	for _, line := range tmpl {
+		if line = fill(line, fields); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	country := strings.ToUpper(a.Country)
+	if known {
+		country = strings.ToUpper(addressrules.CountryName(code))
+	}
+	if country != "" {
+		lines = append(lines, country)
+	}
+	return lines
+}
+
+// fill replaces the fields of a template line with their values. An empty
+// field is left out together with the separator before it, or after it at
+// the start of the line, so "{city}, {state} {zip}" without a state is
+// "Springfield 12345".
+func fill(line string, fields map[string]string) string {
+	var b strings.Builder
+	sep := ""
+	for {
+		start := strings.IndexByte(line, '{')
+		end := strings.IndexByte(line, '}')
+		if start < 0 || end < start {
+			return b.String()
+		}
+		sep += line[:start]
+		name := line[start+1 : end]
+		line = line[end+1:]
+
+		value := strings.Join(strings.Fields(fields[strings.ToLower(name)]), " ")
+		if name != strings.ToLower(name) {
+			value = strings.ToUpper(value)
+		}
+		if value == "" {
+			sep = ""
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(value)
+		sep = ""
+	}
+}
+
+// Single returns the lines of a on one line, separated by commas
+func Single(a model.Address) string {
+	return strings.Join(Lines(a), ", ")
+}
+
+// HTML returns the lines of a, escaped and separated by <br>
+func HTML(a model.Address) string {
+	lines := Lines(a)
+	for i, line := range lines {
+		lines[i] = html.EscapeString(line)
+	}
+	return strings.Join(lines, "<br>")
+}
@@ -0,0 +1,101 @@
+package addressformat
+
+import (
+	"server/internal/model"
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a    model.Address
+		want []string
+	}{
+		{
+			"DE puts the postal code before the city",
+			model.Address{Addr_1: "Invalidenstraße 1", Addr_2: "2. OG", Zip: "10115", City: "Berlin", Country: "DE"},
+			[]string{"Invalidenstraße 1", "2. OG", "10115 Berlin", "GERMANY"},
+		},
+		{
+			"US writes city, state and zip",
+			model.Address{Addr_1: "350 5th Ave", Zip: "10118", City: "New York", State: "NY", Country: "US"},
+			[]string{"350 5th Ave", "New York, NY 10118", "UNITED STATES"},
+		},
+		{
+			"GB capitalizes the post town",
+			model.Address{Addr_1: "10 Downing Street", Zip: "SW1A 2AA", City: "London", Country: "GB"},
+			[]string{"10 Downing Street", "LONDON", "SW1A 2AA", "UNITED KINGDOM"},
+		},
+		{
+			"FR capitalizes the city after the postal code",
+			model.Address{Addr_1: "5 Avenue Anatole France", Zip: "75007", City: "Paris", Country: "FR"},
+			[]string{"5 Avenue Anatole France", "75007 PARIS", "FRANCE"},
+		},
+		{
+			"an empty state drops its separator",
+			model.Address{Addr_1: "1 Main St", Zip: "12345", City: "Springfield", Country: "US"},
+			[]string{"1 Main St", "Springfield 12345", "UNITED STATES"},
+		},
+		{
+			"an empty state at the end drops its separator",
+			model.Address{Addr_1: "Av. Paulista 1000", Zip: "01310-100", City: "São Paulo", Country: "BR"},
+			[]string{"Av. Paulista 1000", "São Paulo", "01310-100", "BRAZIL"},
+		},
+		{
+			"an empty city drops the separator after it",
+			model.Address{Addr_1: "1 Main St", Zip: "12345", State: "IL", Country: "US"},
+			[]string{"1 Main St", "IL 12345", "UNITED STATES"},
+		},
+		{
+			"unknown countries fall back to city, state and zip",
+			model.Address{Addr_1: "1 Long St", Zip: "8001", City: "Cape Town", State: "WC", Country: "ZA"},
+			[]string{"1 Long St", "Cape Town WC 8001", "SOUTH AFRICA"},
+		},
+		{
+			"unknown country names are kept",
+			model.Address{Addr_1: "1 Main St", City: "Atlantis", Country: "Atlantis"},
+			[]string{"1 Main St", "Atlantis", "ATLANTIS"},
+		},
+		{
+			"country names are recognized",
+			model.Address{Addr_1: "Invalidenstraße 1", Zip: "10115", City: "Berlin", Country: "Germany"},
+			[]string{"Invalidenstraße 1", "10115 Berlin", "GERMANY"},
+		},
+	}
+	for _, tc := range tests {
+		got := Lines(tc.a)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: Lines = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSingle(t *testing.T) {
+	a := model.Address{Addr_1: "350 5th Ave", Addr_2: "Floor 86", Zip: "10118", City: "New York", State: "NY", Country: "US"}
+	want := "350 5th Ave, Floor 86, New York, NY 10118, UNITED STATES"
+	if got := Single(a); got != want {
+		t.Errorf("Single = %q, want %q", got, want)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		a    model.Address
+		want string
+	}{
+		{
+			model.Address{Addr_1: "Invalidenstraße 1", Zip: "10115", City: "Berlin", Country: "DE"},
+			"Invalidenstraße 1<br>10115 Berlin<br>GERMANY",
+		},
+		{
+			model.Address{Addr_1: "<b>Smith & Sons</b>", Addr_2: `c/o "Ann"`, Zip: "10115", City: "Berlin", Country: "DE"},
+			"&lt;b&gt;Smith &amp; Sons&lt;/b&gt;<br>c/o &#34;Ann&#34;<br>10115 Berlin<br>GERMANY",
+		},
+	}
+	for _, tc := range tests {
+		if got := HTML(tc.a); got != tc.want {
+			t.Errorf("HTML(%q) = %q, want %q", tc.a.Addr_1, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package addressformat
+
+// template is the lines of an address in a country, before the country
+// line. Fields are written {addr1}, {addr2}, {zip}, {city} and {state}; in
+// capitals, like {CITY}, they are uppercased. Empty fields are dropped with
+// their separator, and lines left empty altogether.
+type template []string
+
+var (
+	// zipCity is the order of most of Europe
+	zipCity = template{"{addr1}", "{addr2}", "{zip} {city}"}
+	// zipCITY is zipCity where the postal service wants the city in capitals
+	zipCITY = template{"{addr1}", "{addr2}", "{zip} {CITY}"}
+	// cityStateZip is used for countries without a template
+	cityStateZip = template{"{addr1}", "{addr2}", "{city} {state} {zip}"}
+)
+
+// templates by ISO 3166-1 alpha-2 code
+var templates = map[string]template{
+	"AT": zipCity,
+	"BE": zipCity,
+	"CH": zipCity,
+	"CZ": zipCity,
+	"DE": zipCity,
+	"DK": zipCity,
+	"FI": zipCity,
+	"FR": zipCITY,
+	"GR": zipCity,
+	"LI": zipCity,
+	"LU": zipCity,
+	"NL": zipCITY,
+	"NO": zipCity,
+	"PL": zipCity,
+	"PT": zipCity,
+	"SE": zipCITY,
+	"SK": zipCity,
+
+	"ES": {"{addr1}", "{addr2}", "{zip} {city}", "{state}"},
+	"IT": {"{addr1}", "{addr2}", "{zip} {city} {STATE}"},
+	"GB": {"{addr1}", "{addr2}", "{CITY}", "{zip}"},
+	"IE": {"{addr1}", "{addr2}", "{city}", "{state}", "{zip}"},
+	"RU": {"{addr1}", "{addr2}", "{city}", "{state}", "{zip}"},
+
+	"US": {"{addr1}", "{addr2}", "{city}, {state} {zip}"},
+	"CA": {"{addr1}", "{addr2}", "{city} {state} {zip}"},
+	"MX": {"{addr1}", "{addr2}", "{zip} {city}, {state}"},
+	"BR": {"{addr1}", "{addr2}", "{city} - {state}", "{zip}"},
+
+	"AU": {"{addr1}", "{addr2}", "{CITY} {state} {zip}"},
+	"NZ": {"{addr1}", "{addr2}", "{city} {zip}"},
+	"CN": {"{addr1}", "{addr2}", "{city}, {state} {zip}"},
+	"JP": {"{addr1}", "{addr2}", "{city}, {state} {zip}"},
+	"IN": {"{addr1}", "{addr2}", "{city} {zip}", "{state}"},
+	"SG": {"{addr1}", "{addr2}", "{CITY} {zip}"},
+	"HK": {"{addr1}", "{addr2}", "{city}"},
+	"AE": {"{addr1}", "{addr2}", "{city}"},
+}
@@ -0,0 +1,169 @@
+// Package addressrules knows how addresses are written per country: ISO
+// 3166-1 alpha-2 country codes, postal code formats, which countries need a
+// state or province, and how fields are cased and spaced. Normalize a field
+// before validating it; the Valid functions expect normalized input.
+// Fingerprint tells addresses that are written differently but are the same
+// place.
+package addressrules
+
+import (
+	"strings"
+	"unicode"
+)
+
+// NormalizeCountry returns the ISO 3166-1 alpha-2 code of a country given as
+// a code or an English name, in any case. ok is false for unknown countries;
+// the result is then the cleaned up input.
+func NormalizeCountry(country string) (code string, ok bool) {
+	country = collapseSpace(country)
+	upper := strings.ToUpper(country)
+	if _, known := countries[upper]; known {
+		return upper, true
+	}
+	lower := strings.ToLower(country)
+	if alias, known := countryAliases[lower]; known {
+		return alias, true
+	}
+	for c, name := range countries {
+		if strings.ToLower(name) == lower {
+			return c, true
+		}
+	}
+	return country, false
+}
+
+// ValidCountry reports whether code is an ISO 3166-1 alpha-2 code
+func ValidCountry(code string) bool {
+	_, ok := countries[code]
+	return ok
+}
+
+// CountryName returns the English short name of a country code, or "" for
+// an unknown one
+func CountryName(code string) string {
+	return countries[code]
+}
+
+// NormalizePostalCode uppercases and respaces a postal code, and puts in the
+// separator or prefix of the country's format if it was left out, e.g.
+// "sw1a1aa" becomes "SW1A 1AA" in GB.
+func NormalizePostalCode(country, code string) string {
+	code = strings.ToUpper(collapseSpace(code))
+	rule, ok := postalRules[country]
+	if !ok || code == "" {
+		return code
+	}
+
+	if rule.drop != "" {
+		code = strings.TrimPrefix(code, rule.drop)
+	}
+	if rule.prefix != "" {
+		bare := strings.TrimPrefix(code, strings.TrimSuffix(rule.prefix, "-"))
+		code = rule.prefix + strings.TrimLeft(bare, "- ")
+	}
+	if rule.sep != "" {
+		compact := strings.NewReplacer(" ", "", "-", "").Replace(code)
+		at := rule.sepAt
+		if at < 0 {
+			at += len(compact)
+		}
+		if at > 0 && at < len(compact) {
+			code = compact[:at] + rule.sep + compact[at:]
+		}
+	}
+	return code
+}
+
+// ValidPostalCode reports whether code is a postal code of country. Where
+// the format isn't known, any short alphanumeric code passes; countries
+// without postal codes only accept an empty one.
+func ValidPostalCode(country, code string) bool {
+	if noPostalCodes[country] {
+		return code == ""
+	}
+	if rule, ok := postalRules[country]; ok {
+		return rule.pattern.MatchString(code)
+	}
+	if code == "" {
+		return true
+	}
+	if len(code) > 12 {
+		return false
+	}
+	for _, r := range code {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// StateRequired reports whether addresses in country need a state or province
+func StateRequired(country string) bool {
+	_, ok := stateRules[country]
+	return ok
+}
+
+// NormalizeState returns the code of a state given as a code or name, in any
+// case, in countries with a list of state codes. Elsewhere it only cleans up
+// the spacing.
+func NormalizeState(country, state string) string {
+	state = collapseSpace(state)
+	rule, ok := stateRules[country]
+	if !ok || rule.codes == nil {
+		return state
+	}
+	upper := strings.ToUpper(state)
+	if _, known := rule.codes[upper]; known {
+		return upper
+	}
+	for code, name := range rule.codes {
+		if strings.EqualFold(name, state) {
+			return code
+		}
+	}
+	return state
+}
+
+// ValidState reports whether state is acceptable for an address in country:
+// a listed code or, without a list, any text where a state is required. In
+// other countries it is optional.
+func ValidState(country, state string) bool {
+	rule, ok := stateRules[country]
+	if !ok {
+		return true
+	}
+	if rule.codes == nil {
+		return state != ""
+	}
+	_, known := rule.codes[state]
+	return known
+}
+
+// NormalizeLine trims a free-text address line and collapses its inner spaces
+func NormalizeLine(line string) string {
+	return collapseSpace(line)
+}
+
+// NormalizeCity cleans up the spacing of a city name and, if it was typed in
+// all upper or all lower case, capitalizes its words: "NEW YORK" and
+// "new york" become "New York". Mixed case is kept as typed.
+func NormalizeCity(city string) string {
+	city = collapseSpace(city)
+	if city != strings.ToUpper(city) && city != strings.ToLower(city) {
+		return city
+	}
+
+	runes := []rune(strings.ToLower(city))
+	for i, r := range runes {
+		if i == 0 || !unicode.IsLetter(runes[i-1]) {
+			runes[i] = unicode.ToUpper(r)
+		}
+	}
+	return string(runes)
+}
+
+// collapseSpace trims s and turns every run of whitespace into one space
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,201 @@
+package addressrules
+
+import "testing"
+
+func TestNormalizeCountry(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"DE", "DE", true},
+		{" de ", "DE", true},
+		{"Germany", "DE", true},
+		{"GERMANY", "DE", true},
+		{"deutschland", "DE", true},
+		{"United  States", "US", true},
+		{"USA", "US", true},
+		{"the netherlands", "NL", true},
+		{"Atlantis", "Atlantis", false},
+		{"XX", "XX", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := NormalizeCountry(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("NormalizeCountry(%q) = %q, %v, want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestNormalizePostalCode(t *testing.T) {
+	tests := []struct {
+		country, in, want string
+	}{
+		{"DE", " 10115 ", "10115"},
+		{"DE", "D-10115", "10115"},
+		{"AT", "A-1010", "1010"},
+		{"GB", "sw1a1aa", "SW1A 1AA"},
+		{"GB", "sw1a  1aa", "SW1A 1AA"},
+		{"GB", "m11ae", "M1 1AE"},
+		{"NL", "1012ab", "1012 AB"},
+		{"CA", "k1a0b1", "K1A 0B1"},
+		{"PL", "00950", "00-950"},
+		{"PT", "1000 001", "1000-001"},
+		{"BR", "01310100", "01310-100"},
+		{"JP", "1000001", "100-0001"},
+		{"SE", "11455", "114 55"},
+		{"IE", "d02x285", "D02 X285"},
+		{"LV", "1050", "LV-1050"},
+		{"LV", "lv-1050", "LV-1050"},
+		{"LT", "LT 01100", "LT-01100"},
+		{"US", "10118", "10118"},
+		{"US", "10118-0110", "10118-0110"},
+		// unknown formats are only cleaned up
+		{"ZZ", " ab  12 ", "AB 12"},
+		{"DE", "", ""},
+	}
+	for _, tc := range tests {
+		if got := NormalizePostalCode(tc.country, tc.in); got != tc.want {
+			t.Errorf("NormalizePostalCode(%q, %q) = %q, want %q", tc.country, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestValidPostalCode(t *testing.T) {
+	tests := []struct {
+		country, code string
+		want          bool
+	}{
+		{"DE", "10115", true},
+		{"DE", "1011", false},
+		{"DE", "101155", false},
+		{"DE", "", false},
+		{"AT", "1010", true},
+		{"GB", "SW1A 1AA", true},
+		{"GB", "M1 1AE", true},
+		{"GB", "GIR 0AA", true},
+		{"GB", "SW1A1AA", false},
+		{"CA", "K1A 0B1", true},
+		{"CA", "D1A 0B1", false},
+		{"NL", "1012 AB", true},
+		{"NL", "1012", false},
+		{"US", "10118", true},
+		{"US", "10118-0110", true},
+		{"US", "1011", false},
+		{"US", "10118-01", false},
+		{"BR", "01310-100", true},
+		{"JP", "100-0001", true},
+		{"IE", "D02 X285", true},
+		{"IE", "D6W 1234", true},
+		{"IE", "B02 X285", false},
+		{"LV", "LV-1050", true},
+		{"LV", "1050", false},
+		{"PL", "00-950", true},
+		{"IS", "101", true},
+		// countries without postal codes
+		{"AE", "", true},
+		{"AE", "12345", false},
+		{"HK", "", true},
+		// unknown formats accept any short alphanumeric code
+		{"ZZ", "", true},
+		{"ZZ", "AB-12 3", true},
+		{"ZZ", "1234567890123", false},
+		{"ZZ", "12#4", false},
+	}
+	for _, tc := range tests {
+		if got := ValidPostalCode(tc.country, tc.code); got != tc.want {
+			t.Errorf("ValidPostalCode(%q, %q) = %v, want %v", tc.country, tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestStates(t *testing.T) {
+	required := []string{"US", "CA", "AU", "BR", "MX", "IN", "CN", "JP"}
+	for _, country := range required {
+		if !StateRequired(country) {
+			t.Errorf("StateRequired(%q) = false", country)
+		}
+	}
+	for _, country := range []string{"DE", "GB", "FR", "ZZ"} {
+		if StateRequired(country) {
+			t.Errorf("StateRequired(%q) = true", country)
+		}
+	}
+
+	normalize := []struct {
+		country, in, want string
+	}{
+		{"US", "ny", "NY"},
+		{"US", "New York", "NY"},
+		{"US", "new  york", "NY"},
+		{"US", "district of columbia", "DC"},
+		{"CA", "Quebec", "QC"},
+		{"AU", "nsw", "NSW"},
+		{"AU", "Western Australia", "WA"},
+		{"BR", "são paulo", "SP"},
+		{"US", "Atlantis", "Atlantis"},
+		// without a list, only the spacing is cleaned up
+		{"MX", " Jalisco ", "Jalisco"},
+		{"DE", " berlin ", "berlin"},
+	}
+	for _, tc := range normalize {
+		if got := NormalizeState(tc.country, tc.in); got != tc.want {
+			t.Errorf("NormalizeState(%q, %q) = %q, want %q", tc.country, tc.in, got, tc.want)
+		}
+	}
+
+	valid := []struct {
+		country, state string
+		want           bool
+	}{
+		{"US", "NY", true},
+		{"US", "PR", true},
+		{"US", "ny", false},
+		{"US", "New York", false},
+		{"US", "", false},
+		{"CA", "ON", true},
+		{"CA", "NY", false},
+		{"AU", "VIC", true},
+		{"BR", "RJ", true},
+		{"MX", "Jalisco", true},
+		{"MX", "", false},
+		{"DE", "", true},
+		{"DE", "Berlin", true},
+	}
+	for _, tc := range valid {
+		if got := ValidState(tc.country, tc.state); got != tc.want {
+			t.Errorf("ValidState(%q, %q) = %v, want %v", tc.country, tc.state, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeFields(t *testing.T) {
+	lines := []struct{ in, want string }{
+		{"  Hauptstraße   5 ", "Hauptstraße 5"},
+		{"a\tb\nc", "a b c"},
+		{"", ""},
+	}
+	for _, tc := range lines {
+		if got := NormalizeLine(tc.in); got != tc.want {
+			t.Errorf("NormalizeLine(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	cities := []struct{ in, want string }{
+		{"NEW YORK", "New York"},
+		{"new york", "New York"},
+		{"  berlin ", "Berlin"},
+		{"FRANKFURT AM MAIN", "Frankfurt Am Main"},
+		{"saint-étienne", "Saint-Étienne"},
+		{"são paulo", "São Paulo"},
+		// mixed case is kept
+		{"Frankfurt am Main", "Frankfurt am Main"},
+		{"McAllen", "McAllen"},
+		{"", ""},
+	}
+	for _, tc := range cities {
+		if got := NormalizeCity(tc.in); got != tc.want {
+			t.Errorf("NormalizeCity(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package addressrules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+)
+
+// foldLetters spells accented and special Latin letters without their marks
+var foldLetters = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'ł': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// abbreviations maps common abbreviations in address lines to the words
+// they stand for. Words that are their own abbreviation, like "no" for
+// number, map to "".
+var abbreviations = map[string]string{
+	"str": "strasse", "st": "street", "ave": "avenue", "av": "avenue",
+	"rd": "road", "blvd": "boulevard", "bd": "boulevard", "dr": "drive",
+	"ln": "lane", "ct": "court", "sq": "square", "hwy": "highway",
+	"pkwy": "parkway", "apt": "apartment", "ste": "suite", "fl": "floor",
+	"n": "north", "s": "south", "e": "east", "w": "west",
+	"nr": "", "no": "", "number": "",
+}
+
+// Fingerprint returns a fingerprint of where an address is: two addresses
+// have the same fingerprint when they differ only in case, spacing,
+// punctuation, accents or common abbreviations ("Hauptstr. 5" and
+// "Hauptstraße 5"). The label, type and default flag of an address aren't
+// part of it.
+func Fingerprint(country, state, postalCode, city, line1, line2 string) string {
+	country, _ = NormalizeCountry(country)
+	parts := []string{
+		country,
+		Canonical(state),
+		Canonical(postalCode),
+		Canonical(city),
+		Canonical(line1),
+		Canonical(line2),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Canonical lowercases s, drops accents and punctuation, spells out
+// abbreviations and then leaves out the spaces, so "Haupt Str." and
+// "Hauptstraße" are both "hauptstrasse". Only a space between two numbers
+// is kept, so "1 23" stays apart from "12 3". It is how Fingerprint compares
+// fields, and works for prefixes of them too.
+func Canonical(s string) string {
+	var folded strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case foldLetters[r] != "":
+			folded.WriteString(foldLetters[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			folded.WriteRune(r)
+		default:
+			folded.WriteRune(' ')
+		}
+	}
+
+	var b strings.Builder
+	for _, word := range strings.Fields(folded.String()) {
+		if long, ok := abbreviations[word]; ok {
+			word = long
+		} else if len(word) > len("str") && strings.HasSuffix(word, "str") {
+			// German street names are written together: "Hauptstr."
+			word += "asse"
+		}
+		if word == "" {
+			continue
+		}
+		if b.Len() > 0 && isDigit(word[0]) && isDigit(b.String()[b.Len()-1]) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,77 @@
+package addressrules
+
+import "testing"
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Hauptstraße 5", "hauptstrasse5"},
+		{"Haupt Str. 5", "hauptstrasse5"},
+		{"HAUPTSTR 5", "hauptstrasse5"},
+		{"  Main   St. ", "mainstreet"},
+		{"Crème Brûlée Ave", "cremebruleeavenue"},
+		{"Apt. 4, No. 12", "apartment4 12"},
+		{"Unit 1 23", "unit1 23"},
+		{"Unit 12 3", "unit12 3"},
+		{"1-23", "1 23"},
+		{"5 a", "5a"},
+		{"", ""},
+		{"...", ""},
+	}
+	for _, tc := range tests {
+		if got := Canonical(tc.in); got != tc.want {
+			t.Errorf("Canonical(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	type place struct {
+		country, state, zip, city, line1, line2 string
+	}
+	fp := func(p place) string {
+		return Fingerprint(p.country, p.state, p.zip, p.city, p.line1, p.line2)
+	}
+	base := place{"DE", "", "10115", "Berlin", "Hauptstraße 5", ""}
+
+	same := []place{
+		{"de", "", "10115", "berlin", "Hauptstr. 5", ""},
+		{"Germany", "", "10115", "BERLIN", "Haupt Str. 5", ""},
+		{"DE", "", " 10115 ", "Berlin", "hauptstrasse 5", " "},
+		{"DE", "", "10115", "Berlin", "Hauptstraße, 5", ""},
+	}
+	for _, p := range same {
+		if fp(p) != fp(base) {
+			t.Errorf("Fingerprint(%+v) differs from %+v", p, base)
+		}
+	}
+
+	different := []place{
+		{"AT", "", "10115", "Berlin", "Hauptstraße 5", ""},
+		{"DE", "", "10117", "Berlin", "Hauptstraße 5", ""},
+		{"DE", "", "10115", "Potsdam", "Hauptstraße 5", ""},
+		{"DE", "", "10115", "Berlin", "Hauptstraße 6", ""},
+		{"DE", "", "10115", "Berlin", "Hauptstraße 5", "2. OG"},
+		{"DE", "", "10115", "Berlin", "Hauptstraße 55", ""},
+		{"DE", "BE", "10115", "Berlin", "Hauptstraße 5", ""},
+		// the line can't run into the next field
+		{"DE", "", "10115", "Berlin", "Hauptstraße", "5"},
+	}
+	for _, p := range different {
+		if fp(p) == fp(base) {
+			t.Errorf("Fingerprint(%+v) equals that of %+v", p, base)
+		}
+	}
+
+	// numbers next to each other stay apart
+	a := place{"US", "NY", "10001", "New York", "Unit 1 23 Main St", ""}
+	b := place{"US", "NY", "10001", "New York", "Unit 12 3 Main St", ""}
+	if fp(a) == fp(b) {
+		t.Errorf("Fingerprint(%q) equals Fingerprint(%q)", a.line1, b.line1)
+	}
+	c := place{"US", "NY", "10001", "New York", "unit 1 23 main street", ""}
+	if fp(a) != fp(c) {
+		t.Errorf("Fingerprint(%q) differs from Fingerprint(%q)", a.line1, c.line1)
+	}
+}
@@ -0,0 +1,136 @@
+package addressrules
+
+import "regexp"
+
+// postalRule describes the postal codes of a country
+type postalRule struct {
+	// pattern matches a normalized code
+	pattern *regexp.Regexp
+	// sepAt is where a separator goes when the user left it out: counted
+	// from the start, or from the end when negative
+	sepAt int
+	sep   string
+	// prefix is prepended to bare digits, e.g. "LV-"
+	prefix string
+	// drop is an old country prefix that is no longer written, e.g. "D-"
+	drop string
+}
+
+var postalRules = map[string]postalRule{
+	"AR": {pattern: regexp.MustCompile(`^([A-Z]\d{4}[A-Z]{3}|\d{4})$`)},
+	"AT": {pattern: regexp.MustCompile(`^\d{4}$`), drop: "A-"},
+	"AU": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	"BE": {pattern: regexp.MustCompile(`^\d{4}$`), drop: "B-"},
+	"BG": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	"BR": {pattern: regexp.MustCompile(`^\d{5}-\d{3}$`), sepAt: 5, sep: "-"},
+	"CA": {pattern: regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z] \d[ABCEGHJ-NPRSTV-Z]\d$`), sepAt: 3, sep: " "},
+	"CH": {pattern: regexp.MustCompile(`^\d{4}$`), drop: "CH-"},
+	"CN": {pattern: regexp.MustCompile(`^\d{6}$`)},
+	"CZ": {pattern: regexp.MustCompile(`^\d{3} \d{2}$`), sepAt: 3, sep: " "},
+	"DE": {pattern: regexp.MustCompile(`^\d{5}$`), drop: "D-"},
+	"DK": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	"EE": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"ES": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"FI": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {pattern: regexp.MustCompile(`^\d{5}$`), drop: "F-"},
+	"GB": {pattern: regexp.MustCompile(`^([A-Z]{1,2}\d[A-Z\d]? \d[A-Z]{2}|GIR 0AA)$`), sepAt: -3, sep: " "},
+	"GR": {pattern: regexp.MustCompile(`^\d{3} \d{2}$`), sepAt: 3, sep: " "},
+	"HR": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"HU": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	// Eircode: routing key and unique identifier
+	"IE": {pattern: regexp.MustCompile(`^([AC-FHKNPRTV-Y]\d{2}|D6W) [0-9AC-FHKNPRTV-Y]{4}$`), sepAt: 3, sep: " "},
+	"IL": {pattern: regexp.MustCompile(`^\d{7}$`)},
+	"IN": {pattern: regexp.MustCompile(`^\d{6}$`)},
+	"IS": {pattern: regexp.MustCompile(`^\d{3}$`)},
+	"IT": {pattern: regexp.MustCompile(`^\d{5}$`), drop: "I-"},
+	"JP": {pattern: regexp.MustCompile(`^\d{3}-\d{4}$`), sepAt: 3, sep: "-"},
+	"KR": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"LI": {pattern: regexp.MustCompile(`^\d{4}$`), drop: "FL-"},
+	"LT": {pattern: regexp.MustCompile(`^LT-\d{5}$`), prefix: "LT-"},
+	"LU": {pattern: regexp.MustCompile(`^\d{4}$`), drop: "L-"},
+	"LV": {pattern: regexp.MustCompile(`^LV-\d{4}$`), prefix: "LV-"},
+	"MX": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"NL": {pattern: regexp.MustCompile(`^\d{4} [A-Z]{2}$`), sepAt: 4, sep: " "},
+	"NO": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	"NZ": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	"PL": {pattern: regexp.MustCompile(`^\d{2}-\d{3}$`), sepAt: 2, sep: "-"},
+	"PT": {pattern: regexp.MustCompile(`^\d{4}-\d{3}$`), sepAt: 4, sep: "-"},
+	"RO": {pattern: regexp.MustCompile(`^\d{6}$`)},
+	"RU": {pattern: regexp.MustCompile(`^\d{6}$`)},
+	"SE": {pattern: regexp.MustCompile(`^\d{3} \d{2}$`), sepAt: 3, sep: " "},
+	"SG": {pattern: regexp.MustCompile(`^\d{6}$`)},
+	"SI": {pattern: regexp.MustCompile(`^\d{4}$`)},
+	"SK": {pattern: regexp.MustCompile(`^\d{3} \d{2}$`), sepAt: 3, sep: " "},
+	"TR": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"UA": {pattern: regexp.MustCompile(`^\d{5}$`)},
+	"US": {pattern: regexp.MustCompile(`^\d{5}(-\d{4})?$`)},
+	"ZA": {pattern: regexp.MustCompile(`^\d{4}$`)},
+}
+
+// noPostalCodes lists countries without a postal code system; addresses
+// there must leave the postal code empty
+var noPostalCodes = map[string]bool{
+	"AE": true, "AG": true, "AO": true, "AW": true, "BF": true, "BI": true,
+	"BJ": true, "BO": true, "BS": true, "BW": true, "BZ": true, "CD": true,
+	"CF": true, "CG": true, "CI": true, "CK": true, "CM": true, "DJ": true,
+	"DM": true, "ER": true, "FJ": true, "GD": true, "GH": true, "GM": true,
+	"GQ": true, "GY": true, "HK": true, "KI": true, "KM": true, "KN": true,
+	"KP": true, "ML": true, "MO": true, "MR": true, "MW": true, "NR": true,
+	"NU": true, "QA": true, "RW": true, "SB": true, "SC": true, "SL": true,
+	"SR": true, "ST": true, "SY": true, "TD": true, "TF": true, "TG": true,
+	"TK": true, "TL": true, "TO": true, "TV": true, "UG": true, "VU": true,
+	"YE": true, "ZW": true,
+}
+
+// stateRule describes the first-level subdivisions (state, province,
+// territory) of a country whose addresses need one
+type stateRule struct {
+	// codes maps the accepted codes to their names; nil accepts any
+	// non-empty text
+	codes map[string]string
+}
+
+var stateRules = map[string]stateRule{
+	"US": {codes: map[string]string{
+		"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas",
+		"CA": "California", "CO": "Colorado", "CT": "Connecticut", "DE": "Delaware",
+		"DC": "District of Columbia", "FL": "Florida", "GA": "Georgia", "HI": "Hawaii",
+		"ID": "Idaho", "IL": "Illinois", "IN": "Indiana", "IA": "Iowa",
+		"KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana", "ME": "Maine",
+		"MD": "Maryland", "MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota",
+		"MS": "Mississippi", "MO": "Missouri", "MT": "Montana", "NE": "Nebraska",
+		"NV": "Nevada", "NH": "New Hampshire", "NJ": "New Jersey", "NM": "New Mexico",
+		"NY": "New York", "NC": "North Carolina", "ND": "North Dakota", "OH": "Ohio",
+		"OK": "Oklahoma", "OR": "Oregon", "PA": "Pennsylvania", "RI": "Rhode Island",
+		"SC": "South Carolina", "SD": "South Dakota", "TN": "Tennessee", "TX": "Texas",
+		"UT": "Utah", "VT": "Vermont", "VA": "Virginia", "WA": "Washington",
+		"WV": "West Virginia", "WI": "Wisconsin", "WY": "Wyoming",
+		"AS": "American Samoa", "GU": "Guam", "MP": "Northern Mariana Islands",
+		"PR": "Puerto Rico", "VI": "U.S. Virgin Islands",
+		"AA": "Armed Forces Americas", "AE": "Armed Forces Europe", "AP": "Armed Forces Pacific",
+	}},
+	"CA": {codes: map[string]string{
+		"AB": "Alberta", "BC": "British Columbia", "MB": "Manitoba", "NB": "New Brunswick",
+		"NL": "Newfoundland and Labrador", "NS": "Nova Scotia", "NT": "Northwest Territories",
+		"NU": "Nunavut", "ON": "Ontario", "PE": "Prince Edward Island", "QC": "Quebec",
+		"SK": "Saskatchewan", "YT": "Yukon",
+	}},
+	"AU": {codes: map[string]string{
+		"ACT": "Australian Capital Territory", "NSW": "New South Wales", "NT": "Northern Territory",
+		"QLD": "Queensland", "SA": "South Australia", "TAS": "Tasmania", "VIC": "Victoria",
+		"WA": "Western Australia",
+	}},
+	"BR": {codes: map[string]string{
+		"AC": "Acre", "AL": "Alagoas", "AP": "Amapá", "AM": "Amazonas", "BA": "Bahia",
+		"CE": "Ceará", "DF": "Distrito Federal", "ES": "Espírito Santo", "GO": "Goiás",
+		"MA": "Maranhão", "MT": "Mato Grosso", "MS": "Mato Grosso do Sul", "MG": "Minas Gerais",
+		"PA": "Pará", "PB": "Paraíba", "PR": "Paraná", "PE": "Pernambuco", "PI": "Piauí",
+		"RJ": "Rio de Janeiro", "RN": "Rio Grande do Norte", "RS": "Rio Grande do Sul",
+		"RO": "Rondônia", "RR": "Roraima", "SC": "Santa Catarina", "SP": "São Paulo",
+		"SE": "Sergipe", "TO": "Tocantins",
+	}},
+	"MX": {},
+	"IN": {},
+	"CN": {},
+	"JP": {},
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"server/internal/config"
 	"server/internal/db"
+	"server/internal/geocode"
 	"server/internal/handler"
+	"server/internal/jwks"
+	"server/internal/mailer"
+	"server/internal/ratelimit"
 	"server/internal/repo"
+	"server/internal/secretbox"
 	"server/internal/service"
 	"server/internal/validator"
+	"syscall"
+	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -23,57 +35,247 @@ if cfgErr != nil {
 }
 
 // connect to db
-dbConn, dbConnErr := db.NewDB(cfg)
+dbConn, dbConnErr := db.NewDB(context.Background(), cfg)
 if dbConnErr != nil {
   log.Fatal("failed to connect to db: %w", dbConnErr)
 }
 defer dbConn.Close()
 
-jwtSecret := []byte(cfg.JwtSecret)
+// JWT signing keys
+var keys *jwks.KeySet
+var keysErr error
+if cfg.JwtKeysDir != "" {
+	keys, keysErr = jwks.LoadDir(cfg.JwtKeysDir, cfg.JwtActiveKID)
+} else {
+	log.Println("JWT_KEYS_DIR not set: signing with an ephemeral key, tokens won't survive a restart")
+	keys, keysErr = jwks.GenerateEphemeral()
+}
+if keysErr != nil {
+	log.Fatal("failed to load jwt keys: ", keysErr)
+}
+
+// outgoing mail
+mail, mailErr := mailer.New(cfg.Mailer, mailer.SMTPConfig{
+	Host: cfg.SmtpHost,
+	Port: cfg.SmtpPort,
+	User: cfg.SmtpUser,
+	Pwd:  cfg.SmtpPwd,
+	From: cfg.MailFrom,
+}, cfg.MailDir)
+if mailErr != nil {
+	log.Fatal("failed to set up mailer: ", mailErr)
+}
 
 // Wire repos and services
 // Auth
 authRepo := repo.NewAuthRepo(dbConn)
-authSvc := service.NewAuthService(authRepo)
-auth := handler.NewAuthHandler(authSvc, jwtSecret)
+txm := repo.NewTxManager(dbConn)
+loginFailureRepo := repo.NewLoginFailureRepo(dbConn)
+throttle := service.NewLoginThrottle(loginFailureRepo, service.LockoutPolicy{
+	MaxFailures:     cfg.LoginMaxFailures,
+	IPMaxFailures:   cfg.LoginIPMaxFailures,
+	LockoutDuration: cfg.LoginLockoutDuration,
+	BackoffBase:     cfg.LoginBackoffBase,
+	BackoffMax:      cfg.LoginBackoffMax,
+	FailureWindow:   cfg.LoginFailureWindow,
+})
+authSvc := service.NewAuthService(authRepo, throttle, cfg.RequireEmailVerification)
+refreshRepo := repo.NewRefreshTokenRepo(dbConn)
+revocationRepo := repo.NewRevocationRepo(dbConn)
+tokenSvc := service.NewTokenService(refreshRepo, revocationRepo, cfg.RefreshTokenTTL, cfg.RevocationCacheTTL)
+userTokenRepo := repo.NewUserTokenRepo(dbConn)
+accountSvc := service.NewAccountService(authRepo, userTokenRepo, tokenSvc, throttle, mail, service.AccountOptions{
+	BaseURL:          cfg.AppBaseURL,
+	VerificationTTL:  cfg.EmailVerificationTTL,
+	PasswordResetURL: cfg.PasswordResetURL,
+	PasswordResetTTL: cfg.PasswordResetTTL,
+	EmailChangeTTL:   cfg.EmailChangeTTL,
+	UnlockTTL:        cfg.UnlockTTL,
+})
+account := handler.NewAccountHandler(accountSvc)
+
+// MFA: TOTP secrets are encrypted at rest
+mfaBox, boxErr := secretbox.NewFromBase64(cfg.MfaEncryptionKey)
+if boxErr != nil {
+	log.Fatal("invalid MFA_ENCRYPTION_KEY: ", boxErr)
+}
+recoveryRepo := repo.NewRecoveryCodeRepo(dbConn)
+mfaChallengeRepo := repo.NewMFAChallengeRepo(dbConn)
+mfaSvc := service.NewMFAService(authRepo, recoveryRepo, mfaChallengeRepo, throttle, txm, mfaBox, cfg.TotpIssuer)
+mfa := handler.NewMFAHandler(mfaSvc)
+
+// Passkeys
+wa, waErr := webauthn.New(&webauthn.Config{
+	RPID:          cfg.WebauthnRPID,
+	RPDisplayName: cfg.WebauthnRPName,
+	RPOrigins:     cfg.WebauthnOrigins,
+})
+if waErr != nil {
+	log.Fatal("invalid webauthn config: ", waErr)
+}
+passkeyRepo := repo.NewPasskeyRepo(dbConn)
+passkeySvc := service.NewPasskeyService(wa, authRepo, passkeyRepo)
+passkey := handler.NewPasskeyHandler(passkeySvc)
+auth := handler.NewAuthHandler(authSvc, accountSvc, mfaSvc, passkeySvc, tokenSvc, keys, cfg.AccessTokenTTL, cfg.RefreshTokenTTL)
 
 // Address
 addrRepo := repo.NewAddressRepo(dbConn)
-addrSvc := service.NewAddressService(addrRepo)
+var geocoder service.Geocoder
+switch cfg.Geocoder {
+case "offline":
+	offline, loadErr := geocode.LoadOffline(cfg.GeocoderDataset)
+	if loadErr != nil {
+		log.Fatal("failed to load geocoder dataset: ", loadErr)
+	}
+	geocoder = offline
+case "nominatim":
+	geocoder = geocode.NewNominatim(cfg.GeocoderURL, cfg.GeocoderUserAgent, cfg.GeocoderTimeout, cfg.GeocoderInterval)
+case "off":
+default:
+	log.Fatalf("unknown GEOCODER %q", cfg.Geocoder)
+}
+addrSvc := service.NewAddressService(addrRepo, txm, service.AddressOptions{
+	RestoreWindow: cfg.AddressRestoreWindow,
+	Retention:     cfg.AddressRetention,
+	Geocoder:      geocoder,
+})
 addr := handler.NewAddressHandler(addrSvc)
 
+// fingerprint the addresses stored without one, for duplicate detection;
+// an ADDRESS_BACKFILL_TIMEOUT of 0 skips it
+if cfg.AddressBackfillTimeout > 0 {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.AddressBackfillTimeout)
+		defer cancel()
+		backfilled, backfillErr := addrSvc.BackfillFingerprints(ctx)
+		if backfillErr != nil {
+			log.Print("address fingerprint backfill failed: ", backfillErr)
+		} else if backfilled > 0 {
+			log.Printf("fingerprinted %d addresses", backfilled)
+		}
+	}()
+}
+
+// purge deleted addresses past ADDRESS_RETENTION in the background; an
+// ADDRESS_PURGE_INTERVAL of 0 turns it off. A run gets at most one
+// interval, so a stuck purge can't pile up behind the next tick
+if cfg.AddressPurgeInterval > 0 {
+	go func() {
+		ticker := time.NewTicker(cfg.AddressPurgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.AddressPurgeInterval)
+			purged, purgeErr := addrSvc.PurgeDeletedAddresses(ctx)
+			cancel()
+			if purgeErr != nil {
+				log.Print("address purge failed: ", purgeErr)
+			} else if purged > 0 {
+				log.Printf("purged %d deleted addresses", purged)
+			}
+		}
+	}()
+}
+
+// Rate limits
+var limiter ratelimit.Store
+if cfg.RateLimitStore != "off" {
+	var limiterErr error
+	limiter, limiterErr = ratelimit.New(cfg.RateLimitStore, dbConn)
+	if limiterErr != nil {
+		log.Fatal("failed to set up rate limits: ", limiterErr)
+	}
+}
+// limit returns a middleware enforcing the policies, or a no-op when rate limiting is off
+limit := func(policies ...ratelimit.Policy) echo.MiddlewareFunc {
+	if limiter == nil {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return ratelimit.Middleware(limiter, policies...)
+}
+// ByJSONField only reads the first 64 KiB of a body; routes keyed by the
+// email in the body refuse longer ones, so padding can't dodge the limit
+peekLimit := middleware.BodyLimit("64K")
+loginLimit := limit(
+	ratelimit.Policy{Name: "login-ip", Limit: ratelimit.PerMinute(20), Key: ratelimit.ByIP()},
+	ratelimit.Policy{Name: "login-email", Limit: ratelimit.PerMinute(10), Key: ratelimit.ByJSONField("email")},
+)
+registerLimit := limit(ratelimit.Policy{Name: "register-ip", Limit: ratelimit.PerHour(10), Key: ratelimit.ByIP()})
+// endpoints that send mail
+mailLimit := limit(
+	ratelimit.Policy{Name: "mail-ip", Limit: ratelimit.PerHour(20), Key: ratelimit.ByIP()},
+	ratelimit.Policy{Name: "mail-email", Limit: ratelimit.PerHour(5), Key: ratelimit.ByJSONField("email")},
+)
+tokenLimit := limit(ratelimit.Policy{Name: "token-ip", Limit: ratelimit.PerMinute(30), Key: ratelimit.ByIP()})
+userLimit := limit(ratelimit.Policy{Name: "user", Limit: ratelimit.PerMinute(60), Key: ratelimit.ByUserID()})
+addressLimit := limit(ratelimit.Policy{Name: "address", Limit: ratelimit.PerMinute(120), Key: ratelimit.ByUserID()})
+
 // instantiate echo
 e := echo.New()
 
 e.Use(middleware.Logger())
+// cancel the request context, and with it any running query, after REQUEST_TIMEOUT
+e.Use(middleware.ContextTimeout(cfg.RequestTimeout))
 
 // Wire up echo validator
 e.Validator = validator.New()
 
+// client IP for login throttling: X-Forwarded-For is only trusted behind a proxy
+if cfg.TrustProxy {
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+} else {
+	e.IPExtractor = echo.ExtractIPDirect()
+}
+
 
 // CORS for React app
 e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
   AllowOrigins: []string{"http://localhost:5173"},
 	AllowCredentials: true,
-	AllowHeaders: []string{echo.HeaderContentType, echo.HeaderAccept, "X-CSRF-Token"},
+	AllowHeaders: []string{echo.HeaderContentType, echo.HeaderAccept, "X-CSRF-Token", "If-Match", "If-None-Match"},
+	ExposeHeaders: []string{"ETag"},
 }))
 
 
 // group for protected API routes (JWT + CSRF)
 	
 // public routes
+e.GET("/.well-known/jwks.json", handler.NewJWKSHandler(keys).GetJWKS)
+
 api := e.Group("/api")
-api.POST("/login", auth.LoginHandler)
-api.POST("/register", auth.RegisterHandler)
+api.POST("/login", auth.LoginHandler, peekLimit, loginLimit)
+api.POST("/login/mfa", auth.LoginMFAHandler, peekLimit, loginLimit)
+api.POST("/login/passkey/begin", auth.LoginPasskeyBeginHandler, tokenLimit)
+api.POST("/login/passkey/finish", auth.LoginPasskeyFinishHandler, peekLimit, loginLimit)
+api.POST("/login/unlock", account.RequestLoginUnlock, peekLimit, mailLimit)
+api.GET("/login/unlock/confirm", account.UnlockLogin, tokenLimit)
+api.POST("/login/unlock/confirm", account.UnlockLogin, tokenLimit)
+api.POST("/register", auth.RegisterHandler, registerLimit)
+api.POST("/refresh", auth.RefreshHandler, tokenLimit)
+api.GET("/verify-email", account.VerifyEmail, tokenLimit)
+api.POST("/verify-email", account.VerifyEmail, tokenLimit)
+api.POST("/verify-email/resend", account.ResendVerification, peekLimit, mailLimit)
+api.POST("/password/forgot", account.ForgotPassword, peekLimit, mailLimit)
+api.POST("/password/reset", account.ResetPassword, tokenLimit)
+api.GET("/email/confirm", account.ConfirmEmailChange, tokenLimit)
+api.POST("/email/confirm", account.ConfirmEmailChange, tokenLimit)
+
+// admin routes, only with ADMIN_API_KEY set
+if cfg.AdminApiKey != "" {
+	admin := handler.NewAdminHandler(throttle, cfg.AdminApiKey)
+	adminGroup := api.Group("/admin", admin.RequireAdminKey)
+	adminGroup.POST("/login/unlock", admin.UnlockLogin)
+}
 
 apiV1 := api.Group("/v1")
-// JWT with Config
+// JWT with Config: any key in the set verifies, so rotation keeps sessions alive
 apiV1.Use(echojwt.WithConfig(echojwt.Config{
-	SigningKey:    jwtSecret,
-	SigningMethod: "HS256",
+	SigningKeys:   keys.VerificationKeys(),
+	SigningMethod: keys.Algorithm(),
   TokenLookup:   "cookie:access_token",
   ContextKey:    "user",
 }))
+// reject JWTs revoked by logout
+apiV1.Use(auth.RequireActiveSession)
 // CSRF with Config
 apiV1.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
 	CookieName:     "csrf_token",
@@ -89,14 +291,56 @@ apiV1.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
 
 // Wire portected routes
 apiV1.POST("/logout", auth.LogoutHandler)
+apiV1.POST("/logout/all", auth.LogoutAllHandler)
+apiV1.PATCH("/users/me/password", account.ChangePassword, userLimit)
+apiV1.PATCH("/users/me/email", account.ChangeEmail, userLimit)
+apiV1.POST("/users/me/mfa/totp", mfa.EnrollTOTP, userLimit)
+apiV1.POST("/users/me/mfa/totp/confirm", mfa.ConfirmTOTP, userLimit)
+apiV1.DELETE("/users/me/mfa/totp", mfa.DisableTOTP, userLimit)
+apiV1.POST("/users/me/passkeys/register/begin", passkey.BeginRegistration, userLimit)
+apiV1.POST("/users/me/passkeys/register/finish", passkey.FinishRegistration, userLimit)
+apiV1.GET("/users/me/passkeys", passkey.ListPasskeys, userLimit)
+apiV1.PATCH("/users/me/passkeys/:id", passkey.RenamePasskey, userLimit)
+apiV1.DELETE("/users/me/passkeys/:id", passkey.DeletePasskey, userLimit)
 
-apiV1.POST("/users/address/add", addr.CreateAddress)
-apiV1.GET("/users/address/:id", addr.GetAddress)
-apiV1.PATCH("/users/address/:id", addr.UpdateAddress)
-apiV1.DELETE("/users/address/:id", addr.DeleteAddress)
+apiV1.POST("/users/address/add", addr.CreateAddress, addressLimit)
+apiV1.GET("/users/address", addr.ListAddresses, addressLimit)
+apiV1.POST("/users/address/import", addr.ImportAddresses, addressLimit)
+apiV1.GET("/users/address/export", addr.ExportAddresses, addressLimit)
+apiV1.GET("/users/address/default", addr.GetDefaultAddress, addressLimit)
+apiV1.PUT("/users/address/:id/default", addr.SetDefaultAddress, addressLimit)
+apiV1.GET("/users/address/:id", addr.GetAddress, addressLimit)
+apiV1.PATCH("/users/address/:id", addr.UpdateAddress, addressLimit)
+apiV1.DELETE("/users/address/:id", addr.DeleteAddress, addressLimit)
+apiV1.POST("/users/address/:id/restore", addr.RestoreAddress, addressLimit)
+apiV1.GET("/users/address/:id/history", addr.AddressHistory, addressLimit)
+apiV1.GET("/address/suggest", addr.SuggestAddresses, addressLimit)
 
 serverPort := cfg.ServerPort
 serverHost := cfg.ServerHost
 addrStr := serverHost + ":" + serverPort
-e.Logger.Fatal(e.Start(addrStr))
+
+// serve until SIGINT or SIGTERM, then let the requests in flight and the
+// background geocoding finish
+stopCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+defer stop()
+go func() {
+	startErr := e.Start(addrStr)
+	if startErr != nil && !errors.Is(startErr, http.ErrServerClosed) {
+		e.Logger.Fatal(startErr)
+	}
+}()
+<-stopCtx.Done()
+
+shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+defer cancel()
+if shutdownErr := e.Shutdown(shutdownCtx); shutdownErr != nil {
+	log.Print("shutdown: ", shutdownErr)
+}
+if geocodeErr := addrSvc.StopGeocoding(shutdownCtx); geocodeErr != nil {
+	log.Print("shutdown: ", geocodeErr)
+}
+if mailErr := accountSvc.StopMail(shutdownCtx); mailErr != nil {
+	log.Print("shutdown: ", mailErr)
+}
 }
@@ -1,19 +1,92 @@
 package config
 
 import (
+	"time"
+
 	"github.com/caarlos0/env/v11"
 )
 
 type Config struct {
-    DbHost     string `env:"DB_HOST" envDefault:"localhost"`
-    DbPort     string `env:"DB_PORT" envDefault:"5432"`
-    DbUser     string `env:"DB_USER,required"`
-    DbPwd      string `env:"DB_PWD,required"`
-    DbName     string `env:"DB_NAME,required"`
-    JwtSecret  string `env:"JWT_SECRET,required"`
-    SessionKey string `env:"SESSION_KEY,required"`
-    ServerHost string `env:"SERVER_HOST" envDefault:"0.0.0.0"`
-    ServerPort string `env:"SERVER_PORT" envDefault:"8080"`
+    DbHost                   string        `env:"DB_HOST" envDefault:"localhost"`
+    DbPort                   string        `env:"DB_PORT" envDefault:"5432"`
+    DbUser                   string        `env:"DB_USER,required"`
+    DbPwd                    string        `env:"DB_PWD,required"`
+    DbName                   string        `env:"DB_NAME,required"`
+    // connection pool
+    DbMaxConns               int32         `env:"DB_MAX_CONNS" envDefault:"10"`
+    DbMinConns               int32         `env:"DB_MIN_CONNS" envDefault:"0"`
+    DbMaxConnIdleTime        time.Duration `env:"DB_MAX_CONN_IDLE_TIME" envDefault:"30m"`
+    DbMaxConnLifetime        time.Duration `env:"DB_MAX_CONN_LIFETIME" envDefault:"1h"`
+    // directory of <kid>.pem signing keys (RSA or Ed25519); empty means an ephemeral dev key
+    JwtKeysDir               string        `env:"JWT_KEYS_DIR"`
+    JwtActiveKID             string        `env:"JWT_ACTIVE_KID"`
+    SessionKey               string        `env:"SESSION_KEY,required"`
+    ServerHost               string        `env:"SERVER_HOST" envDefault:"0.0.0.0"`
+    ServerPort               string        `env:"SERVER_PORT" envDefault:"8080"`
+    // cancels a request, and its queries, after this long
+    RequestTimeout           time.Duration `env:"REQUEST_TIMEOUT" envDefault:"30s"`
+    // on SIGINT or SIGTERM, how long requests in flight and background geocoding may take to finish
+    ShutdownTimeout          time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+    // take the client IP from X-Forwarded-For; only enable behind a proxy that sets it
+    TrustProxy               bool          `env:"TRUST_PROXY" envDefault:"false"`
+    AccessTokenTTL           time.Duration `env:"ACCESS_TOKEN_TTL" envDefault:"15m"`
+    RefreshTokenTTL          time.Duration `env:"REFRESH_TOKEN_TTL" envDefault:"720h"`
+    // how long a "not revoked" lookup is trusted before asking Postgres again
+    RevocationCacheTTL       time.Duration `env:"REVOCATION_CACHE_TTL" envDefault:"30s"`
+    // links in outgoing mail point here
+    AppBaseURL               string        `env:"APP_BASE_URL" envDefault:"http://localhost:8080"`
+    // mailer: smtp, file or memory
+    Mailer                   string        `env:"MAILER" envDefault:"file"`
+    MailDir                  string        `env:"MAIL_DIR" envDefault:"mail"`
+    MailFrom                 string        `env:"MAIL_FROM" envDefault:"noreply@localhost"`
+    SmtpHost                 string        `env:"SMTP_HOST"`
+    SmtpPort                 string        `env:"SMTP_PORT" envDefault:"587"`
+    SmtpUser                 string        `env:"SMTP_USER"`
+    SmtpPwd                  string        `env:"SMTP_PWD"`
+    // refuse logins until the email address is confirmed
+    RequireEmailVerification bool          `env:"REQUIRE_EMAIL_VERIFICATION" envDefault:"false"`
+    EmailVerificationTTL     time.Duration `env:"EMAIL_VERIFICATION_TTL" envDefault:"24h"`
+    // frontend page the password reset link opens
+    PasswordResetURL         string        `env:"PASSWORD_RESET_URL" envDefault:"http://localhost:5173/reset-password"`
+    PasswordResetTTL         time.Duration `env:"PASSWORD_RESET_TTL" envDefault:"1h"`
+    EmailChangeTTL           time.Duration `env:"EMAIL_CHANGE_TTL" envDefault:"24h"`
+    // failed logins: exponential backoff per account, then a temporary lockout; 0 disables a limit
+    LoginMaxFailures         int           `env:"LOGIN_MAX_FAILURES" envDefault:"5"`
+    LoginIPMaxFailures       int           `env:"LOGIN_IP_MAX_FAILURES" envDefault:"50"`
+    LoginLockoutDuration     time.Duration `env:"LOGIN_LOCKOUT_DURATION" envDefault:"15m"`
+    LoginBackoffBase         time.Duration `env:"LOGIN_BACKOFF_BASE" envDefault:"1s"`
+    LoginBackoffMax          time.Duration `env:"LOGIN_BACKOFF_MAX" envDefault:"30s"`
+    LoginFailureWindow       time.Duration `env:"LOGIN_FAILURE_WINDOW" envDefault:"1h"`
+    UnlockTTL                time.Duration `env:"UNLOCK_TTL" envDefault:"1h"`
+    // rate limit store: memory (single instance), postgres (shared) or off
+    RateLimitStore           string        `env:"RATE_LIMIT_STORE" envDefault:"memory"`
+    // enables /api/admin with this X-Admin-Key; empty disables it
+    AdminApiKey              string        `env:"ADMIN_API_KEY"`
+    // base64-encoded 32-byte AES key that encrypts TOTP secrets
+    MfaEncryptionKey         string        `env:"MFA_ENCRYPTION_KEY,required"`
+    // issuer shown in authenticator apps
+    TotpIssuer               string        `env:"TOTP_ISSUER" envDefault:"auth-service"`
+    // passkeys are bound to this domain; changing it orphans registered passkeys
+    WebauthnRPID             string        `env:"WEBAUTHN_RP_ID" envDefault:"localhost"`
+    WebauthnRPName           string        `env:"WEBAUTHN_RP_NAME" envDefault:"auth-service"`
+    // origins the browser may run the ceremonies from, comma-separated
+    WebauthnOrigins          []string      `env:"WEBAUTHN_ORIGINS" envDefault:"http://localhost:5173" envSeparator:","`
+    // deleted addresses can be restored for ADDRESS_RESTORE_WINDOW and are purged
+    // after ADDRESS_RETENTION, which should be longer; the purge runs every ADDRESS_PURGE_INTERVAL
+    AddressRestoreWindow     time.Duration `env:"ADDRESS_RESTORE_WINDOW" envDefault:"720h"`
+    AddressRetention         time.Duration `env:"ADDRESS_RETENTION" envDefault:"2160h"`
+    AddressPurgeInterval     time.Duration `env:"ADDRESS_PURGE_INTERVAL" envDefault:"1h"`
+    // the startup fingerprint backfill gives up after this long; 0 skips it
+    AddressBackfillTimeout   time.Duration `env:"ADDRESS_BACKFILL_TIMEOUT" envDefault:"10m"`
+    // geocoder: offline (a GeoNames postal code file at GEOCODER_DATASET), nominatim
+    // (the API at GEOCODER_URL) or off
+    Geocoder                 string        `env:"GEOCODER" envDefault:"off"`
+    GeocoderDataset          string        `env:"GEOCODER_DATASET"`
+    GeocoderURL              string        `env:"GEOCODER_URL" envDefault:"https://nominatim.openstreetmap.org"`
+    GeocoderUserAgent        string        `env:"GEOCODER_USER_AGENT" envDefault:"auth-service"`
+    GeocoderTimeout          time.Duration `env:"GEOCODER_TIMEOUT" envDefault:"5s"`
+    // minimum time between two requests to the geocoder API; the public Nominatim allows one per second
+    GeocoderInterval         time.Duration `env:"GEOCODER_INTERVAL" envDefault:"1s"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -1,30 +1,43 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"server/internal/config"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var ErrDBConnection = errors.New("database: connection failed")
 
-// NewDB returns a new connection
-func NewDB(cfg *config.Config) (*pgx.Conn, error) {	
+// NewDB returns a connection pool. It is safe for concurrent use; every
+// query borrows a connection for its duration.
+func NewDB(ctx context.Context, cfg *config.Config) (*pgxpool.Pool, error) {	
 	
 	connStr := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s", cfg.DbUser, cfg.DbPwd, cfg.DbHost, cfg.DbPort, cfg.DbName)
 
-	// initialize db connection
-	config, parsingErr := pgx.ParseURI(connStr)
+	// initialize pool config
+	config, parsingErr := pgxpool.ParseConfig(connStr)
 	if parsingErr != nil {
 		return nil, fmt.Errorf("invalid connection string: %w", parsingErr)
 	}
+	config.MaxConns = cfg.DbMaxConns
+	config.MinConns = cfg.DbMinConns
+	config.MaxConnIdleTime = cfg.DbMaxConnIdleTime
+	config.MaxConnLifetime = cfg.DbMaxConnLifetime
 
-	conn, connErr := pgx.Connect(config)
-	if connErr != nil {
-		return nil, fmt.Errorf("%w: %v", ErrDBConnection, connErr)
+	pool, poolErr := pgxpool.NewWithConfig(ctx, config)
+	if poolErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDBConnection, poolErr)
+	}
+
+	// the pool connects lazily; fail at startup rather than on the first request
+	pingErr := pool.Ping(ctx)
+	if pingErr != nil {
+		pool.Close()
+		return nil, fmt.Errorf("%w: %v", ErrDBConnection, pingErr)
 	} else {
-		return conn, nil
+		return pool, nil
 	}
 }
\ No newline at end of file
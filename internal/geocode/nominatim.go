@@ -0,0 +1,245 @@
+package geocode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"server/internal/addressrules"
+	"server/internal/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Nominatim geocodes with a Nominatim-compatible HTTP API, such as
+// https://nominatim.openstreetmap.org or a self-hosted instance. The public
+// instance allows one request per second and needs a UserAgent that
+// identifies the application.
+type Nominatim struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+	// limiter spaces out the requests of all callers
+	limiter *rate.Limiter
+	// suggestions caches the results of Suggest for suggestTTL
+	mu          sync.Mutex
+	suggestions map[string]cachedSuggestions
+}
+
+const (
+	// suggestTTL is how long Suggest reuses the results for a query
+	suggestTTL = 5 * time.Minute
+	// suggestCacheSize bounds the cached queries
+	suggestCacheSize = 10000
+	// suggestMaxWait is how long Suggest waits for the limiter; as the user
+	// is typing, it fails instead of waiting longer
+	suggestMaxWait = 2 * time.Second
+)
+
+type cachedSuggestions struct {
+	suggestions []model.AddressSuggestion
+	expires     time.Time
+}
+
+// NewNominatim returns a Nominatim for the API at baseURL that sends at most
+// one request per interval; an interval of 0 doesn't limit them.
+func NewNominatim(baseURL, userAgent string, timeout, interval time.Duration) *Nominatim {
+	limit := rate.Inf
+	if interval > 0 {
+		limit = rate.Every(interval)
+	}
+	return &Nominatim{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		userAgent:   userAgent,
+		client:      &http.Client{Timeout: timeout},
+		limiter:     rate.NewLimiter(limit, 1),
+		suggestions: map[string]cachedSuggestions{},
+	}
+}
+
+// nominatimResult is a result of /search with addressdetails
+type nominatimResult struct {
+	Lat     string `json:"lat"`
+	Lon     string `json:"lon"`
+	Address struct {
+		HouseNumber string `json:"house_number"`
+		Road        string `json:"road"`
+		Postcode    string `json:"postcode"`
+		City        string `json:"city"`
+		Town        string `json:"town"`
+		Village     string `json:"village"`
+		Hamlet      string `json:"hamlet"`
+		State       string `json:"state"`
+		CountryCode string `json:"country_code"`
+	} `json:"address"`
+}
+
+// Geocode looks a up with a structured search. The location is verified
+// when the result has the postal code and city of a.
+func (n *Nominatim) Geocode(ctx context.Context, a model.Address) (model.Location, bool, error) {
+	params := url.Values{}
+	params.Set("street", a.Addr_1)
+	params.Set("city", a.City)
+	if a.Zip != "" {
+		params.Set("postalcode", a.Zip)
+	}
+	if a.State != "" {
+		params.Set("state", a.State)
+	}
+	params.Set("countrycodes", strings.ToLower(a.Country))
+	params.Set("limit", "1")
+
+	results, searchErr := n.search(ctx, params)
+	if searchErr != nil {
+		return model.Location{}, false, searchErr
+	}
+	if len(results) == 0 {
+		return model.Location{}, false, nil
+	}
+	r := results[0]
+	lat, latErr := strconv.ParseFloat(r.Lat, 64)
+	lng, lngErr := strconv.ParseFloat(r.Lon, 64)
+	if latErr != nil || lngErr != nil {
+		return model.Location{}, false, fmt.Errorf("geocode: nominatim returned invalid coordinates %q, %q", r.Lat, r.Lon)
+	}
+	verified := addressrules.Canonical(r.Address.Postcode) == addressrules.Canonical(a.Zip) &&
+		addressrules.Canonical(r.city()) == addressrules.Canonical(a.City)
+	return model.Location{Lat: lat, Lng: lng, Verified: verified}, true, nil
+}
+
+// Suggest runs a free-form search for q. Results are cached for
+// suggestTTL, and when the limiter is busy for more than suggestMaxWait it
+// fails without asking the API.
+func (n *Nominatim) Suggest(ctx context.Context, q, country string, limit int) ([]model.AddressSuggestion, error) {
+	key := strings.Join([]string{strings.ToLower(strings.Join(strings.Fields(q), " ")), country, strconv.Itoa(limit)}, "|")
+	if cached, ok := n.cachedSuggestions(key); ok {
+		return cached, nil
+	}
+	reservation := n.limiter.Reserve()
+	if delay := reservation.Delay(); delay > suggestMaxWait {
+		reservation.Cancel()
+		return nil, fmt.Errorf("geocode: nominatim: too busy, next request in %s", delay.Round(time.Second))
+	}
+
+	params := url.Values{}
+	params.Set("q", q)
+	if country != "" {
+		params.Set("countrycodes", strings.ToLower(country))
+	}
+	params.Set("limit", strconv.Itoa(limit))
+
+	results, searchErr := n.searchAfter(ctx, reservation.Delay(), params)
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	suggestions := []model.AddressSuggestion{}
+	for _, r := range results {
+		lat, latErr := strconv.ParseFloat(r.Lat, 64)
+		lng, lngErr := strconv.ParseFloat(r.Lon, 64)
+		if latErr != nil || lngErr != nil {
+			continue
+		}
+		code := strings.ToUpper(r.Address.CountryCode)
+		suggestions = append(suggestions, model.AddressSuggestion{
+			Addr1:   strings.TrimSpace(r.Address.Road + " " + r.Address.HouseNumber),
+			Zip:     addressrules.NormalizePostalCode(code, r.Address.Postcode),
+			City:    r.city(),
+			State:   addressrules.NormalizeState(code, r.Address.State),
+			Country: code,
+			Lat:     lat,
+			Lng:     lng,
+		})
+	}
+	n.cacheSuggestions(key, suggestions)
+	return suggestions, nil
+}
+
+// cachedSuggestions returns the cached results for key, unless they expired
+func (n *Nominatim) cachedSuggestions(key string) ([]model.AddressSuggestion, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cached, ok := n.suggestions[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, false
+	}
+	return cached.suggestions, true
+}
+
+// cacheSuggestions stores the results for key, dropping expired results,
+// or else all, when the cache is full
+func (n *Nominatim) cacheSuggestions(key string, suggestions []model.AddressSuggestion) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if len(n.suggestions) >= suggestCacheSize {
+		for k, cached := range n.suggestions {
+			if now.After(cached.expires) {
+				delete(n.suggestions, k)
+			}
+		}
+		if len(n.suggestions) >= suggestCacheSize {
+			n.suggestions = map[string]cachedSuggestions{}
+		}
+	}
+	n.suggestions[key] = cachedSuggestions{suggestions: suggestions, expires: now.Add(suggestTTL)}
+}
+
+// search calls /search with params, once the limiter allows it
+func (n *Nominatim) search(ctx context.Context, params url.Values) ([]nominatimResult, error) {
+	if waitErr := n.limiter.Wait(ctx); waitErr != nil {
+		return nil, fmt.Errorf("geocode: nominatim: %w", waitErr)
+	}
+	return n.searchAfter(ctx, 0, params)
+}
+
+// searchAfter calls /search with params after delay, a slot reserved with
+// the limiter
+func (n *Nominatim) searchAfter(ctx context.Context, delay time.Duration, params url.Values) ([]nominatimResult, error) {
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("geocode: nominatim: %w", ctx.Err())
+		}
+	}
+	params.Set("format", "jsonv2")
+	params.Set("addressdetails", "1")
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, n.baseURL+"/search?"+params.Encode(), nil)
+	if reqErr != nil {
+		return nil, fmt.Errorf("geocode: %w", reqErr)
+	}
+	req.Header.Set("User-Agent", n.userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	resp, doErr := n.client.Do(req)
+	if doErr != nil {
+		return nil, fmt.Errorf("geocode: nominatim: %w", doErr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geocode: nominatim answered %s", resp.Status)
+	}
+
+	var results []nominatimResult
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&results); decodeErr != nil {
+		return nil, fmt.Errorf("geocode: decoding nominatim response: %w", decodeErr)
+	}
+	return results, nil
+}
+
+// city is the most specific place name of the result
+func (r nominatimResult) city() string {
+	for _, name := range []string{r.Address.City, r.Address.Town, r.Address.Village, r.Address.Hamlet} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+// Package geocode has the geocoders of the address service: Offline, backed
+// by a local postal code dataset, and Nominatim, an adapter for
+// Nominatim-compatible HTTP geocoding APIs.
+package geocode
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"server/internal/addressrules"
+	"server/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// place is one line of the dataset
+type place struct {
+	country, zip, city, state string
+	lat, lng                  float64
+	// zipKey and cityKey are the canonical zip and city, for lookups
+	zipKey, cityKey string
+}
+
+// Offline geocodes with a postal code dataset in the GeoNames format
+// (https://download.geonames.org/export/zip/): tab-separated lines of country
+// code, postal code, place name, admin name1, admin code1, admin name2,
+// admin code2, admin name3, admin code3, latitude, longitude and accuracy.
+// It knows postal codes and places, not streets.
+type Offline struct {
+	places []place
+	// byZip and byCity index places by country and zipKey or cityKey
+	byZip  map[string][]int
+	byCity map[string][]int
+	// zipOrder and cityOrder list the places sorted by zipKey and cityKey,
+	// for prefix searches
+	zipOrder  []int
+	cityOrder []int
+}
+
+// LoadOffline reads the dataset file at path
+func LoadOffline(path string) (*Offline, error) {
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, fmt.Errorf("geocode: %w", openErr)
+	}
+	defer f.Close()
+	return NewOffline(f)
+}
+
+// NewOffline reads a dataset from r
+func NewOffline(r io.Reader) (*Offline, error) {
+	o := &Offline{byZip: map[string][]int{}, byCity: map[string][]int{}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 11 {
+			return nil, fmt.Errorf("geocode: dataset line %d: want 11 or 12 fields, got %d", line, len(fields))
+		}
+		lat, latErr := strconv.ParseFloat(fields[9], 64)
+		lng, lngErr := strconv.ParseFloat(fields[10], 64)
+		if latErr != nil || lngErr != nil {
+			return nil, fmt.Errorf("geocode: dataset line %d: invalid coordinates", line)
+		}
+
+		country := strings.ToUpper(strings.TrimSpace(fields[0]))
+		p := place{
+			country: country,
+			zip:     addressrules.NormalizePostalCode(country, fields[1]),
+			city:    addressrules.NormalizeCity(fields[2]),
+			state:   addressrules.NormalizeState(country, fields[3]),
+			lat:     lat,
+			lng:     lng,
+		}
+		p.zipKey, p.cityKey = addressrules.Canonical(p.zip), addressrules.Canonical(p.city)
+
+		i := len(o.places)
+		o.places = append(o.places, p)
+		if p.zipKey != "" {
+			o.byZip[p.country+"|"+p.zipKey] = append(o.byZip[p.country+"|"+p.zipKey], i)
+			o.zipOrder = append(o.zipOrder, i)
+		}
+		o.byCity[p.country+"|"+p.cityKey] = append(o.byCity[p.country+"|"+p.cityKey], i)
+		o.cityOrder = append(o.cityOrder, i)
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		return nil, fmt.Errorf("geocode: reading dataset: %w", scanErr)
+	}
+
+	sort.SliceStable(o.zipOrder, func(i, j int) bool {
+		return o.places[o.zipOrder[i]].zipKey < o.places[o.zipOrder[j]].zipKey
+	})
+	sort.SliceStable(o.cityOrder, func(i, j int) bool {
+		return o.places[o.cityOrder[i]].cityKey < o.places[o.cityOrder[j]].cityKey
+	})
+	return o, nil
+}
+
+// Geocode locates a by its postal code, or by its city where the country
+// has no postal codes. The location is verified when the dataset has the
+// postal code in the city of a.
+func (o *Offline) Geocode(ctx context.Context, a model.Address) (model.Location, bool, error) {
+	country, _ := addressrules.NormalizeCountry(a.Country)
+	cityKey := addressrules.Canonical(a.City)
+
+	if zipKey := addressrules.Canonical(a.Zip); zipKey != "" {
+		matches := o.byZip[country+"|"+zipKey]
+		if len(matches) == 0 {
+			return model.Location{}, false, nil
+		}
+		for _, i := range matches {
+			if o.places[i].cityKey == cityKey {
+				return o.places[i].location(true), true, nil
+			}
+		}
+		// the postal code is known, but not in that city
+		return o.places[matches[0]].location(false), true, nil
+	}
+
+	matches := o.byCity[country+"|"+cityKey]
+	if len(matches) == 0 {
+		return model.Location{}, false, nil
+	}
+	return o.places[matches[0]].location(true), true, nil
+}
+
+// Suggest returns the places whose postal code or name begins like q,
+// postal codes first
+func (o *Offline) Suggest(ctx context.Context, q, country string, limit int) ([]model.AddressSuggestion, error) {
+	prefix := addressrules.Canonical(q)
+	suggestions := []model.AddressSuggestion{}
+	if prefix == "" {
+		return suggestions, nil
+	}
+
+	seen := map[place]bool{}
+	collect := func(order []int, key func(p place) string) {
+		start := sort.Search(len(order), func(i int) bool { return key(o.places[order[i]]) >= prefix })
+		for _, i := range order[start:] {
+			if len(suggestions) >= limit {
+				return
+			}
+			p := o.places[i]
+			if !strings.HasPrefix(key(p), prefix) {
+				return
+			}
+			if (country != "" && p.country != country) || seen[p] {
+				continue
+			}
+			seen[p] = true
+			suggestions = append(suggestions, p.suggestion())
+		}
+	}
+	collect(o.zipOrder, func(p place) string { return p.zipKey })
+	collect(o.cityOrder, func(p place) string { return p.cityKey })
+	return suggestions, nil
+}
+
+func (p place) location(verified bool) model.Location {
+	return model.Location{Lat: p.lat, Lng: p.lng, Verified: verified}
+}
+
+func (p place) suggestion() model.AddressSuggestion {
+	return model.AddressSuggestion{Zip: p.zip, City: p.city, State: p.state, Country: p.country, Lat: p.lat, Lng: p.lng}
+}
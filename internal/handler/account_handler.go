@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"server/internal/service"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AccountHandler struct {
+	accountSvc *service.AccountService
+}
+
+func NewAccountHandler(accountSvc *service.AccountService) *AccountHandler {
+	return &AccountHandler{accountSvc: accountSvc}
+}
+
+// tokenRequest for sanitation
+type tokenRequest struct {
+	Token string `json:"token" query:"token" validate:"required"`
+}
+
+// Normalize implements Normalizable
+func (r *tokenRequest) Normalize() {
+	r.Token = strings.TrimSpace(r.Token)
+}
+
+// emailRequest for sanitation
+type emailRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// Normalize implements Normalizable
+func (r *emailRequest) Normalize() {
+	r.Email = strings.ToLower(strings.TrimSpace(r.Email))
+}
+
+// VerifyEmail handles GET (link from the mail) and POST /api/verify-email
+func (h *AccountHandler) VerifyEmail(c echo.Context) error {
+	req := new(tokenRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	verifyErr := h.accountSvc.VerifyEmail(c.Request().Context(), req.Token)
+	if verifyErr != nil {
+		if errors.Is(verifyErr, service.ErrInvalidToken) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid or expired token")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "verification failed")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"message": "email verified"})
+}
+
+// ResendVerification handles POST /api/verify-email/resend.
+// It always answers 202 so it can't be used to probe for registered emails.
+func (h *AccountHandler) ResendVerification(c echo.Context) error {
+	req := new(emailRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	resendErr := h.accountSvc.ResendVerification(c.Request().Context(), req.Email)
+	if resendErr != nil {
+		c.Logger().Errorf("resend verification: %v", resendErr)
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+// RequestLoginUnlock handles POST /api/login/unlock.
+// Like ForgotPassword it always answers 202 and works in the background.
+func (h *AccountHandler) RequestLoginUnlock(c echo.Context) error {
+	req := new(emailRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	h.accountSvc.QueueLoginUnlock(req.Email)
+	return c.NoContent(http.StatusAccepted)
+}
+
+// UnlockLogin handles GET (link from the mail) and POST /api/login/unlock/confirm
+func (h *AccountHandler) UnlockLogin(c echo.Context) error {
+	req := new(tokenRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	unlockErr := h.accountSvc.UnlockLogin(c.Request().Context(), req.Token)
+	if unlockErr != nil {
+		if errors.Is(unlockErr, service.ErrInvalidToken) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid or expired token")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "unlock failed")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"message": "account unlocked"})
+}
+
+// resetPassword for sanitation
+type resetPassword struct {
+	Token            string `json:"token" validate:"required"`
+	Password         string `json:"password" validate:"required,min=8"`
+	RepeatedPassword string `json:"repeatedPassword" validate:"required,eqfield=Password"`
+}
+
+// Normalize implements Normalizable
+func (r *resetPassword) Normalize() {
+	r.Token = strings.TrimSpace(r.Token)
+}
+
+// ForgotPassword handles POST /api/password/forgot.
+// It always answers 202 and does the work in the background, so neither the
+// status nor the response time reveals whether the email is registered.
+func (h *AccountHandler) ForgotPassword(c echo.Context) error {
+	req := new(emailRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	h.accountSvc.QueuePasswordReset(req.Email)
+	return c.NoContent(http.StatusAccepted)
+}
+
+// ResetPassword handles POST /api/password/reset
+func (h *AccountHandler) ResetPassword(c echo.Context) error {
+	req := new(resetPassword)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	resetErr := h.accountSvc.ResetPassword(c.Request().Context(), req.Token, req.Password)
+	if resetErr != nil {
+		if errors.Is(resetErr, service.ErrInvalidToken) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid or expired token")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "password reset failed")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// changePassword for sanitation
+type changePassword struct {
+	CurrentPassword  string `json:"currentPassword" validate:"required"`
+	Password         string `json:"password" validate:"required,min=8,nefield=CurrentPassword"`
+	RepeatedPassword string `json:"repeatedPassword" validate:"required,eqfield=Password"`
+}
+
+// ChangePassword handles PATCH /api/v1/users/me/password.
+// Every session ends, so the client has to log in again with the new password.
+func (h *AccountHandler) ChangePassword(c echo.Context) error {
+	req := new(changePassword)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	changeErr := h.accountSvc.ChangePassword(c.Request().Context(), currentUserID(c), req.CurrentPassword, req.Password)
+	if changeErr != nil {
+		var blocked *service.LoginBlockedError
+		if errors.As(changeErr, &blocked) {
+			return confirmationBlocked(c, blocked)
+		}
+		if errors.Is(changeErr, service.ErrInvalidCredentials) {
+			return echo.NewHTTPError(http.StatusForbidden, "current password is incorrect")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "password change failed")
+	}
+
+	clearSessionCookies(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// changeEmail for sanitation
+type changeEmail struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+// Normalize implements Normalizable
+func (r *changeEmail) Normalize() {
+	r.Email = strings.ToLower(strings.TrimSpace(r.Email))
+}
+
+// ChangeEmail handles PATCH /api/v1/users/me/email
+func (h *AccountHandler) ChangeEmail(c echo.Context) error {
+	req := new(changeEmail)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	changeErr := h.accountSvc.RequestEmailChange(c.Request().Context(), currentUserID(c), req.Password, req.Email)
+	if changeErr != nil {
+		var blocked *service.LoginBlockedError
+		switch {
+		case errors.As(changeErr, &blocked):
+			return confirmationBlocked(c, blocked)
+		case errors.Is(changeErr, service.ErrInvalidCredentials):
+			return echo.NewHTTPError(http.StatusForbidden, "password is incorrect")
+		default:
+			return echo.NewHTTPError(http.StatusInternalServerError, "email change failed")
+		}
+	}
+	return c.JSON(http.StatusAccepted, echo.Map{"message": "confirmation sent to the new address"})
+}
+
+// ConfirmEmailChange handles GET (link from the mail) and POST /api/email/confirm
+func (h *AccountHandler) ConfirmEmailChange(c echo.Context) error {
+	req := new(tokenRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	confirmErr := h.accountSvc.ConfirmEmailChange(c.Request().Context(), req.Token)
+	if confirmErr != nil {
+		switch {
+		case errors.Is(confirmErr, service.ErrInvalidToken):
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid or expired token")
+		case errors.Is(confirmErr, service.ErrEmailTaken):
+			return echo.NewHTTPError(http.StatusConflict, "email already in use")
+		default:
+			return echo.NewHTTPError(http.StatusInternalServerError, "email change failed")
+		}
+	}
+
+	clearSessionCookies(c)
+	return c.JSON(http.StatusOK, echo.Map{"message": "email changed"})
+}
@@ -1,12 +1,19 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"server/internal/addressformat"
+	"server/internal/addressrules"
 	"server/internal/model"
 	"server/internal/service"
 	"strconv"
 	"strings"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 )
@@ -21,25 +28,45 @@ func NewAddressHandler(addrSvc *service.AddressService) *AddressHandler{
 
 // address for sanitation
 type address struct {
-  Addr1     string `json:"addr_1"    validate:"required,min=5"`    
-  Addr2     string `json:"addr_2"`                                 
-  Zip       string `json:"zip"       validate:"required,min=4"`    
-  City      string `json:"city"      validate:"required"`          
-  Country   string `json:"country"   validate:"required"`          
+  Addr1     string `json:"addr_1"    validate:"required,max=200"`
+  Addr2     string `json:"addr_2"    validate:"max=200"`
+  Zip       string `json:"zip"       validate:"max=12,postal_code=Country"`
+  City      string `json:"city"      validate:"required,max=100"`
+  State     string `json:"state"     validate:"max=100,state=Country"`
+  Country   string `json:"country"   validate:"required,country_code"`
+  Type      string `json:"type"      validate:"oneof=shipping billing custom"`
+  Label     string `json:"label"     validate:"max=50"`
   IsDefault bool   `json:"isdefault"`                             
 }
 
-// Normalize implements Normalizable
+// Normalize implements Normalizable. The country goes first: the postal code
+// and state are normalized by its rules.
 func (r *address) Normalize() {
-	r.Addr1 = strings.TrimSpace(r.Addr1)
-  r.Addr2 = strings.TrimSpace(r.Addr2)
-  r.Zip   = strings.TrimSpace(r.Zip)
-  r.City    = strings.TrimSpace(r.City)
-  r.Country = strings.TrimSpace(r.Country) // better a dropdown
+  r.Country, _ = addressrules.NormalizeCountry(r.Country)
+	r.Addr1 = addressrules.NormalizeLine(r.Addr1)
+  r.Addr2 = addressrules.NormalizeLine(r.Addr2)
+  r.Zip   = addressrules.NormalizePostalCode(r.Country, r.Zip)
+  r.City    = addressrules.NormalizeCity(r.City)
+  r.State   = addressrules.NormalizeState(r.Country, r.State)
+  r.Type    = strings.ToLower(strings.TrimSpace(r.Type))
+  if r.Type == "" {
+    r.Type = model.AddressShipping
+  }
+  r.Label   = addressrules.NormalizeLine(r.Label)
 }
 
-// CreateAddress handles POST /api/v1/users/addr/add
+// CreateAddress handles POST /api/v1/users/addr/add[?force=true]. Without
+// force, a near-duplicate of an address the user has is refused.
 func (h *AddressHandler) CreateAddress(c echo.Context) error {
+	force := false
+	if param := c.QueryParam("force"); param != "" {
+		var parseErr error
+		force, parseErr = strconv.ParseBool(param)
+		if parseErr != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "force must be true or false"})
+		}
+	}
+
 	// Bind into the request type
 	req := new(address)
 	bindErr := c.Bind(&req)
@@ -64,33 +91,122 @@ func (h *AddressHandler) CreateAddress(c echo.Context) error {
     Addr_2:    req.Addr2,
     Zip:       req.Zip,
     City:      req.City,
+    State:     req.State,
     Country:   req.Country,
+    Type:      req.Type,
+    Label:     req.Label,
     IsDefault: req.IsDefault,
   }
 	
 	// Call service
-	createErr := h.addrSvc.CreateAddress(userID, addr)
+	createErr := h.addrSvc.CreateAddress(c.Request().Context(), userID, addr, force)
 	if  createErr != nil {
+		var duplicate *service.DuplicateAddressError
+		if errors.As(createErr, &duplicate) {
+			return c.JSON(http.StatusConflict, echo.Map{"error": createErr.Error(), "existing_id": duplicate.ExistingID})
+		}
+		if errors.Is(createErr, service.ErrDefaultAddressConflict) {
+			return c.JSON(http.StatusConflict, echo.Map{"error": createErr.Error()})
+		}
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": createErr.Error()})
 	}
 	
 	// Return the newly-created address
+	setETag(c, addr.Version)
 	return c.JSON(http.StatusCreated, addr)
 }
 
-// GetAddress handles GET api/v1/users/addr/:id
+// listAddresses are the query parameters of ListAddresses
+type listAddresses struct {
+	Cursor    string `query:"cursor"`
+	Limit     int    `query:"limit"      validate:"min=0,max=100"`
+	Country   string `query:"country"`
+	City      string `query:"city"`
+	Type      string `query:"type"       validate:"omitempty,oneof=shipping billing custom"`
+	IsDefault *bool  `query:"is_default"`
+	Deleted   bool   `query:"deleted"`
+	Sort      string `query:"sort"       validate:"omitempty,oneof=created_at updated_at"`
+	Order     string `query:"order"      validate:"omitempty,oneof=asc desc"`
+}
+
+// Normalize implements Normalizable
+func (r *listAddresses) Normalize() {
+	// a country filter given by name matches the stored code
+	r.Country = strings.TrimSpace(r.Country)
+	if code, ok := addressrules.NormalizeCountry(r.Country); ok {
+		r.Country = code
+	}
+	r.City = strings.TrimSpace(r.City)
+	if r.Limit == 0 {
+		r.Limit = 20
+	}
+	if r.Sort == "" {
+		r.Sort = "created_at"
+	}
+	if r.Order == "" {
+		r.Order = "desc"
+	}
+}
+
+// ListAddresses handles GET api/v1/users/address
+func (h *AddressHandler) ListAddresses(c echo.Context) error {
+	req := new(listAddresses)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid query parameters")
+	}
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	q := model.AddressQuery{
+		Country:   req.Country,
+		City:      req.City,
+		Type:      req.Type,
+		IsDefault: req.IsDefault,
+		Deleted:   req.Deleted,
+		SortBy:    req.Sort,
+		Desc:      req.Order == "desc",
+		Limit:     req.Limit,
+	}
+	page, listErr := h.addrSvc.ListAddresses(c.Request().Context(), userID, q, req.Cursor)
+	if listErr != nil {
+		if errors.Is(listErr, service.ErrInvalidCursor) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": listErr.Error()})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"addresses":   page.Addresses,
+		"total":       page.Total,
+		"next_cursor": page.NextCursor,
+	})
+}
+
+// GetAddress handles GET api/v1/users/addr/:id[?format=lines|single|html].
+// With a format, the address is written in the postal convention of its
+// country instead.
 func (h *AddressHandler) GetAddress(c echo.Context) error {
 	// parse and validate address id from url params
 	addrID, addrIdErr := strconv.Atoi(c.Param("id"))
 	if addrIdErr != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid Address ID"})
 	}
+	format := c.QueryParam("format")
+	if format != "" && format != "lines" && format != "single" && format != "html" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "format must be lines, single or html"})
+	}
 
 	// extract user_id from JWT
   claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
   userID := int(claims["user_id"].(float64))
 	
-	addr, addrErr := h.addrSvc.GetAddress(userID, addrID)
+	addr, addrErr := h.addrSvc.GetAddress(c.Request().Context(), userID, addrID)
 	if addrErr != nil {
 		return c.JSON(http.StatusNotFound, echo.Map{"error": addrErr.Error()})
 	}
@@ -98,24 +214,48 @@ func (h *AddressHandler) GetAddress(c echo.Context) error {
 	if addr.UId != userID {
 		return c.JSON(http.StatusForbidden, echo.Map{"error": "you do not have access to this address"})
   }
-	
+
+	// each format is its own representation, with its own tag
+	tag := formatETag(addr.Version, format)
+	c.Response().Header().Set("ETag", tag)
+	if notModified(c, tag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	switch format {
+	case "lines":
+		return c.JSON(http.StatusOK, echo.Map{"lines": addressformat.Lines(*addr)})
+	case "single":
+		return c.JSON(http.StatusOK, echo.Map{"address": addressformat.Single(*addr)})
+	case "html":
+		return c.JSON(http.StatusOK, echo.Map{"html": addressformat.HTML(*addr)})
+	}
 	return c.JSON(http.StatusOK, addr)
 }
 
 
-// DeleteAddress handles DELETE api/v1/users/addr/:id
+// DeleteAddress handles DELETE api/v1/users/addr/:id[?promote=:other_id]
 func (h *AddressHandler) DeleteAddress(c echo.Context) error {
 	// parse and validate address id from url params
 	addrID, addrIdErr := strconv.Atoi(c.Param("id"))
 	if addrIdErr != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid Address ID"})
 	}
+
+	// the address that becomes the default when the default is deleted
+	promoteID := 0
+	if promote := c.QueryParam("promote"); promote != "" {
+		var promoteErr error
+		promoteID, promoteErr = strconv.Atoi(promote)
+		if promoteErr != nil || promoteID <= 0 {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid promote address ID"})
+		}
+	}
 	
 	// extract user_id from JWT
   claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
   userID := int(claims["user_id"].(float64))
 	
-	addr, addrErr := h.addrSvc.GetAddress(userID, addrID)
+	addr, addrErr := h.addrSvc.GetAddress(c.Request().Context(), userID, addrID)
 	if addrErr != nil {
 		return c.JSON(http.StatusNotFound, echo.Map{"error": addrErr.Error()})
 	}
@@ -123,15 +263,188 @@ func (h *AddressHandler) DeleteAddress(c echo.Context) error {
 	if addr.UId != userID {
 		return c.JSON(http.StatusForbidden, echo.Map{"error": "you do not have access to this address"})
   }
+
+	version, matched := ifMatch(c, addr.Version)
+	if !matched {
+		return preconditionFailed(c)
+	}
 	
-	delErr := h.addrSvc.DeleteAddress(userID, addrID)
+	delErr := h.addrSvc.DeleteAddress(c.Request().Context(), userID, addrID, version, promoteID)
 	if delErr != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": delErr.Error()})
+		switch {
+		case errors.Is(delErr, service.ErrCannotDeleteDefault):
+			return c.JSON(http.StatusConflict, echo.Map{"error": "cannot delete default address; make another address the default with ?promote="})
+		case errors.Is(delErr, service.ErrInvalidPromotion):
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": delErr.Error()})
+		case errors.Is(delErr, service.ErrVersionMismatch):
+			return preconditionFailed(c)
+		case errors.Is(delErr, service.ErrAddressNotFound):
+			return c.JSON(http.StatusNotFound, echo.Map{"error": delErr.Error()})
+		case errors.Is(delErr, service.ErrDefaultAddressConflict):
+			return c.JSON(http.StatusConflict, echo.Map{"error": delErr.Error()})
+		default:
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": delErr.Error()})
+		}
 	}
 	
 	return c.NoContent(http.StatusNoContent)
 }
 
+// AddressHistory handles GET api/v1/users/address/:id/history
+func (h *AddressHandler) AddressHistory(c echo.Context) error {
+	addrID, addrIdErr := strconv.Atoi(c.Param("id"))
+	if addrIdErr != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid Address ID"})
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	versions, historyErr := h.addrSvc.AddressHistory(c.Request().Context(), userID, addrID)
+	if historyErr != nil {
+		switch {
+		case errors.Is(historyErr, service.ErrForbidden):
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "you do not have access to this address"})
+		case errors.Is(historyErr, service.ErrAddressNotFound):
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "address not found"})
+		default:
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": historyErr.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"versions": versions})
+}
+
+// suggestAddresses are the query parameters of SuggestAddresses
+type suggestAddresses struct {
+	Q       string `query:"q"       validate:"required,min=2,max=100"`
+	Country string `query:"country" validate:"omitempty,country_code"`
+	Limit   int    `query:"limit"   validate:"min=0,max=20"`
+}
+
+// Normalize implements Normalizable
+func (r *suggestAddresses) Normalize() {
+	r.Q = strings.Join(strings.Fields(r.Q), " ")
+	if r.Country != "" {
+		r.Country, _ = addressrules.NormalizeCountry(r.Country)
+	}
+	if r.Limit == 0 {
+		r.Limit = 10
+	}
+}
+
+// SuggestAddresses handles GET api/v1/address/suggest?q=, completing a
+// partly typed address for the address form
+func (h *AddressHandler) SuggestAddresses(c echo.Context) error {
+	req := new(suggestAddresses)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid query parameters")
+	}
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	suggestions, suggestErr := h.addrSvc.SuggestAddresses(c.Request().Context(), req.Q, req.Country, req.Limit)
+	if suggestErr != nil {
+		if errors.Is(suggestErr, service.ErrGeocodingDisabled) {
+			return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": "address suggestions are not available"})
+		}
+		// the error names the geocoder's URL, so it's only logged
+		c.Logger().Errorf("suggest addresses: %v", suggestErr)
+		return c.JSON(http.StatusBadGateway, echo.Map{"error": "address suggestions failed, try again later"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"suggestions": suggestions})
+}
+
+// RestoreAddress handles POST api/v1/users/address/:id/restore
+func (h *AddressHandler) RestoreAddress(c echo.Context) error {
+	addrID, addrIdErr := strconv.Atoi(c.Param("id"))
+	if addrIdErr != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid Address ID"})
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	addr, restoreErr := h.addrSvc.RestoreAddress(c.Request().Context(), userID, addrID)
+	if restoreErr != nil {
+		switch {
+		case errors.Is(restoreErr, service.ErrForbidden):
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "you do not have access to this address"})
+		case errors.Is(restoreErr, service.ErrAddressNotFound):
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "no deleted address with this ID"})
+		case errors.Is(restoreErr, service.ErrRestoreExpired):
+			return c.JSON(http.StatusGone, echo.Map{"error": restoreErr.Error()})
+		default:
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": restoreErr.Error()})
+		}
+	}
+
+	setETag(c, addr.Version)
+	return c.JSON(http.StatusOK, addr)
+}
+
+// GetDefaultAddress handles GET api/v1/users/address/default[?type=shipping|billing|custom]
+func (h *AddressHandler) GetDefaultAddress(c echo.Context) error {
+	addrType := c.QueryParam("type")
+	switch addrType {
+	case "":
+		addrType = model.AddressShipping
+	case model.AddressShipping, model.AddressBilling, model.AddressCustom:
+	default:
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "type must be shipping, billing or custom"})
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	addr, addrErr := h.addrSvc.GetDefaultAddress(c.Request().Context(), userID, addrType)
+	if addrErr != nil {
+		if errors.Is(addrErr, service.ErrNoDefaultAddress) {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "no default " + addrType + " address"})
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": addrErr.Error()})
+	}
+
+	setETag(c, addr.Version)
+	return c.JSON(http.StatusOK, addr)
+}
+
+// SetDefaultAddress handles PUT api/v1/users/address/:id/default
+func (h *AddressHandler) SetDefaultAddress(c echo.Context) error {
+	addrID, addrIdErr := strconv.Atoi(c.Param("id"))
+	if addrIdErr != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid Address ID"})
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	addr, setErr := h.addrSvc.SetDefaultAddress(c.Request().Context(), userID, addrID)
+	if setErr != nil {
+		switch {
+		case errors.Is(setErr, service.ErrForbidden):
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "you do not have access to this address"})
+		case errors.Is(setErr, service.ErrAddressNotFound):
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "address not found"})
+		case errors.Is(setErr, service.ErrDefaultAddressConflict):
+			return c.JSON(http.StatusConflict, echo.Map{"error": setErr.Error()})
+		default:
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": setErr.Error()})
+		}
+	}
+
+	setETag(c, addr.Version)
+	return c.JSON(http.StatusOK, addr)
+}
+
+// UpdateAddress handles PATCH api/v1/users/address/:id. The body is a JSON
+// merge patch (RFC 7396): only the fields present in it change, and null
+// clears a field. The merged address must pass the same validation as a
+// new one.
 func (h *AddressHandler) UpdateAddress(c echo.Context) error {
 	// parse & validate id from url params
 	id, paramErr := strconv.Atoi(c.Param("id"))
@@ -139,45 +452,176 @@ func (h *AddressHandler) UpdateAddress(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid address ID"})
 	}
 
-	// bind & normalize & validate body
-	req := new(address)
-	bindErr := c.Bind(req)
-
-	if bindErr != nil {
+	body, readErr := io.ReadAll(c.Request().Body)
+	if readErr != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
 	}
-
-	validateErr := c.Validate(req);
-	if  validateErr != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	patch, patchErr := decodeAddressPatch(body)
+	if patchErr != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": patchErr.Error()})
 	}
 
 	// extract userID from JWT
 	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
 	userID := int(claims["user_id"].(float64))
 
-	// map to model.Address
-	addr := &model.Address{
-		ID:        id,
-		UId:       userID,
-		Addr_1:    req.Addr1,
-		Addr_2:    req.Addr2,
-		Zip:       req.Zip,
-		City:      req.City,
-		Country:   req.Country,
-		IsDefault: req.IsDefault,
-	}
+	// the patch is merged with, and validated against, the address as the
+	// update transaction finds it
+	updated, updateErr := h.addrSvc.UpdateAddressWith(c.Request().Context(), userID, id, 0, func(existing model.Address) (model.AddressPatch, error) {
+		// with If-Match, the write must find the version the client has
+		if _, matched := ifMatch(c, existing.Version); !matched {
+			return patch, service.ErrVersionMismatch
+		}
 
-	// call service
-	updateErr := h.addrSvc.UpdateAddress(userID, addr);
-	if  updateErr != nil {
-		switch updateErr {
-		case service.ErrForbidden:
+		// normalize & validate the address as it will be after the patch
+		merged := patch.Apply(existing)
+		req := &address{
+			Addr1:     merged.Addr_1,
+			Addr2:     merged.Addr_2,
+			Zip:       merged.Zip,
+			City:      merged.City,
+			State:     merged.State,
+			Country:   merged.Country,
+			Type:      merged.Type,
+			Label:     merged.Label,
+			IsDefault: merged.IsDefault,
+		}
+		// only the fields the patch touches are checked, so an address stored
+		// before the current rules can still be updated
+		if validateErr := touchedErrors(c.Validate(req), patch); validateErr != nil {
+			return patch, echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+		}
+		// write the normalized values of the patched fields, and of stored
+		// ones that predate the address rules
+		return normalizedPatch(patch, req, &existing), nil
+	})
+	if updateErr != nil {
+		var validateErr *echo.HTTPError
+		switch {
+		case errors.As(updateErr, &validateErr):
+			return validateErr
+		case errors.Is(updateErr, service.ErrForbidden):
 			return c.JSON(http.StatusForbidden, echo.Map{"error": updateErr.Error()})
+		case errors.Is(updateErr, service.ErrAddressNotFound):
+			return c.JSON(http.StatusNotFound, echo.Map{"error": updateErr.Error()})
+		case errors.Is(updateErr, service.ErrDefaultAddressConflict), errors.Is(updateErr, service.ErrAddressChanged):
+			return c.JSON(http.StatusConflict, echo.Map{"error": updateErr.Error()})
+		case errors.Is(updateErr, service.ErrVersionMismatch):
+			return preconditionFailed(c)
 		default:
 			return c.JSON(http.StatusInternalServerError, echo.Map{"error": updateErr.Error()})
 		}
 	}
 
-	return c.JSON(http.StatusOK, addr)
-}
\ No newline at end of file
+	setETag(c, updated.Version)
+	return c.JSON(http.StatusOK, updated)
+}
+
+// decodeAddressPatch reads a JSON merge patch of an address. Unknown members
+// are ignored, like in a bound request; null clears a field to its zero value.
+func decodeAddressPatch(body []byte) (model.AddressPatch, error) {
+	var patch model.AddressPatch
+	var members map[string]json.RawMessage
+	if json.Unmarshal(body, &members) != nil || members == nil {
+		return patch, errors.New("request payload must be a JSON object")
+	}
+
+	strField := func(name string, dst **string) error {
+		raw, ok := members[name]
+		if !ok {
+			return nil
+		}
+		var v *string
+		if json.Unmarshal(raw, &v) != nil {
+			return fmt.Errorf("%s must be a string or null", name)
+		}
+		if v == nil {
+			v = new(string)
+		}
+		*dst = v
+		return nil
+	}
+	for _, f := range []struct {
+		name string
+		dst  **string
+	}{
+		{"addr_1", &patch.Addr_1},
+		{"addr_2", &patch.Addr_2},
+		{"zip", &patch.Zip},
+		{"city", &patch.City},
+		{"state", &patch.State},
+		{"country", &patch.Country},
+		{"type", &patch.Type},
+		{"label", &patch.Label},
+	} {
+		if err := strField(f.name, f.dst); err != nil {
+			return patch, err
+		}
+	}
+
+	if raw, ok := members["isdefault"]; ok {
+		var v *bool
+		if json.Unmarshal(raw, &v) != nil {
+			return patch, errors.New("isdefault must be a boolean or null")
+		}
+		if v == nil {
+			v = new(bool)
+		}
+		patch.IsDefault = v
+	}
+	return patch, nil
+}
+
+// touchedErrors keeps the validation errors of the fields p sets. A new
+// country touches the postal code and state too, as they follow its rules.
+func touchedErrors(validateErr error, p model.AddressPatch) error {
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(validateErr, &fieldErrs) {
+		return validateErr
+	}
+	touched := map[string]bool{
+		"Addr1":   p.Addr_1 != nil,
+		"Addr2":   p.Addr_2 != nil,
+		"Zip":     p.Zip != nil || p.Country != nil,
+		"City":    p.City != nil,
+		"State":   p.State != nil || p.Country != nil,
+		"Country": p.Country != nil,
+		"Type":    p.Type != nil,
+		"Label":   p.Label != nil,
+	}
+	var kept validator.ValidationErrors
+	for _, fieldErr := range fieldErrs {
+		if touched[fieldErr.StructField()] {
+			kept = append(kept, fieldErr)
+		}
+	}
+	if kept == nil {
+		return nil
+	}
+	return kept
+}
+
+// normalizedPatch takes the values of the fields set in p from the
+// normalized request. Fields that p leaves out are set too where normalizing
+// changed the stored value, e.g. a country stored as "Germany" becomes "DE".
+func normalizedPatch(p model.AddressPatch, req *address, existing *model.Address) model.AddressPatch {
+	for _, f := range []struct {
+		dst        **string
+		normalized *string
+		stored     string
+	}{
+		{&p.Addr_1, &req.Addr1, existing.Addr_1},
+		{&p.Addr_2, &req.Addr2, existing.Addr_2},
+		{&p.Zip, &req.Zip, existing.Zip},
+		{&p.City, &req.City, existing.City},
+		{&p.State, &req.State, existing.State},
+		{&p.Country, &req.Country, existing.Country},
+		{&p.Type, &req.Type, existing.Type},
+		{&p.Label, &req.Label, existing.Label},
+	} {
+		if *f.dst != nil || *f.normalized != f.stored {
+			*f.dst = f.normalized
+		}
+	}
+	return p
+}
@@ -0,0 +1,145 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"server/internal/handler"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"server/internal/validator"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+type addressAPI struct {
+	h     *handler.AddressHandler
+	svc   *service.AddressService
+	users *memory.AuthRepo
+	// addrs writes addresses past the handler, as older code did
+	addrs *memory.AddressRepo
+}
+
+func newAddressAPI(t *testing.T) *addressAPI {
+	t.Helper()
+	db := memory.New()
+	addrs := memory.NewAddressRepo(db)
+	svc := service.NewAddressService(addrs, memory.NewTxManager(db), service.AddressOptions{})
+	return &addressAPI{h: handler.NewAddressHandler(svc), svc: svc, users: memory.NewAuthRepo(db), addrs: addrs}
+}
+
+func (api *addressAPI) createUser(t *testing.T, email string) int {
+	t.Helper()
+	u := &model.User{Username: strings.Split(email, "@")[0], Email: email, PasswordHash: "hash"}
+	if err := api.users.CreateUser(context.Background(), u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	return u.ID
+}
+
+// serve runs h for the user like the JWT middleware would. params are
+// the names and values of the path parameters. An error h returns is
+// written like echo's error handler does.
+func serve(t *testing.T, h echo.HandlerFunc, userID int, req *http.Request, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+	e.Validator = validator.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user", &jwt.Token{Claims: jwt.MapClaims{"user_id": float64(userID)}})
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names, values = append(names, params[i]), append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	if err := h(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+// patch sends a merge patch of address id, with If-Match set when ifMatch
+// isn't empty
+func (api *addressAPI) patch(t *testing.T, userID, id int, body string, ifMatch ...string) (*httptest.ResponseRecorder, model.Address) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/users/address/"+strconv.Itoa(id), strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, "application/merge-patch+json")
+	for _, tag := range ifMatch {
+		req.Header.Add("If-Match", tag)
+	}
+	rec := serve(t, api.h.UpdateAddress, userID, req, "id", strconv.Itoa(id))
+	var updated model.Address
+	_ = json.Unmarshal(rec.Body.Bytes(), &updated)
+	return rec, updated
+}
+
+func TestUpdateAddressValidatesTheTouchedFields(t *testing.T) {
+	api := newAddressAPI(t)
+	userID := api.createUser(t, "ada@example.com")
+
+	// stored before the address rules: a country name and a short postal code
+	legacy := &model.Address{UId: userID, Addr_1: "Hauptstraße 5", Zip: "1011", City: "Berlin", Country: "Germany", Type: model.AddressShipping}
+	if err := api.addrs.CreateAddress(context.Background(), legacy); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+
+	rec, updated := api.patch(t, userID, legacy.ID, `{"label":"Home"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch of the label = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if updated.Label != "Home" || updated.Country != "DE" || updated.Zip != "1011" {
+		t.Fatalf("patched address = %+v, want the label set and the country normalized", updated)
+	}
+
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"bad postal code", `{"zip":"1234"}`, http.StatusBadRequest},
+		{"cleared city", `{"city":null}`, http.StatusBadRequest},
+		{"unknown country", `{"country":"Atlantis"}`, http.StatusBadRequest},
+		// a new country checks the stored postal code and state against its rules
+		{"country with a stored postal code that doesn't fit", `{"country":"NL"}`, http.StatusBadRequest},
+		{"country that needs a state", `{"country":"US","zip":"10118"}`, http.StatusBadRequest},
+		{"country with its postal code", `{"country":"AT","zip":"1010"}`, http.StatusOK},
+		{"postal code", `{"zip":"1020"}`, http.StatusOK},
+	}
+	for _, tc := range tests {
+		if rec, _ := api.patch(t, userID, legacy.ID, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: patch %s = %d %s, want %d", tc.name, tc.body, rec.Code, rec.Body, tc.want)
+		}
+	}
+}
+
+func TestUpdateAddressChecksTheStoredAddress(t *testing.T) {
+	api := newAddressAPI(t)
+	userID := api.createUser(t, "ada@example.com")
+	otherID := api.createUser(t, "bob@example.com")
+	home := &model.Address{UId: userID, Addr_1: "Hauptstraße 5", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressShipping}
+	if err := api.addrs.CreateAddress(context.Background(), home); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+
+	// ownership is checked before the patch is validated
+	if rec, _ := api.patch(t, otherID, home.ID, `{"zip":"1234"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("patch of another user's address = %d %s, want 403", rec.Code, rec.Body)
+	}
+	if rec, _ := api.patch(t, userID, home.ID+1, `{"label":"Home"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("patch of a missing address = %d %s, want 404", rec.Code, rec.Body)
+	}
+
+	rec, updated := api.patch(t, userID, home.ID, `{"label":"Home"}`, `"1"`)
+	if rec.Code != http.StatusOK || updated.Version != 2 || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("patch with the current If-Match = %d %s, want 200 at version 2", rec.Code, rec.Body)
+	}
+	if rec, _ := api.patch(t, userID, home.ID, `{"label":"Office"}`, `"1"`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("patch with a stale If-Match = %d %s, want 412", rec.Code, rec.Body)
+	}
+}
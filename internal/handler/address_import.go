@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"server/internal/model"
+	"server/internal/service"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// maxImportBytes and maxImportRows bound a single import
+	maxImportBytes = 1 << 20
+	maxImportRows  = 1000
+)
+
+// addressColumns are the CSV columns of an import or export, named like the
+// JSON fields of an address
+var addressColumns = []string{"addr_1", "addr_2", "zip", "city", "state", "country", "type", "label", "isdefault"}
+
+// rowErrors are the problems of one row of an import; Row counts from 1,
+// not counting the CSV header
+type rowErrors struct {
+	Row    int      `json:"row"`
+	Errors []string `json:"errors"`
+}
+
+// ImportAddresses handles POST api/v1/users/address/import[?dry_run=true][&force=true].
+// The body is a CSV file with a header row (Content-Type text/csv) or a
+// JSON array of addresses. Every row is validated like a new address and,
+// without force, must not duplicate an address of the user or an earlier
+// row; if any row fails, none are imported and the report lists the errors
+// per row. With dry_run nothing is imported either way.
+func (h *AddressHandler) ImportAddresses(c echo.Context) error {
+	flags := map[string]bool{"dry_run": false, "force": false}
+	for name := range flags {
+		if param := c.QueryParam(name); param != "" {
+			value, parseErr := strconv.ParseBool(param)
+			if parseErr != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{"error": name + " must be true or false"})
+			}
+			flags[name] = value
+		}
+	}
+	dryRun, force := flags["dry_run"], flags["force"]
+
+	body, readErr := io.ReadAll(io.LimitReader(c.Request().Body, maxImportBytes+1))
+	if readErr != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request payload"})
+	}
+	if len(body) > maxImportBytes {
+		return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{"error": fmt.Sprintf("imports are limited to %d bytes", maxImportBytes)})
+	}
+
+	var rows []*address
+	var rowErrs []rowErrors
+	var decodeErr error
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		rows, rowErrs, decodeErr = decodeAddressCSV(body)
+	case strings.HasPrefix(contentType, echo.MIMEApplicationJSON):
+		rows, rowErrs, decodeErr = decodeAddressJSON(body)
+	default:
+		return c.JSON(http.StatusUnsupportedMediaType, echo.Map{"error": "send text/csv or application/json"})
+	}
+	if decodeErr != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": decodeErr.Error()})
+	}
+	if len(rows) > maxImportRows {
+		return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{"error": fmt.Sprintf("imports are limited to %d rows", maxImportRows)})
+	}
+
+	// normalize & validate every row, and allow one default per type
+	defaultRow := map[string]int{}
+	for i, req := range rows {
+		if req == nil {
+			// undecodable, already reported
+			continue
+		}
+		var problems []string
+		if validateErr := c.Validate(req); validateErr != nil {
+			problems = strings.Split(validateErr.Error(), "\n")
+		} else if req.IsDefault {
+			if first, seen := defaultRow[req.Type]; seen {
+				problems = append(problems, fmt.Sprintf("row %d is already the default %s address", first, req.Type))
+			} else {
+				defaultRow[req.Type] = i + 1
+			}
+		}
+		if problems != nil {
+			rowErrs = append(rowErrs, rowErrors{Row: i + 1, Errors: problems})
+		}
+	}
+	report := echo.Map{"dry_run": dryRun, "total": len(rows), "imported": 0, "errors": rowErrs}
+	if len(rowErrs) > 0 {
+		sort.Slice(rowErrs, func(i, j int) bool { return rowErrs[i].Row < rowErrs[j].Row })
+		return c.JSON(http.StatusUnprocessableEntity, report)
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	addrs := make([]*model.Address, len(rows))
+	for i, req := range rows {
+		addrs[i] = &model.Address{
+			UId:       userID,
+			Addr_1:    req.Addr1,
+			Addr_2:    req.Addr2,
+			Zip:       req.Zip,
+			City:      req.City,
+			State:     req.State,
+			Country:   req.Country,
+			Type:      req.Type,
+			Label:     req.Label,
+			IsDefault: req.IsDefault,
+		}
+	}
+
+	if !force {
+		dups, findErr := h.addrSvc.FindDuplicates(c.Request().Context(), userID, addrs)
+		if findErr != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": findErr.Error()})
+		}
+		for i, dup := range dups {
+			var problems []string
+			if dup.ExistingID != 0 {
+				problems = append(problems, fmt.Sprintf("duplicates address %d", dup.ExistingID))
+			}
+			if dup.Row != 0 {
+				problems = append(problems, fmt.Sprintf("duplicates row %d", dup.Row))
+			}
+			if problems != nil {
+				rowErrs = append(rowErrs, rowErrors{Row: i + 1, Errors: problems})
+			}
+		}
+		if len(rowErrs) > 0 {
+			report["errors"] = rowErrs
+			return c.JSON(http.StatusUnprocessableEntity, report)
+		}
+	}
+
+	if dryRun {
+		report["errors"] = []rowErrors{}
+		return c.JSON(http.StatusOK, report)
+	}
+
+	importErr := h.addrSvc.ImportAddresses(c.Request().Context(), userID, addrs, force)
+	if importErr != nil {
+		var duplicate *service.DuplicateAddressError
+		if errors.As(importErr, &duplicate) {
+			// added since FindDuplicates
+			return c.JSON(http.StatusConflict, echo.Map{"error": importErr.Error(), "existing_id": duplicate.ExistingID})
+		}
+		if errors.Is(importErr, service.ErrDefaultAddressConflict) {
+			return c.JSON(http.StatusConflict, echo.Map{"error": importErr.Error()})
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": importErr.Error()})
+	}
+
+	report["imported"] = len(addrs)
+	report["errors"] = []rowErrors{}
+	report["addresses"] = addrs
+	return c.JSON(http.StatusCreated, report)
+}
+
+// decodeAddressCSV reads the rows of a CSV import. The header names the
+// columns, in any order; missing columns are empty. A row that can't be
+// read into an address is nil and reported in rowErrs.
+func decodeAddressCSV(body []byte) (rows []*address, rowErrs []rowErrors, err error) {
+	// spreadsheets like to start UTF-8 files with a byte order mark
+	body = bytes.TrimPrefix(body, []byte("\ufeff"))
+	r := csv.NewReader(bytes.NewReader(body))
+	r.TrimLeadingSpace = true
+	// a row with a wrong field count is reported against that row below
+	r.FieldsPerRecord = -1
+
+	header, headerErr := r.Read()
+	if headerErr != nil {
+		return nil, nil, errors.New("CSV must start with a header row")
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, column := range addressColumns {
+			known = known || column == name
+		}
+		if !known {
+			return nil, nil, fmt.Errorf("unknown CSV column %q; use %s", name, strings.Join(addressColumns, ", "))
+		}
+		index[name] = i
+	}
+
+	for {
+		record, readErr := r.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, nil, fmt.Errorf("invalid CSV: %w", readErr)
+		}
+		if len(record) != len(header) {
+			problem := fmt.Sprintf("row has %d fields, the header has %d", len(record), len(header))
+			rowErrs = append(rowErrs, rowErrors{Row: len(rows) + 1, Errors: []string{problem}})
+			rows = append(rows, nil)
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := index[name]; ok {
+				return unescapeCSVCell(record[i])
+			}
+			return ""
+		}
+
+		req := &address{
+			Addr1:   field("addr_1"),
+			Addr2:   field("addr_2"),
+			Zip:     field("zip"),
+			City:    field("city"),
+			State:   field("state"),
+			Country: field("country"),
+			Type:    field("type"),
+			Label:   field("label"),
+		}
+		if isDefault := strings.TrimSpace(field("isdefault")); isDefault != "" {
+			var parseErr error
+			req.IsDefault, parseErr = strconv.ParseBool(isDefault)
+			if parseErr != nil {
+				rowErrs = append(rowErrs, rowErrors{Row: len(rows) + 1, Errors: []string{"isdefault must be true or false"}})
+				req = nil
+			}
+		}
+		rows = append(rows, req)
+	}
+	return rows, rowErrs, nil
+}
+
+// decodeAddressJSON reads the rows of a JSON import: an array of objects
+// with the fields of a new address. A row that can't be read into an address
+// is nil and reported in rowErrs.
+func decodeAddressJSON(body []byte) (rows []*address, rowErrs []rowErrors, err error) {
+	var raw []json.RawMessage
+	if json.Unmarshal(body, &raw) != nil {
+		return nil, nil, errors.New("request payload must be a JSON array of addresses")
+	}
+	for i, item := range raw {
+		req := new(address)
+		if json.Unmarshal(item, req) != nil || bytes.Equal(bytes.TrimSpace(item), []byte("null")) {
+			rowErrs = append(rowErrs, rowErrors{Row: i + 1, Errors: []string{"row must be an address object"}})
+			req = nil
+		}
+		rows = append(rows, req)
+	}
+	return rows, rowErrs, nil
+}
+
+// ExportAddresses handles GET api/v1/users/address/export[?format=json|csv].
+// The export uses the fields and columns an import reads, so it can be
+// imported again.
+func (h *AddressHandler) ExportAddresses(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "format must be json or csv"})
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	userID := int(claims["user_id"].(float64))
+
+	addrs, exportErr := h.addrSvc.ExportAddresses(c.Request().Context(), userID)
+	if exportErr != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": exportErr.Error()})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="addresses.%s"`, format))
+	if format == "json" {
+		rows := make([]address, len(addrs))
+		for i, a := range addrs {
+			rows[i] = address{
+				Addr1:     a.Addr_1,
+				Addr2:     a.Addr_2,
+				Zip:       a.Zip,
+				City:      a.City,
+				State:     a.State,
+				Country:   a.Country,
+				Type:      a.Type,
+				Label:     a.Label,
+				IsDefault: a.IsDefault,
+			}
+		}
+		return c.JSON(http.StatusOK, rows)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(addressColumns)
+	for _, a := range addrs {
+		record := []string{a.Addr_1, a.Addr_2, a.Zip, a.City, a.State, a.Country, a.Type, a.Label, strconv.FormatBool(a.IsDefault)}
+		for i := range record {
+			record[i] = escapeCSVCell(record[i])
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+	if flushErr := w.Error(); flushErr != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": flushErr.Error()})
+	}
+	return c.Blob(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// escapeCSVCell keeps spreadsheets from running a cell as a formula: a
+// value starting with =, +, - or @ gets a leading apostrophe, which
+// spreadsheets hide and an import drops again.
+func escapeCSVCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// unescapeCSVCell undoes escapeCSVCell
+func unescapeCSVCell(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune("=+-@", rune(value[1])) {
+		return value[1:]
+	}
+	return value
+}
@@ -0,0 +1,200 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// importReport is the body of an import response
+type importReport struct {
+	DryRun   bool `json:"dry_run"`
+	Total    int  `json:"total"`
+	Imported int  `json:"imported"`
+	Errors   []struct {
+		Row    int      `json:"row"`
+		Errors []string `json:"errors"`
+	} `json:"errors"`
+}
+
+func (api *addressAPI) importAddresses(t *testing.T, userID int, query, contentType, body string) (*httptest.ResponseRecorder, importReport) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users/address/import?"+query, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	rec := serve(t, api.h.ImportAddresses, userID, req)
+	var report importReport
+	_ = json.Unmarshal(rec.Body.Bytes(), &report)
+	return rec, report
+}
+
+func (api *addressAPI) export(t *testing.T, userID int, format string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/address/export?format="+format, nil)
+	return serve(t, api.h.ExportAddresses, userID, req)
+}
+
+func (api *addressAPI) count(t *testing.T, userID int) int {
+	t.Helper()
+	addrs, err := api.svc.ExportAddresses(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("ExportAddresses = %v", err)
+	}
+	return len(addrs)
+}
+
+func TestImportAddressesCSV(t *testing.T) {
+	api := newAddressAPI(t)
+	userID := api.createUser(t, "ada@example.com")
+
+	// every bad row is reported and nothing is imported
+	bad := "\ufeffaddr_1,zip,city,country,type,label,isdefault\n" +
+		"Hauptstraße 5,10115,Berlin,DE,shipping,Home,true\n" +
+		"Invalidenstraße 1,10115,Berlin\n" +
+		"Bouchestr 52,1234,Berlin,DE,billing,Office,false\n" +
+		"Main St 1,10001,New York,US,shipping,,maybe\n"
+	rec, report := api.importAddresses(t, userID, "", "text/csv", bad)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("import of bad rows = %d %s, want 422", rec.Code, rec.Body)
+	}
+	if report.Total != 4 || len(report.Errors) != 3 {
+		t.Fatalf("report = %+v, want 4 rows and 3 errors", report)
+	}
+	if e := report.Errors[0]; e.Row != 2 || len(e.Errors) != 1 || e.Errors[0] != "row has 3 fields, the header has 7" {
+		t.Errorf("row 2 errors = %+v, want the field count", e)
+	}
+	if e := report.Errors[1]; e.Row != 3 || !strings.Contains(e.Errors[0], "postal_code") {
+		t.Errorf("row 3 errors = %+v, want the postal code", e)
+	}
+	if e := report.Errors[2]; e.Row != 4 || e.Errors[0] != "isdefault must be true or false" {
+		t.Errorf("row 4 errors = %+v, want isdefault", e)
+	}
+	if n := api.count(t, userID); n != 0 {
+		t.Fatalf("%d addresses after a failed import, want 0", n)
+	}
+
+	good := "addr_1,zip,city,country,type,label,isdefault\n" +
+		"Hauptstraße 5,10115,Berlin,DE,shipping,Home,true\n" +
+		"Bouchestr 52,12435,Berlin,DE,billing,Office,false\n"
+
+	// a dry run validates only
+	rec, report = api.importAddresses(t, userID, "dry_run=true", "text/csv", good)
+	if rec.Code != http.StatusOK || !report.DryRun || report.Total != 2 || report.Imported != 0 || len(report.Errors) != 0 {
+		t.Fatalf("dry run = %d %s, want 200 without errors", rec.Code, rec.Body)
+	}
+	if n := api.count(t, userID); n != 0 {
+		t.Fatalf("%d addresses after a dry run, want 0", n)
+	}
+
+	rec, report = api.importAddresses(t, userID, "", "text/csv", good)
+	if rec.Code != http.StatusCreated || report.Imported != 2 {
+		t.Fatalf("import = %d %s, want 201 with 2 addresses", rec.Code, rec.Body)
+	}
+	if n := api.count(t, userID); n != 2 {
+		t.Fatalf("%d addresses after the import, want 2", n)
+	}
+
+	// the same rows again are duplicates, which a dry run reports too
+	rec, report = api.importAddresses(t, userID, "dry_run=true", "text/csv", good)
+	if rec.Code != http.StatusUnprocessableEntity || len(report.Errors) != 2 || !strings.HasPrefix(report.Errors[0].Errors[0], "duplicates address") {
+		t.Fatalf("dry run of duplicates = %d %s, want 422", rec.Code, rec.Body)
+	}
+	rec, _ = api.importAddresses(t, userID, "force=true", "text/csv", good)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("forced import = %d %s, want 201", rec.Code, rec.Body)
+	}
+}
+
+func TestImportAddressesRequests(t *testing.T) {
+	api := newAddressAPI(t)
+	userID := api.createUser(t, "ada@example.com")
+
+	tests := []struct {
+		name, query, contentType, body string
+		want                           int
+	}{
+		{"no header", "", "text/csv", "", http.StatusBadRequest},
+		{"unknown column", "", "text/csv", "street,zip\nHauptstraße 5,10115\n", http.StatusBadRequest},
+		{"broken quotes", "", "text/csv", "addr_1,zip\n\"Hauptstraße 5,10115\n", http.StatusBadRequest},
+		{"not an array", "", echo.MIMEApplicationJSON, `{"addr_1":"Hauptstraße 5"}`, http.StatusBadRequest},
+		{"bad flag", "dry_run=maybe", "text/csv", "addr_1\n", http.StatusBadRequest},
+		{"other media type", "", "application/xml", "<addresses/>", http.StatusUnsupportedMediaType},
+		{"too large", "", "text/csv", strings.Repeat("x", 1<<20+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		if rec, _ := api.importAddresses(t, userID, tc.query, tc.contentType, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: import = %d %s, want %d", tc.name, rec.Code, rec.Body, tc.want)
+		}
+	}
+
+	rec, report := api.importAddresses(t, userID, "", echo.MIMEApplicationJSON,
+		`[{"addr_1":"Hauptstraße 5","zip":"10115","city":"Berlin","country":"Germany"}, null, 5]`)
+	if rec.Code != http.StatusUnprocessableEntity || len(report.Errors) != 2 || report.Errors[0].Row != 2 || report.Errors[1].Row != 3 {
+		t.Fatalf("JSON import with bad rows = %d %s, want rows 2 and 3 reported", rec.Code, rec.Body)
+	}
+}
+
+func TestExportAddresses(t *testing.T) {
+	api := newAddressAPI(t)
+	userID := api.createUser(t, "ada@example.com")
+	rec, _ := api.importAddresses(t, userID, "", echo.MIMEApplicationJSON,
+		`[{"addr_1":"Hauptstraße 5","zip":"10115","city":"Berlin","country":"DE","label":"=HYPERLINK(\"http://x\")","isdefault":true},
+		  {"addr_1":"-1 Main St","addr_2":"@home","zip":"10001","city":"New York","state":"NY","country":"US","type":"billing","label":"+1"}]`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("import = %d %s", rec.Code, rec.Body)
+	}
+
+	rec = api.export(t, userID, "csv")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "text/csv") {
+		t.Fatalf("CSV export = %d %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	if got := rec.Header().Get(echo.HeaderContentDisposition); got != `attachment; filename="addresses.csv"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	records, csvErr := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+	if csvErr != nil {
+		t.Fatalf("export isn't CSV: %v", csvErr)
+	}
+	want := [][]string{
+		{"addr_1", "addr_2", "zip", "city", "state", "country", "type", "label", "isdefault"},
+		{"Hauptstraße 5", "", "10115", "Berlin", "", "DE", "shipping", `'=HYPERLINK("http://x")`, "true"},
+		{"'-1 Main St", "'@home", "10001", "New York", "NY", "US", "billing", "'+1", "false"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("export has %d records, want %d:\n%s", len(records), len(want), rec.Body)
+	}
+	for i := range want {
+		if strings.Join(records[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("record %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+
+	// the export imports into another account as it was
+	otherID := api.createUser(t, "bob@example.com")
+	exported := rec.Body.String()
+	rec, _ = api.importAddresses(t, otherID, "", "text/csv", exported)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("import of the export = %d %s", rec.Code, rec.Body)
+	}
+	if again := api.export(t, otherID, "csv").Body.String(); again != exported {
+		t.Errorf("export after a round trip =\n%s\nwant\n%s", again, exported)
+	}
+
+	rec = api.export(t, userID, "json")
+	var rows []map[string]any
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &rows) != nil || len(rows) != 2 {
+		t.Fatalf("JSON export = %d %s", rec.Code, rec.Body)
+	}
+	if rows[0]["label"] != `=HYPERLINK("http://x")` || rows[0]["isdefault"] != true || rows[1]["type"] != "billing" {
+		t.Errorf("JSON export = %v, want the values unescaped", rows)
+	}
+
+	if rec = api.export(t, userID, "xml"); rec.Code != http.StatusBadRequest {
+		t.Errorf("export as xml = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"server/internal/service"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AdminHandler struct {
+	throttle *service.LoginThrottle
+	apiKey   string
+}
+
+func NewAdminHandler(throttle *service.LoginThrottle, apiKey string) *AdminHandler {
+	return &AdminHandler{throttle: throttle, apiKey: apiKey}
+}
+
+// RequireAdminKey lets a request through only with the configured X-Admin-Key header
+func (h *AdminHandler) RequireAdminKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get("X-Admin-Key")
+		if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(h.apiKey)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin key")
+		}
+		return next(c)
+	}
+}
+
+// unlockRequest for sanitation
+type unlockRequest struct {
+	Email string `json:"email" validate:"omitempty,email"`
+	IP    string `json:"ip" validate:"omitempty,ip"`
+}
+
+// Normalize implements Normalizable
+func (r *unlockRequest) Normalize() {
+	r.Email = strings.ToLower(strings.TrimSpace(r.Email))
+	r.IP = strings.TrimSpace(r.IP)
+}
+
+// UnlockLogin handles POST /api/admin/login/unlock.
+// It lifts the lockout of an account, a client IP, or both.
+func (h *AdminHandler) UnlockLogin(c echo.Context) error {
+	req := new(unlockRequest)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+	if req.Email == "" && req.IP == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "email or ip is required")
+	}
+
+	if req.Email != "" {
+		unlockErr := h.throttle.UnlockAccount(c.Request().Context(), req.Email)
+		if unlockErr != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "unlock failed")
+		}
+	}
+	if req.IP != "" {
+		unlockErr := h.throttle.UnlockIP(c.Request().Context(), req.IP)
+		if unlockErr != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "unlock failed")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"server/internal/jwks"
 	"server/internal/model"
 	"server/internal/service"
+	"strconv"
 	"strings"
 
 	"time"
@@ -13,16 +17,40 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// typ claims that keep the two kinds of JWT apart
+const (
+	accessTokenType     = "access"
+	mfaPendingTokenType = "mfa_pending"
+)
+
+// mfaTokenAudience keeps mfa_pending tokens from passing as access tokens
+// with services that verify against the JWKS and check the audience
+const mfaTokenAudience = "mfa"
+
+// mfaTokenTTL is how long the user has to enter their code after the password
+const mfaTokenTTL = 5 * time.Minute
 
 type AuthHandler struct {
 	authSvc *service.AuthService
-	jwtSecret []byte
+	accountSvc *service.AccountService
+	mfaSvc *service.MFAService
+	passkeySvc *service.PasskeyService
+	tokenSvc *service.TokenService
+	keys *jwks.KeySet
+	accessTTL time.Duration
+	refreshTTL time.Duration
 }
 
-func NewAuthHandler(authSvc *service.AuthService, jwtSecret []byte) *AuthHandler {
+func NewAuthHandler(authSvc *service.AuthService, accountSvc *service.AccountService, mfaSvc *service.MFAService, passkeySvc *service.PasskeyService, tokenSvc *service.TokenService, keys *jwks.KeySet, accessTTL, refreshTTL time.Duration) *AuthHandler {
 	return &AuthHandler{
 		authSvc: authSvc,
-		jwtSecret: jwtSecret,
+		accountSvc: accountSvc,
+		mfaSvc: mfaSvc,
+		passkeySvc: passkeySvc,
+		tokenSvc: tokenSvc,
+		keys: keys,
+		accessTTL: accessTTL,
+		refreshTTL: refreshTTL,
 	}
 }
 
@@ -55,10 +83,15 @@ func (h *AuthHandler) RegisterHandler(c echo.Context) error {
 	}
 	
 	// wire Auth service
-	user, registerErr := h.authSvc.Register(req.Username, req.Email, req.Password)
+	user, registerErr := h.authSvc.Register(c.Request().Context(), req.Username, req.Email, req.Password)
 	if	registerErr != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "server error")
 	} else {
+		// the account exists either way; the user can ask for a new link
+		mailErr := h.accountSvc.SendVerification(c.Request().Context(), user)
+		if mailErr != nil {
+			c.Logger().Errorf("send verification mail: %v", mailErr)
+		}
 		return c.JSON(http.StatusCreated, echo.Map{
 			"user": echo.Map{
 				"username": user.Username,
@@ -91,29 +124,378 @@ func (h *AuthHandler) LoginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
 	}
 
-	user, loginErr := h.authSvc.Login(req.Email, req.Password)
+	user, loginErr := h.authSvc.Login(c.Request().Context(), req.Email, req.Password, c.RealIP())
 	if loginErr != nil {
-		if errors.Is(loginErr, service.ErrInvalidCredentials) {
+		var blocked *service.LoginBlockedError
+		if errors.As(loginErr, &blocked) {
+			setRetryAfter(c, blocked.RetryAfter)
+			if errors.Is(blocked, service.ErrAccountLocked) {
+				// sent for unknown emails too, so it doesn't confirm the account exists
+				return echo.NewHTTPError(http.StatusLocked, "account temporarily locked")
+			}
+			return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed logins, try again later")
+		} else if errors.Is(loginErr, service.ErrInvalidCredentials) {
 			return echo.NewHTTPError(http.StatusUnauthorized, "invalid credentials")
+		} else if errors.Is(loginErr, service.ErrEmailNotVerified) {
+			return echo.NewHTTPError(http.StatusForbidden, "email not verified")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "login failed")	
 		}
-	} else {
-		tokenString, err := h.issueToken(user)
+	} else if h.mfaSvc.Enabled(user) {
+		// password was right; the session starts once POST /api/login/mfa passes
+		mfaToken, err := h.issueMFAToken(c, user)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "token generation failed")
 		}
+		return c.JSON(http.StatusOK, echo.Map{"mfa_required": true, "mfa_token": mfaToken})
+	} else {
+		return h.startSession(c, user)
+	}	
+}
 
-		// set HttpOnly cookie
-		h.setTokenCookie(c, tokenString)
+// loginMFA for sanitation
+type loginMFA struct {
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	Code         string `json:"code" validate:"omitempty,numeric,len=6"`
+	RecoveryCode string `json:"recovery_code" validate:"required_without=Code"`
+}
 
-		// return basic user info
-		return c.JSON(http.StatusOK, echo.Map{"user": echo.Map{"username": user.Username}})
-	}	
+// Normalize implements Normalizable
+func (r *loginMFA) Normalize() {
+	r.Code = strings.TrimSpace(r.Code)
+	r.RecoveryCode = strings.TrimSpace(r.RecoveryCode)
+}
+
+// LoginMFAHandler finishes a two-step login with a TOTP or recovery code
+func (h *AuthHandler) LoginMFAHandler(c echo.Context) error {
+	req := new(loginMFA)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	userID, jti, parseErr := h.parseMFAToken(req.MFAToken)
+	if parseErr != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired mfa token")
+	}
+
+	user, verifyErr := h.mfaSvc.VerifySecondFactor(c.Request().Context(), userID, jti, c.RealIP(), req.Code, req.RecoveryCode)
+	if verifyErr != nil {
+		var blocked *service.LoginBlockedError
+		if errors.As(verifyErr, &blocked) {
+			setRetryAfter(c, blocked.RetryAfter)
+			if errors.Is(blocked, service.ErrAccountLocked) {
+				return echo.NewHTTPError(http.StatusLocked, "account temporarily locked")
+			}
+			return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed logins, try again later")
+		} else if errors.Is(verifyErr, service.ErrMFAChallengeInvalid) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired mfa token")
+		} else if errors.Is(verifyErr, service.ErrInvalidMFACode) || errors.Is(verifyErr, service.ErrMFANotEnabled) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid code")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "login failed")
+	}
+	return h.startSession(c, user)
+}
+
+// LoginPasskeyBeginHandler starts a passwordless login and returns the
+// options for navigator.credentials.get()
+func (h *AuthHandler) LoginPasskeyBeginHandler(c echo.Context) error {
+	ceremonyID, options, beginErr := h.passkeySvc.BeginLogin(c.Request().Context())
+	if beginErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "login failed")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"ceremony_id": ceremonyID, "options": options})
+}
+
+// loginPasskey for sanitation
+type loginPasskey struct {
+	CeremonyID string          `json:"ceremony_id" validate:"required"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
 }
 
-// LogoutHandler
+// Normalize implements Normalizable
+func (r *loginPasskey) Normalize() {
+	r.CeremonyID = strings.TrimSpace(r.CeremonyID)
+}
+
+// LoginPasskeyFinishHandler verifies the passkey assertion and starts the session.
+// A passkey with user verification counts as two factors, so TOTP isn't asked for.
+func (h *AuthHandler) LoginPasskeyFinishHandler(c echo.Context) error {
+	req := new(loginPasskey)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	user, finishErr := h.passkeySvc.FinishLogin(c.Request().Context(), req.CeremonyID, req.Credential)
+	if finishErr != nil {
+		if errors.Is(finishErr, service.ErrCeremonyNotFound) || errors.Is(finishErr, service.ErrPasskeyRejected) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid credentials")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "login failed")
+	}
+	verifiedErr := h.authSvc.CheckEmailVerified(user)
+	if verifiedErr != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "email not verified")
+	}
+	return h.startSession(c, user)
+}
+
+// RefreshHandler rotates the refresh_token cookie and issues a new access token
+func (h *AuthHandler) RefreshHandler(c echo.Context) error {
+	cookie, cookieErr := c.Cookie("refresh_token")
+	if cookieErr != nil || cookie.Value == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "missing refresh token")
+	}
+
+	// the user and the access token come first, so a failure there leaves
+	// the refresh token valid for a retry
+	var user *model.User
+	var tokenString string
+	refreshToken, rotateErr := h.tokenSvc.RotateRefreshToken(c.Request().Context(), cookie.Value, func(userID int) error {
+		var err error
+		user, err = h.authSvc.GetUser(c.Request().Context(), userID)
+		if err != nil {
+			return err
+		}
+		tokenString, err = h.issueToken(user)
+		return err
+	})
+	if rotateErr != nil {
+		if errors.Is(rotateErr, service.ErrInvalidRefreshToken) || errors.Is(rotateErr, service.ErrRefreshTokenReused) {
+			clearRefreshCookie(c)
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid refresh token")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "token refresh failed")
+	}
+
+	h.setTokenCookie(c, tokenString)
+	h.setRefreshCookie(c, refreshToken)
+	return c.JSON(http.StatusOK, echo.Map{"user": echo.Map{"username": user.Username}})
+}
+
+// LogoutHandler revokes the presented JWT and its refresh token family
 func (h *AuthHandler) LogoutHandler(c echo.Context) error {
+	claims := currentClaims(c)
+	exp, _ := claimTime(claims, "exp")
+	jti, _ := claims["jti"].(string)
+	revokeErr := h.tokenSvc.RevokeAccessToken(c.Request().Context(), jti, currentUserID(c), exp)
+	if revokeErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "logout failed")
+	}
+
+	// Revoke the refresh token family so the session can't be renewed
+	refreshCookie, cookieErr := c.Cookie("refresh_token")
+	if cookieErr == nil && refreshCookie.Value != "" {
+		revokeErr := h.tokenSvc.RevokeRefreshToken(c.Request().Context(), refreshCookie.Value)
+		if revokeErr != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "logout failed")
+		}
+	}
+
+	clearSessionCookies(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// LogoutAllHandler revokes every JWT and refresh token the user holds, on all devices
+func (h *AuthHandler) LogoutAllHandler(c echo.Context) error {
+	revokeErr := h.tokenSvc.RevokeAllSessions(c.Request().Context(), currentUserID(c))
+	if revokeErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "logout failed")
+	}
+
+	clearSessionCookies(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RequireActiveSession rejects JWTs that were revoked server-side.
+// It must run after the echojwt middleware.
+func (h *AuthHandler) RequireActiveSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := currentClaims(c)
+		jti, hasJTI := claims["jti"].(string)
+		iat, hasIat := claimTime(claims, "iat")
+		exp, _ := claimTime(claims, "exp")
+		// an mfa_pending token is signed by the same keys but must never open a session;
+		// it has another typ and aud, and no user_id
+		if !hasJTI || !hasIat || claims["typ"] != accessTokenType {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired jwt")
+		}
+
+		revoked, checkErr := h.tokenSvc.IsAccessTokenRevoked(c.Request().Context(), jti, currentUserID(c), iat, exp)
+		if checkErr != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "session check failed")
+		}
+		if revoked {
+			return echo.NewHTTPError(http.StatusUnauthorized, "session revoked")
+		}
+		return next(c)
+	}
+}
+
+// startSession issues the access and refresh tokens, sets their cookies and returns basic user info
+func (h *AuthHandler) startSession(c echo.Context, user *model.User) error {
+	tokenString, err := h.issueToken(user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "token generation failed")
+	}
+	refreshToken, refreshErr := h.tokenSvc.IssueRefreshToken(c.Request().Context(), user.ID)
+	if refreshErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "token generation failed")
+	}
+
+	// set HttpOnly cookies
+	h.setTokenCookie(c, tokenString)
+	h.setRefreshCookie(c, refreshToken)
+
+	// return basic user info
+	return c.JSON(http.StatusOK, echo.Map{"user": echo.Map{"username": user.Username}})
+}
+
+// issueToken creates a JWT signed by the active key of the key set
+func (h *AuthHandler) issueToken(u *model.User) (string, error){
+	jti, jtiErr := newJTI()
+	if jtiErr != nil {
+		return "", jtiErr
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id": u.ID,
+    "email":   u.Email,
+		"typ": accessTokenType,
+		"jti": jti,
+		"iat": issuedAt(now),
+		"exp": now.Add(h.accessTTL).Unix(),
+	}
+	return h.keys.Sign(claims)
+}
+
+// issueMFAToken creates the short-lived token that links both login steps.
+// Its jti names the challenge that limits the code attempts and makes the
+// token single-use. The user is in sub, not user_id, and the audience is
+// mfaTokenAudience, so it doesn't pass for an access token.
+func (h *AuthHandler) issueMFAToken(c echo.Context, u *model.User) (string, error) {
+	jti, jtiErr := newJTI()
+	if jtiErr != nil {
+		return "", jtiErr
+	}
+	now := time.Now()
+	exp := now.Add(mfaTokenTTL)
+	challengeErr := h.mfaSvc.BeginChallenge(c.Request().Context(), u.ID, jti, exp)
+	if challengeErr != nil {
+		return "", challengeErr
+	}
+	claims := jwt.MapClaims{
+		"sub": strconv.Itoa(u.ID),
+		"aud": mfaTokenAudience,
+		"typ": mfaPendingTokenType,
+		"jti": jti,
+		"iat": now.Unix(),
+		"exp": exp.Unix(),
+	}
+	return h.keys.Sign(claims)
+}
+
+// parseMFAToken verifies an mfa_pending token and returns its user ID and jti
+func (h *AuthHandler) parseMFAToken(raw string) (int, string, error) {
+	token, parseErr := jwt.Parse(raw, h.keys.Keyfunc, jwt.WithExpirationRequired(), jwt.WithAudience(mfaTokenAudience))
+	if parseErr != nil {
+		return 0, "", parseErr
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != mfaPendingTokenType {
+		return 0, "", errors.New("not an mfa_pending token")
+	}
+	sub, _ := claims["sub"].(string)
+	userID, atoiErr := strconv.Atoi(sub)
+	if atoiErr != nil {
+		return 0, "", errors.New("mfa token without user")
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		return 0, "", errors.New("mfa token without jti")
+	}
+	return userID, jti, nil
+}
+
+// setTokenCookie writes the JWT into an HttpOnly cookie
+func (h *AuthHandler) setTokenCookie(c echo.Context, token string) {
+	cookie := &http.Cookie{
+		Name: "access_token",
+		Value: token,
+		Path: "/",
+		Expires: time.Now().Add(h.accessTTL),
+		HttpOnly: true,
+		Secure: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	c.SetCookie(cookie)
+}
+
+// setRefreshCookie writes the refresh token into an HttpOnly cookie scoped to /api.
+// SameSite=Strict keeps it off cross-site requests, since /api/refresh sits outside the CSRF group.
+func (h *AuthHandler) setRefreshCookie(c echo.Context, token string) {
+	cookie := &http.Cookie{
+		Name: "refresh_token",
+		Value: token,
+		Path: "/api",
+		Expires: time.Now().Add(h.refreshTTL),
+		HttpOnly: true,
+		Secure: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	c.SetCookie(cookie)
+}
+
+// confirmationBlocked answers a password confirmation of a logged-in user
+// that the login throttle refused: 423 while locked, else 429
+func confirmationBlocked(c echo.Context, blocked *service.LoginBlockedError) error {
+	setRetryAfter(c, blocked.RetryAfter)
+	if errors.Is(blocked, service.ErrAccountLocked) {
+		return echo.NewHTTPError(http.StatusLocked, "too many wrong passwords, try again later")
+	}
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many wrong passwords, try again later")
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up
+func setRetryAfter(c echo.Context, d time.Duration) {
+	seconds := int64(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// clearRefreshCookie expires the refresh token cookie
+func clearRefreshCookie(c echo.Context) {
+	cookie := &http.Cookie{
+		Name: "refresh_token",
+		Value: "",
+		Path: "/api",
+		Expires: time.Unix(0, 0),
+		MaxAge: -1,
+		HttpOnly: true,
+		Secure: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	c.SetCookie(cookie)
+}
+
+// clearSessionCookies expires the access, refresh and CSRF cookies
+func clearSessionCookies(c echo.Context) {
+	clearRefreshCookie(c)
+
   // Expire the JWT cookie
   accessTokenCookie := &http.Cookie{
     Name:     "access_token",
@@ -139,31 +521,4 @@ func (h *AuthHandler) LogoutHandler(c echo.Context) error {
     SameSite: http.SameSiteStrictMode,
   }
   c.SetCookie(csrfCookie)
-	return c.NoContent(http.StatusNoContent)
 }
-
-// issueToken creates a signed JWT string
-func (h *AuthHandler) issueToken(u *model.User) (string, error){
-	exp := time.Now().Add(24 * time.Hour).Unix()
-	claims := jwt.MapClaims{
-		"user_id": u.ID,
-    "email":   u.Email,
-		"exp": exp,
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(h.jwtSecret)
-}
-
-// setTokenCookie writes the JWT into an HttpOnly cookie
-func (h *AuthHandler) setTokenCookie(c echo.Context, token string) {
-	cookie := &http.Cookie{
-		Name: "access_token",
-		Value: token,
-		Path: "/",
-		Expires: time.Now().Add(24*time.Hour),
-		HttpOnly: true,
-		Secure: true,
-		SameSite: http.SameSiteLaxMode,
-	}
-	c.SetCookie(cookie)
-}
\ No newline at end of file
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// currentClaims returns the claims of the JWT the echojwt middleware put on the context
+func currentClaims(c echo.Context) jwt.MapClaims {
+	return c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+}
+
+// currentUserID extracts user_id from the JWT claims
+func currentUserID(c echo.Context) int {
+	return int(currentClaims(c)["user_id"].(float64))
+}
+
+// claimTime reads a NumericDate claim such as exp or iat, to the microsecond
+func claimTime(claims jwt.MapClaims, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMicro(int64(math.Round(v * 1e6))), true
+}
+
+// issuedAt is the iat claim of a token issued at t. It keeps the
+// microseconds, so a token minted in the same second as a logout of all
+// sessions, but after it, isn't taken for one from before.
+func issuedAt(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// newJTI returns a random token identifier
+func newJTI() (string, error) {
+	b := make([]byte, 16)
+	_, readErr := rand.Read(b)
+	if readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestIssuedAtKeepsMicroseconds(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	for _, at := range []time.Time{now, now.Add(time.Microsecond), now.Truncate(time.Second), now.Truncate(time.Second).Add(999999 * time.Microsecond)} {
+		// the claim goes through the JSON of the token
+		encoded, _ := json.Marshal(jwt.MapClaims{"iat": issuedAt(at)})
+		var claims jwt.MapClaims
+		if err := json.Unmarshal(encoded, &claims); err != nil {
+			t.Fatalf("Unmarshal = %v", err)
+		}
+		got, ok := claimTime(claims, "iat")
+		if !ok || !got.Equal(at) {
+			t.Errorf("iat of %v reads as %v, %v", at, got, ok)
+		}
+	}
+
+	// seconds from tokens issued before are still read
+	got, ok := claimTime(jwt.MapClaims{"iat": float64(1700000000)}, "iat")
+	if !ok || !got.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("iat in seconds reads as %v, %v", got, ok)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// etag is the strong entity tag of a resource at version
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// formatETag is the strong entity tag of another representation of a
+// resource at version, such as a formatted address; it never matches etag,
+// so If-Match only accepts tags of the resource itself
+func formatETag(version int, format string) string {
+	if format == "" {
+		return etag(version)
+	}
+	return `"` + strconv.Itoa(version) + "-" + format + `"`
+}
+
+// setETag tags the response with the version of the resource it carries
+func setETag(c echo.Context, version int) {
+	c.Response().Header().Set("ETag", etag(version))
+}
+
+// ifMatch evaluates the If-Match header against the current version of a
+// resource (RFC 9110, 13.1.1). ok is false when the precondition fails.
+// version is the one the write must still find, or 0 when the request has no
+// If-Match or accepts any version with "*".
+func ifMatch(c echo.Context, current int) (version int, ok bool) {
+	header := c.Request().Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return 0, true
+	}
+	// If-Match uses the strong comparison, so weak tags never match
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(current) {
+			return current, true
+		}
+	}
+	return 0, false
+}
+
+// notModified reports whether the If-None-Match header of a GET matches
+// current, the entity tag of the representation (RFC 9110, 13.1.2)
+func notModified(c echo.Context, current string) bool {
+	header := c.Request().Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	// If-None-Match uses the weak comparison
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditionFailed answers a write whose If-Match didn't match
+func preconditionFailed(c echo.Context) error {
+	return c.JSON(http.StatusPreconditionFailed, echo.Map{"error": "the resource was changed by another request; fetch it again"})
+}
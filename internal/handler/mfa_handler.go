@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"server/internal/service"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type MFAHandler struct {
+	mfaSvc *service.MFAService
+}
+
+func NewMFAHandler(mfaSvc *service.MFAService) *MFAHandler {
+	return &MFAHandler{mfaSvc: mfaSvc}
+}
+
+// totpCode for sanitation
+type totpCode struct {
+	Code string `json:"code" validate:"required,numeric,len=6"`
+}
+
+// Normalize implements Normalizable
+func (r *totpCode) Normalize() {
+	r.Code = strings.TrimSpace(r.Code)
+}
+
+// passwordConfirmation for sanitation
+type passwordConfirmation struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// EnrollTOTP handles POST /api/v1/users/me/mfa/totp
+func (h *MFAHandler) EnrollTOTP(c echo.Context) error {
+	secret, uri, enrollErr := h.mfaSvc.BeginTOTPEnrollment(c.Request().Context(), currentUserID(c))
+	if enrollErr != nil {
+		if errors.Is(enrollErr, service.ErrMFAAlreadyEnabled) {
+			return echo.NewHTTPError(http.StatusConflict, "two-factor authentication already enabled")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "enrollment failed")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"secret": secret, "otpauth_uri": uri})
+}
+
+// ConfirmTOTP handles POST /api/v1/users/me/mfa/totp/confirm
+func (h *MFAHandler) ConfirmTOTP(c echo.Context) error {
+	req := new(totpCode)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	codes, confirmErr := h.mfaSvc.ConfirmTOTPEnrollment(c.Request().Context(), currentUserID(c), req.Code)
+	if confirmErr != nil {
+		switch {
+		case errors.Is(confirmErr, service.ErrInvalidMFACode):
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid code")
+		case errors.Is(confirmErr, service.ErrMFANotPending):
+			return echo.NewHTTPError(http.StatusConflict, "no enrollment in progress")
+		case errors.Is(confirmErr, service.ErrMFAAlreadyEnabled):
+			return echo.NewHTTPError(http.StatusConflict, "two-factor authentication already enabled")
+		default:
+			return echo.NewHTTPError(http.StatusInternalServerError, "enrollment failed")
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
+// DisableTOTP handles DELETE /api/v1/users/me/mfa/totp
+func (h *MFAHandler) DisableTOTP(c echo.Context) error {
+	req := new(passwordConfirmation)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	disableErr := h.mfaSvc.DisableTOTP(c.Request().Context(), currentUserID(c), req.Password)
+	if disableErr != nil {
+		var blocked *service.LoginBlockedError
+		switch {
+		case errors.As(disableErr, &blocked):
+			return confirmationBlocked(c, blocked)
+		case errors.Is(disableErr, service.ErrInvalidCredentials):
+			return echo.NewHTTPError(http.StatusForbidden, "password is incorrect")
+		case errors.Is(disableErr, service.ErrMFANotEnabled):
+			return echo.NewHTTPError(http.StatusConflict, "two-factor authentication not enabled")
+		default:
+			return echo.NewHTTPError(http.StatusInternalServerError, "disabling two-factor authentication failed")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
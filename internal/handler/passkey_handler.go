@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"server/internal/model"
+	"server/internal/service"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type PasskeyHandler struct {
+	passkeySvc *service.PasskeyService
+}
+
+func NewPasskeyHandler(passkeySvc *service.PasskeyService) *PasskeyHandler {
+	return &PasskeyHandler{passkeySvc: passkeySvc}
+}
+
+// passkeyRegistration for sanitation
+type passkeyRegistration struct {
+	CeremonyID string          `json:"ceremony_id" validate:"required"`
+	Name       string          `json:"name" validate:"required,max=64"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+// Normalize implements Normalizable
+func (r *passkeyRegistration) Normalize() {
+	r.Name = strings.TrimSpace(r.Name)
+}
+
+// passkeyName for sanitation
+type passkeyName struct {
+	Name string `json:"name" validate:"required,max=64"`
+}
+
+// Normalize implements Normalizable
+func (r *passkeyName) Normalize() {
+	r.Name = strings.TrimSpace(r.Name)
+}
+
+// BeginRegistration handles POST /api/v1/users/me/passkeys/register/begin
+func (h *PasskeyHandler) BeginRegistration(c echo.Context) error {
+	ceremonyID, options, beginErr := h.passkeySvc.BeginRegistration(c.Request().Context(), currentUserID(c))
+	if beginErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "passkey registration failed")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"ceremony_id": ceremonyID, "options": options})
+}
+
+// FinishRegistration handles POST /api/v1/users/me/passkeys/register/finish
+func (h *PasskeyHandler) FinishRegistration(c echo.Context) error {
+	req := new(passkeyRegistration)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	passkey, finishErr := h.passkeySvc.FinishRegistration(c.Request().Context(), currentUserID(c), req.CeremonyID, req.Name, req.Credential)
+	if finishErr != nil {
+		switch {
+		case errors.Is(finishErr, service.ErrCeremonyNotFound):
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid or expired ceremony")
+		case errors.Is(finishErr, service.ErrPasskeyRejected):
+			return echo.NewHTTPError(http.StatusBadRequest, "passkey verification failed")
+		default:
+			return echo.NewHTTPError(http.StatusInternalServerError, "passkey registration failed")
+		}
+	}
+	return c.JSON(http.StatusCreated, passkeyJSON(passkey))
+}
+
+// ListPasskeys handles GET /api/v1/users/me/passkeys
+func (h *PasskeyHandler) ListPasskeys(c echo.Context) error {
+	passkeys, listErr := h.passkeySvc.ListPasskeys(c.Request().Context(), currentUserID(c))
+	if listErr != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "could not retrieve passkeys")
+	}
+	list := make([]echo.Map, len(passkeys))
+	for i, p := range passkeys {
+		list[i] = passkeyJSON(p)
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// RenamePasskey handles PATCH /api/v1/users/me/passkeys/:id
+func (h *PasskeyHandler) RenamePasskey(c echo.Context) error {
+	id, convErr := strconv.Atoi(c.Param("id"))
+	if convErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid passkey ID")
+	}
+
+	req := new(passkeyName)
+	bindErr := c.Bind(req)
+	if bindErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request payload")
+	}
+
+	validateErr := c.Validate(req)
+	if validateErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, validateErr.Error())
+	}
+
+	renameErr := h.passkeySvc.RenamePasskey(c.Request().Context(), currentUserID(c), id, req.Name)
+	if renameErr != nil {
+		if errors.Is(renameErr, service.ErrPasskeyNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "passkey not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "could not rename passkey")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeletePasskey handles DELETE /api/v1/users/me/passkeys/:id
+func (h *PasskeyHandler) DeletePasskey(c echo.Context) error {
+	id, convErr := strconv.Atoi(c.Param("id"))
+	if convErr != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid passkey ID")
+	}
+
+	deleteErr := h.passkeySvc.DeletePasskey(c.Request().Context(), currentUserID(c), id)
+	if deleteErr != nil {
+		if errors.Is(deleteErr, service.ErrPasskeyNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "passkey not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "could not delete passkey")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// passkeyJSON leaves out the stored public key and sign count
+func passkeyJSON(p *model.Passkey) echo.Map {
+	return echo.Map{
+		"id":           p.ID,
+		"name":         p.Name,
+		"created_at":   p.CreatedAt,
+		"last_used_at": p.LastUsedAt,
+	}
+}
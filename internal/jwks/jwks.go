@@ -0,0 +1,233 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+var ErrNoActiveKey = errors.New("jwks: active key not found")
+var ErrMixedAlgorithms = errors.New("jwks: all keys must use the same algorithm")
+
+// KeySet holds the private key new tokens are signed with and every public
+// key a token may still be verified with. Keeping retired public keys in the
+// set lets keys rotate without invalidating tokens that are still live.
+type KeySet struct {
+	method    jwt.SigningMethod
+	activeKID string
+	signer    crypto.Signer
+	public    map[string]crypto.PublicKey
+}
+
+// JWK is a single public key in RFC 7517 format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP (Ed25519)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Document is the body served at /.well-known/jwks.json
+type Document struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadDir reads the keys in dir. "<kid>.pem" files hold a private key
+// (PKCS#8, or PKCS#1 for RSA); "<kid>.pub.pem" files hold the public key of
+// a retired key whose private half is gone. activeKID picks the signing key.
+func LoadDir(dir, activeKID string) (*KeySet, error) {
+	entries, readErr := os.ReadDir(dir)
+	if readErr != nil {
+		return nil, fmt.Errorf("jwks: read key dir: %w", readErr)
+	}
+
+	ks := &KeySet{activeKID: activeKID, public: make(map[string]crypto.PublicKey)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		data, fileErr := os.ReadFile(filepath.Join(dir, name))
+		if fileErr != nil {
+			return nil, fmt.Errorf("jwks: read %s: %w", name, fileErr)
+		}
+
+		if kid, ok := strings.CutSuffix(name, ".pub.pem"); ok {
+			pub, parseErr := parsePublicKey(data)
+			if parseErr != nil {
+				return nil, fmt.Errorf("jwks: %s: %w", name, parseErr)
+			}
+			if addErr := ks.add(kid, pub); addErr != nil {
+				return nil, addErr
+			}
+			continue
+		}
+
+		kid := strings.TrimSuffix(name, ".pem")
+		priv, parseErr := parsePrivateKey(data)
+		if parseErr != nil {
+			return nil, fmt.Errorf("jwks: %s: %w", name, parseErr)
+		}
+		if addErr := ks.add(kid, priv.Public()); addErr != nil {
+			return nil, addErr
+		}
+		if kid == activeKID {
+			ks.signer = priv
+		}
+	}
+
+	if ks.signer == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoActiveKey, activeKID)
+	}
+	return ks, nil
+}
+
+// GenerateEphemeral creates a throwaway Ed25519 key set. Tokens signed with
+// it stop verifying when the process restarts, so it's only for local dev.
+func GenerateEphemeral() (*KeySet, error) {
+	_, priv, genErr := ed25519.GenerateKey(rand.Reader)
+	if genErr != nil {
+		return nil, fmt.Errorf("jwks: generate key: %w", genErr)
+	}
+	ks := &KeySet{activeKID: "ephemeral", signer: priv, public: make(map[string]crypto.PublicKey)}
+	if addErr := ks.add(ks.activeKID, priv.Public()); addErr != nil {
+		return nil, addErr
+	}
+	return ks, nil
+}
+
+// Sign returns the compact JWT for claims, signed by the active key with its kid in the header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.method, claims)
+	token.Header["kid"] = ks.activeKID
+	return token.SignedString(ks.signer)
+}
+
+// Algorithm is the JWS alg shared by every key in the set
+func (ks *KeySet) Algorithm() string {
+	return ks.method.Alg()
+}
+
+// VerificationKeys maps kid to public key, as echojwt.Config.SigningKeys expects
+func (ks *KeySet) VerificationKeys() map[string]interface{} {
+	keys := make(map[string]interface{}, len(ks.public))
+	for kid, pub := range ks.public {
+		keys[kid] = pub
+	}
+	return keys
+}
+
+// Keyfunc resolves the verification key from a token's kid header
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != ks.method.Alg() {
+		return nil, fmt.Errorf("jwks: unexpected signing method %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	pub, ok := ks.public[kid]
+	if !ok {
+		return nil, fmt.Errorf("jwks: unknown key id %q", kid)
+	}
+	return pub, nil
+}
+
+// Document returns the public half of every key in the set
+func (ks *KeySet) Document() Document {
+	kids := make([]string, 0, len(ks.public))
+	for kid := range ks.public {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	doc := Document{Keys: make([]JWK, 0, len(kids))}
+	for _, kid := range kids {
+		jwk := JWK{Kid: kid, Use: "sig", Alg: ks.method.Alg()}
+		switch pub := ks.public[kid].(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		doc.Keys = append(doc.Keys, jwk)
+	}
+	return doc
+}
+
+// add registers a public key, checking it matches the algorithm of the set
+func (ks *KeySet) add(kid string, pub crypto.PublicKey) error {
+	var method jwt.SigningMethod
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return fmt.Errorf("jwks: key %q: unsupported key type %T", kid, pub)
+	}
+
+	if ks.method == nil {
+		ks.method = method
+	} else if ks.method.Alg() != method.Alg() {
+		return fmt.Errorf("%w: key %q is %s, set is %s", ErrMixedAlgorithms, kid, method.Alg(), ks.method.Alg())
+	}
+	ks.public[kid] = pub
+	return nil
+}
+
+// Helpers
+// parsePrivateKey decodes a PEM private key, RSA or Ed25519
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	if key, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes); pkcs8Err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+
+	key, pkcs1Err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if pkcs1Err != nil {
+		return nil, fmt.Errorf("parse private key: %w", pkcs1Err)
+	}
+	return key, nil
+}
+
+// parsePublicKey decodes a PKIX PEM public key
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	key, parseErr := x509.ParsePKIXPublicKey(block.Bytes)
+	if parseErr != nil {
+		return nil, fmt.Errorf("parse public key: %w", parseErr)
+	}
+	return key, nil
+}
@@ -0,0 +1,211 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes a PEM block of type typ to dir/name
+func writePEM(t *testing.T, dir, name, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func writePrivate(t *testing.T, dir, name string, key crypto.Signer) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	writePEM(t, dir, name, "PRIVATE KEY", der)
+}
+
+func writePublic(t *testing.T, dir, name string, key crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	writePEM(t, dir, name, "PUBLIC KEY", der)
+}
+
+// rotatedDir holds the active Ed25519 key "2024" and the retired "2023",
+// of which only the public half is left; it returns the retired private key
+func rotatedDir(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	dir := t.TempDir()
+	_, active, _ := ed25519.GenerateKey(rand.Reader)
+	_, retired, _ := ed25519.GenerateKey(rand.Reader)
+	writePrivate(t, dir, "2024.pem", active)
+	writePublic(t, dir, "2023.pub.pem", retired.Public())
+	// other files are ignored
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("keys"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, retired
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "1"})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, _ := rotatedDir(t)
+	ks, err := LoadDir(dir, "2024")
+	if err != nil {
+		t.Fatalf("LoadDir = %v", err)
+	}
+	if ks.Algorithm() != "EdDSA" {
+		t.Fatalf("Algorithm = %q, want EdDSA", ks.Algorithm())
+	}
+	keys := ks.VerificationKeys()
+	if len(keys) != 2 || keys["2023"] == nil || keys["2024"] == nil {
+		t.Fatalf("VerificationKeys = %v, want 2023 and 2024", keys)
+	}
+
+	// a retired key can't sign
+	if _, err := LoadDir(dir, "2023"); !errors.Is(err, ErrNoActiveKey) {
+		t.Fatalf("LoadDir with a retired active key = %v, want ErrNoActiveKey", err)
+	}
+	if _, err := LoadDir(dir, "2025"); !errors.Is(err, ErrNoActiveKey) {
+		t.Fatalf("LoadDir with an unknown active key = %v, want ErrNoActiveKey", err)
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writePublic(t, dir, "rsa.pub.pem", &rsaKey.PublicKey)
+	if _, err := LoadDir(dir, "2024"); !errors.Is(err, ErrMixedAlgorithms) {
+		t.Fatalf("LoadDir with an RSA and Ed25519 keys = %v, want ErrMixedAlgorithms", err)
+	}
+
+	broken := t.TempDir()
+	if err := os.WriteFile(filepath.Join(broken, "bad.pem"), []byte("not pem"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDir(broken, "bad"); err == nil || !strings.Contains(err.Error(), "bad.pem") {
+		t.Fatalf("LoadDir with a broken file = %v, want it named", err)
+	}
+}
+
+func TestLoadDirRSA(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	// PKCS#1, as openssl genrsa -traditional writes it
+	writePEM(t, dir, "main.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	ks, err := LoadDir(dir, "main")
+	if err != nil {
+		t.Fatalf("LoadDir = %v", err)
+	}
+	if ks.Algorithm() != "RS256" {
+		t.Fatalf("Algorithm = %q, want RS256", ks.Algorithm())
+	}
+	signed, signErr := ks.Sign(jwt.MapClaims{"sub": "1"})
+	if signErr != nil {
+		t.Fatalf("Sign = %v", signErr)
+	}
+	if _, err := jwt.Parse(signed, ks.Keyfunc); err != nil {
+		t.Fatalf("Parse of a token of the set = %v", err)
+	}
+}
+
+func TestKeyfunc(t *testing.T) {
+	dir, retired := rotatedDir(t)
+	ks, err := LoadDir(dir, "2024")
+	if err != nil {
+		t.Fatalf("LoadDir = %v", err)
+	}
+
+	active, signErr := ks.Sign(jwt.MapClaims{"sub": "1"})
+	if signErr != nil {
+		t.Fatalf("Sign = %v", signErr)
+	}
+	token, parseErr := jwt.Parse(active, ks.Keyfunc)
+	if parseErr != nil || token.Header["kid"] != "2024" {
+		t.Fatalf("Parse of a token of the active key = %v, kid %v", parseErr, token.Header["kid"])
+	}
+	if _, err := jwt.Parse(signWith(t, jwt.SigningMethodEdDSA, "2023", retired), ks.Keyfunc); err != nil {
+		t.Fatalf("Parse of a token of the retired key = %v", err)
+	}
+
+	_, stranger, _ := ed25519.GenerateKey(rand.Reader)
+	rejected := map[string]string{
+		"unknown kid":       signWith(t, jwt.SigningMethodEdDSA, "2022", stranger),
+		"no kid":            signWith(t, jwt.SigningMethodEdDSA, "", retired),
+		"other key as 2023": signWith(t, jwt.SigningMethodEdDSA, "2023", stranger),
+		"HS256":             signWith(t, jwt.SigningMethodHS256, "2023", []byte("secret")),
+	}
+	for name, signed := range rejected {
+		if _, err := jwt.Parse(signed, ks.Keyfunc); err == nil {
+			t.Errorf("%s: Parse succeeded", name)
+		}
+	}
+}
+
+func TestDocumentOnlyHasPublicKeys(t *testing.T) {
+	dir, retired := rotatedDir(t)
+	ks, err := LoadDir(dir, "2024")
+	if err != nil {
+		t.Fatalf("LoadDir = %v", err)
+	}
+	doc := ks.Document()
+	if len(doc.Keys) != 2 || doc.Keys[0].Kid != "2023" || doc.Keys[1].Kid != "2024" {
+		t.Fatalf("Document keys = %+v, want 2023 and 2024 in order", doc.Keys)
+	}
+	retiredX := base64.RawURLEncoding.EncodeToString(retired.Public().(ed25519.PublicKey))
+	if k := doc.Keys[0]; k.Kty != "OKP" || k.Crv != "Ed25519" || k.Alg != "EdDSA" || k.Use != "sig" || k.X != retiredX {
+		t.Fatalf("retired JWK = %+v", k)
+	}
+
+	rsaDir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writePrivate(t, rsaDir, "main.pem", rsaKey)
+	rsaSet, _ := LoadDir(rsaDir, "main")
+	for _, set := range []*KeySet{ks, rsaSet} {
+		body, _ := json.Marshal(set.Document())
+		var raw struct {
+			Keys []map[string]any `json:"keys"`
+		}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			t.Fatalf("Document isn't JSON: %v", err)
+		}
+		// d is the private part of RSA and OKP keys, p, q, dp, dq and qi
+		// the RSA primes and their derivatives
+		for _, key := range raw.Keys {
+			for _, private := range []string{"d", "p", "q", "dp", "dq", "qi"} {
+				if _, ok := key[private]; ok {
+					t.Errorf("JWK %v has the private member %q", key["kid"], private)
+				}
+			}
+		}
+		if strings.Contains(string(body), base64.RawURLEncoding.EncodeToString(rsaKey.D.Bytes())) {
+			t.Error("Document contains the RSA private exponent")
+		}
+	}
+	if k := rsaSet.Document().Keys[0]; k.Kty != "RSA" || k.E != "AQAB" || k.N == "" {
+		t.Fatalf("RSA JWK = %+v", k)
+	}
+}
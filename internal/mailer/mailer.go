@@ -0,0 +1,134 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownMailer = errors.New("mailer: unknown mailer kind")
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as verification links
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New builds the mailer selected by kind: "smtp", "file" or "memory"
+func New(kind string, smtpCfg SMTPConfig, dir string) (Mailer, error) {
+	switch kind {
+	case "smtp":
+		return NewSMTPMailer(smtpCfg), nil
+	case "file":
+		return NewFileMailer(dir, smtpCfg.From), nil
+	case "memory":
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMailer, kind)
+	}
+}
+
+// SMTPConfig holds the relay settings for SMTPMailer; From is used by every mailer
+type SMTPConfig struct {
+	Host string
+	Port string
+	User string
+	Pwd  string
+	From string
+}
+
+// SMTPMailer sends mail through an SMTP relay, upgrading to TLS when the server offers STARTTLS
+type SMTPMailer struct {
+	cfg SMTPConfig
+}
+
+func NewSMTPMailer(cfg SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{cfg: cfg}
+}
+
+// Send satisfies Mailer
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.cfg.User != "" {
+		auth = smtp.PlainAuth("", m.cfg.User, m.cfg.Pwd, m.cfg.Host)
+	}
+	addr := m.cfg.Host + ":" + m.cfg.Port
+	sendErr := smtp.SendMail(addr, auth, m.cfg.From, []string{msg.To}, render(m.cfg.From, msg))
+	if sendErr != nil {
+		return fmt.Errorf("mailer: smtp send: %w", sendErr)
+	}
+	return nil
+}
+
+// FileMailer writes every message as an .eml file into a directory, for local development
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+// Send satisfies Mailer
+func (m *FileMailer) Send(msg Message) error {
+	mkdirErr := os.MkdirAll(m.dir, 0o755)
+	if mkdirErr != nil {
+		return fmt.Errorf("mailer: create mail dir: %w", mkdirErr)
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(msg.To, "@", "_at_"))
+	writeErr := os.WriteFile(filepath.Join(m.dir, name), render(m.from, msg), 0o644)
+	if writeErr != nil {
+		return fmt.Errorf("mailer: write message: %w", writeErr)
+	}
+	return nil
+}
+
+// MemoryMailer keeps sent messages in memory so tests can inspect them
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send satisfies Mailer
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns a copy of every message sent so far
+func (m *MemoryMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
+
+// render formats msg as an RFC 5322 message
+func render(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
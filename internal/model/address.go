@@ -2,6 +2,13 @@ package model
 
 import "time"
 
+// Address types; a user has at most one default address of each type
+const (
+	AddressShipping = "shipping"
+	AddressBilling  = "billing"
+	AddressCustom   = "custom"
+)
+
 type Address struct {
 	ID int
 	UId int
@@ -9,8 +16,135 @@ type Address struct {
   Addr_2 string 
   Zip string 
   City string 
+  // State is the state or province, where the country uses them
+  State string
   Country string  
+  // Type is one of AddressShipping, AddressBilling and AddressCustom
+  Type string
+  // Label names the address for its user, e.g. "Home" or "Office"
+  Label string
   IsDefault bool
+  // Lat and Lng locate the address once it is geocoded, in the background
+  // after every change of the place
+  Lat *float64
+  Lng *float64
+  // Verified is set when the geocoder knows the postal code and city of the
+  // address together
+  Verified bool
+  // Version counts the changes of the address; it is served as its ETag
+  Version int
   CreatedAt time.Time
   UpdatedAt time.Time
-}
\ No newline at end of file
+  // DeletedAt is set while the address is soft-deleted
+  DeletedAt *time.Time `json:",omitempty"`
+  // Fingerprint identifies where the address is, to find duplicates; see
+  // addressrules.Fingerprint. Of the lookups, only FindByFingerprint reads it.
+  Fingerprint string `json:"-"`
+}
+
+// AddressVersion is the state an address had before a change: Version and
+// the other fields of Address are as they were, ChangedBy and ChangedAt say
+// who replaced that state and when
+type AddressVersion struct {
+	Address
+	ChangedBy int
+	ChangedAt time.Time
+}
+
+// Location is where a geocoder found an address
+type Location struct {
+	Lat, Lng float64
+	// Verified is set when the postal code and city of the address belong together
+	Verified bool
+}
+
+// AddressSuggestion completes a partly typed address, with the JSON fields of
+// a new address. Fields the source doesn't know are empty.
+type AddressSuggestion struct {
+	Addr1   string  `json:"addr_1,omitempty"`
+	Zip     string  `json:"zip"`
+	City    string  `json:"city"`
+	State   string  `json:"state"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+}
+
+// AddressPatch is a partial update of an address: nil fields stay as they are
+type AddressPatch struct {
+	Addr_1    *string
+	Addr_2    *string
+	Zip       *string
+	City      *string
+	State     *string
+	Country   *string
+	Type      *string
+	Label     *string
+	IsDefault *bool
+	// Fingerprint is written along with changes of the place; a new one
+	// clears the location
+	Fingerprint *string
+}
+
+// Apply returns a copy of a with the fields of the patch set
+func (p AddressPatch) Apply(a Address) Address {
+	if p.Addr_1 != nil {
+		a.Addr_1 = *p.Addr_1
+	}
+	if p.Addr_2 != nil {
+		a.Addr_2 = *p.Addr_2
+	}
+	if p.Zip != nil {
+		a.Zip = *p.Zip
+	}
+	if p.City != nil {
+		a.City = *p.City
+	}
+	if p.State != nil {
+		a.State = *p.State
+	}
+	if p.Country != nil {
+		a.Country = *p.Country
+	}
+	if p.Type != nil {
+		a.Type = *p.Type
+	}
+	if p.Label != nil {
+		a.Label = *p.Label
+	}
+	if p.IsDefault != nil {
+		a.IsDefault = *p.IsDefault
+	}
+	if p.Fingerprint != nil {
+		if *p.Fingerprint != a.Fingerprint {
+			// the address moved and is located again
+			a.Lat, a.Lng, a.Verified = nil, nil, false
+		}
+		a.Fingerprint = *p.Fingerprint
+	}
+	return a
+}
+
+// AddressQuery selects a page of one user's addresses
+type AddressQuery struct {
+	UId int
+	// filters; empty or nil matches everything
+	Country   string
+	City      string
+	Type      string
+	IsDefault *bool
+	// Deleted lists the soft-deleted addresses instead of the others
+	Deleted bool
+	// SortBy is "created_at" or "updated_at"; ties are broken by ID
+	SortBy string
+	Desc   bool
+	// After continues the listing behind this position
+	After *AddressCursor
+	Limit int
+}
+
+// AddressCursor is the position of an address in a sorted listing
+type AddressCursor struct {
+	SortValue time.Time
+	ID        int
+}
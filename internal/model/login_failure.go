@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+type LoginFailure struct {
+	// Key is "email:<address>" or "ip:<address>"
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
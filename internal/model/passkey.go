@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+type Passkey struct {
+	ID           int
+	UId          int
+	CredentialID []byte
+	Name         string
+	// Credential is the JSON-encoded WebAuthn credential
+	Credential []byte
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
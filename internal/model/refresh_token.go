@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+type RefreshToken struct {
+	ID        int
+	UId       int
+	TokenHash string
+	FamilyID  string
+	ExpiresAt time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
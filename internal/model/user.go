@@ -7,6 +7,11 @@ type User struct {
 	Username string
 	Email string
 	PasswordHash string
+	EmailVerifiedAt *time.Time
+	// TOTPSecret is encrypted at rest; TOTP is only active once TOTPEnabledAt is set
+	TOTPSecret string
+	TOTPEnabledAt *time.Time
+	TOTPLastStep int64
 	CreatedAt time.Time
   UpdatedAt time.Time
 }
\ No newline at end of file
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// Purposes of a UserToken
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+	TokenPurposeChangeEmail   = "change_email"
+	TokenPurposeUnlockLogin   = "unlock_login"
+)
+
+type UserToken struct {
+	ID        int
+	UId       int
+	Purpose   string
+	TokenHash string
+	// NewEmail is only set for TokenPurposeChangeEmail
+	NewEmail  string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
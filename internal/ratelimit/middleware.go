@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// maxPeekBody bounds how much of a request body ByJSONField reads
+const maxPeekBody = 64 << 10
+
+// KeyFunc picks the client a request is counted against. ok is false when
+// the request has no such key, e.g. no email in the body; the policy then
+// doesn't apply.
+type KeyFunc func(c echo.Context) (key string, ok bool)
+
+// Policy is a named limit on requests that share a key
+type Policy struct {
+	// Name separates the buckets of different policies in the store
+	Name  string
+	Limit Limit
+	Key   KeyFunc
+}
+
+// ByIP keys requests by client IP, as resolved by Echo's IPExtractor
+func ByIP() KeyFunc {
+	return func(c echo.Context) (string, bool) {
+		return c.RealIP(), true
+	}
+}
+
+// ByUserID keys requests by the user_id claim of the JWT. It must run after
+// the echojwt middleware.
+func ByUserID() KeyFunc {
+	return func(c echo.Context) (string, bool) {
+		token, ok := c.Get("user").(*jwt.Token)
+		if !ok {
+			return "", false
+		}
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return "", false
+		}
+		userID, ok := claims["user_id"].(float64)
+		if !ok {
+			return "", false
+		}
+		return strconv.FormatInt(int64(userID), 10), true
+	}
+}
+
+// ByJSONField keys requests by a string field of the JSON body, such as
+// "email". The value is lowercased and trimmed, and the body is left
+// intact for the handler. Only the first maxPeekBody bytes are read, so a
+// padded body would go unkeyed: routes using it must refuse longer bodies,
+// e.g. with middleware.BodyLimit("64K") ahead of the rate limit.
+func ByJSONField(field string) KeyFunc {
+	return func(c echo.Context) (string, bool) {
+		req := c.Request()
+		if req.Body == nil {
+			return "", false
+		}
+		body, readErr := io.ReadAll(io.LimitReader(req.Body, maxPeekBody))
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		if readErr != nil {
+			return "", false
+		}
+
+		var fields map[string]any
+		if json.Unmarshal(body, &fields) != nil {
+			return "", false
+		}
+		value, ok := fields[field].(string)
+		value = strings.ToLower(strings.TrimSpace(value))
+		if !ok || value == "" {
+			return "", false
+		}
+		return value, true
+	}
+}
+
+// Middleware enforces every policy on the request. A request over any
+// limit gets 429 with Retry-After; all responses carry the RateLimit-*
+// headers of the policy closest to its limit. If the store fails, the
+// request is let through and the error logged.
+func Middleware(store Store, policies ...Policy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var tightest *Result
+			var tightestPolicy Policy
+			for _, p := range policies {
+				key, ok := p.Key(c)
+				if !ok {
+					continue
+				}
+				res, takeErr := store.Take(c.Request().Context(), p.Name+":"+key, p.Limit)
+				if takeErr != nil {
+					c.Logger().Errorf("rate limit %s: %v", p.Name, takeErr)
+					continue
+				}
+				if tightest == nil || tighter(res, *tightest) {
+					tightest = &res
+					tightestPolicy = p
+				}
+			}
+
+			if tightest == nil {
+				return next(c)
+			}
+			setHeaders(c, tightestPolicy, *tightest)
+			if !tightest.Allowed {
+				c.Response().Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(tightest.RetryAfter), 10))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+// tighter reports whether a should be reported over b: a rejection beats
+// an allowed request, then fewer remaining requests win
+func tighter(a, b Result) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+// setHeaders writes the RateLimit-* headers of the IETF httpapi-ratelimit-headers draft
+func setHeaders(c echo.Context, p Policy, res Result) {
+	h := c.Response().Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit.Requests))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(res.Reset), 10))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;name=%q", res.Limit.Requests, ceilSeconds(res.Limit.Window), p.Name))
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
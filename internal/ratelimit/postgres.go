@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// purgeAfter is how long a bucket may sit untouched before it is deleted.
+// It should exceed the longest window in use, or an idle client gets a
+// full bucket early.
+const purgeAfter = 24 * time.Hour
+
+// PostgresStore keeps the buckets in the rate_limit_buckets table, so every
+// instance behind a load balancer enforces the same limits. Each Take is a
+// single atomic upsert.
+type PostgresStore struct {
+	db *pgxpool.Pool
+
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+func NewPostgresStore(db *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{db: db, lastPurge: time.Now()}
+}
+
+// Take satisfies Store
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	// $2 is the bucket size, $3 the refill rate in tokens per second
+	query := `
+		INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::double precision - 1, true, now())
+		ON CONFLICT (key) DO UPDATE
+		   SET (tokens, allowed, updated_at) = (
+		         SELECT CASE WHEN refill.tokens >= 1 THEN refill.tokens - 1 ELSE refill.tokens END,
+		                refill.tokens >= 1,
+		                now()
+		           FROM (SELECT LEAST($2::double precision,
+		                         b.tokens + GREATEST(EXTRACT(EPOCH FROM now() - b.updated_at)::double precision, 0) * $3::double precision) AS tokens) AS refill
+		       )
+		RETURNING tokens, allowed;
+	`
+	var tokens float64
+	var allowed bool
+	scanErr := s.db.QueryRow(ctx, query, key, float64(limit.Requests), limit.ratePerSecond()).Scan(&tokens, &allowed)
+	if scanErr != nil {
+		return Result{}, fmt.Errorf("ratelimit: take %s: %w", key, scanErr)
+	}
+
+	s.purge(ctx)
+	return result(allowed, tokens, limit), nil
+}
+
+// purge deletes idle buckets, at most once a minute
+func (s *PostgresStore) purge(ctx context.Context) {
+	s.mu.Lock()
+	if time.Since(s.lastPurge) < sweepInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPurge = time.Now()
+	s.mu.Unlock()
+
+	// opportunistic cleanup; a failure here doesn't affect the request
+	_, _ = s.db.Exec(ctx, `DELETE FROM rate_limit_buckets WHERE updated_at < $1;`, time.Now().Add(-purgeAfter))
+}
@@ -0,0 +1,99 @@
+// Package ratelimit limits request rates with token buckets. Buckets live in
+// a Store: in memory for a single instance, or in Postgres when several
+// instances have to share the limits.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrUnknownStore = errors.New("ratelimit: unknown store")
+
+// Limit allows Requests per Window. The bucket holds Requests tokens and
+// refills continuously, so a client may burst up to Requests at once.
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// PerMinute allows n requests a minute
+func PerMinute(n int) Limit {
+	return Limit{Requests: n, Window: time.Minute}
+}
+
+// PerHour allows n requests an hour
+func PerHour(n int) Limit {
+	return Limit{Requests: n, Window: time.Hour}
+}
+
+// ratePerSecond is the refill speed of the bucket
+func (l Limit) ratePerSecond() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+// Result of taking a token from a bucket
+type Result struct {
+	Allowed bool
+	Limit   Limit
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token, zero when Allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Take refills the bucket of key for the time that
+// passed, then takes one token if there is one. It must be safe for
+// concurrent use.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// New returns the Store for kind: "memory" or "postgres"
+func New(kind string, db *pgxpool.Pool) (Store, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore(db), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStore, kind)
+	}
+}
+
+// refill returns the tokens in a bucket after elapsed time, capped at its size
+func refill(tokens float64, elapsed time.Duration, limit Limit) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.Requests), tokens+elapsed.Seconds()*limit.ratePerSecond())
+}
+
+// result describes a bucket holding tokens after a Take
+func result(allowed bool, tokens float64, limit Limit) Result {
+	rate := limit.ratePerSecond()
+	r := Result{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     seconds((float64(limit.Requests) - tokens) / rate),
+	}
+	if !allowed {
+		r.RetryAfter = seconds((1 - tokens) / rate)
+	}
+	return r
+}
+
+func seconds(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,220 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newTestStore returns a MemoryStore on a clock that only moves when
+// advance is called
+func newTestStore() (store *MemoryStore, advance func(time.Duration)) {
+	now := time.Now()
+	store = NewMemoryStore()
+	store.now = func() time.Time { return now }
+	return store, func(d time.Duration) { now = now.Add(d) }
+}
+
+func take(t *testing.T, store Store, key string, limit Limit) Result {
+	t.Helper()
+	res, err := store.Take(context.Background(), key, limit)
+	if err != nil {
+		t.Fatalf("Take(%s) = %v", key, err)
+	}
+	return res
+}
+
+func TestMemoryStoreBurst(t *testing.T) {
+	store, _ := newTestStore()
+	limit := PerMinute(3)
+
+	for want := 2; want >= 0; want-- {
+		res := take(t, store, "a", limit)
+		if !res.Allowed || res.Remaining != want || res.RetryAfter != 0 {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", 3-want, res, want)
+		}
+	}
+	res := take(t, store, "a", limit)
+	// one token comes back every 20s; the bucket is full after 60s
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter != 20*time.Second || res.Reset != time.Minute {
+		t.Fatalf("request over the limit = %+v, want rejected, retry after 20s", res)
+	}
+	if res := take(t, store, "b", limit); !res.Allowed || res.Remaining != 2 {
+		t.Fatalf("other key = %+v, want its own full bucket", res)
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	store, advance := newTestStore()
+	limit := PerMinute(3)
+	for i := 0; i < 3; i++ {
+		take(t, store, "a", limit)
+	}
+
+	advance(15 * time.Second)
+	if res := take(t, store, "a", limit); res.Allowed || res.RetryAfter != 5*time.Second {
+		t.Fatalf("after 15s = %+v, want rejected, retry after 5s", res)
+	}
+	advance(5 * time.Second)
+	if res := take(t, store, "a", limit); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("after 20s = %+v, want the refilled token", res)
+	}
+
+	// an idle bucket fills up to the limit, not beyond
+	advance(time.Hour)
+	for want := 2; want >= 0; want-- {
+		if res := take(t, store, "a", limit); !res.Allowed || res.Remaining != want {
+			t.Fatalf("after an hour = %+v, want %d remaining", res, want)
+		}
+	}
+	if res := take(t, store, "a", limit); res.Allowed {
+		t.Fatalf("past the burst after an hour = %+v, want rejected", res)
+	}
+}
+
+func TestMemoryStoreSweepsFullBuckets(t *testing.T) {
+	store, advance := newTestStore()
+	take(t, store, "idle", PerMinute(3))
+	for i := 0; i < 3; i++ {
+		take(t, store, "busy", PerHour(3))
+	}
+
+	advance(2 * time.Minute)
+	take(t, store, "other", PerMinute(3))
+	if _, ok := store.buckets["idle"]; ok {
+		t.Error("full bucket wasn't swept")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Error("bucket still refilling was swept")
+	}
+}
+
+func TestTighter(t *testing.T) {
+	allowed := func(remaining int) Result { return Result{Allowed: true, Remaining: remaining} }
+	rejected := func(retry time.Duration) Result { return Result{RetryAfter: retry} }
+	tests := []struct {
+		name string
+		a, b Result
+		want bool
+	}{
+		{"rejection over allowed", rejected(time.Second), allowed(0), true},
+		{"allowed under rejection", allowed(0), rejected(time.Second), false},
+		{"longer wait", rejected(time.Minute), rejected(time.Second), true},
+		{"shorter wait", rejected(time.Second), rejected(time.Minute), false},
+		{"fewer remaining", allowed(1), allowed(5), true},
+		{"more remaining", allowed(5), allowed(1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tighter(tt.a, tt.b); got != tt.want {
+				t.Errorf("tighter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// serve sends a POST with body from ip through the policies and returns the
+// response and the body the handler read
+func serve(t *testing.T, store Store, ip, body string, policies ...Policy) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	e := echo.New()
+	var got string
+	e.POST("/", func(c echo.Context) error {
+		read, _ := io.ReadAll(c.Request().Body)
+		got = string(read)
+		return c.NoContent(http.StatusNoContent)
+	}, Middleware(store, policies...))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.RemoteAddr = ip + ":1234"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec, got
+}
+
+func TestMiddleware(t *testing.T) {
+	store, advance := newTestStore()
+	ipPolicy := Policy{Name: "ip", Limit: PerMinute(2), Key: ByIP()}
+
+	rec, _ := serve(t, store, "192.0.2.1", "{}", ipPolicy)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("first request = %d", rec.Code)
+	}
+	wantHeaders := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "1",
+		"RateLimit-Reset":     "30",
+		"RateLimit-Policy":    `2;w=60;name="ip"`,
+		"Retry-After":         "",
+	}
+	for name, want := range wantHeaders {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	serve(t, store, "192.0.2.1", "{}", ipPolicy)
+	rec, _ = serve(t, store, "192.0.2.1", "{}", ipPolicy)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("over the limit = %d, Retry-After %q, RateLimit-Remaining %q", rec.Code, rec.Header().Get("Retry-After"), rec.Header().Get("RateLimit-Remaining"))
+	}
+	if rec, _ := serve(t, store, "192.0.2.2", "{}", ipPolicy); rec.Code != http.StatusNoContent {
+		t.Fatalf("other IP = %d, want its own limit", rec.Code)
+	}
+
+	advance(30 * time.Second)
+	if rec, _ := serve(t, store, "192.0.2.1", "{}", ipPolicy); rec.Code != http.StatusNoContent {
+		t.Fatalf("after the refill = %d", rec.Code)
+	}
+}
+
+func TestMiddlewareReportsTightestPolicy(t *testing.T) {
+	store, _ := newTestStore()
+	policies := []Policy{
+		{Name: "ip", Limit: PerMinute(10), Key: ByIP()},
+		{Name: "email", Limit: PerMinute(2), Key: ByJSONField("email")},
+	}
+	body := `{"email": " Ann@Example.com "}`
+
+	rec, got := serve(t, store, "192.0.2.1", body, policies...)
+	if rec.Header().Get("RateLimit-Policy") != `2;w=60;name="email"` || rec.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("headers = %v, want the email policy", rec.Header())
+	}
+	if got != body {
+		t.Fatalf("handler read %q, want the body intact", got)
+	}
+
+	// the same email from other IPs, normalized, shares a bucket
+	serve(t, store, "192.0.2.2", `{"email": "ann@example.com"}`, policies...)
+	rec, _ = serve(t, store, "192.0.2.3", `{"email": "ANN@example.com"}`, policies...)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("RateLimit-Policy") != `2;w=60;name="email"` {
+		t.Fatalf("email over its limit = %d, policy %q", rec.Code, rec.Header().Get("RateLimit-Policy"))
+	}
+
+	// without an email only the IP policy applies
+	rec, _ = serve(t, store, "192.0.2.3", `{"name": "ann"}`, policies...)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("RateLimit-Policy") != `10;w=60;name="ip"` {
+		t.Fatalf("request without email = %d, policy %q", rec.Code, rec.Header().Get("RateLimit-Policy"))
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, Limit) (Result, error) {
+	return Result{}, errors.New("store down")
+}
+
+func TestMiddlewareLetsRequestsThroughWhenStoreFails(t *testing.T) {
+	rec, _ := serve(t, failingStore{}, "192.0.2.1", "{}", Policy{Name: "ip", Limit: PerMinute(1), Key: ByIP()})
+	if rec.Code != http.StatusNoContent || rec.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("with a failing store = %d, headers %v", rec.Code, rec.Header())
+	}
+}
@@ -1,70 +1,89 @@
 package repo
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"server/internal/model"
+	"strings"
+	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// ErrDuplicateDefault is returned when a write would give a user a second
+// default address of a type
+var ErrDuplicateDefault = errors.New("repo: user already has a default address")
+
+// oneDefaultConstraint enforces a single default address per user and type.
+// It is deferrable, so SetDefault can move the flag in one statement.
+const oneDefaultConstraint = "addresses_one_default_per_type"
+
 type AddressRepo struct {
-	db *pgx.Conn
+	db *pgxpool.Pool
 }
 
-func NewAddressRepo(db *pgx.Conn) *AddressRepo {
+func NewAddressRepo(db *pgxpool.Pool) *AddressRepo {
 	return  &AddressRepo{db: db}
 }
 
-// CreateAddress inserts a new address and populates a.ID, CreatedAt, UpdatedAt.
-func (r *AddressRepo) CreateAddress(a *model.Address) error{
+// CreateAddress inserts a new address and populates a.ID, Version, CreatedAt, UpdatedAt.
+func (r *AddressRepo) CreateAddress(ctx context.Context, a *model.Address) error{
 	query := `INSERT INTO addresses
-      (u_id, addr_1, addr_2, zip, city, country, is_default)
+      (u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, fingerprint)
     VALUES
-      ($1,$2,$3,$4,$5,$6,$7)
-    RETURNING id, created_at, updated_at;
+      ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+    RETURNING id, version, created_at, updated_at;
 	`
-	row := r.db.QueryRow(query, a.UId, a.Addr_1, a.Addr_2, a.Zip, a.City, a.Country, a.IsDefault,)
-  scanErr := row.Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt)
+	row := conn(ctx, r.db).QueryRow(ctx, query, a.UId, a.Addr_1, a.Addr_2, a.Zip, a.City, a.State, a.Country, a.Type, a.Label, a.IsDefault, a.Fingerprint,)
+  scanErr := row.Scan(&a.ID, &a.Version, &a.CreatedAt, &a.UpdatedAt)
 	if scanErr != nil {
+		if isDuplicateDefault(scanErr) {
+			return ErrDuplicateDefault
+		}
 		return fmt.Errorf("Create Address: %w", scanErr)
 	} else {
 		return nil
 	}
 }
 
-// ClearDefaultForUser sets defaut=false on all addresses for the given user.
-func (r *AddressRepo) ClearDefaultForUser(userID int) error {
+// ClearDefaultForUser sets defaut=false on all addresses of addrType for the given user.
+func (r *AddressRepo) ClearDefaultForUser(ctx context.Context, userID int, addrType string) error {
 	query := `
 		UPDATE addresses
-  	  SET is_default = FALSE
- 		WHERE u_id = $1;
+  	  SET is_default = FALSE,
+  	      version = version + 1
+ 		WHERE u_id = $1 AND type = $2 AND is_default;
 	`
-	_, execErr := r.db.Exec(query, userID)
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, userID, addrType)
   if execErr != nil {
     return fmt.Errorf("ClearDefaultForUser: %w", execErr)
   }
   return nil
 }
 
-// GetByID fetches a single address by its primary key.
-func (r *AddressRepo) GetByID(id int) (*model.Address, error){
+// GetByID fetches a single address by its primary key; soft-deleted ones
+// count as missing.
+func (r *AddressRepo) GetByID(ctx context.Context, id int) (*model.Address, error){
 	query := `
-    SELECT id, u_id, addr_1, addr_2, zip, city, country,  is_default, created_at, updated_at
+    SELECT id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at
       FROM addresses
-    WHERE id = $1;
+    WHERE id = $1 AND deleted_at IS NULL;
   `
 
   a := new(model.Address)
-  row := r.db.QueryRow(query, id)
+  row := conn(ctx, r.db).QueryRow(ctx, query, id)
 	scanErr := row.Scan(
     &a.ID, &a.UId,
     &a.Addr_1, &a.Addr_2,
-    &a.Zip, &a.City, &a.Country,
-    &a.IsDefault, &a.CreatedAt, &a.UpdatedAt,
+    &a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+    &a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt,
   )
   if scanErr != nil {
     if scanErr == pgx.ErrNoRows {
-        return nil, fmt.Errorf("GetByID: no address with id %d", id)
+        return nil, fmt.Errorf("GetByID: no address with id %d: %w", id, scanErr)
     }
     return nil, fmt.Errorf("GetByID: %w", scanErr)
   }
@@ -72,39 +91,454 @@ func (r *AddressRepo) GetByID(id int) (*model.Address, error){
   return a, nil
 }
 
-// Delete removes an address by its ID.
-func (r *AddressRepo) Delete(id int) error {
-	query := `DELETE FROM addresses
-	 WHERE id = $1;
+// Delete soft-deletes an address by its ID and unsets its default flag. If
+// version isn't 0, the address must still be at that version. It fails with
+// pgx.ErrNoRows if nothing was deleted.
+func (r *AddressRepo) Delete(ctx context.Context, id, version int) error {
+	query := `UPDATE addresses
+	   SET deleted_at = now(),
+	       is_default = FALSE,
+	       version = version + 1
+	 WHERE id = $1
+	   AND deleted_at IS NULL
+	   AND ($2 = 0 OR version = $2);
 	`
-	_, execErr := r.db.Exec(query, id)
+	tag, execErr := conn(ctx, r.db).Exec(ctx, query, id, version)
   if execErr != nil {
     return fmt.Errorf("Delete: %w", execErr)
   }
+  if tag.RowsAffected() == 0 {
+    return pgx.ErrNoRows
+  }
   return nil
 }
 
-// Update modifies an existing address, flipping the default flag if requested.
-func (r *AddressRepo) Update(a *model.Address) error {
-	const query = `
+// GetDeletedByID fetches a soft-deleted address. It fails with pgx.ErrNoRows
+// if there is none with the id, or it isn't deleted.
+func (r *AddressRepo) GetDeletedByID(ctx context.Context, id int) (*model.Address, error) {
+	query := `
+		SELECT id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at, deleted_at
+		  FROM addresses
+		 WHERE id = $1 AND deleted_at IS NOT NULL;
+	`
+	a := new(model.Address)
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, id).Scan(
+		&a.ID, &a.UId,
+		&a.Addr_1, &a.Addr_2,
+		&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+		&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt, &a.DeletedAt,
+	)
+	if scanErr != nil {
+		return nil, fmt.Errorf("AddressRepo.GetDeletedByID: %w", scanErr)
+	}
+	return a, nil
+}
+
+// Restore undeletes a soft-deleted address, which comes back without its
+// default flag. It fails with pgx.ErrNoRows if the address isn't deleted.
+func (r *AddressRepo) Restore(ctx context.Context, id int) (*model.Address, error) {
+	query := `
 		UPDATE addresses
-		   SET addr_1     = $1,
-		       addr_2     = $2,
-		       zip        = $3,
-		       city       = $4,
-		       country    = $5,
-		       is_default = $6,
+		   SET deleted_at = NULL,
+		       version = version + 1,
 		       updated_at = now()
-		 WHERE id = $7
+		 WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at;
 	`
+	a := new(model.Address)
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, id).Scan(
+		&a.ID, &a.UId,
+		&a.Addr_1, &a.Addr_2,
+		&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+		&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt,
+	)
+	if scanErr != nil {
+		return nil, fmt.Errorf("AddressRepo.Restore: %w", scanErr)
+	}
+	return a, nil
+}
 
-  _, execErr := r.db.Exec(query,
-		a.Addr_1, a.Addr_2,
-		a.Zip, a.City, a.Country,
-		a.IsDefault, a.ID,
+// PurgeDeleted hard-deletes the addresses soft-deleted before the given time
+// and returns how many there were.
+func (r *AddressRepo) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	query := `DELETE FROM addresses WHERE deleted_at < $1;`
+	tag, execErr := conn(ctx, r.db).Exec(ctx, query, before)
+	if execErr != nil {
+		return 0, fmt.Errorf("AddressRepo.PurgeDeleted: %w", execErr)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Patch changes the fields that are set in p, and returns the updated
+// address. If version isn't 0, the address must still be at that version.
+// It fails with pgx.ErrNoRows if there is no such address, or it's deleted.
+func (r *AddressRepo) Patch(ctx context.Context, id, version int, p model.AddressPatch) (*model.Address, error) {
+	// only columns present in the patch are written
+	var sets []string
+	var args []any
+	set := func(column string, value any) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if p.Addr_1 != nil {
+		set("addr_1", *p.Addr_1)
+	}
+	if p.Addr_2 != nil {
+		set("addr_2", *p.Addr_2)
+	}
+	if p.Zip != nil {
+		set("zip", *p.Zip)
+	}
+	if p.City != nil {
+		set("city", *p.City)
+	}
+	if p.State != nil {
+		set("state", *p.State)
+	}
+	if p.Country != nil {
+		set("country", *p.Country)
+	}
+	if p.Type != nil {
+		set("type", *p.Type)
+	}
+	if p.Label != nil {
+		set("label", *p.Label)
+	}
+	if p.IsDefault != nil {
+		set("is_default", *p.IsDefault)
+	}
+	if p.Fingerprint != nil {
+		// SET sees the old fingerprint: a moved address is located again
+		set("fingerprint", *p.Fingerprint)
+		n := len(args)
+		sets = append(sets,
+			fmt.Sprintf("lat = CASE WHEN fingerprint = $%d THEN lat END", n),
+			fmt.Sprintf("lng = CASE WHEN fingerprint = $%d THEN lng END", n),
+			fmt.Sprintf("verified = verified AND fingerprint = $%d", n),
+		)
+	}
+	sets = append(sets, "version = version + 1", "updated_at = now()")
+	args = append(args, id, version)
+
+	query := fmt.Sprintf(`
+		UPDATE addresses
+		   SET %s
+		 WHERE id = $%d
+		   AND deleted_at IS NULL
+		   AND ($%d = 0 OR version = $%d)
+		RETURNING id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at;
+	`, strings.Join(sets, ",\n\t\t       "), len(args)-1, len(args), len(args))
+
+	a := new(model.Address)
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, args...).Scan(
+		&a.ID, &a.UId,
+		&a.Addr_1, &a.Addr_2,
+		&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+		&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt,
+	)
+	if scanErr != nil {
+		if isDuplicateDefault(scanErr) {
+			return nil, ErrDuplicateDefault
+		}
+		return nil, fmt.Errorf("AddressRepo.Patch: %w", scanErr)
+	}
+	return a, nil
+}
+
+// RecordVersion stores the state prior had before changedBy changed it
+func (r *AddressRepo) RecordVersion(ctx context.Context, prior model.Address, changedBy int) error {
+	query := `INSERT INTO address_versions
+      (address_id, version, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, created_at, updated_at, changed_by)
+    VALUES
+      ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15);
+	`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query,
+		prior.ID, prior.Version, prior.UId,
+		prior.Addr_1, prior.Addr_2, prior.Zip, prior.City, prior.State, prior.Country, prior.Type, prior.Label,
+		prior.IsDefault, prior.CreatedAt, prior.UpdatedAt, changedBy,
 	)
 	if execErr != nil {
-		return fmt.Errorf("AddressRepo.Update: %w", execErr)
+		return fmt.Errorf("AddressRepo.RecordVersion: %w", execErr)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// ListVersions returns the recorded prior states of an address, newest first
+func (r *AddressRepo) ListVersions(ctx context.Context, addressID int) ([]model.AddressVersion, error) {
+	query := `
+		SELECT address_id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, version, created_at, updated_at, changed_by, changed_at
+		  FROM address_versions
+		 WHERE address_id = $1
+		 ORDER BY version DESC;
+	`
+	rows, queryErr := conn(ctx, r.db).Query(ctx, query, addressID)
+	if queryErr != nil {
+		return nil, fmt.Errorf("AddressRepo.ListVersions: %w", queryErr)
+	}
+	defer rows.Close()
+
+	versions := []model.AddressVersion{}
+	for rows.Next() {
+		var v model.AddressVersion
+		scanErr := rows.Scan(
+			&v.ID, &v.UId,
+			&v.Addr_1, &v.Addr_2,
+			&v.Zip, &v.City, &v.State, &v.Country, &v.Type, &v.Label,
+			&v.IsDefault, &v.Version, &v.CreatedAt, &v.UpdatedAt,
+			&v.ChangedBy, &v.ChangedAt,
+		)
+		if scanErr != nil {
+			return nil, fmt.Errorf("AddressRepo.ListVersions: %w", scanErr)
+		}
+		versions = append(versions, v)
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, fmt.Errorf("AddressRepo.ListVersions: %w", rowsErr)
+	}
+	return versions, nil
+}
+
+// FindByFingerprint fetches the oldest live address of addrType of a user
+// with the fingerprint. It fails with pgx.ErrNoRows when there is none.
+func (r *AddressRepo) FindByFingerprint(ctx context.Context, userID int, addrType, fingerprint string) (*model.Address, error) {
+	query := `
+		SELECT id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at, fingerprint
+		  FROM addresses
+		 WHERE u_id = $1 AND fingerprint = $2 AND type = $3 AND deleted_at IS NULL
+		 ORDER BY id
+		 LIMIT 1;
+	`
+	a := new(model.Address)
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, userID, fingerprint, addrType).Scan(
+		&a.ID, &a.UId,
+		&a.Addr_1, &a.Addr_2,
+		&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+		&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt, &a.Fingerprint,
+	)
+	if scanErr != nil {
+		return nil, fmt.Errorf("AddressRepo.FindByFingerprint: %w", scanErr)
+	}
+	return a, nil
+}
+
+// ListWithoutFingerprint returns up to limit addresses, deleted or not, that
+// have no fingerprint yet, by ID
+func (r *AddressRepo) ListWithoutFingerprint(ctx context.Context, limit int) ([]model.Address, error) {
+	query := `
+		SELECT id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at, deleted_at
+		  FROM addresses
+		 WHERE fingerprint = ''
+		 ORDER BY id
+		 LIMIT $1;
+	`
+	rows, queryErr := conn(ctx, r.db).Query(ctx, query, limit)
+	if queryErr != nil {
+		return nil, fmt.Errorf("AddressRepo.ListWithoutFingerprint: %w", queryErr)
+	}
+	defer rows.Close()
+
+	addresses := []model.Address{}
+	for rows.Next() {
+		var a model.Address
+		scanErr := rows.Scan(
+			&a.ID, &a.UId,
+			&a.Addr_1, &a.Addr_2,
+			&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+			&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt, &a.DeletedAt,
+		)
+		if scanErr != nil {
+			return nil, fmt.Errorf("AddressRepo.ListWithoutFingerprint: %w", scanErr)
+		}
+		addresses = append(addresses, a)
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, fmt.Errorf("AddressRepo.ListWithoutFingerprint: %w", rowsErr)
+	}
+	return addresses, nil
+}
+
+// SetFingerprint stores the fingerprint of an address that has none. An
+// address that got a fingerprint since it was read, by an update, keeps it.
+// It isn't a change of the address, so its version stays the same.
+func (r *AddressRepo) SetFingerprint(ctx context.Context, id int, fingerprint string) error {
+	query := `UPDATE addresses SET fingerprint = $2 WHERE id = $1 AND fingerprint = '';`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, id, fingerprint)
+	if execErr != nil {
+		return fmt.Errorf("AddressRepo.SetFingerprint: %w", execErr)
+	}
+	return nil
+}
+
+// SetLocation stores where the geocoder located an address, unless the
+// address moved since: it only applies while the address still has the
+// fingerprint and isn't deleted. Like SetFingerprint, it keeps the version.
+func (r *AddressRepo) SetLocation(ctx context.Context, id int, fingerprint string, loc model.Location) error {
+	query := `
+		UPDATE addresses
+		   SET lat = $3, lng = $4, verified = $5
+		 WHERE id = $1 AND fingerprint = $2 AND deleted_at IS NULL;
+	`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, id, fingerprint, loc.Lat, loc.Lng, loc.Verified)
+	if execErr != nil {
+		return fmt.Errorf("AddressRepo.SetLocation: %w", execErr)
+	}
+	return nil
+}
+
+// isDuplicateDefault reports whether err violates oneDefaultConstraint
+func isDuplicateDefault(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23P01 is exclusion_violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23P01" && pgErr.ConstraintName == oneDefaultConstraint
+}
+
+// GetDefaultForUser fetches the default address of addrType of a user.
+// It fails with pgx.ErrNoRows when the user has none.
+func (r *AddressRepo) GetDefaultForUser(ctx context.Context, userID int, addrType string) (*model.Address, error) {
+	query := `
+		SELECT id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at
+		  FROM addresses
+		 WHERE u_id = $1 AND type = $2 AND is_default AND deleted_at IS NULL;
+	`
+	a := new(model.Address)
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, userID, addrType).Scan(
+		&a.ID, &a.UId,
+		&a.Addr_1, &a.Addr_2,
+		&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+		&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt,
+	)
+	if scanErr != nil {
+		return nil, fmt.Errorf("AddressRepo.GetDefaultForUser: %w", scanErr)
+	}
+	return a, nil
+}
+
+// SetDefault makes address id the default of its type for userID and unsets
+// the previous default of that type, in a single statement. It returns the
+// new default, or fails with pgx.ErrNoRows and changes nothing if the user
+// has no such address.
+func (r *AddressRepo) SetDefault(ctx context.Context, userID, id int) (*model.Address, error) {
+	query := `
+		WITH flipped AS (
+			UPDATE addresses
+			   SET is_default = (id = $1),
+			       version = version + 1,
+			       updated_at = now()
+			 WHERE u_id = $2
+			   AND (is_default OR id = $1)
+			   AND type = (SELECT type FROM addresses WHERE id = $1 AND u_id = $2 AND deleted_at IS NULL)
+			RETURNING id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at
+		)
+		SELECT * FROM flipped WHERE id = $1;
+	`
+	a := new(model.Address)
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, id, userID).Scan(
+		&a.ID, &a.UId,
+		&a.Addr_1, &a.Addr_2,
+		&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+		&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt,
+	)
+	if scanErr != nil {
+		if isDuplicateDefault(scanErr) {
+			return nil, ErrDuplicateDefault
+		}
+		return nil, fmt.Errorf("AddressRepo.SetDefault: %w", scanErr)
+	}
+	return a, nil
+}
+
+// ListByUser returns up to q.Limit addresses of q.UId that match the filters
+// of q, in q.SortBy order and starting behind q.After.
+func (r *AddressRepo) ListByUser(ctx context.Context, q model.AddressQuery) ([]model.Address, error) {
+	where, args := addressFilter(q)
+
+	// the sort column is whitelisted; everything else is a parameter
+	column := "created_at"
+	if q.SortBy == "updated_at" {
+		column = "updated_at"
+	}
+	direction, cmp := "ASC", ">"
+	if q.Desc {
+		direction, cmp = "DESC", "<"
+	}
+	if q.After != nil {
+		args = append(args, q.After.SortValue, q.After.ID)
+		where += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", column, cmp, len(args)-1, len(args))
+	}
+	args = append(args, q.Limit)
+
+	query := fmt.Sprintf(`
+		SELECT id, u_id, addr_1, addr_2, zip, city, state, country, type, label, is_default, lat, lng, verified, version, created_at, updated_at, deleted_at
+		  FROM addresses
+		 WHERE %s
+		 ORDER BY %s %s, id %s
+		 LIMIT $%d;
+	`, where, column, direction, direction, len(args))
+
+	rows, queryErr := conn(ctx, r.db).Query(ctx, query, args...)
+	if queryErr != nil {
+		return nil, fmt.Errorf("AddressRepo.ListByUser: %w", queryErr)
+	}
+	defer rows.Close()
+
+	addresses := []model.Address{}
+	for rows.Next() {
+		var a model.Address
+		scanErr := rows.Scan(
+			&a.ID, &a.UId,
+			&a.Addr_1, &a.Addr_2,
+			&a.Zip, &a.City, &a.State, &a.Country, &a.Type, &a.Label,
+			&a.IsDefault, &a.Lat, &a.Lng, &a.Verified, &a.Version, &a.CreatedAt, &a.UpdatedAt, &a.DeletedAt,
+		)
+		if scanErr != nil {
+			return nil, fmt.Errorf("AddressRepo.ListByUser: %w", scanErr)
+		}
+		addresses = append(addresses, a)
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, fmt.Errorf("AddressRepo.ListByUser: %w", rowsErr)
+	}
+	return addresses, nil
+}
+
+// CountByUser counts the addresses of q.UId that match the filters of q;
+// sorting, cursor and limit are ignored.
+func (r *AddressRepo) CountByUser(ctx context.Context, q model.AddressQuery) (int, error) {
+	where, args := addressFilter(q)
+	query := `SELECT count(*) FROM addresses WHERE ` + where + `;`
+
+	var total int
+	scanErr := conn(ctx, r.db).QueryRow(ctx, query, args...).Scan(&total)
+	if scanErr != nil {
+		return 0, fmt.Errorf("AddressRepo.CountByUser: %w", scanErr)
+	}
+	return total, nil
+}
+
+// addressFilter builds the WHERE clause of the filters of q. Country and
+// city match case-insensitively. Soft-deleted addresses are left out, unless
+// q asks for them alone.
+func addressFilter(q model.AddressQuery) (string, []any) {
+	args := []any{q.UId}
+	where := "u_id = $1 AND deleted_at IS NULL"
+	if q.Deleted {
+		where = "u_id = $1 AND deleted_at IS NOT NULL"
+	}
+	if q.Country != "" {
+		args = append(args, q.Country)
+		where += fmt.Sprintf(" AND lower(country) = lower($%d)", len(args))
+	}
+	if q.City != "" {
+		args = append(args, q.City)
+		where += fmt.Sprintf(" AND lower(city) = lower($%d)", len(args))
+	}
+	if q.Type != "" {
+		args = append(args, q.Type)
+		where += fmt.Sprintf(" AND type = $%d", len(args))
+	}
+	if q.IsDefault != nil {
+		args = append(args, *q.IsDefault)
+		where += fmt.Sprintf(" AND is_default = $%d", len(args))
+	}
+	return where, args
+}
@@ -1,29 +1,38 @@
 package repo
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"server/internal/model"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var ErrEmailTaken = errors.New("repo: email already in use")
 
 type AuthRepo struct {
-	db *pgx.Conn
+	db *pgxpool.Pool
 }
 
-func NewAuthRepo(db *pgx.Conn) *AuthRepo {
+func NewAuthRepo(db *pgxpool.Pool) *AuthRepo {
 	return  &AuthRepo{db: db}
 }
 
 // CreateUser queries db to create a new user
-func (r *AuthRepo) CreateUser(u *model.User) error {
+func (r *AuthRepo) CreateUser(ctx context.Context, u *model.User) error {
 	query := `INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3)
 	RETURNING id, created_at, updated_at
 	`
-	row := r.db.QueryRow(query, u.Username, u.Email, u.PasswordHash)
+	row := conn(ctx, r.db).QueryRow(ctx, query, u.Username, u.Email, u.PasswordHash)
 	scanErr := row.Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt)
 	if  scanErr != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(scanErr, &pgErr) && pgErr.Code == "23505" {
+			return ErrEmailTaken
+		}
 	  return fmt.Errorf("create user scan returning: %w", scanErr)
 	} else {
 		return nil
@@ -31,16 +40,131 @@ func (r *AuthRepo) CreateUser(u *model.User) error {
 }
 
 // GetByEmail uses db connection to query users table by username
-func (r *AuthRepo) GetByEmail(email string) (*model.User, error){
+func (r *AuthRepo) GetByEmail(ctx context.Context, email string) (*model.User, error){
 	u := new(model.User)
-	query := `SELECT id, username, email, password_hash FROM users WHERE email=$1`
-	row := r.db.QueryRow(query, email)
+	query := `SELECT id, username, email, password_hash, email_verified_at, totp_secret, totp_enabled_at, totp_last_step
+	FROM users WHERE email=$1`
+	row := conn(ctx, r.db).QueryRow(ctx, query, email)
 	
-	scanErr := row.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash)
+	scanErr := row.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.EmailVerifiedAt,
+		&u.TOTPSecret, &u.TOTPEnabledAt, &u.TOTPLastStep)
 	
 	if scanErr != nil {
 		return nil, scanErr
 	} else {
 		return u, nil
 	}
-}
\ No newline at end of file
+}
+
+// GetByID fetches a user by primary key
+func (r *AuthRepo) GetByID(ctx context.Context, id int) (*model.User, error){
+	u := new(model.User)
+	query := `SELECT id, username, email, password_hash, email_verified_at, totp_secret, totp_enabled_at, totp_last_step
+	FROM users WHERE id=$1`
+	row := conn(ctx, r.db).QueryRow(ctx, query, id)
+
+	scanErr := row.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.EmailVerifiedAt,
+		&u.TOTPSecret, &u.TOTPEnabledAt, &u.TOTPLastStep)
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	return u, nil
+}
+
+// DeleteUser removes a user; addresses, tokens and credentials of the user
+// go with it through ON DELETE CASCADE
+func (r *AuthRepo) DeleteUser(ctx context.Context, id int) error {
+	query := `DELETE FROM users WHERE id=$1`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, id)
+	if execErr != nil {
+		return fmt.Errorf("delete user: %w", execErr)
+	}
+	return nil
+}
+
+// MarkEmailVerified stamps email_verified_at, keeping the first verification time
+func (r *AuthRepo) MarkEmailVerified(ctx context.Context, id int) error {
+	query := `UPDATE users
+	SET email_verified_at = COALESCE(email_verified_at, now()), updated_at = now()
+	WHERE id=$1`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, id)
+	if execErr != nil {
+		return fmt.Errorf("mark email verified: %w", execErr)
+	}
+	return nil
+}
+
+// UpdatePassword replaces the bcrypt hash of a user
+func (r *AuthRepo) UpdatePassword(ctx context.Context, id int, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1, updated_at = now() WHERE id=$2`
+	tag, execErr := conn(ctx, r.db).Exec(ctx, query, passwordHash, id)
+	if execErr != nil {
+		return fmt.Errorf("update password: %w", execErr)
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateEmail switches a user to a new, already confirmed email address
+func (r *AuthRepo) UpdateEmail(ctx context.Context, id int, email string) error {
+	query := `UPDATE users SET email = $1, email_verified_at = now(), updated_at = now() WHERE id=$2`
+	tag, execErr := conn(ctx, r.db).Exec(ctx, query, email, id)
+	if execErr != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(execErr, &pgErr) && pgErr.Code == "23505" {
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("update email: %w", execErr)
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// SetPendingTOTP stores a new encrypted TOTP secret that isn't active until EnableTOTP
+func (r *AuthRepo) SetPendingTOTP(ctx context.Context, id int, encryptedSecret string) error {
+	query := `UPDATE users
+	SET totp_secret = $1, totp_enabled_at = NULL, totp_last_step = 0, updated_at = now()
+	WHERE id=$2`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, encryptedSecret, id)
+	if execErr != nil {
+		return fmt.Errorf("set pending totp: %w", execErr)
+	}
+	return nil
+}
+
+// EnableTOTP activates the pending TOTP secret
+func (r *AuthRepo) EnableTOTP(ctx context.Context, id int) error {
+	query := `UPDATE users SET totp_enabled_at = now(), updated_at = now() WHERE id=$1 AND totp_secret <> ''`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, id)
+	if execErr != nil {
+		return fmt.Errorf("enable totp: %w", execErr)
+	}
+	return nil
+}
+
+// DisableTOTP removes the TOTP secret
+func (r *AuthRepo) DisableTOTP(ctx context.Context, id int) error {
+	query := `UPDATE users
+	SET totp_secret = '', totp_enabled_at = NULL, totp_last_step = 0, updated_at = now()
+	WHERE id=$1`
+	_, execErr := conn(ctx, r.db).Exec(ctx, query, id)
+	if execErr != nil {
+		return fmt.Errorf("disable totp: %w", execErr)
+	}
+	return nil
+}
+
+// AdvanceTOTPStep records step as the last used TOTP step. It reports false
+// when that step or a later one was already used, which blocks code replay.
+func (r *AuthRepo) AdvanceTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	query := `UPDATE users SET totp_last_step = $1 WHERE id=$2 AND totp_last_step < $1`
+	tag, execErr := conn(ctx, r.db).Exec(ctx, query, step, id)
+	if execErr != nil {
+		return false, fmt.Errorf("advance totp step: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,93 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"server/internal/model"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type LoginFailureRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewLoginFailureRepo(db *pgxpool.Pool) *LoginFailureRepo {
+	return &LoginFailureRepo{db: db}
+}
+
+// Get returns the failure record of a key.
+// It fails with pgx.ErrNoRows when the key has no recorded failures.
+func (r *LoginFailureRepo) Get(ctx context.Context, key string) (*model.LoginFailure, error) {
+	query := `SELECT key, failures, last_failure_at, locked_until FROM login_failures WHERE key = $1;`
+	f := new(model.LoginFailure)
+	scanErr := r.db.QueryRow(ctx, query, key).Scan(&f.Key, &f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	if scanErr != nil {
+		return nil, fmt.Errorf("LoginFailureRepo.Get: %w", scanErr)
+	}
+	return f, nil
+}
+
+// RecordFailure counts a failed login for key and returns the updated record.
+// Failures older than windowStart no longer count, so the counter starts over.
+func (r *LoginFailureRepo) RecordFailure(ctx context.Context, key string, windowStart time.Time) (*model.LoginFailure, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE
+		   SET failures = CASE
+		                    WHEN login_failures.last_failure_at < $2 THEN 1
+		                    ELSE login_failures.failures + 1
+		                  END,
+		       last_failure_at = now()
+		RETURNING key, failures, last_failure_at, locked_until;
+	`
+	f := new(model.LoginFailure)
+	scanErr := r.db.QueryRow(ctx, query, key, windowStart).Scan(&f.Key, &f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	if scanErr != nil {
+		return nil, fmt.Errorf("LoginFailureRepo.RecordFailure: %w", scanErr)
+	}
+	return f, nil
+}
+
+// Lock blocks logins for key until the given time and resets its counter,
+// so the lockout doesn't escalate while it is in force.
+func (r *LoginFailureRepo) Lock(ctx context.Context, key string, until time.Time) error {
+	query := `
+		UPDATE login_failures
+		   SET locked_until = $1,
+		       failures = 0
+		 WHERE key = $2;
+	`
+	_, execErr := r.db.Exec(ctx, query, until, key)
+	if execErr != nil {
+		return fmt.Errorf("LoginFailureRepo.Lock: %w", execErr)
+	}
+	return nil
+}
+
+// Clear forgets all failures and any lockout of key.
+func (r *LoginFailureRepo) Clear(ctx context.Context, key string) error {
+	query := `DELETE FROM login_failures WHERE key = $1;`
+	_, execErr := r.db.Exec(ctx, query, key)
+	if execErr != nil {
+		return fmt.Errorf("LoginFailureRepo.Clear: %w", execErr)
+	}
+	return nil
+}
+
+// PurgeStale deletes records whose failures fell out of the window and
+// that aren't locked anymore.
+func (r *LoginFailureRepo) PurgeStale(ctx context.Context, windowStart time.Time) error {
+	query := `
+		DELETE FROM login_failures
+		 WHERE last_failure_at < $1
+		   AND (locked_until IS NULL OR locked_until < now());
+	`
+	_, execErr := r.db.Exec(ctx, query, windowStart)
+	if execErr != nil {
+		return fmt.Errorf("LoginFailureRepo.PurgeStale: %w", execErr)
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"server/internal/model"
+	"server/internal/repo"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AddressRepo keeps addresses in a DB, like repo.AddressRepo does in Postgres
+type AddressRepo struct {
+	db *DB
+}
+
+func NewAddressRepo(db *DB) *AddressRepo {
+	return &AddressRepo{db: db}
+}
+
+// CreateAddress stores a new address and populates a.ID, Version, CreatedAt, UpdatedAt.
+// The user must exist.
+func (r *AddressRepo) CreateAddress(ctx context.Context, a *model.Address) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[a.UId]; !ok {
+		return fmt.Errorf("AddressRepo.CreateAddress: no user with id %d", a.UId)
+	}
+	if a.IsDefault && r.db.hasOtherDefault(a.UId, a.Type, 0) {
+		return repo.ErrDuplicateDefault
+	}
+	r.db.lastAddressID++
+	now := time.Now()
+	a.ID, a.Version, a.CreatedAt, a.UpdatedAt = r.db.lastAddressID, 1, now, now
+	r.db.addresses[a.ID] = *a
+	return nil
+}
+
+// ClearDefaultForUser unsets the default flag on all addresses of addrType
+// of the user
+func (r *AddressRepo) ClearDefaultForUser(ctx context.Context, userID int, addrType string) error {
+	defer r.db.lock(ctx)()
+
+	for id, a := range r.db.addresses {
+		if a.UId == userID && a.Type == addrType && a.IsDefault {
+			a.IsDefault = false
+			a.Version++
+			r.db.addresses[id] = a
+		}
+	}
+	return nil
+}
+
+// GetByID returns the address with the id. It fails with a wrapped
+// pgx.ErrNoRows if there is none, or it's soft-deleted.
+func (r *AddressRepo) GetByID(ctx context.Context, id int) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	a, ok := r.db.addresses[id]
+	if !ok || a.DeletedAt != nil {
+		return nil, fmt.Errorf("GetByID: no address with id %d: %w", id, pgx.ErrNoRows)
+	}
+	return &a, nil
+}
+
+// Delete soft-deletes an address by its ID and unsets its default flag. If
+// version isn't 0, the address must still be at that version. It fails with
+// pgx.ErrNoRows if nothing was deleted.
+func (r *AddressRepo) Delete(ctx context.Context, id, version int) error {
+	defer r.db.lock(ctx)()
+
+	a, ok := r.db.addresses[id]
+	if !ok || a.DeletedAt != nil || (version != 0 && a.Version != version) {
+		return pgx.ErrNoRows
+	}
+	now := time.Now()
+	a.DeletedAt = &now
+	a.IsDefault = false
+	a.Version++
+	r.db.addresses[id] = a
+	return nil
+}
+
+// GetDeletedByID returns a soft-deleted address. It fails with pgx.ErrNoRows
+// if there is none with the id, or it isn't deleted.
+func (r *AddressRepo) GetDeletedByID(ctx context.Context, id int) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	a, ok := r.db.addresses[id]
+	if !ok || a.DeletedAt == nil {
+		return nil, pgx.ErrNoRows
+	}
+	return &a, nil
+}
+
+// Restore undeletes a soft-deleted address, which comes back without its
+// default flag. It fails with pgx.ErrNoRows if the address isn't deleted.
+func (r *AddressRepo) Restore(ctx context.Context, id int) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	a, ok := r.db.addresses[id]
+	if !ok || a.DeletedAt == nil {
+		return nil, pgx.ErrNoRows
+	}
+	a.DeletedAt = nil
+	a.Version++
+	a.UpdatedAt = time.Now()
+	r.db.addresses[id] = a
+	return &a, nil
+}
+
+// PurgeDeleted removes the addresses soft-deleted before the given time and
+// returns how many there were
+func (r *AddressRepo) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	defer r.db.lock(ctx)()
+
+	purged := 0
+	for id, a := range r.db.addresses {
+		if a.DeletedAt != nil && a.DeletedAt.Before(before) {
+			delete(r.db.addresses, id)
+			delete(r.db.addressVersions, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Patch changes the fields that are set in p, and returns the updated
+// address. If version isn't 0, the address must still be at that version.
+// It fails with pgx.ErrNoRows if there is no such address, or it's deleted.
+func (r *AddressRepo) Patch(ctx context.Context, id, version int, p model.AddressPatch) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	existing, ok := r.db.addresses[id]
+	if !ok || existing.DeletedAt != nil || (version != 0 && existing.Version != version) {
+		return nil, pgx.ErrNoRows
+	}
+	patched := p.Apply(existing)
+	if patched.IsDefault && r.db.hasOtherDefault(existing.UId, patched.Type, id) {
+		return nil, repo.ErrDuplicateDefault
+	}
+	patched.Version++
+	patched.UpdatedAt = time.Now()
+	r.db.addresses[id] = patched
+	return &patched, nil
+}
+
+// RecordVersion stores the state prior had before changedBy changed it. Like
+// in Postgres, the address must exist and each version is recorded once.
+func (r *AddressRepo) RecordVersion(ctx context.Context, prior model.Address, changedBy int) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.addresses[prior.ID]; !ok {
+		return fmt.Errorf("AddressRepo.RecordVersion: no address with id %d", prior.ID)
+	}
+	for _, v := range r.db.addressVersions[prior.ID] {
+		if v.Version == prior.Version {
+			return fmt.Errorf("AddressRepo.RecordVersion: version %d of address %d already recorded", prior.Version, prior.ID)
+		}
+	}
+	prior.DeletedAt = nil
+	v := model.AddressVersion{Address: prior, ChangedBy: changedBy, ChangedAt: time.Now()}
+	r.db.addressVersions[prior.ID] = append(r.db.addressVersions[prior.ID], v)
+	return nil
+}
+
+// ListVersions returns the recorded prior states of an address, newest first
+func (r *AddressRepo) ListVersions(ctx context.Context, addressID int) ([]model.AddressVersion, error) {
+	defer r.db.lock(ctx)()
+
+	versions := append([]model.AddressVersion{}, r.db.addressVersions[addressID]...)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// FindByFingerprint returns the oldest live address of addrType of the user
+// with the fingerprint, or pgx.ErrNoRows
+func (r *AddressRepo) FindByFingerprint(ctx context.Context, userID int, addrType, fingerprint string) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	var found *model.Address
+	for _, a := range r.db.addresses {
+		if a.UId == userID && a.Type == addrType && a.Fingerprint == fingerprint && a.DeletedAt == nil &&
+			(found == nil || a.ID < found.ID) {
+			a := a
+			found = &a
+		}
+	}
+	if found == nil {
+		return nil, pgx.ErrNoRows
+	}
+	return found, nil
+}
+
+// ListWithoutFingerprint returns up to limit addresses, deleted or not, that
+// have no fingerprint yet, by ID
+func (r *AddressRepo) ListWithoutFingerprint(ctx context.Context, limit int) ([]model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	addresses := []model.Address{}
+	for _, a := range r.db.addresses {
+		if a.Fingerprint == "" {
+			addresses = append(addresses, a)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].ID < addresses[j].ID })
+	if len(addresses) > limit {
+		addresses = addresses[:limit]
+	}
+	return addresses, nil
+}
+
+// SetFingerprint stores the fingerprint of an address, keeping its version
+func (r *AddressRepo) SetFingerprint(ctx context.Context, id int, fingerprint string) error {
+	defer r.db.lock(ctx)()
+
+	if a, ok := r.db.addresses[id]; ok && a.Fingerprint == "" {
+		a.Fingerprint = fingerprint
+		r.db.addresses[id] = a
+	}
+	return nil
+}
+
+// SetLocation stores where the geocoder located an address while it still
+// has the fingerprint and isn't deleted, keeping its version
+func (r *AddressRepo) SetLocation(ctx context.Context, id int, fingerprint string, loc model.Location) error {
+	defer r.db.lock(ctx)()
+
+	if a, ok := r.db.addresses[id]; ok && a.Fingerprint == fingerprint && a.DeletedAt == nil {
+		a.Lat, a.Lng, a.Verified = &loc.Lat, &loc.Lng, loc.Verified
+		r.db.addresses[id] = a
+	}
+	return nil
+}
+
+// hasOtherDefault reports whether the user has a default address of addrType
+// other than exceptID; callers hold the lock
+func (db *DB) hasOtherDefault(userID int, addrType string, exceptID int) bool {
+	for id, a := range db.addresses {
+		if a.UId == userID && a.Type == addrType && a.IsDefault && id != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDefaultForUser returns the default address of addrType of the user, or
+// pgx.ErrNoRows
+func (r *AddressRepo) GetDefaultForUser(ctx context.Context, userID int, addrType string) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	for _, a := range r.db.addresses {
+		if a.UId == userID && a.Type == addrType && a.IsDefault {
+			return &a, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+// SetDefault makes address id the default of its type for userID and unsets
+// the previous default of that type. It fails with pgx.ErrNoRows if the user
+// has no such address.
+func (r *AddressRepo) SetDefault(ctx context.Context, userID, id int) (*model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	target, ok := r.db.addresses[id]
+	if !ok || target.UId != userID || target.DeletedAt != nil {
+		return nil, pgx.ErrNoRows
+	}
+	now := time.Now()
+	for addrID, a := range r.db.addresses {
+		if a.UId == userID && a.Type == target.Type && (a.IsDefault || addrID == id) {
+			a.IsDefault = addrID == id
+			a.Version++
+			a.UpdatedAt = now
+			r.db.addresses[addrID] = a
+		}
+	}
+	target = r.db.addresses[id]
+	return &target, nil
+}
+
+// ListByUser returns up to q.Limit addresses of q.UId that match the filters
+// of q, in q.SortBy order and starting behind q.After
+func (r *AddressRepo) ListByUser(ctx context.Context, q model.AddressQuery) ([]model.Address, error) {
+	defer r.db.lock(ctx)()
+
+	sortValue := func(a model.Address) time.Time { return a.CreatedAt }
+	if q.SortBy == "updated_at" {
+		sortValue = func(a model.Address) time.Time { return a.UpdatedAt }
+	}
+	// before reports whether a is listed before b
+	before := func(a, b model.AddressCursor) bool {
+		if q.Desc {
+			a, b = b, a
+		}
+		if !a.SortValue.Equal(b.SortValue) {
+			return a.SortValue.Before(b.SortValue)
+		}
+		return a.ID < b.ID
+	}
+	cursor := func(a model.Address) model.AddressCursor {
+		return model.AddressCursor{SortValue: sortValue(a), ID: a.ID}
+	}
+
+	addresses := []model.Address{}
+	for _, a := range r.db.addresses {
+		if matches(a, q) && (q.After == nil || before(*q.After, cursor(a))) {
+			addresses = append(addresses, a)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return before(cursor(addresses[i]), cursor(addresses[j]))
+	})
+	if len(addresses) > q.Limit {
+		addresses = addresses[:q.Limit]
+	}
+	return addresses, nil
+}
+
+// CountByUser counts the addresses of q.UId that match the filters of q
+func (r *AddressRepo) CountByUser(ctx context.Context, q model.AddressQuery) (int, error) {
+	defer r.db.lock(ctx)()
+
+	total := 0
+	for _, a := range r.db.addresses {
+		if matches(a, q) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+// matches reports whether a passes the filters of q. Soft-deleted addresses
+// only match q.Deleted.
+func matches(a model.Address, q model.AddressQuery) bool {
+	return a.UId == q.UId &&
+		(a.DeletedAt != nil) == q.Deleted &&
+		(q.Country == "" || strings.EqualFold(a.Country, q.Country)) &&
+		(q.City == "" || strings.EqualFold(a.City, q.City)) &&
+		(q.Type == "" || a.Type == q.Type) &&
+		(q.IsDefault == nil || a.IsDefault == *q.IsDefault)
+}
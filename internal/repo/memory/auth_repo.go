@@ -0,0 +1,209 @@
+package memory
+
+import (
+	"context"
+	"server/internal/model"
+	"server/internal/repo"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AuthRepo keeps users in a DB, like repo.AuthRepo does in Postgres
+type AuthRepo struct {
+	db *DB
+}
+
+func NewAuthRepo(db *DB) *AuthRepo {
+	return &AuthRepo{db: db}
+}
+
+// CreateUser stores a new user and populates u.ID, CreatedAt, UpdatedAt
+func (r *AuthRepo) CreateUser(ctx context.Context, u *model.User) error {
+	defer r.db.lock(ctx)()
+
+	if _, taken := r.db.userByEmail(u.Email); taken {
+		return repo.ErrEmailTaken
+	}
+	r.db.lastUserID++
+	now := time.Now()
+	u.ID, u.CreatedAt, u.UpdatedAt = r.db.lastUserID, now, now
+	r.db.users[u.ID] = *u
+	return nil
+}
+
+// GetByEmail returns the user with the email, or pgx.ErrNoRows
+func (r *AuthRepo) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	defer r.db.lock(ctx)()
+
+	u, ok := r.db.userByEmail(email)
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &u, nil
+}
+
+// GetByID returns the user with the id, or pgx.ErrNoRows
+func (r *AuthRepo) GetByID(ctx context.Context, id int) (*model.User, error) {
+	defer r.db.lock(ctx)()
+
+	u, ok := r.db.users[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &u, nil
+}
+
+// DeleteUser removes a user together with their addresses, passkeys,
+// recovery codes, MFA challenges, mailed tokens and refresh tokens
+func (r *AuthRepo) DeleteUser(ctx context.Context, id int) error {
+	defer r.db.lock(ctx)()
+
+	delete(r.db.users, id)
+	for addrID, a := range r.db.addresses {
+		if a.UId == id {
+			delete(r.db.addresses, addrID)
+			delete(r.db.addressVersions, addrID)
+		}
+	}
+	for passkeyID, p := range r.db.passkeys {
+		if p.UId == id {
+			delete(r.db.passkeys, passkeyID)
+		}
+	}
+	for ceremonyID, c := range r.db.ceremonies {
+		if c.userID != nil && *c.userID == id {
+			delete(r.db.ceremonies, ceremonyID)
+		}
+	}
+	r.db.deleteRecoveryCodes(id)
+	for jti, c := range r.db.mfaChallenges {
+		if c.userID == id {
+			delete(r.db.mfaChallenges, jti)
+		}
+	}
+	for tokenID, t := range r.db.userTokens {
+		if t.UId == id {
+			delete(r.db.userTokens, tokenID)
+		}
+	}
+	for tokenID, t := range r.db.refreshTokens {
+		if t.UId == id {
+			delete(r.db.refreshTokens, tokenID)
+		}
+	}
+	return nil
+}
+
+// MarkEmailVerified stamps EmailVerifiedAt, keeping the first verification time
+func (r *AuthRepo) MarkEmailVerified(ctx context.Context, id int) error {
+	defer r.db.lock(ctx)()
+
+	r.db.updateUser(id, func(u *model.User) {
+		if u.EmailVerifiedAt == nil {
+			now := time.Now()
+			u.EmailVerifiedAt = &now
+		}
+	})
+	return nil
+}
+
+// UpdatePassword replaces the bcrypt hash of a user
+func (r *AuthRepo) UpdatePassword(ctx context.Context, id int, passwordHash string) error {
+	defer r.db.lock(ctx)()
+
+	found := r.db.updateUser(id, func(u *model.User) {
+		u.PasswordHash = passwordHash
+	})
+	if !found {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateEmail switches a user to a new, already confirmed email address
+func (r *AuthRepo) UpdateEmail(ctx context.Context, id int, email string) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[id]; !ok {
+		return pgx.ErrNoRows
+	}
+	if other, taken := r.db.userByEmail(email); taken && other.ID != id {
+		return repo.ErrEmailTaken
+	}
+	r.db.updateUser(id, func(u *model.User) {
+		now := time.Now()
+		u.Email, u.EmailVerifiedAt = email, &now
+	})
+	return nil
+}
+
+// SetPendingTOTP stores a new encrypted TOTP secret that isn't active until EnableTOTP
+func (r *AuthRepo) SetPendingTOTP(ctx context.Context, id int, encryptedSecret string) error {
+	defer r.db.lock(ctx)()
+
+	r.db.updateUser(id, func(u *model.User) {
+		u.TOTPSecret, u.TOTPEnabledAt, u.TOTPLastStep = encryptedSecret, nil, 0
+	})
+	return nil
+}
+
+// EnableTOTP activates the pending TOTP secret
+func (r *AuthRepo) EnableTOTP(ctx context.Context, id int) error {
+	defer r.db.lock(ctx)()
+
+	r.db.updateUser(id, func(u *model.User) {
+		if u.TOTPSecret != "" {
+			now := time.Now()
+			u.TOTPEnabledAt = &now
+		}
+	})
+	return nil
+}
+
+// DisableTOTP removes the TOTP secret
+func (r *AuthRepo) DisableTOTP(ctx context.Context, id int) error {
+	defer r.db.lock(ctx)()
+
+	r.db.updateUser(id, func(u *model.User) {
+		u.TOTPSecret, u.TOTPEnabledAt, u.TOTPLastStep = "", nil, 0
+	})
+	return nil
+}
+
+// AdvanceTOTPStep records step as the last used TOTP step. It reports false
+// when that step or a later one was already used.
+func (r *AuthRepo) AdvanceTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	u, ok := r.db.users[id]
+	if !ok || u.TOTPLastStep >= step {
+		return false, nil
+	}
+	u.TOTPLastStep = step
+	r.db.users[id] = u
+	return true, nil
+}
+
+// userByEmail finds a user by exact email; callers hold the lock
+func (db *DB) userByEmail(email string) (model.User, bool) {
+	for _, u := range db.users {
+		if u.Email == email {
+			return u, true
+		}
+	}
+	return model.User{}, false
+}
+
+// updateUser applies change to the user and stamps UpdatedAt. It reports
+// false if there is no such user. Callers hold the lock.
+func (db *DB) updateUser(id int, change func(u *model.User)) bool {
+	u, ok := db.users[id]
+	if !ok {
+		return false
+	}
+	change(&u)
+	u.UpdatedAt = time.Now()
+	db.users[id] = u
+	return true
+}
@@ -0,0 +1,81 @@
+package memory
+
+import (
+	"context"
+	"server/internal/model"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// LoginFailureRepo counts failed logins in a DB, like repo.LoginFailureRepo does in Postgres
+type LoginFailureRepo struct {
+	db *DB
+}
+
+func NewLoginFailureRepo(db *DB) *LoginFailureRepo {
+	return &LoginFailureRepo{db: db}
+}
+
+// Get returns the failure record of a key, or pgx.ErrNoRows
+func (r *LoginFailureRepo) Get(ctx context.Context, key string) (*model.LoginFailure, error) {
+	defer r.db.lock(ctx)()
+
+	f, ok := r.db.loginFailures[key]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &f, nil
+}
+
+// RecordFailure counts a failed login for key and returns the updated record.
+// Failures older than windowStart no longer count, so the counter starts over.
+func (r *LoginFailureRepo) RecordFailure(ctx context.Context, key string, windowStart time.Time) (*model.LoginFailure, error) {
+	defer r.db.lock(ctx)()
+
+	f, ok := r.db.loginFailures[key]
+	if !ok {
+		f = model.LoginFailure{Key: key}
+	}
+	if ok && f.LastFailureAt.Before(windowStart) {
+		f.Failures = 1
+	} else {
+		f.Failures++
+	}
+	f.LastFailureAt = time.Now()
+	r.db.loginFailures[key] = f
+	return &f, nil
+}
+
+// Lock blocks logins for key until the given time and resets its counter
+func (r *LoginFailureRepo) Lock(ctx context.Context, key string, until time.Time) error {
+	defer r.db.lock(ctx)()
+
+	if f, ok := r.db.loginFailures[key]; ok {
+		f.LockedUntil, f.Failures = &until, 0
+		r.db.loginFailures[key] = f
+	}
+	return nil
+}
+
+// Clear forgets all failures and any lockout of key
+func (r *LoginFailureRepo) Clear(ctx context.Context, key string) error {
+	defer r.db.lock(ctx)()
+
+	delete(r.db.loginFailures, key)
+	return nil
+}
+
+// PurgeStale deletes records whose failures fell out of the window and
+// that aren't locked anymore
+func (r *LoginFailureRepo) PurgeStale(ctx context.Context, windowStart time.Time) error {
+	defer r.db.lock(ctx)()
+
+	now := time.Now()
+	for key, f := range r.db.loginFailures {
+		if f.LastFailureAt.Before(windowStart) && (f.LockedUntil == nil || f.LockedUntil.Before(now)) {
+			delete(r.db.loginFailures, key)
+		}
+	}
+	return nil
+}
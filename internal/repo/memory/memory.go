@@ -0,0 +1,123 @@
+// Package memory implements the stores of the service layer in process
+// memory, with the semantics of the Postgres repos: unique emails, one
+// default address per user and type, addresses, their history, passkeys,
+// two-factor state, mailed tokens and refresh tokens deleted along with their user, and
+// transactions that roll back. It backs fast tests that don't need a
+// database.
+package memory
+
+import (
+	"context"
+	"server/internal/model"
+	"sync"
+)
+
+// DB holds the rows the repos of this package share, like the tables of a
+// database. Transactions are serialized: while one runs, other calls wait.
+type DB struct {
+	// txMu is held by a running transaction and by every call outside one
+	txMu sync.Mutex
+	mu   sync.Mutex
+
+	users     map[int]model.User
+	addresses map[int]model.Address
+	// addressVersions holds the prior states of each address, oldest first
+	addressVersions map[int][]model.AddressVersion
+	passkeys        map[int]model.Passkey
+	ceremonies      map[string]ceremony
+	loginFailures   map[string]model.LoginFailure
+	// recoveryCodes tells whether each code was used
+	recoveryCodes map[recoveryCode]bool
+	mfaChallenges map[string]mfaChallenge
+	refreshTokens map[int]model.RefreshToken
+	userTokens    map[int]model.UserToken
+	// like sequences, ids aren't reused after a rollback
+	lastUserID         int
+	lastAddressID      int
+	lastPasskeyID      int
+	lastRefreshTokenID int
+	lastUserTokenID    int
+}
+
+func New() *DB {
+	return &DB{
+		users:           make(map[int]model.User),
+		addresses:       make(map[int]model.Address),
+		addressVersions: make(map[int][]model.AddressVersion),
+		passkeys:        make(map[int]model.Passkey),
+		ceremonies:      make(map[string]ceremony),
+		loginFailures:   make(map[string]model.LoginFailure),
+		recoveryCodes:   make(map[recoveryCode]bool),
+		mfaChallenges:   make(map[string]mfaChallenge),
+		refreshTokens:   make(map[int]model.RefreshToken),
+		userTokens:      make(map[int]model.UserToken),
+	}
+}
+
+// txKey marks a context that runs inside a transaction
+type txKey struct{}
+
+// lock takes the locks a call with ctx needs and returns their release
+func (db *DB) lock(ctx context.Context) func() {
+	inTx, _ := ctx.Value(txKey{}).(*DB)
+	if inTx != db {
+		db.txMu.Lock()
+	}
+	db.mu.Lock()
+	return func() {
+		db.mu.Unlock()
+		if inTx != db {
+			db.txMu.Unlock()
+		}
+	}
+}
+
+// TxManager runs calls on the repos of a DB as one unit of work, like
+// repo.TxManager does in Postgres.
+type TxManager struct {
+	db *DB
+}
+
+func NewTxManager(db *DB) *TxManager {
+	return &TxManager{db: db}
+}
+
+// WithinTx runs fn with exclusive access to the DB and undoes its changes
+// if fn returns an error. If ctx already runs in a transaction, fn joins it.
+func (m *TxManager) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if inTx, _ := ctx.Value(txKey{}).(*DB); inTx == m.db {
+		return fn(ctx)
+	}
+
+	m.db.txMu.Lock()
+	defer m.db.txMu.Unlock()
+
+	m.db.mu.Lock()
+	users, addresses, versions := copyMap(m.db.users), copyMap(m.db.addresses), copyMap(m.db.addressVersions)
+	passkeys, ceremonies := copyMap(m.db.passkeys), copyMap(m.db.ceremonies)
+	loginFailures := copyMap(m.db.loginFailures)
+	recoveryCodes, mfaChallenges := copyMap(m.db.recoveryCodes), copyMap(m.db.mfaChallenges)
+	refreshTokens, userTokens := copyMap(m.db.refreshTokens), copyMap(m.db.userTokens)
+	m.db.mu.Unlock()
+
+	fnErr := fn(context.WithValue(ctx, txKey{}, m.db))
+	if fnErr != nil {
+		m.db.mu.Lock()
+		m.db.users, m.db.addresses, m.db.addressVersions = users, addresses, versions
+		m.db.passkeys, m.db.ceremonies = passkeys, ceremonies
+		m.db.loginFailures = loginFailures
+		m.db.recoveryCodes, m.db.mfaChallenges = recoveryCodes, mfaChallenges
+		m.db.refreshTokens, m.db.userTokens = refreshTokens, userTokens
+		m.db.mu.Unlock()
+		return fnErr
+	}
+	return nil
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,140 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// recoveryCode is a row of mfa_recovery_codes
+type recoveryCode struct {
+	userID int
+	hash   string
+}
+
+// mfaChallenge is a row of mfa_challenges
+type mfaChallenge struct {
+	userID    int
+	expiresAt time.Time
+	attempts  int
+	used      bool
+}
+
+// RecoveryCodeRepo keeps recovery codes in a DB, like repo.RecoveryCodeRepo does in Postgres
+type RecoveryCodeRepo struct {
+	db *DB
+}
+
+func NewRecoveryCodeRepo(db *DB) *RecoveryCodeRepo {
+	return &RecoveryCodeRepo{db: db}
+}
+
+// ReplaceForUser swaps all recovery codes of a user for the given hashes
+func (r *RecoveryCodeRepo) ReplaceForUser(ctx context.Context, userID int, hashes []string) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[userID]; !ok {
+		return errors.New("memory: recovery codes of a missing user")
+	}
+	r.db.deleteRecoveryCodes(userID)
+	for _, hash := range hashes {
+		r.db.recoveryCodes[recoveryCode{userID: userID, hash: hash}] = false
+	}
+	return nil
+}
+
+// Consume marks an unused recovery code as used. It reports false when the
+// code doesn't exist or was already used.
+func (r *RecoveryCodeRepo) Consume(ctx context.Context, userID int, hash string) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	code := recoveryCode{userID: userID, hash: hash}
+	used, ok := r.db.recoveryCodes[code]
+	if !ok || used {
+		return false, nil
+	}
+	r.db.recoveryCodes[code] = true
+	return true, nil
+}
+
+// DeleteForUser removes every recovery code of a user
+func (r *RecoveryCodeRepo) DeleteForUser(ctx context.Context, userID int) error {
+	defer r.db.lock(ctx)()
+
+	r.db.deleteRecoveryCodes(userID)
+	return nil
+}
+
+func (db *DB) deleteRecoveryCodes(userID int) {
+	for code := range db.recoveryCodes {
+		if code.userID == userID {
+			delete(db.recoveryCodes, code)
+		}
+	}
+}
+
+// MFAChallengeRepo keeps the challenges of mfa_pending tokens in a DB, like
+// repo.MFAChallengeRepo does in Postgres
+type MFAChallengeRepo struct {
+	db *DB
+}
+
+func NewMFAChallengeRepo(db *DB) *MFAChallengeRepo {
+	return &MFAChallengeRepo{db: db}
+}
+
+// Create records the challenge of a new mfa_pending token
+func (r *MFAChallengeRepo) Create(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[userID]; !ok {
+		return errors.New("memory: challenge of a missing user")
+	}
+	if _, ok := r.db.mfaChallenges[jti]; ok {
+		return errors.New("memory: duplicate challenge jti")
+	}
+	r.db.mfaChallenges[jti] = mfaChallenge{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+// Attempt counts a code attempt against the challenge. It reports false
+// when the challenge doesn't belong to the user, expired, was already used
+// or has no attempts left.
+func (r *MFAChallengeRepo) Attempt(ctx context.Context, jti string, userID, maxAttempts int) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	c, ok := r.db.mfaChallenges[jti]
+	if !ok || c.userID != userID || c.used || !c.expiresAt.After(time.Now()) || c.attempts >= maxAttempts {
+		return false, nil
+	}
+	c.attempts++
+	r.db.mfaChallenges[jti] = c
+	return true, nil
+}
+
+// Consume marks the challenge as used. It reports false when it was
+// already used.
+func (r *MFAChallengeRepo) Consume(ctx context.Context, jti string) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	c, ok := r.db.mfaChallenges[jti]
+	if !ok || c.used {
+		return false, nil
+	}
+	c.used = true
+	r.db.mfaChallenges[jti] = c
+	return true, nil
+}
+
+// PurgeExpired drops the challenges of expired tokens
+func (r *MFAChallengeRepo) PurgeExpired(ctx context.Context) error {
+	defer r.db.lock(ctx)()
+
+	now := time.Now()
+	for jti, c := range r.db.mfaChallenges {
+		if c.expiresAt.Before(now) {
+			delete(r.db.mfaChallenges, jti)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"server/internal/model"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ceremony is a row of passkey_ceremonies
+type ceremony struct {
+	userID    *int
+	session   []byte
+	expiresAt time.Time
+}
+
+// PasskeyRepo keeps passkeys and ceremonies in a DB, like repo.PasskeyRepo does in Postgres
+type PasskeyRepo struct {
+	db *DB
+}
+
+func NewPasskeyRepo(db *DB) *PasskeyRepo {
+	return &PasskeyRepo{db: db}
+}
+
+// Create stores a registered passkey and populates p.ID and CreatedAt
+func (r *PasskeyRepo) Create(ctx context.Context, p *model.Passkey) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[p.UId]; !ok {
+		return errors.New("memory: passkey of a missing user")
+	}
+	for _, other := range r.db.passkeys {
+		if bytes.Equal(other.CredentialID, p.CredentialID) {
+			return errors.New("memory: duplicate credential id")
+		}
+	}
+	r.db.lastPasskeyID++
+	p.ID, p.CreatedAt = r.db.lastPasskeyID, time.Now()
+	r.db.passkeys[p.ID] = *p
+	return nil
+}
+
+// ListByUser returns the passkeys of a user, oldest first
+func (r *PasskeyRepo) ListByUser(ctx context.Context, userID int) ([]*model.Passkey, error) {
+	defer r.db.lock(ctx)()
+
+	passkeys := []*model.Passkey{}
+	for _, p := range r.db.passkeys {
+		if p.UId == userID {
+			p := p
+			passkeys = append(passkeys, &p)
+		}
+	}
+	sort.Slice(passkeys, func(i, j int) bool { return passkeys[i].ID < passkeys[j].ID })
+	return passkeys, nil
+}
+
+// UpdateAfterLogin stores the credential with its new sign count and stamps LastUsedAt
+func (r *PasskeyRepo) UpdateAfterLogin(ctx context.Context, id int, credential []byte) error {
+	defer r.db.lock(ctx)()
+
+	p, ok := r.db.passkeys[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	p.Credential, p.LastUsedAt = credential, &now
+	r.db.passkeys[id] = p
+	return nil
+}
+
+// Rename changes the label of a passkey owned by the user
+func (r *PasskeyRepo) Rename(ctx context.Context, id, userID int, name string) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	p, ok := r.db.passkeys[id]
+	if !ok || p.UId != userID {
+		return false, nil
+	}
+	p.Name = name
+	r.db.passkeys[id] = p
+	return true, nil
+}
+
+// Delete removes a passkey owned by the user
+func (r *PasskeyRepo) Delete(ctx context.Context, id, userID int) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	p, ok := r.db.passkeys[id]
+	if !ok || p.UId != userID {
+		return false, nil
+	}
+	delete(r.db.passkeys, id)
+	return true, nil
+}
+
+// SaveCeremony stores the state of a started registration or login
+func (r *PasskeyRepo) SaveCeremony(ctx context.Context, id string, userID *int, session []byte, expiresAt time.Time) error {
+	defer r.db.lock(ctx)()
+
+	if _, taken := r.db.ceremonies[id]; taken {
+		return errors.New("memory: duplicate ceremony id")
+	}
+	r.db.ceremonies[id] = ceremony{userID: userID, session: session, expiresAt: expiresAt}
+
+	now := time.Now()
+	for other, c := range r.db.ceremonies {
+		if c.expiresAt.Before(now) {
+			delete(r.db.ceremonies, other)
+		}
+	}
+	return nil
+}
+
+// TakeCeremony deletes an unexpired ceremony and returns its owner and
+// state, or pgx.ErrNoRows
+func (r *PasskeyRepo) TakeCeremony(ctx context.Context, id string) (*int, []byte, error) {
+	defer r.db.lock(ctx)()
+
+	c, ok := r.db.ceremonies[id]
+	if !ok || !c.expiresAt.After(time.Now()) {
+		return nil, nil, pgx.ErrNoRows
+	}
+	delete(r.db.ceremonies, id)
+	return c.userID, c.session, nil
+}
@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"server/internal/model"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RefreshTokenRepo keeps refresh tokens in a DB, like repo.RefreshTokenRepo does in Postgres
+type RefreshTokenRepo struct {
+	db *DB
+}
+
+func NewRefreshTokenRepo(db *DB) *RefreshTokenRepo {
+	return &RefreshTokenRepo{db: db}
+}
+
+// Create stores a new refresh token and populates t.ID and CreatedAt
+func (r *RefreshTokenRepo) Create(ctx context.Context, t *model.RefreshToken) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[t.UId]; !ok {
+		return errors.New("memory: refresh token of a missing user")
+	}
+	for _, other := range r.db.refreshTokens {
+		if other.TokenHash == t.TokenHash {
+			return errors.New("memory: duplicate refresh token hash")
+		}
+	}
+	r.db.lastRefreshTokenID++
+	t.ID, t.CreatedAt = r.db.lastRefreshTokenID, time.Now()
+	r.db.refreshTokens[t.ID] = *t
+	return nil
+}
+
+// GetByHash fetches a refresh token by the hash of its raw value, or pgx.ErrNoRows
+func (r *RefreshTokenRepo) GetByHash(ctx context.Context, hash string) (*model.RefreshToken, error) {
+	defer r.db.lock(ctx)()
+
+	for _, t := range r.db.refreshTokens {
+		if t.TokenHash == hash {
+			return &t, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+// MarkRotated flags a token as used. It reports false when the token was
+// already rotated or revoked.
+func (r *RefreshTokenRepo) MarkRotated(ctx context.Context, id int) (bool, error) {
+	defer r.db.lock(ctx)()
+
+	t, ok := r.db.refreshTokens[id]
+	if !ok || t.RotatedAt != nil || t.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	t.RotatedAt = &now
+	r.db.refreshTokens[id] = t
+	return true, nil
+}
+
+// RevokeFamily revokes every token descending from the same login
+func (r *RefreshTokenRepo) RevokeFamily(ctx context.Context, familyID string) error {
+	defer r.db.lock(ctx)()
+
+	r.db.revokeRefreshTokens(func(t model.RefreshToken) bool { return t.FamilyID == familyID })
+	return nil
+}
+
+// RevokeAllForUser revokes every outstanding refresh token of a user
+func (r *RefreshTokenRepo) RevokeAllForUser(ctx context.Context, userID int) error {
+	defer r.db.lock(ctx)()
+
+	r.db.revokeRefreshTokens(func(t model.RefreshToken) bool { return t.UId == userID })
+	return nil
+}
+
+// revokeRefreshTokens revokes the unrevoked tokens that match
+func (db *DB) revokeRefreshTokens(match func(t model.RefreshToken) bool) {
+	now := time.Now()
+	for id, t := range db.refreshTokens {
+		if t.RevokedAt == nil && match(t) {
+			t.RevokedAt = &now
+			db.refreshTokens[id] = t
+		}
+	}
+}
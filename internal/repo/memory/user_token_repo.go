@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"server/internal/model"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// UserTokenRepo keeps mailed tokens in a DB, like repo.UserTokenRepo does in Postgres
+type UserTokenRepo struct {
+	db *DB
+}
+
+func NewUserTokenRepo(db *DB) *UserTokenRepo {
+	return &UserTokenRepo{db: db}
+}
+
+// Create stores a new token and populates t.ID and CreatedAt
+func (r *UserTokenRepo) Create(ctx context.Context, t *model.UserToken) error {
+	defer r.db.lock(ctx)()
+
+	if _, ok := r.db.users[t.UId]; !ok {
+		return errors.New("memory: user token of a missing user")
+	}
+	for _, other := range r.db.userTokens {
+		if other.TokenHash == t.TokenHash {
+			return errors.New("memory: duplicate user token hash")
+		}
+	}
+	r.db.lastUserTokenID++
+	t.ID, t.CreatedAt = r.db.lastUserTokenID, time.Now()
+	r.db.userTokens[t.ID] = *t
+	return nil
+}
+
+// Consume marks an unused, unexpired token as used and returns it, or
+// pgx.ErrNoRows
+func (r *UserTokenRepo) Consume(ctx context.Context, hash, purpose string) (*model.UserToken, error) {
+	defer r.db.lock(ctx)()
+
+	now := time.Now()
+	for id, t := range r.db.userTokens {
+		if t.TokenHash == hash && t.Purpose == purpose && t.UsedAt == nil && t.ExpiresAt.After(now) {
+			t.UsedAt = &now
+			r.db.userTokens[id] = t
+			return &t, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+// InvalidateForUser marks all unused tokens of a purpose as used
+func (r *UserTokenRepo) InvalidateForUser(ctx context.Context, userID int, purpose string) error {
+	defer r.db.lock(ctx)()
+
+	now := time.Now()
+	for id, t := range r.db.userTokens {
+		if t.UId == userID && t.Purpose == purpose && t.UsedAt == nil {
+			t.UsedAt = &now
+			r.db.userTokens[id] = t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type MFAChallengeRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewMFAChallengeRepo(db *pgxpool.Pool) *MFAChallengeRepo {
+	return &MFAChallengeRepo{db: db}
+}
+
+// Create records the challenge of a new mfa_pending token.
+func (r *MFAChallengeRepo) Create(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	query := `INSERT INTO mfa_challenges (jti, u_id, expires_at) VALUES ($1, $2, $3);`
+	_, execErr := r.db.Exec(ctx, query, jti, userID, expiresAt)
+	if execErr != nil {
+		return fmt.Errorf("MFAChallengeRepo.Create: %w", execErr)
+	}
+	return nil
+}
+
+// Attempt counts a code attempt against the challenge. It reports false
+// when the challenge doesn't belong to the user, expired, was already used
+// or has no attempts left.
+func (r *MFAChallengeRepo) Attempt(ctx context.Context, jti string, userID, maxAttempts int) (bool, error) {
+	query := `
+		UPDATE mfa_challenges
+		   SET attempts = attempts + 1
+		 WHERE jti = $1
+		   AND u_id = $2
+		   AND used_at IS NULL
+		   AND expires_at > now()
+		   AND attempts < $3;
+	`
+	tag, execErr := r.db.Exec(ctx, query, jti, userID, maxAttempts)
+	if execErr != nil {
+		return false, fmt.Errorf("MFAChallengeRepo.Attempt: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Consume marks the challenge as used. It reports false when it was
+// already used.
+func (r *MFAChallengeRepo) Consume(ctx context.Context, jti string) (bool, error) {
+	query := `
+		UPDATE mfa_challenges
+		   SET used_at = now()
+		 WHERE jti = $1
+		   AND used_at IS NULL;
+	`
+	tag, execErr := r.db.Exec(ctx, query, jti)
+	if execErr != nil {
+		return false, fmt.Errorf("MFAChallengeRepo.Consume: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PurgeExpired drops the challenges of expired tokens.
+func (r *MFAChallengeRepo) PurgeExpired(ctx context.Context) error {
+	_, execErr := r.db.Exec(ctx, `DELETE FROM mfa_challenges WHERE expires_at < now();`)
+	if execErr != nil {
+		return fmt.Errorf("MFAChallengeRepo.PurgeExpired: %w", execErr)
+	}
+	return nil
+}
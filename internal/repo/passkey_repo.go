@@ -0,0 +1,134 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"server/internal/model"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PasskeyRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPasskeyRepo(db *pgxpool.Pool) *PasskeyRepo {
+	return &PasskeyRepo{db: db}
+}
+
+// Create stores a registered passkey and populates p.ID and CreatedAt.
+func (r *PasskeyRepo) Create(ctx context.Context, p *model.Passkey) error {
+	query := `INSERT INTO passkey_credentials (u_id, credential_id, name, credential)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at
+	`
+	row := r.db.QueryRow(ctx, query, p.UId, p.CredentialID, p.Name, string(p.Credential))
+	scanErr := row.Scan(&p.ID, &p.CreatedAt)
+	if scanErr != nil {
+		return fmt.Errorf("PasskeyRepo.Create: %w", scanErr)
+	}
+	return nil
+}
+
+// ListByUser returns the passkeys of a user, oldest first.
+func (r *PasskeyRepo) ListByUser(ctx context.Context, userID int) ([]*model.Passkey, error) {
+	query := `
+		SELECT id, u_id, credential_id, name, credential, created_at, last_used_at
+		  FROM passkey_credentials
+		 WHERE u_id = $1
+		 ORDER BY created_at, id;
+	`
+	rows, queryErr := r.db.Query(ctx, query, userID)
+	if queryErr != nil {
+		return nil, fmt.Errorf("PasskeyRepo.ListByUser: %w", queryErr)
+	}
+	defer rows.Close()
+
+	passkeys := []*model.Passkey{}
+	for rows.Next() {
+		p := new(model.Passkey)
+		scanErr := rows.Scan(&p.ID, &p.UId, &p.CredentialID, &p.Name, &p.Credential, &p.CreatedAt, &p.LastUsedAt)
+		if scanErr != nil {
+			return nil, fmt.Errorf("PasskeyRepo.ListByUser: %w", scanErr)
+		}
+		passkeys = append(passkeys, p)
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, fmt.Errorf("PasskeyRepo.ListByUser: %w", rowsErr)
+	}
+	return passkeys, nil
+}
+
+// UpdateAfterLogin stores the credential with its new sign count and stamps last_used_at.
+func (r *PasskeyRepo) UpdateAfterLogin(ctx context.Context, id int, credential []byte) error {
+	query := `
+		UPDATE passkey_credentials
+		   SET credential = $1,
+		       last_used_at = now()
+		 WHERE id = $2;
+	`
+	_, execErr := r.db.Exec(ctx, query, string(credential), id)
+	if execErr != nil {
+		return fmt.Errorf("PasskeyRepo.UpdateAfterLogin: %w", execErr)
+	}
+	return nil
+}
+
+// Rename changes the label of a passkey owned by the user. It reports false
+// when the user has no passkey with that ID.
+func (r *PasskeyRepo) Rename(ctx context.Context, id, userID int, name string) (bool, error) {
+	query := `UPDATE passkey_credentials SET name = $1 WHERE id = $2 AND u_id = $3;`
+	tag, execErr := r.db.Exec(ctx, query, name, id, userID)
+	if execErr != nil {
+		return false, fmt.Errorf("PasskeyRepo.Rename: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Delete removes a passkey owned by the user. It reports false when the
+// user has no passkey with that ID.
+func (r *PasskeyRepo) Delete(ctx context.Context, id, userID int) (bool, error) {
+	query := `DELETE FROM passkey_credentials WHERE id = $1 AND u_id = $2;`
+	tag, execErr := r.db.Exec(ctx, query, id, userID)
+	if execErr != nil {
+		return false, fmt.Errorf("PasskeyRepo.Delete: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// SaveCeremony stores the state of a started registration or login.
+// userID is nil for logins, where the user isn't known yet.
+func (r *PasskeyRepo) SaveCeremony(ctx context.Context, id string, userID *int, session []byte, expiresAt time.Time) error {
+	query := `
+		INSERT INTO passkey_ceremonies (id, u_id, session, expires_at)
+		VALUES ($1, $2, $3, $4);
+	`
+	_, execErr := r.db.Exec(ctx, query, id, userID, string(session), expiresAt)
+	if execErr != nil {
+		return fmt.Errorf("PasskeyRepo.SaveCeremony: %w", execErr)
+	}
+
+	// opportunistic cleanup of abandoned ceremonies
+	_, _ = r.db.Exec(ctx, `DELETE FROM passkey_ceremonies WHERE expires_at < now();`)
+	return nil
+}
+
+// TakeCeremony deletes an unexpired ceremony and returns its owner and state,
+// so every challenge can be answered only once. It fails with
+// pgx.ErrNoRows when there is no such ceremony.
+func (r *PasskeyRepo) TakeCeremony(ctx context.Context, id string) (*int, []byte, error) {
+	query := `
+		DELETE FROM passkey_ceremonies
+		 WHERE id = $1
+		   AND expires_at > now()
+		RETURNING u_id, session;
+	`
+	var userID *int
+	var session []byte
+	scanErr := r.db.QueryRow(ctx, query, id).Scan(&userID, &session)
+	if scanErr != nil {
+		return nil, nil, fmt.Errorf("PasskeyRepo.TakeCeremony: %w", scanErr)
+	}
+	return userID, session, nil
+}
@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type RecoveryCodeRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewRecoveryCodeRepo(db *pgxpool.Pool) *RecoveryCodeRepo {
+	return &RecoveryCodeRepo{db: db}
+}
+
+// ReplaceForUser swaps all recovery codes of a user for the given hashes.
+// Inside a TxManager.WithinTx call it runs in a savepoint of that transaction.
+func (r *RecoveryCodeRepo) ReplaceForUser(ctx context.Context, userID int, hashes []string) error {
+	tx, beginErr := conn(ctx, r.db).Begin(ctx)
+	if beginErr != nil {
+		return fmt.Errorf("RecoveryCodeRepo.ReplaceForUser: %w", beginErr)
+	}
+	defer tx.Rollback(ctx)
+
+	_, deleteErr := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE u_id = $1;`, userID)
+	if deleteErr != nil {
+		return fmt.Errorf("RecoveryCodeRepo.ReplaceForUser: %w", deleteErr)
+	}
+	for _, hash := range hashes {
+		_, insertErr := tx.Exec(ctx, `INSERT INTO mfa_recovery_codes (u_id, code_hash) VALUES ($1, $2);`, userID, hash)
+		if insertErr != nil {
+			return fmt.Errorf("RecoveryCodeRepo.ReplaceForUser: %w", insertErr)
+		}
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return fmt.Errorf("RecoveryCodeRepo.ReplaceForUser: %w", commitErr)
+	}
+	return nil
+}
+
+// Consume marks an unused recovery code as used. It reports false when the
+// code doesn't exist or was already used.
+func (r *RecoveryCodeRepo) Consume(ctx context.Context, userID int, hash string) (bool, error) {
+	query := `
+		UPDATE mfa_recovery_codes
+		   SET used_at = now()
+		 WHERE u_id = $1
+		   AND code_hash = $2
+		   AND used_at IS NULL;
+	`
+	tag, execErr := conn(ctx, r.db).Exec(ctx, query, userID, hash)
+	if execErr != nil {
+		return false, fmt.Errorf("RecoveryCodeRepo.Consume: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteForUser removes every recovery code of a user.
+func (r *RecoveryCodeRepo) DeleteForUser(ctx context.Context, userID int) error {
+	_, execErr := conn(ctx, r.db).Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE u_id = $1;`, userID)
+	if execErr != nil {
+		return fmt.Errorf("RecoveryCodeRepo.DeleteForUser: %w", execErr)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"server/internal/model"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type RefreshTokenRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewRefreshTokenRepo(db *pgxpool.Pool) *RefreshTokenRepo {
+	return &RefreshTokenRepo{db: db}
+}
+
+// Create stores a new refresh token and populates t.ID and CreatedAt.
+func (r *RefreshTokenRepo) Create(ctx context.Context, t *model.RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (u_id, token_hash, family_id, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at
+	`
+	row := r.db.QueryRow(ctx, query, t.UId, t.TokenHash, t.FamilyID, t.ExpiresAt)
+	scanErr := row.Scan(&t.ID, &t.CreatedAt)
+	if scanErr != nil {
+		return fmt.Errorf("RefreshTokenRepo.Create: %w", scanErr)
+	}
+	return nil
+}
+
+// GetByHash fetches a refresh token by the SHA-256 hash of its raw value.
+func (r *RefreshTokenRepo) GetByHash(ctx context.Context, hash string) (*model.RefreshToken, error) {
+	query := `
+		SELECT id, u_id, token_hash, family_id, expires_at, rotated_at, revoked_at, created_at
+		  FROM refresh_tokens
+		 WHERE token_hash = $1;
+	`
+	t := new(model.RefreshToken)
+	row := r.db.QueryRow(ctx, query, hash)
+	scanErr := row.Scan(
+		&t.ID, &t.UId, &t.TokenHash, &t.FamilyID,
+		&t.ExpiresAt, &t.RotatedAt, &t.RevokedAt, &t.CreatedAt,
+	)
+	if scanErr != nil {
+		return nil, fmt.Errorf("RefreshTokenRepo.GetByHash: %w", scanErr)
+	}
+	return t, nil
+}
+
+// MarkRotated flags a token as used. It reports false when the token was
+// already rotated or revoked, so two concurrent refreshes can't both win.
+func (r *RefreshTokenRepo) MarkRotated(ctx context.Context, id int) (bool, error) {
+	query := `
+		UPDATE refresh_tokens
+		   SET rotated_at = now()
+		 WHERE id = $1
+		   AND rotated_at IS NULL
+		   AND revoked_at IS NULL;
+	`
+	tag, execErr := r.db.Exec(ctx, query, id)
+	if execErr != nil {
+		return false, fmt.Errorf("RefreshTokenRepo.MarkRotated: %w", execErr)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RevokeFamily revokes every token descending from the same login.
+func (r *RefreshTokenRepo) RevokeFamily(ctx context.Context, familyID string) error {
+	query := `
+		UPDATE refresh_tokens
+		   SET revoked_at = now()
+		 WHERE family_id = $1
+		   AND revoked_at IS NULL;
+	`
+	_, execErr := r.db.Exec(ctx, query, familyID)
+	if execErr != nil {
+		return fmt.Errorf("RefreshTokenRepo.RevokeFamily: %w", execErr)
+	}
+	return nil
+}
+
+// RevokeAllForUser revokes every outstanding refresh token of a user.
+func (r *RefreshTokenRepo) RevokeAllForUser(ctx context.Context, userID int) error {
+	query := `
+		UPDATE refresh_tokens
+		   SET revoked_at = now()
+		 WHERE u_id = $1
+		   AND revoked_at IS NULL;
+	`
+	_, execErr := r.db.Exec(ctx, query, userID)
+	if execErr != nil {
+		return fmt.Errorf("RefreshTokenRepo.RevokeAllForUser: %w", execErr)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type RevocationRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewRevocationRepo(db *pgxpool.Pool) *RevocationRepo {
+	return &RevocationRepo{db: db}
+}
+
+// RevokeJTI records a single access token as revoked until it expires.
+func (r *RevocationRepo) RevokeJTI(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	query := `
+		INSERT INTO revoked_tokens (jti, u_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING;
+	`
+	_, execErr := r.db.Exec(ctx, query, jti, userID, expiresAt)
+	if execErr != nil {
+		return fmt.Errorf("RevocationRepo.RevokeJTI: %w", execErr)
+	}
+	return nil
+}
+
+// IsJTIRevoked reports whether the access token with the given jti was revoked.
+func (r *RevocationRepo) IsJTIRevoked(ctx context.Context, jti string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1);`
+	var revoked bool
+	scanErr := r.db.QueryRow(ctx, query, jti).Scan(&revoked)
+	if scanErr != nil {
+		return false, fmt.Errorf("RevocationRepo.IsJTIRevoked: %w", scanErr)
+	}
+	return revoked, nil
+}
+
+// RevokeAllForUser rejects every token of the user issued at or before the given time.
+func (r *RevocationRepo) RevokeAllForUser(ctx context.Context, userID int, before time.Time) error {
+	query := `
+		INSERT INTO user_token_revocations (u_id, revoked_before)
+		VALUES ($1, $2)
+		ON CONFLICT (u_id) DO UPDATE
+		   SET revoked_before = GREATEST(user_token_revocations.revoked_before, EXCLUDED.revoked_before);
+	`
+	_, execErr := r.db.Exec(ctx, query, userID, before)
+	if execErr != nil {
+		return fmt.Errorf("RevocationRepo.RevokeAllForUser: %w", execErr)
+	}
+	return nil
+}
+
+// GetUserCutoff returns the user's revoked_before time, or the zero time
+// when the user never logged out all sessions.
+func (r *RevocationRepo) GetUserCutoff(ctx context.Context, userID int) (time.Time, error) {
+	query := `SELECT revoked_before FROM user_token_revocations WHERE u_id = $1;`
+	var cutoff time.Time
+	scanErr := r.db.QueryRow(ctx, query, userID).Scan(&cutoff)
+	if scanErr != nil {
+		if errors.Is(scanErr, pgx.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("RevocationRepo.GetUserCutoff: %w", scanErr)
+	}
+	return cutoff, nil
+}
+
+// PurgeExpired drops revocations of tokens that have expired on their own.
+func (r *RevocationRepo) PurgeExpired(ctx context.Context) error {
+	query := `DELETE FROM revoked_tokens WHERE expires_at < now();`
+	_, execErr := r.db.Exec(ctx, query)
+	if execErr != nil {
+		return fmt.Errorf("RevocationRepo.PurgeExpired: %w", execErr)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DBTX is what repos run their queries on: the pool, or the transaction of
+// a TxManager.WithinTx call.
+type DBTX interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// txKey is the context key of the running transaction
+type txKey struct{}
+
+// TxManager runs several repo calls as one unit of work. The transaction
+// travels in the context, so repos need no extra parameter to take part.
+type TxManager struct {
+	db *pgxpool.Pool
+}
+
+func NewTxManager(db *pgxpool.Pool) *TxManager {
+	return &TxManager{db: db}
+}
+
+// WithinTx runs fn in a transaction and commits it if fn returns nil, or
+// rolls it back otherwise. Repo calls made with the ctx passed to fn run in
+// the transaction. If ctx already carries one, fn joins it.
+func (m *TxManager) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, beginErr := m.db.Begin(ctx)
+	if beginErr != nil {
+		return fmt.Errorf("TxManager.WithinTx: %w", beginErr)
+	}
+	// a no-op after Commit
+	defer tx.Rollback(ctx)
+
+	fnErr := fn(context.WithValue(ctx, txKey{}, tx))
+	if fnErr != nil {
+		return fnErr
+	}
+
+	commitErr := tx.Commit(ctx)
+	if commitErr != nil {
+		return fmt.Errorf("TxManager.WithinTx: %w", commitErr)
+	}
+	return nil
+}
+
+// conn returns the transaction carried by ctx, or else the pool
+func conn(ctx context.Context, db *pgxpool.Pool) DBTX {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return db
+}
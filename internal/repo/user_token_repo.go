@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"server/internal/model"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type UserTokenRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewUserTokenRepo(db *pgxpool.Pool) *UserTokenRepo {
+	return &UserTokenRepo{db: db}
+}
+
+// Create stores a new token and populates t.ID and CreatedAt.
+func (r *UserTokenRepo) Create(ctx context.Context, t *model.UserToken) error {
+	query := `INSERT INTO user_tokens (u_id, purpose, token_hash, new_email, expires_at)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at
+	`
+	row := r.db.QueryRow(ctx, query, t.UId, t.Purpose, t.TokenHash, t.NewEmail, t.ExpiresAt)
+	scanErr := row.Scan(&t.ID, &t.CreatedAt)
+	if scanErr != nil {
+		return fmt.Errorf("UserTokenRepo.Create: %w", scanErr)
+	}
+	return nil
+}
+
+// Consume marks an unused, unexpired token as used and returns it.
+// It fails with pgx.ErrNoRows when no such token exists, so a token can
+// only ever be consumed once.
+func (r *UserTokenRepo) Consume(ctx context.Context, hash, purpose string) (*model.UserToken, error) {
+	query := `
+		UPDATE user_tokens
+		   SET used_at = now()
+		 WHERE token_hash = $1
+		   AND purpose = $2
+		   AND used_at IS NULL
+		   AND expires_at > now()
+		RETURNING id, u_id, purpose, token_hash, new_email, expires_at, used_at, created_at;
+	`
+	t := new(model.UserToken)
+	row := r.db.QueryRow(ctx, query, hash, purpose)
+	scanErr := row.Scan(&t.ID, &t.UId, &t.Purpose, &t.TokenHash, &t.NewEmail, &t.ExpiresAt, &t.UsedAt, &t.CreatedAt)
+	if scanErr != nil {
+		return nil, fmt.Errorf("UserTokenRepo.Consume: %w", scanErr)
+	}
+	return t, nil
+}
+
+// InvalidateForUser marks all unused tokens of a purpose as used, e.g. before issuing a new one.
+func (r *UserTokenRepo) InvalidateForUser(ctx context.Context, userID int, purpose string) error {
+	query := `
+		UPDATE user_tokens
+		   SET used_at = now()
+		 WHERE u_id = $1
+		   AND purpose = $2
+		   AND used_at IS NULL;
+	`
+	_, execErr := r.db.Exec(ctx, query, userID, purpose)
+	if execErr != nil {
+		return fmt.Errorf("UserTokenRepo.InvalidateForUser: %w", execErr)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidKey = errors.New("secretbox: key must be 32 bytes, base64-encoded")
+var ErrCiphertext = errors.New("secretbox: malformed ciphertext")
+
+// Box encrypts small secrets at rest with AES-256-GCM
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewFromBase64 builds a Box from a base64-encoded 32-byte key
+func NewFromBase64(encodedKey string) (*Box, error) {
+	key, decodeErr := base64.StdEncoding.DecodeString(encodedKey)
+	if decodeErr != nil || len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	block, blockErr := aes.NewCipher(key)
+	if blockErr != nil {
+		return nil, fmt.Errorf("secretbox: %w", blockErr)
+	}
+	aead, gcmErr := cipher.NewGCM(block)
+	if gcmErr != nil {
+		return nil, fmt.Errorf("secretbox: %w", gcmErr)
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts plaintext and returns base64(nonce || ciphertext)
+func (b *Box) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	_, readErr := rand.Read(nonce)
+	if readErr != nil {
+		return "", fmt.Errorf("secretbox: nonce: %w", readErr)
+	}
+	sealed := b.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open reverses Seal
+func (b *Box) Open(encoded string) ([]byte, error) {
+	sealed, decodeErr := base64.StdEncoding.DecodeString(encoded)
+	if decodeErr != nil || len(sealed) < b.aead.NonceSize() {
+		return nil, ErrCiphertext
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plaintext, openErr := b.aead.Open(nil, nonce, ciphertext, nil)
+	if openErr != nil {
+		return nil, fmt.Errorf("secretbox: open: %w", openErr)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,63 @@
+package secretbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func newBox(t *testing.T, key byte) *Box {
+	t.Helper()
+	box, err := NewFromBase64(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{key}, 32)))
+	if err != nil {
+		t.Fatalf("NewFromBase64 = %v", err)
+	}
+	return box
+}
+
+func TestSealOpen(t *testing.T) {
+	box := newBox(t, 1)
+	sealed, err := box.Seal([]byte("JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatalf("Seal = %v", err)
+	}
+	opened, err := box.Open(sealed)
+	if err != nil || string(opened) != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("Open = %q, %v, want the plaintext", opened, err)
+	}
+
+	// every seal draws a new nonce
+	if again, _ := box.Seal([]byte("JBSWY3DPEHPK3PXP")); again == sealed {
+		t.Fatal("Seal returned the same ciphertext twice")
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	box := newBox(t, 1)
+	sealed, _ := box.Seal([]byte("JBSWY3DPEHPK3PXP"))
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := box.Open(base64.StdEncoding.EncodeToString(tampered)); err == nil {
+		t.Error("Open of a tampered ciphertext didn't fail")
+	}
+	if _, err := newBox(t, 2).Open(sealed); err == nil {
+		t.Error("Open with the wrong key didn't fail")
+	}
+	if _, err := box.Open("not base64!"); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("Open of malformed input = %v, want ErrCiphertext", err)
+	}
+	if _, err := box.Open(base64.StdEncoding.EncodeToString(raw[:4])); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("Open of a truncated ciphertext = %v, want ErrCiphertext", err)
+	}
+}
+
+func TestNewFromBase64RejectsBadKeys(t *testing.T) {
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := NewFromBase64(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("NewFromBase64(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
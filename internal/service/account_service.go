@@ -0,0 +1,480 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"server/internal/mailer"
+	"server/internal/model"
+	"server/internal/repo"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrInvalidToken = errors.New("service: invalid or expired token")
+var ErrEmailTaken = errors.New("service: email already in use")
+
+// mailTimeout bounds a mail flow run in the background
+const mailTimeout = 30 * time.Second
+
+const (
+	// mailWorkers run the queued mail flows, one at a time each
+	mailWorkers = 2
+	// mailQueueSize is how many mail flows can wait; more are dropped and
+	// logged, the rate limits keep the queue far from full
+	mailQueueSize = 1000
+)
+
+// AccountOptions configures the links and token lifetimes of AccountService
+type AccountOptions struct {
+	// BaseURL is prepended to the links in outgoing mail
+	BaseURL         string
+	VerificationTTL time.Duration
+	// PasswordResetURL is the frontend page that collects the new password
+	PasswordResetURL string
+	PasswordResetTTL time.Duration
+	EmailChangeTTL   time.Duration
+	UnlockTTL        time.Duration
+}
+
+// AccountService runs the account lifecycle flows that go through the
+// user's mailbox or touch credentials: email verification, password
+// recovery, unlocking a locked login, and changing the password or email of
+// a logged-in user.
+type AccountService struct {
+	authRepo  UserStore
+	tokenRepo UserTokenStore
+	tokenSvc  *TokenService
+	throttle  *LoginThrottle
+	mailer    mailer.Mailer
+	opts      AccountOptions
+	// mailQueue feeds the mail workers; it is closed by StopMail, under
+	// queueMu
+	mailQueue   chan mailJob
+	queueMu     sync.Mutex
+	queueClosed bool
+	// mailing counts the queued flows, workers the running workers
+	mailing sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+// mailJob is a mail flow run in the background; name is used in logs
+type mailJob struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func NewAccountService(authRepo UserStore, tokenRepo UserTokenStore, tokenSvc *TokenService, throttle *LoginThrottle, m mailer.Mailer, opts AccountOptions) *AccountService {
+	s := &AccountService{authRepo: authRepo, tokenRepo: tokenRepo, tokenSvc: tokenSvc, throttle: throttle, mailer: m, opts: opts}
+	s.mailQueue = make(chan mailJob, mailQueueSize)
+	for i := 0; i < mailWorkers; i++ {
+		s.workers.Add(1)
+		go s.mailWorker()
+	}
+	return s
+}
+
+// SendVerification mails a fresh verification link, invalidating older ones.
+func (s *AccountService) SendVerification(ctx context.Context, u *model.User) error {
+	invalidateErr := s.tokenRepo.InvalidateForUser(ctx, u.ID, model.TokenPurposeVerifyEmail)
+	if invalidateErr != nil {
+		return fmt.Errorf("service: invalidate verification tokens: %w", invalidateErr)
+	}
+
+	raw, issueErr := s.issueToken(ctx, &model.UserToken{UId: u.ID, Purpose: model.TokenPurposeVerifyEmail}, s.opts.VerificationTTL)
+	if issueErr != nil {
+		return issueErr
+	}
+
+	sendErr := s.mailer.Send(mailer.Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm your email address by opening this link:\n\n%s\n\nThe link expires in %s.\n",
+			u.Username, s.link(s.opts.BaseURL+"/api/verify-email", raw), s.opts.VerificationTTL),
+	})
+	if sendErr != nil {
+		return fmt.Errorf("service: send verification mail: %w", sendErr)
+	}
+	return nil
+}
+
+// VerifyEmail consumes a verification token and marks the address verified.
+func (s *AccountService) VerifyEmail(ctx context.Context, raw string) error {
+	t, consumeErr := s.tokenRepo.Consume(ctx, hashToken(raw), model.TokenPurposeVerifyEmail)
+	if consumeErr != nil {
+		if errors.Is(consumeErr, pgx.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("service: consume verification token: %w", consumeErr)
+	}
+
+	verifyErr := s.authRepo.MarkEmailVerified(ctx, t.UId)
+	if verifyErr != nil {
+		return fmt.Errorf("service: VerifyEmail failed: %w", verifyErr)
+	}
+	return nil
+}
+
+// ResendVerification mails a new link to an unverified account. Unknown and
+// already verified addresses are silently ignored, so the caller can't tell
+// which emails are registered.
+func (s *AccountService) ResendVerification(ctx context.Context, email string) error {
+	usr, fetchErr := s.authRepo.GetByEmail(ctx, email)
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	if usr.EmailVerifiedAt != nil {
+		return nil
+	}
+	return s.SendVerification(ctx, usr)
+}
+
+// RequestPasswordReset mails a reset link if the email belongs to an account.
+// Unknown emails are silently ignored.
+func (s *AccountService) RequestPasswordReset(ctx context.Context, email string) error {
+	usr, fetchErr := s.authRepo.GetByEmail(ctx, email)
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+
+	invalidateErr := s.tokenRepo.InvalidateForUser(ctx, usr.ID, model.TokenPurposeResetPassword)
+	if invalidateErr != nil {
+		return fmt.Errorf("service: invalidate reset tokens: %w", invalidateErr)
+	}
+	raw, issueErr := s.issueToken(ctx, &model.UserToken{UId: usr.ID, Purpose: model.TokenPurposeResetPassword}, s.opts.PasswordResetTTL)
+	if issueErr != nil {
+		return issueErr
+	}
+
+	sendErr := s.mailer.Send(mailer.Message{
+		To:      usr.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. To choose a new one, open this link:\n\n%s\n\nThe link expires in %s. If you didn't ask for this, you can ignore this mail.\n",
+			usr.Username, s.link(s.opts.PasswordResetURL, raw), s.opts.PasswordResetTTL),
+	})
+	if sendErr != nil {
+		return fmt.Errorf("service: send reset mail: %w", sendErr)
+	}
+	return nil
+}
+
+// QueuePasswordReset runs RequestPasswordReset in the background, so
+// neither the status nor the response time of the request reveals whether
+// the email is registered. Failures are only logged.
+func (s *AccountService) QueuePasswordReset(email string) {
+	s.queueMail("password reset", func(ctx context.Context) error {
+		return s.RequestPasswordReset(ctx, email)
+	})
+}
+
+// ResetPassword consumes a reset token, sets the new password and ends
+// every session of the account.
+func (s *AccountService) ResetPassword(ctx context.Context, raw, newPassword string) error {
+	t, consumeErr := s.tokenRepo.Consume(ctx, hashToken(raw), model.TokenPurposeResetPassword)
+	if consumeErr != nil {
+		if errors.Is(consumeErr, pgx.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("service: consume reset token: %w", consumeErr)
+	}
+
+	hashedPwd, hashErr := hashPassword(newPassword)
+	if hashErr != nil {
+		return fmt.Errorf("service: hash password: %w", hashErr)
+	}
+	updateErr := s.authRepo.UpdatePassword(ctx, t.UId, hashedPwd)
+	if updateErr != nil {
+		return fmt.Errorf("service: ResetPassword failed: %w", updateErr)
+	}
+
+	revokeErr := s.tokenSvc.RevokeAllSessions(ctx, t.UId)
+	if revokeErr != nil {
+		return fmt.Errorf("service: ResetPassword failed: %w", revokeErr)
+	}
+	return nil
+}
+
+// RequestLoginUnlock mails an unlock link if the email belongs to an account
+// that is locked after too many failed logins. Anything else is silently
+// ignored.
+func (s *AccountService) RequestLoginUnlock(ctx context.Context, email string) error {
+	locked, lockedErr := s.throttle.Locked(ctx, email)
+	if lockedErr != nil {
+		return lockedErr
+	}
+	if !locked {
+		return nil
+	}
+	usr, fetchErr := s.authRepo.GetByEmail(ctx, email)
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+
+	invalidateErr := s.tokenRepo.InvalidateForUser(ctx, usr.ID, model.TokenPurposeUnlockLogin)
+	if invalidateErr != nil {
+		return fmt.Errorf("service: invalidate unlock tokens: %w", invalidateErr)
+	}
+	raw, issueErr := s.issueToken(ctx, &model.UserToken{UId: usr.ID, Purpose: model.TokenPurposeUnlockLogin}, s.opts.UnlockTTL)
+	if issueErr != nil {
+		return issueErr
+	}
+
+	sendErr := s.mailer.Send(mailer.Message{
+		To:      usr.Email,
+		Subject: "Unlock your account",
+		Body: fmt.Sprintf("Hi %s,\n\nyour account was locked after too many failed login attempts. To unlock it now, open this link:\n\n%s\n\nThe link expires in %s. If the failed attempts weren't you, consider changing your password.\n",
+			usr.Username, s.link(s.opts.BaseURL+"/api/login/unlock/confirm", raw), s.opts.UnlockTTL),
+	})
+	if sendErr != nil {
+		return fmt.Errorf("service: send unlock mail: %w", sendErr)
+	}
+	return nil
+}
+
+// QueueLoginUnlock runs RequestLoginUnlock in the background, so the
+// response doesn't reveal whether the account is locked. Failures are only
+// logged.
+func (s *AccountService) QueueLoginUnlock(email string) {
+	s.queueMail("login unlock", func(ctx context.Context) error {
+		return s.RequestLoginUnlock(ctx, email)
+	})
+}
+
+// UnlockLogin consumes an unlock token and lifts the lockout of the account.
+func (s *AccountService) UnlockLogin(ctx context.Context, raw string) error {
+	t, consumeErr := s.tokenRepo.Consume(ctx, hashToken(raw), model.TokenPurposeUnlockLogin)
+	if consumeErr != nil {
+		if errors.Is(consumeErr, pgx.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("service: consume unlock token: %w", consumeErr)
+	}
+
+	usr, fetchErr := s.authRepo.GetByID(ctx, t.UId)
+	if fetchErr != nil {
+		return fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	return s.throttle.UnlockAccount(ctx, usr.Email)
+}
+
+// ChangePassword re-checks the current password, sets the new one and ends
+// every session of the account, including the caller's.
+func (s *AccountService) ChangePassword(ctx context.Context, userID int, currentPassword, newPassword string) error {
+	usr, authErr := s.reauthenticate(ctx, userID, currentPassword)
+	if authErr != nil {
+		return authErr
+	}
+
+	hashedPwd, hashErr := hashPassword(newPassword)
+	if hashErr != nil {
+		return fmt.Errorf("service: hash password: %w", hashErr)
+	}
+	updateErr := s.authRepo.UpdatePassword(ctx, usr.ID, hashedPwd)
+	if updateErr != nil {
+		return fmt.Errorf("service: ChangePassword failed: %w", updateErr)
+	}
+
+	revokeErr := s.tokenSvc.RevokeAllSessions(ctx, usr.ID)
+	if revokeErr != nil {
+		return fmt.Errorf("service: ChangePassword failed: %w", revokeErr)
+	}
+	return nil
+}
+
+// RequestEmailChange re-checks the password, then mails a confirmation link
+// to the new address and a heads-up to the current one. The email only
+// changes once the link is opened. If the new address already belongs to an
+// account, its owner is told instead and the caller sees the same result, so
+// the request can't be used to find out which emails are registered.
+func (s *AccountService) RequestEmailChange(ctx context.Context, userID int, password, newEmail string) error {
+	usr, authErr := s.reauthenticate(ctx, userID, password)
+	if authErr != nil {
+		return authErr
+	}
+
+	owner, lookupErr := s.authRepo.GetByEmail(ctx, newEmail)
+	if lookupErr == nil {
+		return s.sendEmailTakenNotice(owner)
+	}
+	if !errors.Is(lookupErr, pgx.ErrNoRows) {
+		return fmt.Errorf("service: user lookup: %w", lookupErr)
+	}
+
+	invalidateErr := s.tokenRepo.InvalidateForUser(ctx, usr.ID, model.TokenPurposeChangeEmail)
+	if invalidateErr != nil {
+		return fmt.Errorf("service: invalidate email change tokens: %w", invalidateErr)
+	}
+	raw, issueErr := s.issueToken(ctx, &model.UserToken{UId: usr.ID, Purpose: model.TokenPurposeChangeEmail, NewEmail: newEmail}, s.opts.EmailChangeTTL)
+	if issueErr != nil {
+		return issueErr
+	}
+
+	confirmErr := s.mailer.Send(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm your new email address by opening this link:\n\n%s\n\nThe link expires in %s.\n",
+			usr.Username, s.link(s.opts.BaseURL+"/api/email/confirm", raw), s.opts.EmailChangeTTL),
+	})
+	if confirmErr != nil {
+		return fmt.Errorf("service: send email change mail: %w", confirmErr)
+	}
+
+	noticeErr := s.mailer.Send(mailer.Message{
+		To:      usr.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to change the email address of your account to %s. It changes once the new address is confirmed.\n\nIf this wasn't you, reset your password right away.\n",
+			usr.Username, newEmail),
+	})
+	if noticeErr != nil {
+		return fmt.Errorf("service: send email change notice: %w", noticeErr)
+	}
+	return nil
+}
+
+// sendEmailTakenNotice tells the owner of an address that someone asked to
+// move another account to it
+func (s *AccountService) sendEmailTakenNotice(owner *model.User) error {
+	sendErr := s.mailer.Send(mailer.Message{
+		To:      owner.Email,
+		Subject: "Your email address was used in an email change",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to change the email address of an account to this one. It already belongs to your account, so nothing changed.\n\nIf this wasn't you, you can ignore this mail.\n",
+			owner.Username),
+	})
+	if sendErr != nil {
+		return fmt.Errorf("service: send email taken notice: %w", sendErr)
+	}
+	return nil
+}
+
+// ConfirmEmailChange consumes an email change token, switches the account to
+// the new address and ends every session of the account.
+func (s *AccountService) ConfirmEmailChange(ctx context.Context, raw string) error {
+	t, consumeErr := s.tokenRepo.Consume(ctx, hashToken(raw), model.TokenPurposeChangeEmail)
+	if consumeErr != nil {
+		if errors.Is(consumeErr, pgx.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("service: consume email change token: %w", consumeErr)
+	}
+
+	updateErr := s.authRepo.UpdateEmail(ctx, t.UId, t.NewEmail)
+	if updateErr != nil {
+		if errors.Is(updateErr, repo.ErrEmailTaken) {
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("service: ConfirmEmailChange failed: %w", updateErr)
+	}
+
+	revokeErr := s.tokenSvc.RevokeAllSessions(ctx, t.UId)
+	if revokeErr != nil {
+		return fmt.Errorf("service: ConfirmEmailChange failed: %w", revokeErr)
+	}
+	return nil
+}
+
+// reauthenticate loads the user and checks their password, throttled like
+// logins
+func (s *AccountService) reauthenticate(ctx context.Context, userID int, password string) (*model.User, error) {
+	usr, fetchErr := s.authRepo.GetByID(ctx, userID)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	pwdErr := confirmPassword(ctx, s.throttle, usr, password)
+	if pwdErr != nil {
+		return nil, pwdErr
+	}
+	return usr, nil
+}
+
+// issueToken stores the hash of a new single-use token, filling in t, and
+// returns the raw value
+func (s *AccountService) issueToken(ctx context.Context, t *model.UserToken, ttl time.Duration) (string, error) {
+	raw, rawErr := randomToken()
+	if rawErr != nil {
+		return "", fmt.Errorf("service: generate %s token: %w", t.Purpose, rawErr)
+	}
+	t.TokenHash = hashToken(raw)
+	t.ExpiresAt = time.Now().Add(ttl)
+	createErr := s.tokenRepo.Create(ctx, t)
+	if createErr != nil {
+		return "", fmt.Errorf("service: store %s token: %w", t.Purpose, createErr)
+	}
+	return raw, nil
+}
+
+// link appends the token to base as a query parameter
+func (s *AccountService) link(base, token string) string {
+	return base + "?token=" + url.QueryEscape(token)
+}
+
+// queueMail queues a mail flow for the workers. A full or stopped queue
+// drops it with a log line.
+func (s *AccountService) queueMail(name string, run func(ctx context.Context) error) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.queueClosed {
+		log.Printf("mail stopped: %s isn't sent", name)
+		return
+	}
+	s.mailing.Add(1)
+	select {
+	case s.mailQueue <- mailJob{name: name, run: run}:
+	default:
+		s.mailing.Done()
+		log.Printf("mail queue full: %s isn't sent", name)
+	}
+}
+
+// mailWorker runs the queued mail flows until the queue is closed
+func (s *AccountService) mailWorker() {
+	defer s.workers.Done()
+	for job := range s.mailQueue {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		if runErr := job.run(ctx); runErr != nil {
+			log.Printf("%s failed: %v", job.name, runErr)
+		}
+		cancel()
+		s.mailing.Done()
+	}
+}
+
+// WaitMail waits until the queued mail flows are done
+func (s *AccountService) WaitMail() {
+	s.mailing.Wait()
+}
+
+// StopMail stops taking mail flows and waits until the queued ones are
+// done, or ctx ends. Call it on shutdown, once no more requests come in.
+func (s *AccountService) StopMail(ctx context.Context) error {
+	s.queueMu.Lock()
+	if !s.queueClosed {
+		s.queueClosed = true
+		close(s.mailQueue)
+	}
+	s.queueMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("service: %d mails left to send: %w", len(s.mailQueue), ctx.Err())
+	}
+}
@@ -0,0 +1,206 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"server/internal/mailer"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"testing"
+	"time"
+)
+
+// accountEnv is an AccountService on a memory DB, with the mail it sends
+type accountEnv struct {
+	svc   *service.AccountService
+	auth  *service.AuthService
+	users service.UserStore
+	mail  *mailer.MemoryMailer
+}
+
+func newAccountService(t *testing.T, opts service.AccountOptions) accountEnv {
+	t.Helper()
+	db := memory.New()
+	users := memory.NewAuthRepo(db)
+	throttle := service.NewLoginThrottle(memory.NewLoginFailureRepo(db), service.LockoutPolicy{MaxFailures: 3, LockoutDuration: time.Minute, FailureWindow: time.Hour})
+	tokens := service.NewTokenService(memory.NewRefreshTokenRepo(db), nil, time.Hour, time.Minute)
+	mail := mailer.NewMemoryMailer()
+	opts.BaseURL = "https://auth.example.com"
+	svc := service.NewAccountService(users, memory.NewUserTokenRepo(db), tokens, throttle, mail, opts)
+	t.Cleanup(func() { _ = svc.StopMail(context.Background()) })
+	return accountEnv{svc: svc, auth: service.NewAuthService(users, throttle, false), users: users, mail: mail}
+}
+
+// register signs up ada and sends the verification mail, as the handler does
+func (env accountEnv) register(t *testing.T) *model.User {
+	t.Helper()
+	ctx := context.Background()
+	u, registerErr := env.auth.Register(ctx, "ada", "ada@example.com", "correct horse")
+	if registerErr != nil {
+		t.Fatalf("Register = %v", registerErr)
+	}
+	if err := env.svc.SendVerification(ctx, u); err != nil {
+		t.Fatalf("SendVerification = %v", err)
+	}
+	return u
+}
+
+var mailedLink = regexp.MustCompile(`https://\S+\?token=(\S+)`)
+
+// lastToken returns the token in the link of the latest mail, after
+// checking it went to to
+func (env accountEnv) lastToken(t *testing.T, to string) string {
+	t.Helper()
+	sent := env.mail.Sent()
+	if len(sent) == 0 {
+		t.Fatal("no mail sent")
+	}
+	msg := sent[len(sent)-1]
+	if msg.To != to {
+		t.Fatalf("mail went to %q, want %q", msg.To, to)
+	}
+	m := mailedLink.FindStringSubmatch(msg.Body)
+	if m == nil {
+		t.Fatalf("no link in %q", msg.Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatalf("link token %q: %v", m[1], err)
+	}
+	return token
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+	env := newAccountService(t, service.AccountOptions{VerificationTTL: time.Hour})
+	u := env.register(t)
+	token := env.lastToken(t, "ada@example.com")
+
+	if err := env.svc.VerifyEmail(ctx, "not-"+token); !errors.Is(err, service.ErrInvalidToken) {
+		t.Fatalf("VerifyEmail of a wrong token = %v, want ErrInvalidToken", err)
+	}
+	if err := env.svc.VerifyEmail(ctx, token); err != nil {
+		t.Fatalf("VerifyEmail = %v", err)
+	}
+	if got, _ := env.users.GetByID(ctx, u.ID); got.EmailVerifiedAt == nil {
+		t.Fatal("email isn't verified")
+	}
+	if err := env.svc.VerifyEmail(ctx, token); !errors.Is(err, service.ErrInvalidToken) {
+		t.Fatalf("second VerifyEmail = %v, want ErrInvalidToken", err)
+	}
+
+	// a verified address gets no more mail
+	if err := env.svc.ResendVerification(ctx, "ada@example.com"); err != nil {
+		t.Fatalf("ResendVerification = %v", err)
+	}
+	if n := len(env.mail.Sent()); n != 1 {
+		t.Fatalf("%d mails sent, want only the first", n)
+	}
+}
+
+func TestVerificationExpires(t *testing.T) {
+	env := newAccountService(t, service.AccountOptions{VerificationTTL: 50 * time.Millisecond})
+	env.register(t)
+	token := env.lastToken(t, "ada@example.com")
+
+	time.Sleep(100 * time.Millisecond)
+	if err := env.svc.VerifyEmail(context.Background(), token); !errors.Is(err, service.ErrInvalidToken) {
+		t.Fatalf("VerifyEmail of an expired token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestResendVerificationInvalidatesOldLink(t *testing.T) {
+	ctx := context.Background()
+	env := newAccountService(t, service.AccountOptions{VerificationTTL: time.Hour})
+	env.register(t)
+	first := env.lastToken(t, "ada@example.com")
+
+	if err := env.svc.ResendVerification(ctx, "ada@example.com"); err != nil {
+		t.Fatalf("ResendVerification = %v", err)
+	}
+	second := env.lastToken(t, "ada@example.com")
+	if second == first {
+		t.Fatal("resend mailed the same token")
+	}
+	if err := env.svc.VerifyEmail(ctx, first); !errors.Is(err, service.ErrInvalidToken) {
+		t.Fatalf("VerifyEmail of the old token = %v, want ErrInvalidToken", err)
+	}
+	if err := env.svc.VerifyEmail(ctx, second); err != nil {
+		t.Fatalf("VerifyEmail of the new token = %v", err)
+	}
+
+	// unknown addresses are ignored without mail
+	if err := env.svc.ResendVerification(ctx, "nobody@example.com"); err != nil {
+		t.Fatalf("ResendVerification of an unknown email = %v", err)
+	}
+	if n := len(env.mail.Sent()); n != 2 {
+		t.Fatalf("%d mails sent, want 2", n)
+	}
+}
+
+func TestQueuePasswordReset(t *testing.T) {
+	ctx := context.Background()
+	env := newAccountService(t, service.AccountOptions{VerificationTTL: time.Hour, PasswordResetURL: "https://app.example.com/reset", PasswordResetTTL: time.Hour})
+	env.register(t)
+
+	env.svc.QueuePasswordReset("ada@example.com")
+	env.svc.QueuePasswordReset("nobody@example.com")
+	env.svc.WaitMail()
+	sent := env.mail.Sent()
+	if len(sent) != 2 || sent[1].Subject != "Reset your password" {
+		t.Fatalf("sent %+v, want the verification and one reset mail", sent)
+	}
+	env.lastToken(t, "ada@example.com")
+
+	// on shutdown the queue is worked off, later requests are dropped
+	if err := env.svc.StopMail(ctx); err != nil {
+		t.Fatalf("StopMail = %v", err)
+	}
+	env.svc.QueuePasswordReset("ada@example.com")
+	env.svc.WaitMail()
+	if n := len(env.mail.Sent()); n != 2 {
+		t.Fatalf("%d mails sent after StopMail, want 2", n)
+	}
+}
+
+func TestRequestEmailChangeThrottlesPasswords(t *testing.T) {
+	ctx := context.Background()
+	env := newAccountService(t, service.AccountOptions{VerificationTTL: time.Hour, EmailChangeTTL: time.Hour})
+	u := env.register(t)
+
+	// a right password resets the count
+	for i := 0; i < 2; i++ {
+		if err := env.svc.RequestEmailChange(ctx, u.ID, "wrong", "ada@example.org"); !errors.Is(err, service.ErrInvalidCredentials) {
+			t.Fatalf("RequestEmailChange with a wrong password = %v, want ErrInvalidCredentials", err)
+		}
+	}
+	if err := env.svc.RequestEmailChange(ctx, u.ID, "correct horse", "ada@example.org"); err != nil {
+		t.Fatalf("RequestEmailChange = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := env.svc.RequestEmailChange(ctx, u.ID, "wrong", "ada@example.org"); !errors.Is(err, service.ErrInvalidCredentials) {
+			t.Fatalf("attempt %d = %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+	sent := len(env.mail.Sent())
+	var blocked *service.LoginBlockedError
+	err := env.svc.RequestEmailChange(ctx, u.ID, "correct horse", "ada@example.org")
+	if !errors.As(err, &blocked) || !errors.Is(err, service.ErrAccountLocked) || blocked.RetryAfter <= 0 {
+		t.Fatalf("RequestEmailChange when locked = %v, want ErrAccountLocked", err)
+	}
+	if err := env.svc.ChangePassword(ctx, u.ID, "correct horse", "battery staple"); !errors.Is(err, service.ErrAccountLocked) {
+		t.Fatalf("ChangePassword when locked = %v, want ErrAccountLocked", err)
+	}
+	if n := len(env.mail.Sent()); n != sent {
+		t.Fatalf("%d mails sent while locked", n-sent)
+	}
+
+	// a stolen session can't lock the owner out of logging in
+	if _, err := env.auth.Login(ctx, "ada@example.com", "correct horse", "192.0.2.1"); err != nil {
+		t.Fatalf("Login = %v", err)
+	}
+}
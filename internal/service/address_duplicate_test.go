@@ -0,0 +1,115 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"testing"
+)
+
+func newAddressService(t *testing.T) (*service.AddressService, *model.User) {
+	t.Helper()
+	db := memory.New()
+	u := &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: "hash"}
+	if err := memory.NewAuthRepo(db).CreateUser(context.Background(), u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	return service.NewAddressService(memory.NewAddressRepo(db), memory.NewTxManager(db), service.AddressOptions{}), u
+}
+
+func TestCreateAddressRefusesDuplicates(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newAddressService(t)
+
+	first := &model.Address{Addr_1: "Hauptstraße 5", Zip: "10115", City: "Berlin", Country: "DE"}
+	if err := svc.CreateAddress(ctx, u.ID, first, false); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+
+	again := &model.Address{Addr_1: "hauptstr. 5", Zip: "10115", City: "BERLIN", Country: "DE", Label: "Office"}
+	err := svc.CreateAddress(ctx, u.ID, again, false)
+	var duplicate *service.DuplicateAddressError
+	if !errors.As(err, &duplicate) || !errors.Is(err, service.ErrDuplicateAddress) {
+		t.Fatalf("CreateAddress of a duplicate = %v, want a DuplicateAddressError", err)
+	}
+	if duplicate.ExistingID != first.ID {
+		t.Fatalf("ExistingID = %d, want %d", duplicate.ExistingID, first.ID)
+	}
+
+	// another type, another street number or force are no duplicates
+	billing := &model.Address{Addr_1: "Hauptstraße 5", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressBilling}
+	if err := svc.CreateAddress(ctx, u.ID, billing, false); err != nil {
+		t.Fatalf("CreateAddress of the billing address = %v", err)
+	}
+	neighbour := &model.Address{Addr_1: "Hauptstraße 55", Zip: "10115", City: "Berlin", Country: "DE"}
+	if err := svc.CreateAddress(ctx, u.ID, neighbour, false); err != nil {
+		t.Fatalf("CreateAddress of Hauptstraße 55 = %v", err)
+	}
+	if err := svc.CreateAddress(ctx, u.ID, again, true); err != nil {
+		t.Fatalf("CreateAddress with force = %v", err)
+	}
+	if again.ID == 0 || again.ID == first.ID {
+		t.Fatalf("forced duplicate has ID %d, want a new address", again.ID)
+	}
+
+	// a deleted address doesn't count
+	other := &model.Address{Addr_1: "Invalidenstraße 1", Zip: "10115", City: "Berlin", Country: "DE"}
+	if err := svc.CreateAddress(ctx, u.ID, other, false); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+	if err := svc.DeleteAddress(ctx, u.ID, other.ID, 0, 0); err != nil {
+		t.Fatalf("DeleteAddress = %v", err)
+	}
+	if err := svc.CreateAddress(ctx, u.ID, &model.Address{Addr_1: "Invalidenstr. 1", Zip: "10115", City: "Berlin", Country: "DE"}, false); err != nil {
+		t.Fatalf("CreateAddress after delete = %v", err)
+	}
+}
+
+func TestFindDuplicatesOfImport(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newAddressService(t)
+
+	existing := &model.Address{Addr_1: "Hauptstraße 5", Zip: "10115", City: "Berlin", Country: "DE"}
+	if err := svc.CreateAddress(ctx, u.ID, existing, false); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+
+	rows := []*model.Address{
+		{Addr_1: "Haupt Str. 5", Zip: "10115", City: "Berlin", Country: "DE"},
+		{Addr_1: "Main St 1", Zip: "10001", City: "New York", State: "NY", Country: "US"},
+		{Addr_1: "main street 1", Zip: "10001", City: "new york", State: "NY", Country: "US"},
+		{Addr_1: "Main St 1", Zip: "10001", City: "New York", State: "NY", Country: "US", Type: model.AddressBilling},
+		{Addr_1: "Main St 2", Zip: "10001", City: "New York", State: "NY", Country: "US"},
+	}
+	dups, err := svc.FindDuplicates(ctx, u.ID, rows)
+	if err != nil {
+		t.Fatalf("FindDuplicates = %v", err)
+	}
+	want := []service.ImportDuplicate{
+		{ExistingID: existing.ID},
+		{},
+		{Row: 2},
+		{},
+		{},
+	}
+	for i := range want {
+		if dups[i] != want[i] {
+			t.Errorf("row %d: FindDuplicates = %+v, want %+v", i+1, dups[i], want[i])
+		}
+	}
+
+	// without force the import refuses the duplicate, with force it takes all rows
+	importErr := svc.ImportAddresses(ctx, u.ID, rows[:2], false)
+	if !errors.Is(importErr, service.ErrDuplicateAddress) {
+		t.Fatalf("ImportAddresses = %v, want ErrDuplicateAddress", importErr)
+	}
+	if err := svc.ImportAddresses(ctx, u.ID, rows, true); err != nil {
+		t.Fatalf("ImportAddresses with force = %v", err)
+	}
+	all, _ := svc.ExportAddresses(ctx, u.ID)
+	if len(all) != 1+len(rows) {
+		t.Fatalf("%d addresses after the forced import, want %d", len(all), 1+len(rows))
+	}
+}
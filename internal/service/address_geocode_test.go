@@ -0,0 +1,146 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"server/internal/geocode"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"strings"
+	"testing"
+)
+
+// The geocoding tests use the offline geocoder with this dataset, in the
+// GeoNames postal code format
+const testPostalCodes = "DE\t10115\tBerlin\tBerlin\tBE\t\t00\tBerlin, Stadt\t11000\t52.5323\t13.3846\t4\n" +
+	"DE\t10117\tBerlin\tBerlin\tBE\t\t00\tBerlin, Stadt\t11000\t52.517\t13.3872\t4\n" +
+	"DE\t80331\tMünchen\tBayern\tBY\tOberbayern\t091\tMünchen, Kreisfreie Stadt\t09162\t48.1372\t11.5755\t4\n" +
+	"US\t10001\tNew York\tNew York\tNY\tNew York\t061\t\t\t40.7484\t-73.9967\t4\n" +
+	"AE\t\tDubai\tDubai\tDU\t\t\t\t\t25.0657\t55.1713\t4\n"
+
+func newGeocodedService(t *testing.T) (*service.AddressService, *model.User) {
+	t.Helper()
+	offline, loadErr := geocode.NewOffline(strings.NewReader(testPostalCodes))
+	if loadErr != nil {
+		t.Fatalf("NewOffline = %v", loadErr)
+	}
+	db := memory.New()
+	u := &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: "hash"}
+	if err := memory.NewAuthRepo(db).CreateUser(context.Background(), u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	svc := service.NewAddressService(memory.NewAddressRepo(db), memory.NewTxManager(db), service.AddressOptions{Geocoder: offline})
+	return svc, u
+}
+
+func TestAddressesAreGeocodedAfterChanges(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newGeocodedService(t)
+
+	a := &model.Address{Addr_1: "Invalidenstraße 1", Zip: "10115", City: "Berlin", Country: "DE"}
+	if err := svc.CreateAddress(ctx, u.ID, a, false); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+	svc.WaitGeocoding()
+	got, _ := svc.GetAddress(ctx, u.ID, a.ID)
+	if got.Lat == nil || *got.Lat != 52.5323 || got.Lng == nil || *got.Lng != 13.3846 || !got.Verified {
+		t.Fatalf("location after create = %v, %v, %v", got.Lat, got.Lng, got.Verified)
+	}
+
+	// moving the address locates it again; the postal code isn't in that city
+	zip, city := "80331", "Berlin"
+	if _, err := svc.UpdateAddress(ctx, u.ID, a.ID, 0, model.AddressPatch{Zip: &zip, City: &city}); err != nil {
+		t.Fatalf("UpdateAddress = %v", err)
+	}
+	svc.WaitGeocoding()
+	got, _ = svc.GetAddress(ctx, u.ID, a.ID)
+	if got.Lat == nil || *got.Lat != 48.1372 || got.Verified {
+		t.Fatalf("location after move = %v, %v, want unverified 48.1372", got.Lat, got.Verified)
+	}
+
+	// other changes keep the location
+	label := "Home"
+	updated, err := svc.UpdateAddress(ctx, u.ID, a.ID, 0, model.AddressPatch{Label: &label})
+	if err != nil || updated.Lat == nil || *updated.Lat != 48.1372 {
+		t.Fatalf("UpdateAddress of label = %+v, %v, want the location kept", updated, err)
+	}
+
+	// an unknown postal code leaves the address without a location
+	zip = "99999"
+	if _, err := svc.UpdateAddress(ctx, u.ID, a.ID, 0, model.AddressPatch{Zip: &zip}); err != nil {
+		t.Fatalf("UpdateAddress = %v", err)
+	}
+	svc.WaitGeocoding()
+	got, _ = svc.GetAddress(ctx, u.ID, a.ID)
+	if got.Lat != nil || got.Verified {
+		t.Fatalf("location of unknown postal code = %v, %v", got.Lat, got.Verified)
+	}
+
+	// countries without postal codes are located by city
+	dubai := &model.Address{Addr_1: "Sheikh Zayed Road 1", City: "Dubai", Country: "AE"}
+	if err := svc.ImportAddresses(ctx, u.ID, []*model.Address{dubai}, false); err != nil {
+		t.Fatalf("ImportAddresses = %v", err)
+	}
+	svc.WaitGeocoding()
+	got, _ = svc.GetAddress(ctx, u.ID, dubai.ID)
+	if got.Lat == nil || *got.Lat != 25.0657 || !got.Verified {
+		t.Fatalf("location after import = %v, %v", got.Lat, got.Verified)
+	}
+
+	// once stopped, addresses are still created but not located
+	if err := svc.StopGeocoding(ctx); err != nil {
+		t.Fatalf("StopGeocoding = %v", err)
+	}
+	late := &model.Address{Addr_1: "Invalidenstraße 2", Zip: "10115", City: "Berlin", Country: "DE"}
+	if err := svc.CreateAddress(ctx, u.ID, late, false); err != nil {
+		t.Fatalf("CreateAddress after StopGeocoding = %v", err)
+	}
+	svc.WaitGeocoding()
+	if got, _ = svc.GetAddress(ctx, u.ID, late.ID); got.Lat != nil {
+		t.Fatalf("address created after StopGeocoding was located")
+	}
+}
+
+func TestSuggestAddresses(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newGeocodedService(t)
+
+	tests := []struct {
+		q, country string
+		limit      int
+		want       []string
+	}{
+		{"101", "", 10, []string{"10115 Berlin", "10117 Berlin"}},
+		{"101", "", 1, []string{"10115 Berlin"}},
+		{"100", "", 10, []string{"10001 New York"}},
+		{"100", "DE", 10, []string{}},
+		{"munch", "", 10, []string{"80331 München"}},
+		{"MÜNCHEN", "DE", 10, []string{"80331 München"}},
+		{"new y", "", 10, []string{"10001 New York"}},
+		{"paris", "", 10, []string{}},
+	}
+	for _, tc := range tests {
+		suggestions, err := svc.SuggestAddresses(ctx, tc.q, tc.country, tc.limit)
+		if err != nil {
+			t.Fatalf("SuggestAddresses(%q) = %v", tc.q, err)
+		}
+		got := []string{}
+		for _, s := range suggestions {
+			got = append(got, s.Zip+" "+s.City)
+		}
+		if strings.Join(got, ", ") != strings.Join(tc.want, ", ") {
+			t.Errorf("SuggestAddresses(%q, %q, %d) = %v, want %v", tc.q, tc.country, tc.limit, got, tc.want)
+		}
+	}
+
+	suggestions, _ := svc.SuggestAddresses(ctx, "10001", "US", 1)
+	if len(suggestions) != 1 || suggestions[0].State != "NY" || suggestions[0].Country != "US" {
+		t.Fatalf("suggestion for 10001 = %+v, want state NY in US", suggestions)
+	}
+
+	noGeocoder := service.NewAddressService(memory.NewAddressRepo(memory.New()), memory.NewTxManager(memory.New()), service.AddressOptions{})
+	if _, err := noGeocoder.SuggestAddresses(ctx, "101", "", 10); !errors.Is(err, service.ErrGeocodingDisabled) {
+		t.Fatalf("SuggestAddresses without geocoder = %v, want ErrGeocodingDisabled", err)
+	}
+}
@@ -0,0 +1,97 @@
+package service_test
+
+import (
+	"context"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"testing"
+	"time"
+)
+
+// historyOf returns the recorded versions of an address and whether each
+// of them was the default, newest first
+func historyOf(t *testing.T, svc *service.AddressService, userID, id int) (versions []int, defaults []bool) {
+	t.Helper()
+	history, err := svc.AddressHistory(context.Background(), userID, id)
+	if err != nil {
+		t.Fatalf("AddressHistory(%d) = %v", id, err)
+	}
+	for _, v := range history {
+		versions = append(versions, v.Version)
+		defaults = append(defaults, v.IsDefault)
+	}
+	return versions, defaults
+}
+
+func TestAddressHistoryRecordsEveryChange(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	u := &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: "hash"}
+	if err := memory.NewAuthRepo(db).CreateUser(ctx, u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	svc := service.NewAddressService(memory.NewAddressRepo(db), memory.NewTxManager(db), service.AddressOptions{RestoreWindow: time.Hour})
+
+	home := &model.Address{Addr_1: "Hauptstraße 5", Zip: "10115", City: "Berlin", Country: "DE", IsDefault: true}
+	if err := svc.CreateAddress(ctx, u.ID, home, false); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+
+	// a new default clears the old one
+	office := &model.Address{Addr_1: "Invalidenstraße 1", Zip: "10115", City: "Berlin", Country: "DE", IsDefault: true}
+	if err := svc.CreateAddress(ctx, u.ID, office, false); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+	if versions, defaults := historyOf(t, svc, u.ID, home.ID); !equalIDs(versions, []int{1}) || !defaults[0] {
+		t.Fatalf("home after a new default: versions %v, defaults %v, want version 1 as the default", versions, defaults)
+	}
+
+	// set default records both addresses
+	if _, err := svc.SetDefaultAddress(ctx, u.ID, home.ID); err != nil {
+		t.Fatalf("SetDefaultAddress = %v", err)
+	}
+	if versions, _ := historyOf(t, svc, u.ID, home.ID); !equalIDs(versions, []int{2, 1}) {
+		t.Fatalf("home after SetDefaultAddress: versions %v, want [2 1]", versions)
+	}
+	if versions, defaults := historyOf(t, svc, u.ID, office.ID); !equalIDs(versions, []int{1}) || !defaults[0] {
+		t.Fatalf("office after SetDefaultAddress: versions %v, defaults %v, want version 1 as the default", versions, defaults)
+	}
+
+	// a patch that takes the default clears the old one
+	makeDefault := true
+	if _, err := svc.UpdateAddress(ctx, u.ID, office.ID, 0, model.AddressPatch{IsDefault: &makeDefault}); err != nil {
+		t.Fatalf("UpdateAddress = %v", err)
+	}
+	if versions, _ := historyOf(t, svc, u.ID, home.ID); !equalIDs(versions, []int{3, 2, 1}) {
+		t.Fatalf("home after the patch: versions %v, want [3 2 1]", versions)
+	}
+	if versions, _ := historyOf(t, svc, u.ID, office.ID); !equalIDs(versions, []int{2, 1}) {
+		t.Fatalf("office after the patch: versions %v, want [2 1]", versions)
+	}
+
+	// deleting and restoring are recorded
+	if err := svc.DeleteAddress(ctx, u.ID, home.ID, 0, 0); err != nil {
+		t.Fatalf("DeleteAddress = %v", err)
+	}
+	if _, err := svc.RestoreAddress(ctx, u.ID, home.ID); err != nil {
+		t.Fatalf("RestoreAddress = %v", err)
+	}
+	if versions, _ := historyOf(t, svc, u.ID, home.ID); !equalIDs(versions, []int{5, 4, 3, 2, 1}) {
+		t.Fatalf("home after delete and restore: versions %v, want [5 4 3 2 1]", versions)
+	}
+
+	// so is deleting a default with a promotion, for both addresses
+	if err := svc.DeleteAddress(ctx, u.ID, office.ID, 0, home.ID); err != nil {
+		t.Fatalf("DeleteAddress with promote = %v", err)
+	}
+	if versions, defaults := historyOf(t, svc, u.ID, home.ID); !equalIDs(versions, []int{6, 5, 4, 3, 2, 1}) || defaults[0] {
+		t.Fatalf("home after the promotion: versions %v, defaults %v, want version 6 not the default", versions, defaults)
+	}
+	if _, err := svc.RestoreAddress(ctx, u.ID, office.ID); err != nil {
+		t.Fatalf("RestoreAddress = %v", err)
+	}
+	if versions, defaults := historyOf(t, svc, u.ID, office.ID); !equalIDs(versions, []int{4, 3, 2, 1}) || !defaults[1] {
+		t.Fatalf("office after delete and restore: versions %v, defaults %v, want [4 3 2 1] with 3 the default", versions, defaults)
+	}
+}
@@ -1,43 +1,360 @@
 package service
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"server/internal/addressrules"
 	"server/internal/model"
 	"server/internal/repo"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
 )
 
 var ErrForbidden = errors.New("not allowed to access this resource")
 var ErrCannotDeleteDefault = errors.New("cannot delete default address")
+var ErrInvalidPromotion = errors.New("service: address to promote must be another address of the user with the same type")
+var ErrAddressNotFound = errors.New("service: address not found")
+var ErrNoDefaultAddress = errors.New("service: no default address")
+var ErrVersionMismatch = errors.New("service: address was changed by another request")
+var ErrInvalidCursor = errors.New("service: invalid cursor")
+var ErrRestoreExpired = errors.New("service: address was deleted too long ago to restore")
+var ErrDefaultAddressConflict = errors.New("service: default address changed concurrently, retry the request")
+var ErrAddressChanged = errors.New("service: address changed concurrently, retry the request")
+var ErrDuplicateAddress = errors.New("service: the user already has this address")
+var ErrGeocodingDisabled = errors.New("service: no geocoder configured")
+
+// DuplicateAddressError is returned by CreateAddress when the user already
+// has an address of the same type at the same place; see
+// addressrules.Fingerprint. It unwraps to ErrDuplicateAddress.
+type DuplicateAddressError struct {
+	ExistingID int
+}
+
+func (e *DuplicateAddressError) Error() string {
+	return fmt.Sprintf("service: duplicate of address %d", e.ExistingID)
+}
+
+func (e *DuplicateAddressError) Unwrap() error {
+	return ErrDuplicateAddress
+}
+
+// geocodeTimeout bounds the background geocoding of one address
+const geocodeTimeout = 30 * time.Second
+
+const (
+	// geocodeWorkers locate the addresses of the geocoding queue, one at a
+	// time each; the geocoder may space out their requests further
+	geocodeWorkers = 2
+	// geocodeQueueSize is how many addresses can wait to be located; more
+	// are left without a location
+	geocodeQueueSize = 10000
+)
+
+// Geocoder locates addresses and completes partly typed ones. It must be
+// safe for concurrent use.
+type Geocoder interface {
+	// Geocode locates a; found is false when the geocoder doesn't know where it is
+	Geocode(ctx context.Context, a model.Address) (loc model.Location, found bool, err error)
+	// Suggest returns up to limit addresses that begin like q, in country
+	// unless that is empty
+	Suggest(ctx context.Context, q, country string, limit int) ([]model.AddressSuggestion, error)
+}
+
+// AddressOptions configures what happens to deleted addresses, and geocoding
+type AddressOptions struct {
+	// RestoreWindow is how long a deleted address can be restored
+	RestoreWindow time.Duration
+	// Retention is how long a deleted address is kept before it is purged
+	Retention time.Duration
+	// Geocoder locates addresses after they change and suggests addresses;
+	// nil turns both off
+	Geocoder Geocoder
+}
 
 type AddressService struct {
-	addrRepo *repo.AddressRepo
+	addrRepo AddressStore
+	txm      Transactor
+	opts     AddressOptions
+	// geocodeQueue feeds the geocoding workers; it is closed by
+	// StopGeocoding, under queueMu
+	geocodeQueue chan model.Address
+	queueMu      sync.Mutex
+	queueClosed  bool
+	// geocoding counts the queued addresses, workers the running workers
+	geocoding sync.WaitGroup
+	workers   sync.WaitGroup
 }
 
 
-func NewAddressService(addrRepo *repo.AddressRepo) *AddressService {
-	return &AddressService{addrRepo: addrRepo}
+func NewAddressService(addrRepo AddressStore, txm Transactor, opts AddressOptions) *AddressService {
+	s := &AddressService{addrRepo: addrRepo, txm: txm, opts: opts}
+	if opts.Geocoder != nil {
+		s.geocodeQueue = make(chan model.Address, geocodeQueueSize)
+		for i := 0; i < geocodeWorkers; i++ {
+			s.workers.Add(1)
+			go s.geocodeWorker()
+		}
+	}
+	return s
 }
 
-func (s *AddressService) CreateAddress(userID int, a *model.Address) error {
+// CreateAddress stores a new address of the user, a shipping address unless
+// a.Type says otherwise. Unless force is set, it fails with a
+// DuplicateAddressError if the user has a near-duplicate of it. Clearing the
+// old default of its type and inserting the new one happen in one
+// transaction.
+// The address is located in the background afterwards.
+func (s *AddressService) CreateAddress(ctx context.Context, userID int, a *model.Address, force bool) error {
+	createErr := s.createAddress(ctx, userID, a, force)
+	if createErr != nil {
+		return createErr
+	}
+	s.locate(*a)
+	return nil
+}
+
+func (s *AddressService) createAddress(ctx context.Context, userID int, a *model.Address, force bool) error {
   a.UId = userID
-	if a.IsDefault {
-		clearAccErr := s.addrRepo.ClearDefaultForUser(a.UId)
-    if clearAccErr != nil {
-      return fmt.Errorf("service: clearing previous defaults: %w", clearAccErr)
-    }
-  }
+	if a.Type == "" {
+		a.Type = model.AddressShipping
+	}
+	a.Fingerprint = fingerprint(*a)
+	txErr := s.txm.WithinTx(ctx, func(ctx context.Context) error {
+		if !force {
+			existing, findErr := s.addrRepo.FindByFingerprint(ctx, userID, a.Type, a.Fingerprint)
+			if findErr == nil {
+				return &DuplicateAddressError{ExistingID: existing.ID}
+			}
+			if !errors.Is(findErr, pgx.ErrNoRows) {
+				return fmt.Errorf("service: looking for duplicates: %w", findErr)
+			}
+		}
 
-	createAccErr := s.addrRepo.CreateAddress(a)
-  if createAccErr != nil {
-    return fmt.Errorf("service: CreateAddress failed: %w", createAccErr)
-  }
-  return nil
+		if a.IsDefault {
+			clearAccErr := s.clearDefault(ctx, a.UId, a.Type)
+			if clearAccErr != nil {
+				return clearAccErr
+			}
+		}
+
+		createAccErr := s.addrRepo.CreateAddress(ctx, a)
+		if createAccErr != nil {
+			return fmt.Errorf("service: CreateAddress failed: %w", createAccErr)
+		}
+		return nil
+	})
+	return defaultConflict(txErr)
+}
+
+// ImportAddresses stores new addresses of the user all-or-nothing: if one
+// can't be created, none are. They are created in order, like with
+// CreateAddress, so a default one replaces the previous default of its type
+// and, unless force is set, a duplicate fails the import.
+func (s *AddressService) ImportAddresses(ctx context.Context, userID int, addrs []*model.Address, force bool) error {
+	txErr := s.txm.WithinTx(ctx, func(ctx context.Context) error {
+		for i, a := range addrs {
+			if createErr := s.createAddress(ctx, userID, a, force); createErr != nil {
+				return fmt.Errorf("service: import row %d: %w", i+1, createErr)
+			}
+		}
+		return nil
+	})
+	if txErr != nil {
+		return defaultConflict(txErr)
+	}
+	// once committed, the geocoder can store their locations
+	for _, a := range addrs {
+		s.locate(*a)
+	}
+	return nil
+}
+
+// ImportDuplicate says what an address to import duplicates: an address the
+// user has (ExistingID), or an earlier address of the import (Row, counted
+// from 1). Both are 0 for an address that isn't a duplicate.
+type ImportDuplicate struct {
+	ExistingID int
+	Row        int
+}
+
+// FindDuplicates looks for duplicates of addrs, an import for the user,
+// among the user's addresses and the earlier addrs of the same type
+func (s *AddressService) FindDuplicates(ctx context.Context, userID int, addrs []*model.Address) ([]ImportDuplicate, error) {
+	dups := make([]ImportDuplicate, len(addrs))
+	firstRow := map[[2]string]int{}
+	for i, a := range addrs {
+		addrType := a.Type
+		if addrType == "" {
+			addrType = model.AddressShipping
+		}
+		fp := fingerprint(*a)
+		existing, findErr := s.addrRepo.FindByFingerprint(ctx, userID, addrType, fp)
+		switch {
+		case findErr == nil:
+			dups[i].ExistingID = existing.ID
+		case !errors.Is(findErr, pgx.ErrNoRows):
+			return nil, fmt.Errorf("service: FindDuplicates failed: %w", findErr)
+		}
+
+		key := [2]string{addrType, fp}
+		if row, seen := firstRow[key]; seen {
+			dups[i].Row = row
+		} else {
+			firstRow[key] = i + 1
+		}
+	}
+	return dups, nil
+}
+
+// BackfillFingerprints gives the addresses stored without a fingerprint,
+// from before fingerprints or after they were reset, their fingerprint.
+// It returns how many addresses it updated.
+func (s *AddressService) BackfillFingerprints(ctx context.Context) (int, error) {
+	updated := 0
+	for {
+		addrs, listErr := s.addrRepo.ListWithoutFingerprint(ctx, 100)
+		if listErr != nil {
+			return updated, fmt.Errorf("service: BackfillFingerprints failed: %w", listErr)
+		}
+		for _, a := range addrs {
+			if setErr := s.addrRepo.SetFingerprint(ctx, a.ID, fingerprint(a)); setErr != nil {
+				return updated, fmt.Errorf("service: BackfillFingerprints failed: %w", setErr)
+			}
+			updated++
+		}
+		if len(addrs) < 100 {
+			return updated, nil
+		}
+	}
+}
+
+// SuggestAddresses completes the partly typed address q, within country
+// unless that is empty. It fails with ErrGeocodingDisabled without a
+// Geocoder.
+func (s *AddressService) SuggestAddresses(ctx context.Context, q, country string, limit int) ([]model.AddressSuggestion, error) {
+	if s.opts.Geocoder == nil {
+		return nil, ErrGeocodingDisabled
+	}
+	suggestions, suggestErr := s.opts.Geocoder.Suggest(ctx, q, country, limit)
+	if suggestErr != nil {
+		return nil, fmt.Errorf("service: SuggestAddresses failed: %w", suggestErr)
+	}
+	return suggestions, nil
+}
+
+// locate queues a to be geocoded in the background. Failures, and a full
+// queue, are only logged; the address stays without a location until its
+// next update.
+func (s *AddressService) locate(a model.Address) {
+	if s.opts.Geocoder == nil {
+		return
+	}
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.queueClosed {
+		log.Printf("geocoding stopped: address %d isn't located", a.ID)
+		return
+	}
+	s.geocoding.Add(1)
+	select {
+	case s.geocodeQueue <- a:
+	default:
+		s.geocoding.Done()
+		log.Printf("geocoding queue full: address %d isn't located", a.ID)
+	}
+}
+
+// geocodeWorker locates the queued addresses until the queue is closed
+func (s *AddressService) geocodeWorker() {
+	defer s.workers.Done()
+	for a := range s.geocodeQueue {
+		s.geocode(a)
+		s.geocoding.Done()
+	}
+}
+
+// geocode locates a and stores where it is, unless a moved in the meantime
+func (s *AddressService) geocode(a model.Address) {
+	ctx, cancel := context.WithTimeout(context.Background(), geocodeTimeout)
+	defer cancel()
+
+	loc, found, geocodeErr := s.opts.Geocoder.Geocode(ctx, a)
+	if geocodeErr != nil {
+		log.Printf("geocoding address %d failed: %v", a.ID, geocodeErr)
+		return
+	}
+	if !found {
+		return
+	}
+	if setErr := s.addrRepo.SetLocation(ctx, a.ID, fingerprint(a), loc); setErr != nil {
+		log.Printf("storing location of address %d failed: %v", a.ID, setErr)
+	}
+}
+
+// WaitGeocoding waits until the queued addresses are located
+func (s *AddressService) WaitGeocoding() {
+	s.geocoding.Wait()
+}
+
+// StopGeocoding stops taking addresses to locate and waits until the
+// queued ones are done, or ctx ends. Call it on shutdown, once no more
+// requests come in.
+func (s *AddressService) StopGeocoding(ctx context.Context) error {
+	if s.opts.Geocoder == nil {
+		return nil
+	}
+	s.queueMu.Lock()
+	if !s.queueClosed {
+		s.queueClosed = true
+		close(s.geocodeQueue)
+	}
+	s.queueMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("service: %d addresses left to geocode: %w", len(s.geocodeQueue), ctx.Err())
+	}
+}
+
+// fingerprint returns the fingerprint of where a is
+func fingerprint(a model.Address) string {
+	return addressrules.Fingerprint(a.Country, a.State, a.Zip, a.City, a.Addr_1, a.Addr_2)
+}
+
+// ExportAddresses returns all addresses of the user, oldest first
+func (s *AddressService) ExportAddresses(ctx context.Context, userID int) ([]model.Address, error) {
+	q := model.AddressQuery{UId: userID, SortBy: "created_at", Limit: 100}
+	all := []model.Address{}
+	for {
+		page, listErr := s.addrRepo.ListByUser(ctx, q)
+		if listErr != nil {
+			return nil, fmt.Errorf("service: ExportAddresses failed: %w", listErr)
+		}
+		all = append(all, page...)
+		if len(page) < q.Limit {
+			return all, nil
+		}
+		last := page[len(page)-1]
+		q.After = &model.AddressCursor{SortValue: last.CreatedAt, ID: last.ID}
+	}
 }
 
 // GetAddress retrieves a single address by its ID
-func (s *AddressService) GetAddress(userID, id int) (*model.Address, error) {
-  addr, fetchErr := s.addrRepo.GetByID(id)
+func (s *AddressService) GetAddress(ctx context.Context, userID, id int) (*model.Address, error) {
+  addr, fetchErr := s.addrRepo.GetByID(ctx, id)
   if fetchErr != nil {
     return nil, fmt.Errorf("service: GetAddress failed: %w", fetchErr)
   }
@@ -48,47 +365,421 @@ func (s *AddressService) GetAddress(userID, id int) (*model.Address, error) {
 }
 
 
-// DeleteAddress removes an address record
-func (s *AddressService) DeleteAddress(userID, id int) error {
-  addr, err := s.addrRepo.GetByID(id)
-  if err != nil {
-    return err
-  }
-  if addr.UId != userID {
-    return ErrForbidden
-  }
-  if addr.IsDefault {
-    return ErrCannotDeleteDefault
-  }
-   deleteErr := s.addrRepo.Delete(id)
-	if deleteErr != nil {
-    return fmt.Errorf("service: DeleteAddress failed: %w", deleteErr)
-  }
-  return nil
+// DeleteAddress soft-deletes an address; RestoreAddress brings it back within
+// the restore window. A default address can only be
+// deleted together with promoting another address of the user and the same
+// type: promoteID names it, 0 promotes none. promoteID is ignored for other
+// addresses. The prior states of the deleted and the promoted address are
+// recorded in the same transaction.
+// If version isn't 0, the address must still be at that version.
+func (s *AddressService) DeleteAddress(ctx context.Context, userID, id, version, promoteID int) error {
+	var txErr error
+	// like UpdateAddress, retried when the address changes between reading
+	// and deleting it, so the recorded state is the one deleted
+	for attempt := 0; attempt < 3; attempt++ {
+		txErr = s.deleteAddress(ctx, userID, id, version, promoteID)
+		if !errors.Is(txErr, ErrAddressChanged) {
+			break
+		}
+	}
+	return defaultConflict(txErr)
 }
 
-// UpdateAddress applies updates, enforcing ownership and single-default rules.
-func (s *AddressService) UpdateAddress(userID int, a *model.Address) error {
-	// fetch existing to check ownership
-	existing, err := s.addrRepo.GetByID(a.ID)
-	if err != nil {
-		return fmt.Errorf("service: fetch existing: %w", err)
+func (s *AddressService) deleteAddress(ctx context.Context, userID, id, version, promoteID int) error {
+	return s.txm.WithinTx(ctx, func(ctx context.Context) error {
+		addr, fetchErr := s.addrRepo.GetByID(ctx, id)
+		if fetchErr != nil {
+			if errors.Is(fetchErr, pgx.ErrNoRows) {
+				return ErrAddressNotFound
+			}
+			return fmt.Errorf("service: fetch existing: %w", fetchErr)
+		}
+		if addr.UId != userID {
+			return ErrForbidden
+		}
+		if version != 0 && addr.Version != version {
+			return ErrVersionMismatch
+		}
+		if addr.IsDefault && promoteID == 0 {
+			return ErrCannotDeleteDefault
+		}
+		if addr.IsDefault && promoteID == id {
+			return ErrInvalidPromotion
+		}
+
+		deleteErr := s.addrRepo.Delete(ctx, id, addr.Version)
+		if deleteErr != nil {
+			if errors.Is(deleteErr, pgx.ErrNoRows) {
+				if version != 0 {
+					return ErrVersionMismatch
+				}
+				return ErrAddressChanged
+			}
+			return fmt.Errorf("service: DeleteAddress failed: %w", deleteErr)
+		}
+		if err := s.addrRepo.RecordVersion(ctx, *addr, userID); err != nil {
+			return fmt.Errorf("service: record address version: %w", err)
+		}
+		if !addr.IsDefault {
+			return nil
+		}
+
+		promoted, fetchErr := s.addrRepo.GetByID(ctx, promoteID)
+		if fetchErr != nil {
+			if errors.Is(fetchErr, pgx.ErrNoRows) {
+				return ErrInvalidPromotion
+			}
+			return fmt.Errorf("service: promote address: %w", fetchErr)
+		}
+		if promoted.UId != userID || promoted.Type != addr.Type {
+			return ErrInvalidPromotion
+		}
+
+		// the old default is gone, so promoting can't clash with it
+		_, promoteErr := s.addrRepo.SetDefault(ctx, userID, promoteID)
+		if promoteErr != nil {
+			if errors.Is(promoteErr, pgx.ErrNoRows) {
+				return ErrInvalidPromotion
+			}
+			return fmt.Errorf("service: promote address: %w", promoteErr)
+		}
+		if err := s.addrRepo.RecordVersion(ctx, *promoted, userID); err != nil {
+			return fmt.Errorf("service: record address version: %w", err)
+		}
+		return nil
+	})
+}
+
+// RestoreAddress brings back an address the user deleted less than
+// RestoreWindow ago. It returns without its default flag. The deleted state
+// is recorded in the address history.
+func (s *AddressService) RestoreAddress(ctx context.Context, userID, id int) (*model.Address, error) {
+	var addr *model.Address
+	txErr := s.txm.WithinTx(ctx, func(ctx context.Context) error {
+		deleted, fetchErr := s.addrRepo.GetDeletedByID(ctx, id)
+		if fetchErr != nil {
+			if errors.Is(fetchErr, pgx.ErrNoRows) {
+				return ErrAddressNotFound
+			}
+			return fmt.Errorf("service: fetch deleted address: %w", fetchErr)
+		}
+		if deleted.UId != userID {
+			return ErrForbidden
+		}
+		if time.Since(*deleted.DeletedAt) > s.opts.RestoreWindow {
+			return ErrRestoreExpired
+		}
+
+		var restoreErr error
+		addr, restoreErr = s.addrRepo.Restore(ctx, id)
+		if restoreErr != nil {
+			if errors.Is(restoreErr, pgx.ErrNoRows) {
+				// restored or purged in the meantime
+				return ErrAddressNotFound
+			}
+			return fmt.Errorf("service: RestoreAddress failed: %w", restoreErr)
+		}
+		if err := s.addrRepo.RecordVersion(ctx, *deleted, userID); err != nil {
+			return fmt.Errorf("service: record address version: %w", err)
+		}
+		return nil
+	})
+	if txErr != nil {
+		return nil, txErr
 	}
-	if existing.UId != userID {
-		return ErrForbidden
+	return addr, nil
+}
+
+// PurgeDeletedAddresses removes the addresses deleted more than Retention
+// ago for good, and returns how many there were
+func (s *AddressService) PurgeDeletedAddresses(ctx context.Context) (int, error) {
+	purged, purgeErr := s.addrRepo.PurgeDeleted(ctx, time.Now().Add(-s.opts.Retention))
+	if purgeErr != nil {
+		return 0, fmt.Errorf("service: PurgeDeletedAddresses failed: %w", purgeErr)
 	}
+	return purged, nil
+}
 
-	// if setting new default, clear old ones
-	if a.IsDefault {
-		if err := s.addrRepo.ClearDefaultForUser(userID); err != nil {
-			return fmt.Errorf("service: clearing previous defaults: %w", err)
+// staleAddress is the error for a conditional write that matched no row
+// although the address was there when it was read: it changed or went away
+// in between.
+func staleAddress(version int) error {
+	if version != 0 {
+		return ErrVersionMismatch
+	}
+	return ErrAddressNotFound
+}
+
+// GetDefaultAddress returns the default address of addrType of the user
+func (s *AddressService) GetDefaultAddress(ctx context.Context, userID int, addrType string) (*model.Address, error) {
+	addr, fetchErr := s.addrRepo.GetDefaultForUser(ctx, userID, addrType)
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return nil, ErrNoDefaultAddress
 		}
+		return nil, fmt.Errorf("service: GetDefaultAddress failed: %w", fetchErr)
 	}
+	return addr, nil
+}
 
-	// perform update
-	if err := s.addrRepo.Update(a); err != nil {
-		return fmt.Errorf("service: update address: %w", err)
+// SetDefaultAddress makes address id the user's default of its type and
+// returns it. The prior states of the address and of the default it
+// replaces are recorded in the same transaction.
+func (s *AddressService) SetDefaultAddress(ctx context.Context, userID, id int) (*model.Address, error) {
+	var addr *model.Address
+	txErr := s.txm.WithinTx(ctx, func(ctx context.Context) error {
+		existing, fetchErr := s.addrRepo.GetByID(ctx, id)
+		if fetchErr != nil {
+			if errors.Is(fetchErr, pgx.ErrNoRows) {
+				return ErrAddressNotFound
+			}
+			return fmt.Errorf("service: fetch existing: %w", fetchErr)
+		}
+		if existing.UId != userID {
+			return ErrForbidden
+		}
+		previous, previousErr := s.addrRepo.GetDefaultForUser(ctx, userID, existing.Type)
+		if previousErr != nil && !errors.Is(previousErr, pgx.ErrNoRows) {
+			return fmt.Errorf("service: fetch previous default: %w", previousErr)
+		}
+
+		var setErr error
+		addr, setErr = s.addrRepo.SetDefault(ctx, userID, id)
+		if setErr != nil {
+			if errors.Is(setErr, repo.ErrDuplicateDefault) {
+				return ErrDefaultAddressConflict
+			}
+			if errors.Is(setErr, pgx.ErrNoRows) {
+				// deleted in the meantime
+				return ErrAddressNotFound
+			}
+			return fmt.Errorf("service: SetDefaultAddress failed: %w", setErr)
+		}
+
+		if previous != nil && previous.ID != id {
+			if err := s.addrRepo.RecordVersion(ctx, *previous, userID); err != nil {
+				return fmt.Errorf("service: record address version: %w", err)
+			}
+		}
+		if err := s.addrRepo.RecordVersion(ctx, *existing, userID); err != nil {
+			return fmt.Errorf("service: record address version: %w", err)
+		}
+		return nil
+	})
+	if txErr != nil {
+		return nil, txErr
 	}
+	return addr, nil
+}
 
+// clearDefault unsets the default address of addrType of the user, if
+// there is one, and records its prior state. It runs in the transaction of
+// the write that brings the new default.
+func (s *AddressService) clearDefault(ctx context.Context, userID int, addrType string) error {
+	previous, fetchErr := s.addrRepo.GetDefaultForUser(ctx, userID, addrType)
+	if errors.Is(fetchErr, pgx.ErrNoRows) {
+		return nil
+	}
+	if fetchErr != nil {
+		return fmt.Errorf("service: clearing previous defaults: %w", fetchErr)
+	}
+	if err := s.addrRepo.ClearDefaultForUser(ctx, userID, addrType); err != nil {
+		return fmt.Errorf("service: clearing previous defaults: %w", err)
+	}
+	if err := s.addrRepo.RecordVersion(ctx, *previous, userID); err != nil {
+		return fmt.Errorf("service: record address version: %w", err)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// UpdateAddress applies a partial update, enforcing ownership and
+// single-default rules, and returns the updated address. The state before
+// the update is recorded in the address history in the same transaction.
+// If version isn't 0, the address must still be at that version.
+func (s *AddressService) UpdateAddress(ctx context.Context, userID, id, version int, p model.AddressPatch) (*model.Address, error) {
+	return s.UpdateAddressWith(ctx, userID, id, version, func(model.Address) (model.AddressPatch, error) {
+		return p, nil
+	})
+}
+
+// AddressPatcher builds the patch of an update from the stored address it
+// applies to, e.g. to validate the merged result. An error aborts the update
+// and is returned as is.
+type AddressPatcher func(existing model.Address) (model.AddressPatch, error)
+
+// UpdateAddressWith is UpdateAddress with a patch built by patcher, which
+// runs in the transaction of the update, so the patch is built from the
+// state it replaces. It runs again when the update is retried.
+func (s *AddressService) UpdateAddressWith(ctx context.Context, userID, id, version int, patcher AddressPatcher) (*model.Address, error) {
+	var updated *model.Address
+	var txErr error
+	// without a version, a concurrent write between reading and patching
+	// the address is retried, so the recorded state is the one replaced
+	for attempt := 0; attempt < 3; attempt++ {
+		updated, txErr = s.updateAddress(ctx, userID, id, version, patcher)
+		if !errors.Is(txErr, ErrAddressChanged) {
+			break
+		}
+	}
+	if txErr != nil {
+		return nil, defaultConflict(txErr)
+	}
+	// a change of the place cleared the location
+	if updated.Lat == nil {
+		s.locate(*updated)
+	}
+	return updated, nil
+}
+
+func (s *AddressService) updateAddress(ctx context.Context, userID, id, version int, patcher AddressPatcher) (*model.Address, error) {
+	var updated *model.Address
+	txErr := s.txm.WithinTx(ctx, func(ctx context.Context) error {
+		// fetch existing to check ownership
+		existing, err := s.addrRepo.GetByID(ctx, id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrAddressNotFound
+			}
+			return fmt.Errorf("service: fetch existing: %w", err)
+		}
+		if existing.UId != userID {
+			return ErrForbidden
+		}
+		if version != 0 && existing.Version != version {
+			return ErrVersionMismatch
+		}
+		p, err := patcher(*existing)
+		if err != nil {
+			return err
+		}
+
+		// if it becomes the default of a type, clear the old one
+		merged := p.Apply(*existing)
+		fp := fingerprint(merged)
+		p.Fingerprint = &fp
+		if merged.IsDefault && (!existing.IsDefault || merged.Type != existing.Type) {
+			if err := s.clearDefault(ctx, userID, merged.Type); err != nil {
+				return err
+			}
+		}
+
+		// perform update on the state that is recorded
+		updated, err = s.addrRepo.Patch(ctx, id, existing.Version, p)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				if version != 0 {
+					return ErrVersionMismatch
+				}
+				return ErrAddressChanged
+			}
+			return fmt.Errorf("service: update address: %w", err)
+		}
+		if err := s.addrRepo.RecordVersion(ctx, *existing, userID); err != nil {
+			return fmt.Errorf("service: record address version: %w", err)
+		}
+		return nil
+	})
+	return updated, txErr
+}
+
+// AddressHistory returns the states an address of the user had before each
+// of its updates, newest first
+func (s *AddressService) AddressHistory(ctx context.Context, userID, id int) ([]model.AddressVersion, error) {
+	addr, fetchErr := s.addrRepo.GetByID(ctx, id)
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return nil, ErrAddressNotFound
+		}
+		return nil, fmt.Errorf("service: AddressHistory failed: %w", fetchErr)
+	}
+	if addr.UId != userID {
+		return nil, ErrForbidden
+	}
+	versions, listErr := s.addrRepo.ListVersions(ctx, id)
+	if listErr != nil {
+		return nil, fmt.Errorf("service: AddressHistory failed: %w", listErr)
+	}
+	return versions, nil
+}
+
+// defaultConflict maps a violation of the one-default-per-user index, which
+// a concurrent request can cause, to ErrDefaultAddressConflict
+func defaultConflict(err error) error {
+	if errors.Is(err, repo.ErrDuplicateDefault) {
+		return ErrDefaultAddressConflict
+	}
+	return err
+}
+
+// AddressPage is one page of a user's addresses
+type AddressPage struct {
+	Addresses []model.Address
+	// Total counts all addresses that match the filters, on every page
+	Total int
+	// NextCursor continues the listing; it's empty on the last page
+	NextCursor string
+}
+
+// ListAddresses returns the addresses of the user that match the filters
+// of q, a page of q.Limit at a time. cursor is the NextCursor of the
+// previous page, or empty for the first one; it has to come from a listing
+// with the same sort order.
+func (s *AddressService) ListAddresses(ctx context.Context, userID int, q model.AddressQuery, cursor string) (*AddressPage, error) {
+	q.UId = userID
+	if cursor != "" {
+		after, decodeErr := decodeAddressCursor(cursor, q)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		q.After = after
+	}
+
+	// one extra row tells whether there is a next page
+	limit := q.Limit
+	q.Limit++
+	addresses, listErr := s.addrRepo.ListByUser(ctx, q)
+	if listErr != nil {
+		return nil, fmt.Errorf("service: ListAddresses failed: %w", listErr)
+	}
+	total, countErr := s.addrRepo.CountByUser(ctx, q)
+	if countErr != nil {
+		return nil, fmt.Errorf("service: ListAddresses failed: %w", countErr)
+	}
+
+	page := &AddressPage{Addresses: addresses, Total: total}
+	if len(addresses) > limit {
+		page.Addresses = addresses[:limit]
+		page.NextCursor = encodeAddressCursor(page.Addresses[limit-1], q)
+	}
+	return page, nil
+}
+
+// addressCursor is the JSON inside an opaque listing cursor. It records the
+// sort order too, so a cursor isn't applied to a differently sorted listing.
+type addressCursor struct {
+	SortBy    string    `json:"s"`
+	Desc      bool      `json:"d"`
+	SortValue time.Time `json:"v"`
+	ID        int       `json:"id"`
+}
+
+func encodeAddressCursor(last model.Address, q model.AddressQuery) string {
+	c := addressCursor{SortBy: q.SortBy, Desc: q.Desc, SortValue: last.CreatedAt, ID: last.ID}
+	if q.SortBy == "updated_at" {
+		c.SortValue = last.UpdatedAt
+	}
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeAddressCursor(cursor string, q model.AddressQuery) (*model.AddressCursor, error) {
+	raw, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+	if decodeErr != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c addressCursor
+	if json.Unmarshal(raw, &c) != nil || c.SortBy != q.SortBy || c.Desc != q.Desc {
+		return nil, ErrInvalidCursor
+	}
+	return &model.AddressCursor{SortValue: c.SortValue, ID: c.ID}, nil
+}
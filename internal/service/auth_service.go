@@ -1,31 +1,41 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"server/internal/model"
 	"server/internal/repo"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 
 var ErrInvalidCredentials = errors.New("service: invalid credentials")
 var ErrUserExist = errors.New("service: can't register this user")
+var ErrEmailNotVerified = errors.New("service: email not verified")
+
+// dummyPasswordHash is checked against when the email is unknown, so the
+// login takes as long as for a registered one. It is a bcrypt hash at
+// bcrypt.DefaultCost, like the stored ones.
+const dummyPasswordHash = "$2a$10$5dOwKDn.PCfF0H1YExgeceQSUFgNgl1fqz.aK3FCxO66BQo.sYJOG"
 
 
 type AuthService struct {
-	authRepo *repo.AuthRepo
+	authRepo UserStore
+	throttle *LoginThrottle
+	// requireVerifiedEmail makes Login refuse accounts that never confirmed their email
+	requireVerifiedEmail bool
 }
 
-func NewAuthService(authRepo *repo.AuthRepo) *AuthService {
-	return &AuthService{authRepo: authRepo}
+func NewAuthService(authRepo UserStore, throttle *LoginThrottle, requireVerifiedEmail bool) *AuthService {
+	return &AuthService{authRepo: authRepo, throttle: throttle, requireVerifiedEmail: requireVerifiedEmail}
 }
 
-func (s *AuthService) Register(username, email, pwd string) (*model.User, error) {
+func (s *AuthService) Register(ctx context.Context, username, email, pwd string) (*model.User, error) {
 	// Check if user exists
-	_, exists  := s.authRepo.GetByEmail(email)
+	_, exists  := s.authRepo.GetByEmail(ctx, email)
 	if exists == nil {
 		return nil, ErrUserExist
 	}
@@ -40,8 +50,12 @@ func (s *AuthService) Register(username, email, pwd string) (*model.User, error)
 			Email: email,
 			PasswordHash: hashedPwd,
 		}
-		createUserErr := s.authRepo.CreateUser(usr)
+		createUserErr := s.authRepo.CreateUser(ctx, usr)
 		if createUserErr != nil{
+			// registered concurrently since the check above
+			if errors.Is(createUserErr, repo.ErrEmailTaken) {
+				return nil, ErrUserExist
+			}
 			return nil, createUserErr
 		} else {
 			return usr, nil
@@ -49,13 +63,23 @@ func (s *AuthService) Register(username, email, pwd string) (*model.User, error)
 	}
 }
 
-// Login
-func (s *AuthService) Login(email, password string) (*model.User, error){
+// Login checks the password of the account. ip is the client address the
+// attempt came from; failed attempts are throttled per account and per IP.
+func (s *AuthService) Login(ctx context.Context, email, password, ip string) (*model.User, error){
+	// refuse early while locked out or backing off
+	blockErr := s.throttle.Check(ctx, email, ip)
+	if blockErr != nil {
+		return nil, blockErr
+	}
+
 	// Check if user exists
-	usr, fetchingErr := s.authRepo.GetByEmail(email)
+	usr, fetchingErr := s.authRepo.GetByEmail(ctx, email)
 	if fetchingErr != nil {
 		if errors.Is(fetchingErr, pgx.ErrNoRows) {
-			return nil, ErrInvalidCredentials
+			// hashed and counted like a wrong password, so unknown emails take
+			// as long and lock out the same way
+			_ = checkPassword(dummyPasswordHash, password)
+			return nil, s.loginFailed(ctx, email, ip)
 		} else {
 			return nil, fmt.Errorf("service: user lookup: %w", fetchingErr)
 		}
@@ -64,10 +88,48 @@ func (s *AuthService) Login(email, password string) (*model.User, error){
 	// compare passwords
 	pwdErr := checkPassword(usr.PasswordHash, password)
 	if pwdErr != nil {
-		return nil, ErrInvalidCredentials
-	} else {
-		return usr, nil
+		return nil, s.loginFailed(ctx, email, ip)
+	}
+	successErr := s.throttle.RecordSuccess(ctx, email)
+	if successErr != nil {
+		return nil, successErr
 	}
+
+	// only checked after the password, so it doesn't reveal which emails exist
+	verifiedErr := s.CheckEmailVerified(usr)
+	if verifiedErr != nil {
+		return nil, verifiedErr
+	}
+	return usr, nil
+}
+
+// CheckEmailVerified returns ErrEmailNotVerified when logins require a
+// confirmed email and the user never confirmed theirs. Every login path
+// checks it once the user proved who they are.
+func (s *AuthService) CheckEmailVerified(usr *model.User) error {
+	if s.requireVerifiedEmail && usr.EmailVerifiedAt == nil {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// GetUser loads a user by ID, e.g. when refreshing a session
+func (s *AuthService) GetUser(ctx context.Context, id int) (*model.User, error) {
+	usr, fetchErr := s.authRepo.GetByID(ctx, id)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	return usr, nil
+}
+
+// loginFailed records the failure and returns ErrInvalidCredentials.
+// If the failure can't be recorded the login fails closed.
+func (s *AuthService) loginFailed(ctx context.Context, email, ip string) error {
+	recordErr := s.throttle.RecordFailure(ctx, email, ip)
+	if recordErr != nil {
+		return recordErr
+	}
+	return ErrInvalidCredentials
 }
 
 // Helpers
@@ -84,4 +146,4 @@ func hashPassword(password string) (string, error) {
 // checkPassword
 func checkPassword(hashed, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
-}
\ No newline at end of file
+}
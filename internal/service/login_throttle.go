@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"server/internal/model"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrAccountLocked = errors.New("service: account temporarily locked")
+var ErrLoginThrottled = errors.New("service: too many failed logins")
+
+// LoginBlockedError is returned by Login when an attempt is refused before
+// the password is checked. Err is ErrAccountLocked or ErrLoginThrottled.
+type LoginBlockedError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoginBlockedError) Unwrap() error {
+	return e.Err
+}
+
+// LockoutPolicy configures LoginThrottle. A zero MaxFailures or
+// IPMaxFailures disables that lockout, a zero BackoffBase the delays.
+type LockoutPolicy struct {
+	// MaxFailures locks an account after that many failures in a row
+	MaxFailures int
+	// IPMaxFailures blocks a client address after that many failures, across all accounts
+	IPMaxFailures   int
+	LockoutDuration time.Duration
+	// BackoffBase is the delay after the first failure; it doubles with every further one
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// FailureWindow is how long a failure counts towards a lockout
+	FailureWindow time.Duration
+}
+
+// LoginThrottle tracks failed password logins per account and per client IP,
+// enforcing exponential delays between attempts and temporary lockouts.
+// Accounts are keyed by the email that was tried, whether or not it's
+// registered, so the responses don't reveal which emails exist. Wrong
+// two-factor codes count against the user ID instead, and wrong passwords
+// of a logged-in user confirming a change against a key of their own.
+type LoginThrottle struct {
+	failureRepo LoginFailureStore
+	policy      LockoutPolicy
+}
+
+func NewLoginThrottle(failureRepo LoginFailureStore, policy LockoutPolicy) *LoginThrottle {
+	return &LoginThrottle{failureRepo: failureRepo, policy: policy}
+}
+
+// Check refuses a login attempt while the IP or the account is locked, or
+// while the account's backoff delay hasn't passed.
+func (t *LoginThrottle) Check(ctx context.Context, email, ip string) error {
+	return t.check(ctx, emailKey(email), ip)
+}
+
+// CheckSecondFactor is Check for the second login step, where the account
+// is known by its user ID.
+func (t *LoginThrottle) CheckSecondFactor(ctx context.Context, userID int, ip string) error {
+	return t.check(ctx, userKey(userID), ip)
+}
+
+// RecordFailure counts a failed login against the account and the IP and
+// locks either once it reaches its limit.
+func (t *LoginThrottle) RecordFailure(ctx context.Context, email, ip string) error {
+	return t.recordFailures(ctx, emailKey(email), ip)
+}
+
+// RecordSecondFactorFailure counts a wrong two-factor code like a failed
+// login, so codes can't be guessed faster than passwords.
+func (t *LoginThrottle) RecordSecondFactorFailure(ctx context.Context, userID int, ip string) error {
+	return t.recordFailures(ctx, userKey(userID), ip)
+}
+
+// RecordSuccess resets the account's failures. The IP's failures are kept,
+// so one valid account doesn't let a client keep guessing at others.
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, email string) error {
+	clearErr := t.failureRepo.Clear(ctx, emailKey(email))
+	if clearErr != nil {
+		return fmt.Errorf("service: reset login failures: %w", clearErr)
+	}
+
+	// opportunistic cleanup; a failure here doesn't undo the login
+	_ = t.failureRepo.PurgeStale(ctx, time.Now().Add(-t.policy.FailureWindow))
+	return nil
+}
+
+// RecordSecondFactorSuccess resets the failures of the user's second factor
+func (t *LoginThrottle) RecordSecondFactorSuccess(ctx context.Context, userID int) error {
+	clearErr := t.failureRepo.Clear(ctx, userKey(userID))
+	if clearErr != nil {
+		return fmt.Errorf("service: reset login failures: %w", clearErr)
+	}
+	return nil
+}
+
+// CheckReauthentication is Check for the password a logged-in user
+// confirms a change with. Its failures are kept apart from the logins, so a
+// stolen session can't lock the owner out.
+func (t *LoginThrottle) CheckReauthentication(ctx context.Context, userID int) error {
+	return t.check(ctx, reauthKey(userID), "")
+}
+
+// RecordReauthenticationFailure counts a wrong password of a logged-in user
+func (t *LoginThrottle) RecordReauthenticationFailure(ctx context.Context, userID int) error {
+	return t.recordFailures(ctx, reauthKey(userID), "")
+}
+
+// RecordReauthenticationSuccess resets the failures of the user's password
+// confirmations
+func (t *LoginThrottle) RecordReauthenticationSuccess(ctx context.Context, userID int) error {
+	clearErr := t.failureRepo.Clear(ctx, reauthKey(userID))
+	if clearErr != nil {
+		return fmt.Errorf("service: reset reauthentication failures: %w", clearErr)
+	}
+	return nil
+}
+
+// Locked reports whether the account is currently locked
+func (t *LoginThrottle) Locked(ctx context.Context, email string) (bool, error) {
+	record, getErr := t.get(ctx, emailKey(email))
+	if getErr != nil {
+		return false, getErr
+	}
+	return record != nil && record.LockedUntil != nil && record.LockedUntil.After(time.Now()), nil
+}
+
+// UnlockAccount lifts the lockout and delays of an account
+func (t *LoginThrottle) UnlockAccount(ctx context.Context, email string) error {
+	clearErr := t.failureRepo.Clear(ctx, emailKey(email))
+	if clearErr != nil {
+		return fmt.Errorf("service: unlock account: %w", clearErr)
+	}
+	return nil
+}
+
+// UnlockIP lifts the lockout of a client address
+func (t *LoginThrottle) UnlockIP(ctx context.Context, ip string) error {
+	clearErr := t.failureRepo.Clear(ctx, ipKey(ip))
+	if clearErr != nil {
+		return fmt.Errorf("service: unlock ip: %w", clearErr)
+	}
+	return nil
+}
+
+// check refuses an attempt on the account key while it or the IP is
+// locked, or while the account's backoff delay hasn't passed
+func (t *LoginThrottle) check(ctx context.Context, key, ip string) error {
+	now := time.Now()
+
+	if ip != "" {
+		ipRecord, ipErr := t.get(ctx, ipKey(ip))
+		if ipErr != nil {
+			return ipErr
+		}
+		if ipRecord != nil && ipRecord.LockedUntil != nil && ipRecord.LockedUntil.After(now) {
+			return &LoginBlockedError{Err: ErrLoginThrottled, RetryAfter: ipRecord.LockedUntil.Sub(now)}
+		}
+	}
+
+	record, getErr := t.get(ctx, key)
+	if getErr != nil {
+		return getErr
+	}
+	if record == nil {
+		return nil
+	}
+	if record.LockedUntil != nil && record.LockedUntil.After(now) {
+		return &LoginBlockedError{Err: ErrAccountLocked, RetryAfter: record.LockedUntil.Sub(now)}
+	}
+	if record.Failures > 0 && record.LastFailureAt.After(now.Add(-t.policy.FailureWindow)) {
+		next := record.LastFailureAt.Add(t.backoff(record.Failures))
+		if next.After(now) {
+			return &LoginBlockedError{Err: ErrLoginThrottled, RetryAfter: next.Sub(now)}
+		}
+	}
+	return nil
+}
+
+// recordFailures counts a failure against the account key and the IP
+func (t *LoginThrottle) recordFailures(ctx context.Context, key, ip string) error {
+	lockErr := t.recordFailure(ctx, key, t.policy.MaxFailures)
+	if lockErr != nil {
+		return lockErr
+	}
+	if ip != "" {
+		return t.recordFailure(ctx, ipKey(ip), t.policy.IPMaxFailures)
+	}
+	return nil
+}
+
+// recordFailure counts a failure for key and locks it at maxFailures
+func (t *LoginThrottle) recordFailure(ctx context.Context, key string, maxFailures int) error {
+	record, recordErr := t.failureRepo.RecordFailure(ctx, key, time.Now().Add(-t.policy.FailureWindow))
+	if recordErr != nil {
+		return fmt.Errorf("service: record login failure: %w", recordErr)
+	}
+	if maxFailures > 0 && record.Failures >= maxFailures {
+		lockErr := t.failureRepo.Lock(ctx, key, time.Now().Add(t.policy.LockoutDuration))
+		if lockErr != nil {
+			return fmt.Errorf("service: lock %s: %w", key, lockErr)
+		}
+	}
+	return nil
+}
+
+// get returns the failure record of key, or nil if there is none
+func (t *LoginThrottle) get(ctx context.Context, key string) (*model.LoginFailure, error) {
+	record, getErr := t.failureRepo.Get(ctx, key)
+	if getErr != nil {
+		if errors.Is(getErr, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("service: login failure lookup: %w", getErr)
+	}
+	return record, nil
+}
+
+// backoff is the delay required after the given number of failures:
+// BackoffBase, doubled for each further failure, capped at BackoffMax
+func (t *LoginThrottle) backoff(failures int) time.Duration {
+	if t.policy.BackoffBase <= 0 {
+		return 0
+	}
+	delay := t.policy.BackoffBase
+	for i := 1; i < failures && delay < t.policy.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > t.policy.BackoffMax {
+		delay = t.policy.BackoffMax
+	}
+	return delay
+}
+
+func emailKey(email string) string {
+	return "email:" + email
+}
+
+// userKey is the key of a user's second factor
+func userKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// reauthKey is the key of a logged-in user's password confirmations
+func reauthKey(userID int) string {
+	return "reauth:" + strconv.Itoa(userID)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// confirmPassword checks the password a logged-in user confirms a change
+// with, throttled by their reauthentication key. It fails with a
+// *LoginBlockedError before the check, or ErrInvalidCredentials.
+func confirmPassword(ctx context.Context, throttle *LoginThrottle, usr *model.User, password string) error {
+	blockErr := throttle.CheckReauthentication(ctx, usr.ID)
+	if blockErr != nil {
+		return blockErr
+	}
+	if checkPassword(usr.PasswordHash, password) != nil {
+		recordErr := throttle.RecordReauthenticationFailure(ctx, usr.ID)
+		if recordErr != nil {
+			return recordErr
+		}
+		return ErrInvalidCredentials
+	}
+	return throttle.RecordReauthenticationSuccess(ctx, usr.ID)
+}
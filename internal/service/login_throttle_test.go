@@ -0,0 +1,158 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testLockout = service.LockoutPolicy{
+	MaxFailures:     4,
+	IPMaxFailures:   10,
+	LockoutDuration: time.Hour,
+	BackoffBase:     time.Second,
+	BackoffMax:      3 * time.Second,
+	FailureWindow:   time.Hour,
+}
+
+// retryAfter returns how long err asks the client to wait, and fails the
+// test unless err is a LoginBlockedError for want
+func retryAfter(t *testing.T, err, want error) time.Duration {
+	t.Helper()
+	var blocked *service.LoginBlockedError
+	if !errors.As(err, &blocked) || !errors.Is(err, want) {
+		t.Fatalf("Check = %v, want %v", err, want)
+	}
+	return blocked.RetryAfter
+}
+
+func TestLoginThrottleBacksOffAndLocks(t *testing.T) {
+	ctx := context.Background()
+	throttle := service.NewLoginThrottle(memory.NewLoginFailureRepo(memory.New()), testLockout)
+
+	if err := throttle.Check(ctx, "ada@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("Check before any failure = %v", err)
+	}
+
+	// the delay doubles with every failure, up to BackoffMax
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if err := throttle.RecordFailure(ctx, "ada@example.com", "192.0.2.1"); err != nil {
+			t.Fatalf("RecordFailure = %v", err)
+		}
+		wait := retryAfter(t, throttle.Check(ctx, "ada@example.com", "192.0.2.1"), service.ErrLoginThrottled)
+		if wait > want || wait < want-100*time.Millisecond {
+			t.Fatalf("after %d failures Retry-After = %v, want %v", i+1, wait, want)
+		}
+	}
+	// another account from the same IP isn't delayed
+	if err := throttle.Check(ctx, "bob@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("Check of another account = %v", err)
+	}
+
+	// the last failure before MaxFailures locks the account
+	if err := throttle.RecordFailure(ctx, "ada@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("RecordFailure = %v", err)
+	}
+	if wait := retryAfter(t, throttle.Check(ctx, "ada@example.com", "198.51.100.7"), service.ErrAccountLocked); wait < time.Hour-time.Minute {
+		t.Fatalf("lockout Retry-After = %v, want the lockout duration", wait)
+	}
+	if locked, err := throttle.Locked(ctx, "ada@example.com"); err != nil || !locked {
+		t.Fatalf("Locked = %v, %v, want true", locked, err)
+	}
+
+	if err := throttle.UnlockAccount(ctx, "ada@example.com"); err != nil {
+		t.Fatalf("UnlockAccount = %v", err)
+	}
+	if err := throttle.Check(ctx, "ada@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("Check after UnlockAccount = %v", err)
+	}
+
+	// a success resets the account's delay
+	_ = throttle.RecordFailure(ctx, "ada@example.com", "192.0.2.1")
+	if err := throttle.RecordSuccess(ctx, "ada@example.com"); err != nil {
+		t.Fatalf("RecordSuccess = %v", err)
+	}
+	if err := throttle.Check(ctx, "ada@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("Check after RecordSuccess = %v", err)
+	}
+}
+
+func TestLoginThrottleLocksIPs(t *testing.T) {
+	ctx := context.Background()
+	policy := testLockout
+	policy.IPMaxFailures = 3
+	throttle := service.NewLoginThrottle(memory.NewLoginFailureRepo(memory.New()), policy)
+
+	// one failure each on different accounts still adds up for the IP
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if err := throttle.RecordFailure(ctx, email, "192.0.2.1"); err != nil {
+			t.Fatalf("RecordFailure = %v", err)
+		}
+	}
+	retryAfter(t, throttle.Check(ctx, "d@example.com", "192.0.2.1"), service.ErrLoginThrottled)
+	if err := throttle.Check(ctx, "d@example.com", "198.51.100.7"); err != nil {
+		t.Fatalf("Check from another IP = %v", err)
+	}
+	if err := throttle.UnlockIP(ctx, "192.0.2.1"); err != nil {
+		t.Fatalf("UnlockIP = %v", err)
+	}
+	if err := throttle.Check(ctx, "d@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("Check after UnlockIP = %v", err)
+	}
+}
+
+func TestLoginLocksOutUnknownEmailsLikeKnownOnes(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	users := memory.NewAuthRepo(db)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err := users.CreateUser(ctx, &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: string(hash)}); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	// no delays, so only the lockout answers
+	policy := testLockout
+	policy.BackoffBase = 0
+	svc := service.NewAuthService(users, service.NewLoginThrottle(memory.NewLoginFailureRepo(db), policy), false)
+
+	for _, email := range []string{"ada@example.com", "nobody@example.com"} {
+		for i := 0; i < policy.MaxFailures; i++ {
+			if _, err := svc.Login(ctx, email, "wrong", ""); !errors.Is(err, service.ErrInvalidCredentials) {
+				t.Fatalf("Login %d of %s = %v, want ErrInvalidCredentials", i+1, email, err)
+			}
+		}
+		if _, err := svc.Login(ctx, email, "correct horse", ""); !errors.Is(err, service.ErrAccountLocked) {
+			t.Fatalf("Login of %s after %d failures = %v, want ErrAccountLocked", email, policy.MaxFailures, err)
+		}
+	}
+}
+
+func TestLoginHashesForUnknownEmails(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	users := memory.NewAuthRepo(db)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.DefaultCost)
+	if err := users.CreateUser(ctx, &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: string(hash)}); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	svc := service.NewAuthService(users, service.NewLoginThrottle(memory.NewLoginFailureRepo(db), service.LockoutPolicy{}), false)
+
+	elapsed := func(email string) time.Duration {
+		start := time.Now()
+		if _, err := svc.Login(ctx, email, "wrong", ""); !errors.Is(err, service.ErrInvalidCredentials) {
+			t.Fatalf("Login of %s = %v, want ErrInvalidCredentials", email, err)
+		}
+		return time.Since(start)
+	}
+	known, unknown := elapsed("ada@example.com"), elapsed("nobody@example.com")
+	// both run bcrypt at the same cost; without it the unknown email
+	// answers orders of magnitude faster
+	if unknown < known/4 {
+		t.Fatalf("Login of an unknown email took %v, of a known one %v", unknown, known)
+	}
+}
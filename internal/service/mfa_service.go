@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"server/internal/model"
+	"server/internal/secretbox"
+	"server/internal/totp"
+	"strings"
+	"time"
+)
+
+var ErrMFAAlreadyEnabled = errors.New("service: two-factor authentication already enabled")
+var ErrMFANotPending = errors.New("service: no two-factor enrollment in progress")
+var ErrMFANotEnabled = errors.New("service: two-factor authentication not enabled")
+var ErrInvalidMFACode = errors.New("service: invalid two-factor code")
+var ErrMFAChallengeInvalid = errors.New("service: two-factor challenge expired, used or out of attempts")
+
+const recoveryCodeCount = 10
+
+// totpSkew accepts the previous and next code too, to absorb clock drift
+const totpSkew = 1
+
+// mfaMaxAttempts is how many codes may be tried with one mfa_pending token
+const mfaMaxAttempts = 5
+
+// MFAService manages TOTP two-factor authentication and recovery codes.
+type MFAService struct {
+	authRepo      UserStore
+	recoveryRepo  RecoveryCodeStore
+	challengeRepo MFAChallengeStore
+	throttle      *LoginThrottle
+	txManager     Transactor
+	box           *secretbox.Box
+	issuer        string
+}
+
+func NewMFAService(authRepo UserStore, recoveryRepo RecoveryCodeStore, challengeRepo MFAChallengeStore, throttle *LoginThrottle, txManager Transactor, box *secretbox.Box, issuer string) *MFAService {
+	return &MFAService{authRepo: authRepo, recoveryRepo: recoveryRepo, challengeRepo: challengeRepo, throttle: throttle, txManager: txManager, box: box, issuer: issuer}
+}
+
+// Enabled reports whether the user has to pass a second factor on login
+func (s *MFAService) Enabled(u *model.User) bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// BeginTOTPEnrollment stores a new pending secret and returns it together
+// with the otpauth:// URI for authenticator apps.
+func (s *MFAService) BeginTOTPEnrollment(ctx context.Context, userID int) (string, string, error) {
+	usr, fetchErr := s.authRepo.GetByID(ctx, userID)
+	if fetchErr != nil {
+		return "", "", fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	if s.Enabled(usr) {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+
+	secret, genErr := totp.GenerateSecret()
+	if genErr != nil {
+		return "", "", fmt.Errorf("service: %w", genErr)
+	}
+	sealed, sealErr := s.box.Seal([]byte(secret))
+	if sealErr != nil {
+		return "", "", fmt.Errorf("service: encrypt totp secret: %w", sealErr)
+	}
+	storeErr := s.authRepo.SetPendingTOTP(ctx, usr.ID, sealed)
+	if storeErr != nil {
+		return "", "", fmt.Errorf("service: BeginTOTPEnrollment failed: %w", storeErr)
+	}
+	return secret, totp.URI(s.issuer, usr.Email, secret), nil
+}
+
+// ConfirmTOTPEnrollment activates the pending secret once the user proves
+// their app produces valid codes, and returns a fresh set of recovery codes.
+// The plain codes are only ever shown here.
+func (s *MFAService) ConfirmTOTPEnrollment(ctx context.Context, userID int, code string) ([]string, error) {
+	usr, fetchErr := s.authRepo.GetByID(ctx, userID)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	if s.Enabled(usr) {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if usr.TOTPSecret == "" {
+		return nil, ErrMFANotPending
+	}
+
+	codeErr := s.checkTOTP(ctx, usr, code)
+	if codeErr != nil {
+		return nil, codeErr
+	}
+
+	codes, hashes, genErr := generateRecoveryCodes()
+	if genErr != nil {
+		return nil, fmt.Errorf("service: generate recovery codes: %w", genErr)
+	}
+	// the new codes only replace the old ones if TOTP is switched on too
+	txErr := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		storeErr := s.recoveryRepo.ReplaceForUser(ctx, usr.ID, hashes)
+		if storeErr != nil {
+			return storeErr
+		}
+		return s.authRepo.EnableTOTP(ctx, usr.ID)
+	})
+	if txErr != nil {
+		return nil, fmt.Errorf("service: ConfirmTOTPEnrollment failed: %w", txErr)
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off after re-checking the
+// password, throttled like logins.
+func (s *MFAService) DisableTOTP(ctx context.Context, userID int, password string) error {
+	usr, fetchErr := s.authRepo.GetByID(ctx, userID)
+	if fetchErr != nil {
+		return fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	pwdErr := confirmPassword(ctx, s.throttle, usr, password)
+	if pwdErr != nil {
+		return pwdErr
+	}
+	if !s.Enabled(usr) {
+		return ErrMFANotEnabled
+	}
+
+	txErr := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		disableErr := s.authRepo.DisableTOTP(ctx, usr.ID)
+		if disableErr != nil {
+			return disableErr
+		}
+		return s.recoveryRepo.DeleteForUser(ctx, usr.ID)
+	})
+	if txErr != nil {
+		return fmt.Errorf("service: DisableTOTP failed: %w", txErr)
+	}
+	return nil
+}
+
+// BeginChallenge records the challenge of a new mfa_pending token, which
+// the token names by its jti.
+func (s *MFAService) BeginChallenge(ctx context.Context, userID int, jti string, expiresAt time.Time) error {
+	createErr := s.challengeRepo.Create(ctx, jti, userID, expiresAt)
+	if createErr != nil {
+		return fmt.Errorf("service: BeginChallenge failed: %w", createErr)
+	}
+
+	// opportunistic cleanup; a failure here doesn't undo the login
+	_ = s.challengeRepo.PurgeExpired(ctx)
+	return nil
+}
+
+// VerifySecondFactor checks a TOTP code, or else a single-use recovery code,
+// for the second login step of the challenge jti. ip is the client address
+// the attempt came from. Wrong codes are throttled like wrong passwords, and
+// a challenge allows mfaMaxAttempts codes and one successful login.
+func (s *MFAService) VerifySecondFactor(ctx context.Context, userID int, jti, ip, code, recoveryCode string) (*model.User, error) {
+	// refuse early while locked out or backing off
+	blockErr := s.throttle.CheckSecondFactor(ctx, userID, ip)
+	if blockErr != nil {
+		return nil, blockErr
+	}
+	attempted, attemptErr := s.challengeRepo.Attempt(ctx, jti, userID, mfaMaxAttempts)
+	if attemptErr != nil {
+		return nil, fmt.Errorf("service: mfa challenge lookup: %w", attemptErr)
+	}
+	if !attempted {
+		return nil, ErrMFAChallengeInvalid
+	}
+
+	usr, fetchErr := s.authRepo.GetByID(ctx, userID)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	if !s.Enabled(usr) {
+		return nil, ErrMFANotEnabled
+	}
+
+	if recoveryCode != "" {
+		used, consumeErr := s.recoveryRepo.Consume(ctx, usr.ID, hashRecoveryCode(recoveryCode))
+		if consumeErr != nil {
+			return nil, fmt.Errorf("service: recovery code lookup: %w", consumeErr)
+		}
+		if !used {
+			return nil, s.secondFactorFailed(ctx, usr.ID, ip)
+		}
+	} else {
+		codeErr := s.checkTOTP(ctx, usr, code)
+		if errors.Is(codeErr, ErrInvalidMFACode) {
+			return nil, s.secondFactorFailed(ctx, usr.ID, ip)
+		}
+		if codeErr != nil {
+			return nil, codeErr
+		}
+	}
+
+	consumed, consumeErr := s.challengeRepo.Consume(ctx, jti)
+	if consumeErr != nil {
+		return nil, fmt.Errorf("service: mfa challenge: %w", consumeErr)
+	}
+	if !consumed {
+		// a concurrent request finished the login with the same token first
+		return nil, ErrMFAChallengeInvalid
+	}
+	successErr := s.throttle.RecordSecondFactorSuccess(ctx, usr.ID)
+	if successErr != nil {
+		return nil, successErr
+	}
+	return usr, nil
+}
+
+// secondFactorFailed records the failure and returns ErrInvalidMFACode.
+// If the failure can't be recorded the login fails closed.
+func (s *MFAService) secondFactorFailed(ctx context.Context, userID int, ip string) error {
+	recordErr := s.throttle.RecordSecondFactorFailure(ctx, userID, ip)
+	if recordErr != nil {
+		return recordErr
+	}
+	return ErrInvalidMFACode
+}
+
+// checkTOTP validates code against the user's secret and burns its time step
+func (s *MFAService) checkTOTP(ctx context.Context, u *model.User, code string) error {
+	secret, openErr := s.box.Open(u.TOTPSecret)
+	if openErr != nil {
+		return fmt.Errorf("service: decrypt totp secret: %w", openErr)
+	}
+
+	step, ok := totp.Validate(string(secret), code, time.Now(), totpSkew)
+	if !ok || step <= u.TOTPLastStep {
+		return ErrInvalidMFACode
+	}
+	advanced, advanceErr := s.authRepo.AdvanceTOTPStep(ctx, u.ID, step)
+	if advanceErr != nil {
+		return fmt.Errorf("service: %w", advanceErr)
+	}
+	if !advanced {
+		// a concurrent login used the same code first
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// Helpers
+// recoveryAlphabet leaves out characters that are easy to confuse
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// generateRecoveryCodes returns plain codes like "k7mq2-x9tfp" and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		for j := range b {
+			n, randErr := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+			if randErr != nil {
+				return nil, nil, randErr
+			}
+			b[j] = recoveryAlphabet[n.Int64()]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, as users retype codes loosely
+func hashRecoveryCode(code string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	return hashToken(normalized)
+}
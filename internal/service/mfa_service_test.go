@@ -0,0 +1,196 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/secretbox"
+	"server/internal/service"
+	"server/internal/totp"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newMFAService returns the service and a user who enrolled in TOTP, with
+// their secret and recovery codes. The enrollment used the code of the
+// current time step.
+func newMFAService(t *testing.T) (svc *service.MFAService, u *model.User, secret string, recoveryCodes []string) {
+	t.Helper()
+	ctx := context.Background()
+	db := memory.New()
+	users := memory.NewAuthRepo(db)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	u = &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: string(hash)}
+	if err := users.CreateUser(ctx, u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	box, boxErr := secretbox.NewFromBase64(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if boxErr != nil {
+		t.Fatalf("NewFromBase64 = %v", boxErr)
+	}
+	throttle := service.NewLoginThrottle(memory.NewLoginFailureRepo(db), service.LockoutPolicy{MaxFailures: 10, LockoutDuration: time.Minute, FailureWindow: time.Hour})
+	svc = service.NewMFAService(users, memory.NewRecoveryCodeRepo(db), memory.NewMFAChallengeRepo(db), throttle, memory.NewTxManager(db), box, "Example")
+
+	secret, _, beginErr := svc.BeginTOTPEnrollment(ctx, u.ID)
+	if beginErr != nil {
+		t.Fatalf("BeginTOTPEnrollment = %v", beginErr)
+	}
+	recoveryCodes, confirmErr := svc.ConfirmTOTPEnrollment(ctx, u.ID, codeAt(t, secret, 0))
+	if confirmErr != nil {
+		t.Fatalf("ConfirmTOTPEnrollment = %v", confirmErr)
+	}
+	return svc, u, secret, recoveryCodes
+}
+
+// codeAt returns the TOTP code offset steps from now
+func codeAt(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := totp.Code(secret, totp.Step(time.Now())+offset)
+	if err != nil {
+		t.Fatalf("totp.Code = %v", err)
+	}
+	return code
+}
+
+// challenge starts the second login step of the user under jti
+func challenge(t *testing.T, svc *service.MFAService, userID int, jti string) {
+	t.Helper()
+	if err := svc.BeginChallenge(context.Background(), userID, jti, time.Now().Add(5*time.Minute)); err != nil {
+		t.Fatalf("BeginChallenge = %v", err)
+	}
+}
+
+func TestMFAEnrollment(t *testing.T) {
+	ctx := context.Background()
+	svc, u, _, recoveryCodes := newMFAService(t)
+	if len(recoveryCodes) != 10 {
+		t.Fatalf("ConfirmTOTPEnrollment returned %d recovery codes, want 10", len(recoveryCodes))
+	}
+	if _, _, err := svc.BeginTOTPEnrollment(ctx, u.ID); !errors.Is(err, service.ErrMFAAlreadyEnabled) {
+		t.Fatalf("BeginTOTPEnrollment when enabled = %v, want ErrMFAAlreadyEnabled", err)
+	}
+	if err := svc.DisableTOTP(ctx, u.ID, "wrong"); !errors.Is(err, service.ErrInvalidCredentials) {
+		t.Fatalf("DisableTOTP with a wrong password = %v, want ErrInvalidCredentials", err)
+	}
+	if err := svc.DisableTOTP(ctx, u.ID, "correct horse"); err != nil {
+		t.Fatalf("DisableTOTP = %v", err)
+	}
+	if err := svc.DisableTOTP(ctx, u.ID, "correct horse"); !errors.Is(err, service.ErrMFANotEnabled) {
+		t.Fatalf("DisableTOTP when disabled = %v, want ErrMFANotEnabled", err)
+	}
+	if _, err := svc.ConfirmTOTPEnrollment(ctx, u.ID, "000000"); !errors.Is(err, service.ErrMFANotPending) {
+		t.Fatalf("ConfirmTOTPEnrollment without a pending secret = %v, want ErrMFANotPending", err)
+	}
+}
+
+func TestVerifySecondFactorRejectsReplayedCodes(t *testing.T) {
+	ctx := context.Background()
+	svc, u, secret, _ := newMFAService(t)
+
+	// the code that confirmed the enrollment is used up
+	challenge(t, svc, u.ID, "jti-1")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", codeAt(t, secret, 0), ""); !errors.Is(err, service.ErrInvalidMFACode) {
+		t.Fatalf("VerifySecondFactor with the enrollment code = %v, want ErrInvalidMFACode", err)
+	}
+	next := codeAt(t, secret, 1)
+	got, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", next, "")
+	if err != nil || got.ID != u.ID {
+		t.Fatalf("VerifySecondFactor = %v, %v, want the user", got, err)
+	}
+
+	// neither the code nor the challenge can be used again
+	challenge(t, svc, u.ID, "jti-2")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-2", "192.0.2.1", next, ""); !errors.Is(err, service.ErrInvalidMFACode) {
+		t.Fatalf("VerifySecondFactor with a replayed code = %v, want ErrInvalidMFACode", err)
+	}
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", next, ""); !errors.Is(err, service.ErrMFAChallengeInvalid) {
+		t.Fatalf("VerifySecondFactor with a used challenge = %v, want ErrMFAChallengeInvalid", err)
+	}
+	// a challenge belongs to its user
+	if _, err := svc.VerifySecondFactor(ctx, u.ID+1, "jti-2", "192.0.2.1", next, ""); !errors.Is(err, service.ErrMFAChallengeInvalid) {
+		t.Fatalf("VerifySecondFactor by another user = %v, want ErrMFAChallengeInvalid", err)
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	svc, u, _, recoveryCodes := newMFAService(t)
+
+	// codes are retyped loosely
+	challenge(t, svc, u.ID, "jti-1")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", "", " "+recoveryCodes[0]+" "); err != nil {
+		t.Fatalf("VerifySecondFactor with a recovery code = %v", err)
+	}
+	challenge(t, svc, u.ID, "jti-2")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-2", "192.0.2.1", "", recoveryCodes[0]); !errors.Is(err, service.ErrInvalidMFACode) {
+		t.Fatalf("VerifySecondFactor with a used recovery code = %v, want ErrInvalidMFACode", err)
+	}
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-2", "192.0.2.1", "", recoveryCodes[1]); err != nil {
+		t.Fatalf("VerifySecondFactor with another recovery code = %v", err)
+	}
+
+	// disabling TOTP drops the codes, enrolling again issues new ones
+	if err := svc.DisableTOTP(ctx, u.ID, "correct horse"); err != nil {
+		t.Fatalf("DisableTOTP = %v", err)
+	}
+	secret, _, beginErr := svc.BeginTOTPEnrollment(ctx, u.ID)
+	if beginErr != nil {
+		t.Fatalf("BeginTOTPEnrollment = %v", beginErr)
+	}
+	if _, err := svc.ConfirmTOTPEnrollment(ctx, u.ID, codeAt(t, secret, 0)); err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment = %v", err)
+	}
+	challenge(t, svc, u.ID, "jti-3")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-3", "192.0.2.1", "", recoveryCodes[2]); !errors.Is(err, service.ErrInvalidMFACode) {
+		t.Fatalf("VerifySecondFactor with a code of the old enrollment = %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestVerifySecondFactorLimitsAttempts(t *testing.T) {
+	ctx := context.Background()
+	svc, u, secret, _ := newMFAService(t)
+
+	challenge(t, svc, u.ID, "jti-1")
+	for i := 0; i < 5; i++ {
+		if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", "000000", ""); !errors.Is(err, service.ErrInvalidMFACode) {
+			t.Fatalf("attempt %d = %v, want ErrInvalidMFACode", i+1, err)
+		}
+	}
+	// even the right code fails once the challenge is out of attempts
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", codeAt(t, secret, 1), ""); !errors.Is(err, service.ErrMFAChallengeInvalid) {
+		t.Fatalf("attempt 6 = %v, want ErrMFAChallengeInvalid", err)
+	}
+	// a new password login gets a new challenge
+	challenge(t, svc, u.ID, "jti-2")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-2", "192.0.2.1", codeAt(t, secret, 1), ""); err != nil {
+		t.Fatalf("VerifySecondFactor with a new challenge = %v", err)
+	}
+}
+
+func TestDisableTOTPThrottlesPasswords(t *testing.T) {
+	ctx := context.Background()
+	svc, u, secret, _ := newMFAService(t)
+
+	for i := 0; i < 10; i++ {
+		if err := svc.DisableTOTP(ctx, u.ID, "wrong"); !errors.Is(err, service.ErrInvalidCredentials) {
+			t.Fatalf("attempt %d = %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+	var blocked *service.LoginBlockedError
+	if err := svc.DisableTOTP(ctx, u.ID, "correct horse"); !errors.As(err, &blocked) || !errors.Is(err, service.ErrAccountLocked) {
+		t.Fatalf("DisableTOTP when locked = %v, want ErrAccountLocked", err)
+	}
+	if _, _, err := svc.BeginTOTPEnrollment(ctx, u.ID); !errors.Is(err, service.ErrMFAAlreadyEnabled) {
+		t.Fatalf("BeginTOTPEnrollment after the locked DisableTOTP = %v, want ErrMFAAlreadyEnabled", err)
+	}
+	// the lock is the confirmations', the second login step still works
+	challenge(t, svc, u.ID, "jti-1")
+	if _, err := svc.VerifySecondFactor(ctx, u.ID, "jti-1", "192.0.2.1", codeAt(t, secret, 1), ""); err != nil {
+		t.Fatalf("VerifySecondFactor = %v", err)
+	}
+}
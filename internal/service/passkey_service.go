@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"server/internal/model"
+	"strconv"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrCeremonyNotFound = errors.New("service: passkey ceremony not found or expired")
+var ErrPasskeyRejected = errors.New("service: passkey verification failed")
+var ErrPasskeyNotFound = errors.New("service: passkey not found")
+
+// ceremonyTTL bounds the time between the begin and finish steps
+const ceremonyTTL = 5 * time.Minute
+
+// PasskeyService runs the WebAuthn registration and login ceremonies and
+// manages the passkeys a user registered.
+type PasskeyService struct {
+	wa          *webauthn.WebAuthn
+	authRepo    UserStore
+	passkeyRepo PasskeyStore
+}
+
+func NewPasskeyService(wa *webauthn.WebAuthn, authRepo UserStore, passkeyRepo PasskeyStore) *PasskeyService {
+	return &PasskeyService{wa: wa, authRepo: authRepo, passkeyRepo: passkeyRepo}
+}
+
+// BeginRegistration starts registering a new passkey for a logged-in user and
+// returns the ceremony ID and the options for navigator.credentials.create().
+func (s *PasskeyService) BeginRegistration(ctx context.Context, userID int) (string, *protocol.CredentialCreation, error) {
+	user, loadErr := s.loadUser(ctx, userID)
+	if loadErr != nil {
+		return "", nil, loadErr
+	}
+
+	// a discoverable credential lets the login start without a username
+	creation, session, beginErr := s.wa.BeginRegistration(user,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationRequired,
+		}),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(user.creds).CredentialDescriptors()),
+	)
+	if beginErr != nil {
+		return "", nil, fmt.Errorf("service: begin passkey registration: %w", beginErr)
+	}
+
+	ceremonyID, saveErr := s.saveCeremony(ctx, &userID, session)
+	if saveErr != nil {
+		return "", nil, saveErr
+	}
+	return ceremonyID, creation, nil
+}
+
+// FinishRegistration verifies the authenticator's response and stores the new passkey.
+func (s *PasskeyService) FinishRegistration(ctx context.Context, userID int, ceremonyID, name string, response []byte) (*model.Passkey, error) {
+	owner, session, takeErr := s.takeCeremony(ctx, ceremonyID)
+	if takeErr != nil {
+		return nil, takeErr
+	}
+	if owner == nil || *owner != userID {
+		return nil, ErrCeremonyNotFound
+	}
+
+	user, loadErr := s.loadUser(ctx, userID)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	parsed, parseErr := protocol.ParseCredentialCreationResponseBytes(response)
+	if parseErr != nil {
+		return nil, ErrPasskeyRejected
+	}
+	credential, createErr := s.wa.CreateCredential(user, *session, parsed)
+	if createErr != nil {
+		return nil, ErrPasskeyRejected
+	}
+
+	encoded, encodeErr := json.Marshal(credential)
+	if encodeErr != nil {
+		return nil, fmt.Errorf("service: encode passkey: %w", encodeErr)
+	}
+	p := &model.Passkey{
+		UId:          userID,
+		CredentialID: credential.ID,
+		Name:         name,
+		Credential:   encoded,
+	}
+	storeErr := s.passkeyRepo.Create(ctx, p)
+	if storeErr != nil {
+		return nil, fmt.Errorf("service: FinishRegistration failed: %w", storeErr)
+	}
+	return p, nil
+}
+
+// BeginLogin starts a passwordless login. The authenticator picks the
+// account, so no username is needed.
+func (s *PasskeyService) BeginLogin(ctx context.Context) (string, *protocol.CredentialAssertion, error) {
+	assertion, session, beginErr := s.wa.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if beginErr != nil {
+		return "", nil, fmt.Errorf("service: begin passkey login: %w", beginErr)
+	}
+
+	ceremonyID, saveErr := s.saveCeremony(ctx, nil, session)
+	if saveErr != nil {
+		return "", nil, saveErr
+	}
+	return ceremonyID, assertion, nil
+}
+
+// FinishLogin verifies the assertion and returns the user it belongs to.
+func (s *PasskeyService) FinishLogin(ctx context.Context, ceremonyID string, response []byte) (*model.User, error) {
+	owner, session, takeErr := s.takeCeremony(ctx, ceremonyID)
+	if takeErr != nil {
+		return nil, takeErr
+	}
+	if owner != nil {
+		// a registration ceremony can't be used to log in
+		return nil, ErrCeremonyNotFound
+	}
+
+	parsed, parseErr := protocol.ParseCredentialRequestResponseBytes(response)
+	if parseErr != nil {
+		return nil, ErrPasskeyRejected
+	}
+	found, credential, validateErr := s.wa.ValidatePasskeyLogin(s.discoverUser(ctx), *session, parsed)
+	if validateErr != nil {
+		return nil, ErrPasskeyRejected
+	}
+	if credential.Authenticator.CloneWarning {
+		// the sign count went backwards: two copies of this authenticator exist
+		return nil, ErrPasskeyRejected
+	}
+
+	user := found.(*passkeyUser)
+	passkeyID := user.passkeyIDs[string(credential.ID)]
+	encoded, encodeErr := json.Marshal(credential)
+	if encodeErr != nil {
+		return nil, fmt.Errorf("service: encode passkey: %w", encodeErr)
+	}
+	updateErr := s.passkeyRepo.UpdateAfterLogin(ctx, passkeyID, encoded)
+	if updateErr != nil {
+		return nil, fmt.Errorf("service: FinishLogin failed: %w", updateErr)
+	}
+	return user.user, nil
+}
+
+// ListPasskeys returns the passkeys registered by a user
+func (s *PasskeyService) ListPasskeys(ctx context.Context, userID int) ([]*model.Passkey, error) {
+	passkeys, listErr := s.passkeyRepo.ListByUser(ctx, userID)
+	if listErr != nil {
+		return nil, fmt.Errorf("service: ListPasskeys failed: %w", listErr)
+	}
+	return passkeys, nil
+}
+
+// RenamePasskey changes the label of one of the user's passkeys
+func (s *PasskeyService) RenamePasskey(ctx context.Context, userID, id int, name string) error {
+	renamed, renameErr := s.passkeyRepo.Rename(ctx, id, userID, name)
+	if renameErr != nil {
+		return fmt.Errorf("service: RenamePasskey failed: %w", renameErr)
+	}
+	if !renamed {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// DeletePasskey removes one of the user's passkeys
+func (s *PasskeyService) DeletePasskey(ctx context.Context, userID, id int) error {
+	deleted, deleteErr := s.passkeyRepo.Delete(ctx, id, userID)
+	if deleteErr != nil {
+		return fmt.Errorf("service: DeletePasskey failed: %w", deleteErr)
+	}
+	if !deleted {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// discoverUser resolves the user handle an authenticator returned during a discoverable login
+func (s *PasskeyService) discoverUser(ctx context.Context) webauthn.DiscoverableUserHandler {
+	return func(_, userHandle []byte) (webauthn.User, error) {
+		userID, parseErr := strconv.Atoi(string(userHandle))
+		if parseErr != nil {
+			return nil, fmt.Errorf("service: malformed user handle")
+		}
+		return s.loadUser(ctx, userID)
+	}
+}
+
+// loadUser wraps a user and their credentials as a webauthn.User
+func (s *PasskeyService) loadUser(ctx context.Context, userID int) (*passkeyUser, error) {
+	usr, fetchErr := s.authRepo.GetByID(ctx, userID)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("service: user lookup: %w", fetchErr)
+	}
+	passkeys, listErr := s.passkeyRepo.ListByUser(ctx, userID)
+	if listErr != nil {
+		return nil, fmt.Errorf("service: passkey lookup: %w", listErr)
+	}
+
+	user := &passkeyUser{user: usr, passkeyIDs: make(map[string]int, len(passkeys))}
+	for _, p := range passkeys {
+		var credential webauthn.Credential
+		decodeErr := json.Unmarshal(p.Credential, &credential)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("service: decode passkey %d: %w", p.ID, decodeErr)
+		}
+		user.creds = append(user.creds, credential)
+		user.passkeyIDs[string(credential.ID)] = p.ID
+	}
+	return user, nil
+}
+
+// saveCeremony persists the session data under a random ID, so the finish
+// step can land on any instance
+func (s *PasskeyService) saveCeremony(ctx context.Context, userID *int, session *webauthn.SessionData) (string, error) {
+	ceremonyID, idErr := randomToken()
+	if idErr != nil {
+		return "", fmt.Errorf("service: generate ceremony id: %w", idErr)
+	}
+	encoded, encodeErr := json.Marshal(session)
+	if encodeErr != nil {
+		return "", fmt.Errorf("service: encode ceremony: %w", encodeErr)
+	}
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(ceremonyTTL)
+	}
+
+	saveErr := s.passkeyRepo.SaveCeremony(ctx, ceremonyID, userID, encoded, expiresAt)
+	if saveErr != nil {
+		return "", fmt.Errorf("service: save ceremony: %w", saveErr)
+	}
+	return ceremonyID, nil
+}
+
+// takeCeremony loads and burns a ceremony
+func (s *PasskeyService) takeCeremony(ctx context.Context, ceremonyID string) (*int, *webauthn.SessionData, error) {
+	owner, encoded, takeErr := s.passkeyRepo.TakeCeremony(ctx, ceremonyID)
+	if takeErr != nil {
+		if errors.Is(takeErr, pgx.ErrNoRows) {
+			return nil, nil, ErrCeremonyNotFound
+		}
+		return nil, nil, fmt.Errorf("service: ceremony lookup: %w", takeErr)
+	}
+
+	session := new(webauthn.SessionData)
+	decodeErr := json.Unmarshal(encoded, session)
+	if decodeErr != nil {
+		return nil, nil, fmt.Errorf("service: decode ceremony: %w", decodeErr)
+	}
+	return owner, session, nil
+}
+
+// passkeyUser adapts model.User to webauthn.User
+type passkeyUser struct {
+	user  *model.User
+	creds []webauthn.Credential
+	// passkeyIDs maps credential IDs to passkey_credentials.id
+	passkeyIDs map[string]int
+}
+
+// WebAuthnID is the user handle stored on the authenticator. The numeric
+// user ID carries no personal data, as the spec requires.
+func (u *passkeyUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.ID))
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.creds
+}
@@ -0,0 +1,270 @@
+package service_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"strconv"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+// authenticator is a software passkey: an ES256 key with user
+// verification that answers the ceremonies like a browser would
+type authenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newAuthenticator(t *testing.T, userID int) *authenticator {
+	t.Helper()
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("GenerateKey = %v", keyErr)
+	}
+	credID := make([]byte, 16)
+	_, _ = rand.Read(credID)
+	return &authenticator{key: key, credID: credID, userHandle: []byte(strconv.Itoa(userID))}
+}
+
+// authData builds the authenticator data for flags, with the credential
+// attached when attested is set
+func (a *authenticator) authData(t *testing.T, attested bool) []byte {
+	t.Helper()
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	if attested {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attested {
+		return data
+	}
+
+	publicKey, keyErr := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if keyErr != nil {
+		t.Fatalf("encode public key: %v", keyErr)
+	}
+	data = append(data, make([]byte, 16)...) // zero AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credID)))
+	data = append(data, a.credID...)
+	return append(data, publicKey...)
+}
+
+func clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	t.Helper()
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testOrigin,
+	})
+	return data
+}
+
+// create answers navigator.credentials.create() with "none" attestation
+func (a *authenticator) create(t *testing.T, options *protocol.CredentialCreation) []byte {
+	t.Helper()
+	attestation, encodeErr := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(t, true),
+	})
+	if encodeErr != nil {
+		t.Fatalf("encode attestation: %v", encodeErr)
+	}
+	return a.respond(map[string]string{
+		"clientDataJSON":    b64(clientData(t, "webauthn.create", options.Response.Challenge)),
+		"attestationObject": b64(attestation),
+	})
+}
+
+// get answers navigator.credentials.get() and bumps the sign count
+func (a *authenticator) get(t *testing.T, options *protocol.CredentialAssertion) []byte {
+	t.Helper()
+	a.signCount++
+	data := a.authData(t, false)
+	client := clientData(t, "webauthn.get", options.Response.Challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, data...), clientHash[:]...))
+	signature, signErr := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if signErr != nil {
+		t.Fatalf("sign assertion: %v", signErr)
+	}
+	return a.respond(map[string]string{
+		"clientDataJSON":    b64(client),
+		"authenticatorData": b64(data),
+		"signature":         b64(signature),
+		"userHandle":        b64(a.userHandle),
+	})
+}
+
+func (a *authenticator) respond(response map[string]string) []byte {
+	body, _ := json.Marshal(map[string]any{
+		"id":       b64(a.credID),
+		"rawId":    b64(a.credID),
+		"type":     "public-key",
+		"response": response,
+	})
+	return body
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newPasskeyService(t *testing.T) (*service.PasskeyService, *model.User) {
+	t.Helper()
+	wa, waErr := webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPDisplayName: "Example",
+		RPOrigins:     []string{testOrigin},
+	})
+	if waErr != nil {
+		t.Fatalf("webauthn.New = %v", waErr)
+	}
+	db := memory.New()
+	users := memory.NewAuthRepo(db)
+	u := &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: "hash"}
+	if err := users.CreateUser(context.Background(), u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	return service.NewPasskeyService(wa, users, memory.NewPasskeyRepo(db)), u
+}
+
+// register runs a whole registration ceremony with the authenticator
+func register(t *testing.T, svc *service.PasskeyService, userID int, a *authenticator) *model.Passkey {
+	t.Helper()
+	ctx := context.Background()
+	ceremonyID, options, beginErr := svc.BeginRegistration(ctx, userID)
+	if beginErr != nil {
+		t.Fatalf("BeginRegistration = %v", beginErr)
+	}
+	p, finishErr := svc.FinishRegistration(ctx, userID, ceremonyID, "Laptop", a.create(t, options))
+	if finishErr != nil {
+		t.Fatalf("FinishRegistration = %v", finishErr)
+	}
+	return p
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newPasskeyService(t)
+	a := newAuthenticator(t, u.ID)
+
+	p := register(t, svc, u.ID, a)
+	if p.ID == 0 || p.UId != u.ID || p.Name != "Laptop" || string(p.CredentialID) != string(a.credID) {
+		t.Fatalf("FinishRegistration = %+v", p)
+	}
+	passkeys, _ := svc.ListPasskeys(ctx, u.ID)
+	if len(passkeys) != 1 || passkeys[0].ID != p.ID {
+		t.Fatalf("ListPasskeys = %+v, want the new passkey", passkeys)
+	}
+
+	// the ceremony can be finished once, by the user who started it
+	ceremonyID, options, _ := svc.BeginRegistration(ctx, u.ID)
+	second := newAuthenticator(t, u.ID)
+	if _, err := svc.FinishRegistration(ctx, u.ID+1, ceremonyID, "Phone", second.create(t, options)); !errors.Is(err, service.ErrCeremonyNotFound) {
+		t.Fatalf("FinishRegistration by another user = %v, want ErrCeremonyNotFound", err)
+	}
+	if _, err := svc.FinishRegistration(ctx, u.ID, ceremonyID, "Phone", second.create(t, options)); !errors.Is(err, service.ErrCeremonyNotFound) {
+		t.Fatalf("FinishRegistration of a used ceremony = %v, want ErrCeremonyNotFound", err)
+	}
+
+	// the response must answer the challenge of its own ceremony
+	ceremonyID, _, _ = svc.BeginRegistration(ctx, u.ID)
+	if _, err := svc.FinishRegistration(ctx, u.ID, ceremonyID, "Phone", second.create(t, options)); !errors.Is(err, service.ErrPasskeyRejected) {
+		t.Fatalf("FinishRegistration with a stale challenge = %v, want ErrPasskeyRejected", err)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newPasskeyService(t)
+	a := newAuthenticator(t, u.ID)
+	p := register(t, svc, u.ID, a)
+
+	ceremonyID, options, beginErr := svc.BeginLogin(ctx)
+	if beginErr != nil {
+		t.Fatalf("BeginLogin = %v", beginErr)
+	}
+	user, loginErr := svc.FinishLogin(ctx, ceremonyID, a.get(t, options))
+	if loginErr != nil {
+		t.Fatalf("FinishLogin = %v", loginErr)
+	}
+	if user.ID != u.ID {
+		t.Fatalf("FinishLogin logged in user %d, want %d", user.ID, u.ID)
+	}
+	passkeys, _ := svc.ListPasskeys(ctx, u.ID)
+	if passkeys[0].ID != p.ID || passkeys[0].LastUsedAt == nil {
+		t.Fatalf("passkey after login = %+v, want LastUsedAt set", passkeys[0])
+	}
+
+	// every challenge is answered once
+	if _, err := svc.FinishLogin(ctx, ceremonyID, a.get(t, options)); !errors.Is(err, service.ErrCeremonyNotFound) {
+		t.Fatalf("FinishLogin of a used ceremony = %v, want ErrCeremonyNotFound", err)
+	}
+
+	// a key that wasn't registered doesn't verify
+	ceremonyID, options, _ = svc.BeginLogin(ctx)
+	impostor := newAuthenticator(t, u.ID)
+	impostor.credID = a.credID
+	if _, err := svc.FinishLogin(ctx, ceremonyID, impostor.get(t, options)); !errors.Is(err, service.ErrPasskeyRejected) {
+		t.Fatalf("FinishLogin with another key = %v, want ErrPasskeyRejected", err)
+	}
+
+	// a sign count that doesn't grow means the authenticator was cloned
+	ceremonyID, options, _ = svc.BeginLogin(ctx)
+	a.signCount = 0 // the next assertion repeats the count of the first login
+	if _, err := svc.FinishLogin(ctx, ceremonyID, a.get(t, options)); !errors.Is(err, service.ErrPasskeyRejected) {
+		t.Fatalf("FinishLogin with a repeated sign count = %v, want ErrPasskeyRejected", err)
+	}
+
+	// a registration ceremony can't be used to log in
+	ceremonyID, _, _ = svc.BeginRegistration(ctx, u.ID)
+	if _, err := svc.FinishLogin(ctx, ceremonyID, a.get(t, options)); !errors.Is(err, service.ErrCeremonyNotFound) {
+		t.Fatalf("FinishLogin of a registration ceremony = %v, want ErrCeremonyNotFound", err)
+	}
+}
+
+func TestCheckEmailVerified(t *testing.T) {
+	u := &model.User{ID: 1, Email: "ada@example.com"}
+	if err := service.NewAuthService(nil, nil, true).CheckEmailVerified(u); !errors.Is(err, service.ErrEmailNotVerified) {
+		t.Fatalf("CheckEmailVerified of an unverified user = %v, want ErrEmailNotVerified", err)
+	}
+	if err := service.NewAuthService(nil, nil, false).CheckEmailVerified(u); err != nil {
+		t.Fatalf("CheckEmailVerified without REQUIRE_EMAIL_VERIFICATION = %v", err)
+	}
+	u.EmailVerifiedAt = &u.CreatedAt
+	if err := service.NewAuthService(nil, nil, true).CheckEmailVerified(u); err != nil {
+		t.Fatalf("CheckEmailVerified of a verified user = %v", err)
+	}
+}
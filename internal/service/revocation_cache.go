@@ -0,0 +1,102 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// revocationCache keeps recent revocation lookups in memory so the JWT
+// check doesn't hit Postgres on every request. Positive results for a jti
+// are kept until the token expires; negative results and per-user cutoffs
+// only for ttl, so revocations made by other instances are picked up.
+type revocationCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	jtis      map[string]jtiEntry
+	cutoffs   map[int]cutoffEntry
+	lastPrune time.Time
+}
+
+type jtiEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+type cutoffEntry struct {
+	cutoff time.Time
+	until  time.Time
+}
+
+func newRevocationCache(ttl time.Duration) *revocationCache {
+	return &revocationCache{
+		ttl:       ttl,
+		jtis:      make(map[string]jtiEntry),
+		cutoffs:   make(map[int]cutoffEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+// jti returns the cached revocation state of a token, if still fresh
+func (c *revocationCache) jti(jti string) (revoked, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.jtis[jti]
+	if !found || time.Now().After(entry.until) {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+// setJTI caches a lookup result; revoked tokens stay cached until they expire
+func (c *revocationCache) setJTI(jti string, revoked bool, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	until := time.Now().Add(c.ttl)
+	if revoked {
+		until = expiresAt
+	}
+	c.jtis[jti] = jtiEntry{revoked: revoked, until: until}
+	c.pruneLocked()
+}
+
+// cutoff returns the cached revoked_before time of a user, if still fresh
+func (c *revocationCache) cutoff(userID int) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.cutoffs[userID]
+	if !found || time.Now().After(entry.until) {
+		return time.Time{}, false
+	}
+	return entry.cutoff, true
+}
+
+func (c *revocationCache) setCutoff(userID int, cutoff time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cutoffs[userID] = cutoffEntry{cutoff: cutoff, until: time.Now().Add(c.ttl)}
+	c.pruneLocked()
+}
+
+// pruneLocked drops stale entries at most once per ttl
+func (c *revocationCache) pruneLocked() {
+	now := time.Now()
+	if now.Sub(c.lastPrune) < c.ttl {
+		return
+	}
+	for k, e := range c.jtis {
+		if now.After(e.until) {
+			delete(c.jtis, k)
+		}
+	}
+	for k, e := range c.cutoffs {
+		if now.After(e.until) {
+			delete(c.cutoffs, k)
+		}
+	}
+	c.lastPrune = now
+}
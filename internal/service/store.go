@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"server/internal/model"
+	"time"
+)
+
+// UserStore persists user accounts. repo.AuthRepo keeps them in Postgres,
+// memory.AuthRepo in process memory.
+//
+// Lookups of missing users fail with pgx.ErrNoRows; creating or switching
+// to an email that's already taken fails with repo.ErrEmailTaken. Deleting
+// a user deletes their addresses too.
+type UserStore interface {
+	CreateUser(ctx context.Context, u *model.User) error
+	GetByEmail(ctx context.Context, email string) (*model.User, error)
+	GetByID(ctx context.Context, id int) (*model.User, error)
+	DeleteUser(ctx context.Context, id int) error
+	MarkEmailVerified(ctx context.Context, id int) error
+	UpdatePassword(ctx context.Context, id int, passwordHash string) error
+	UpdateEmail(ctx context.Context, id int, email string) error
+	SetPendingTOTP(ctx context.Context, id int, encryptedSecret string) error
+	EnableTOTP(ctx context.Context, id int) error
+	DisableTOTP(ctx context.Context, id int) error
+	AdvanceTOTPStep(ctx context.Context, id int, step int64) (bool, error)
+}
+
+// AddressStore persists the addresses of users.
+//
+// GetByID, GetDefaultForUser, SetDefault, Patch and Delete fail with
+// pgx.ErrNoRows for a missing address. Delete is a soft delete: the address
+// is missing to everything but GetDeletedByID, Restore, ListByUser and
+// CountByUser with q.Deleted, until PurgeDeleted removes it for good, with its
+// recorded versions. Every change bumps the Version of an
+// address; Patch and Delete with a version other than 0 only apply to the
+// address at that version, and fail with pgx.ErrNoRows otherwise. A user has
+// at most one default address of each type; a write that would add a second
+// fails with repo.ErrDuplicateDefault. FindByFingerprint returns the oldest
+// live address of a user and type with a.Fingerprint, or pgx.ErrNoRows. A
+// Patch that changes the fingerprint clears the location; SetLocation only
+// stores one while the address has the given fingerprint.
+type AddressStore interface {
+	CreateAddress(ctx context.Context, a *model.Address) error
+	ClearDefaultForUser(ctx context.Context, userID int, addrType string) error
+	GetByID(ctx context.Context, id int) (*model.Address, error)
+	Delete(ctx context.Context, id, version int) error
+	GetDeletedByID(ctx context.Context, id int) (*model.Address, error)
+	Restore(ctx context.Context, id int) (*model.Address, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	Patch(ctx context.Context, id, version int, p model.AddressPatch) (*model.Address, error)
+	GetDefaultForUser(ctx context.Context, userID int, addrType string) (*model.Address, error)
+	SetDefault(ctx context.Context, userID, id int) (*model.Address, error)
+	RecordVersion(ctx context.Context, prior model.Address, changedBy int) error
+	ListVersions(ctx context.Context, addressID int) ([]model.AddressVersion, error)
+	FindByFingerprint(ctx context.Context, userID int, addrType, fingerprint string) (*model.Address, error)
+	ListWithoutFingerprint(ctx context.Context, limit int) ([]model.Address, error)
+	SetFingerprint(ctx context.Context, id int, fingerprint string) error
+	SetLocation(ctx context.Context, id int, fingerprint string, loc model.Location) error
+	ListByUser(ctx context.Context, q model.AddressQuery) ([]model.Address, error)
+	CountByUser(ctx context.Context, q model.AddressQuery) (int, error)
+}
+
+// PasskeyStore persists registered passkeys and the state of unfinished
+// WebAuthn ceremonies. repo.PasskeyRepo keeps them in Postgres,
+// memory.PasskeyRepo in process memory.
+//
+// TakeCeremony deletes the ceremony it returns and fails with pgx.ErrNoRows
+// when there is no unexpired ceremony with that ID. Rename and Delete report
+// false when the user has no passkey with that ID.
+type PasskeyStore interface {
+	Create(ctx context.Context, p *model.Passkey) error
+	ListByUser(ctx context.Context, userID int) ([]*model.Passkey, error)
+	UpdateAfterLogin(ctx context.Context, id int, credential []byte) error
+	Rename(ctx context.Context, id, userID int, name string) (bool, error)
+	Delete(ctx context.Context, id, userID int) (bool, error)
+	SaveCeremony(ctx context.Context, id string, userID *int, session []byte, expiresAt time.Time) error
+	TakeCeremony(ctx context.Context, id string) (*int, []byte, error)
+}
+
+// Transactor runs fn as one unit of work: the store calls fn makes with the
+// ctx it is given take effect together or not at all.
+type Transactor interface {
+	WithinTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// LoginFailureStore counts failed logins per key for LoginThrottle.
+// repo.LoginFailureRepo keeps them in Postgres, memory.LoginFailureRepo in
+// process memory.
+//
+// Get fails with pgx.ErrNoRows for a key without recorded failures.
+// RecordFailure starts the count over when the last failure is older than
+// windowStart; Lock resets the count while the lockout is in force.
+type LoginFailureStore interface {
+	Get(ctx context.Context, key string) (*model.LoginFailure, error)
+	RecordFailure(ctx context.Context, key string, windowStart time.Time) (*model.LoginFailure, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Clear(ctx context.Context, key string) error
+	PurgeStale(ctx context.Context, windowStart time.Time) error
+}
+
+// RecoveryCodeStore persists the hashed recovery codes of the users with
+// two-factor authentication. repo.RecoveryCodeRepo keeps them in Postgres,
+// memory.RecoveryCodeRepo in process memory.
+//
+// Consume reports false when the user has no unused code with that hash.
+type RecoveryCodeStore interface {
+	ReplaceForUser(ctx context.Context, userID int, hashes []string) error
+	Consume(ctx context.Context, userID int, hash string) (bool, error)
+	DeleteForUser(ctx context.Context, userID int) error
+}
+
+// MFAChallengeStore persists the challenges of mfa_pending tokens, keyed by
+// the token's jti. repo.MFAChallengeRepo keeps them in Postgres,
+// memory.MFAChallengeRepo in process memory.
+//
+// Attempt reports false when the challenge isn't the user's, expired, was
+// consumed or already had maxAttempts; Consume reports false when the
+// challenge was already consumed.
+type MFAChallengeStore interface {
+	Create(ctx context.Context, jti string, userID int, expiresAt time.Time) error
+	Attempt(ctx context.Context, jti string, userID, maxAttempts int) (bool, error)
+	Consume(ctx context.Context, jti string) (bool, error)
+	PurgeExpired(ctx context.Context) error
+}
+
+// RefreshTokenStore persists refresh tokens by the hash of their raw value.
+// repo.RefreshTokenRepo keeps them in Postgres, memory.RefreshTokenRepo in
+// process memory.
+//
+// GetByHash fails with pgx.ErrNoRows for an unknown hash. MarkRotated
+// reports false when the token was already rotated or revoked.
+type RefreshTokenStore interface {
+	Create(ctx context.Context, t *model.RefreshToken) error
+	GetByHash(ctx context.Context, hash string) (*model.RefreshToken, error)
+	MarkRotated(ctx context.Context, id int) (bool, error)
+	RevokeFamily(ctx context.Context, familyID string) error
+	RevokeAllForUser(ctx context.Context, userID int) error
+}
+
+// UserTokenStore persists the single-use tokens mailed to users, by the
+// hash of their raw value. repo.UserTokenRepo keeps them in Postgres,
+// memory.UserTokenRepo in process memory.
+//
+// Consume fails with pgx.ErrNoRows when no unused, unexpired token of the
+// purpose has that hash.
+type UserTokenStore interface {
+	Create(ctx context.Context, t *model.UserToken) error
+	Consume(ctx context.Context, hash, purpose string) (*model.UserToken, error)
+	InvalidateForUser(ctx context.Context, userID int, purpose string) error
+}
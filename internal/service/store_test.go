@@ -0,0 +1,1073 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"server/internal/model"
+	"server/internal/repo"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The contract tests run against every store implementation. The Postgres
+// stores are only tested when TEST_DATABASE_URL points at a migrated,
+// disposable database: each test truncates the users table, everything
+// that references it and the login failures.
+
+// stores is one backend under test
+type stores struct {
+	users     service.UserStore
+	addresses service.AddressStore
+	passkeys  service.PasskeyStore
+	failures  service.LoginFailureStore
+	recovery  service.RecoveryCodeStore
+	mfa       service.MFAChallengeStore
+	refresh   service.RefreshTokenStore
+	tokens    service.UserTokenStore
+	tx        service.Transactor
+}
+
+type backend struct {
+	name string
+	// open returns empty stores
+	open func(t *testing.T) stores
+}
+
+func backends(t *testing.T) []backend {
+	all := []backend{{
+		name: "memory",
+		open: func(t *testing.T) stores {
+			db := memory.New()
+			return stores{memory.NewAuthRepo(db), memory.NewAddressRepo(db), memory.NewPasskeyRepo(db), memory.NewLoginFailureRepo(db),
+				memory.NewRecoveryCodeRepo(db), memory.NewMFAChallengeRepo(db), memory.NewRefreshTokenRepo(db), memory.NewUserTokenRepo(db), memory.NewTxManager(db)}
+		},
+	}}
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Log("TEST_DATABASE_URL not set, skipping the postgres stores")
+		return all
+	}
+	pool, poolErr := pgxpool.New(context.Background(), url)
+	if poolErr != nil {
+		t.Fatalf("connect to TEST_DATABASE_URL: %v", poolErr)
+	}
+	t.Cleanup(pool.Close)
+
+	return append(all, backend{
+		name: "postgres",
+		open: func(t *testing.T) stores {
+			_, truncErr := pool.Exec(context.Background(), `TRUNCATE users, login_failures RESTART IDENTITY CASCADE`)
+			if truncErr != nil {
+				t.Fatalf("truncate: %v", truncErr)
+			}
+			return stores{repo.NewAuthRepo(pool), repo.NewAddressRepo(pool), repo.NewPasskeyRepo(pool), repo.NewLoginFailureRepo(pool),
+				repo.NewRecoveryCodeRepo(pool), repo.NewMFAChallengeRepo(pool), repo.NewRefreshTokenRepo(pool), repo.NewUserTokenRepo(pool), repo.NewTxManager(pool)}
+		},
+	})
+}
+
+var errAbort = errors.New("abort")
+
+var contractTests = []struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, s stores)
+}{
+	{"create and get user", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		if u.ID == 0 {
+			t.Fatal("CreateUser didn't set the id")
+		}
+		byID, idErr := s.users.GetByID(ctx, u.ID)
+		if idErr != nil || byID.Email != "ada@example.com" || byID.Username != "ada" {
+			t.Fatalf("GetByID = %+v, %v", byID, idErr)
+		}
+		byEmail, emailErr := s.users.GetByEmail(ctx, "ada@example.com")
+		if emailErr != nil || byEmail.ID != u.ID {
+			t.Fatalf("GetByEmail = %+v, %v", byEmail, emailErr)
+		}
+	}},
+	{"missing user", func(t *testing.T, ctx context.Context, s stores) {
+		if _, err := s.users.GetByID(ctx, 4242); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByID = %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.users.GetByEmail(ctx, "nobody@example.com"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByEmail = %v, want pgx.ErrNoRows", err)
+		}
+		if err := s.users.UpdatePassword(ctx, 4242, "hash"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("UpdatePassword = %v, want pgx.ErrNoRows", err)
+		}
+		if err := s.users.UpdateEmail(ctx, 4242, "new@example.com"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("UpdateEmail = %v, want pgx.ErrNoRows", err)
+		}
+	}},
+	{"unique email", func(t *testing.T, ctx context.Context, s stores) {
+		mustCreateUser(t, ctx, s, "ada@example.com")
+		other := mustCreateUser(t, ctx, s, "bob@example.com")
+
+		dup := &model.User{Username: "ada2", Email: "ada@example.com", PasswordHash: "hash"}
+		if err := s.users.CreateUser(ctx, dup); !errors.Is(err, repo.ErrEmailTaken) {
+			t.Fatalf("CreateUser = %v, want repo.ErrEmailTaken", err)
+		}
+		if err := s.users.UpdateEmail(ctx, other.ID, "ada@example.com"); !errors.Is(err, repo.ErrEmailTaken) {
+			t.Fatalf("UpdateEmail = %v, want repo.ErrEmailTaken", err)
+		}
+		if err := s.users.UpdateEmail(ctx, other.ID, "bob@example.com"); err != nil {
+			t.Fatalf("UpdateEmail to own email = %v", err)
+		}
+	}},
+	{"update email marks it verified", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		if err := s.users.UpdateEmail(ctx, u.ID, "lovelace@example.com"); err != nil {
+			t.Fatalf("UpdateEmail = %v", err)
+		}
+		got, _ := s.users.GetByID(ctx, u.ID)
+		if got.Email != "lovelace@example.com" || got.EmailVerifiedAt == nil {
+			t.Fatalf("after UpdateEmail: %+v", got)
+		}
+	}},
+	{"mark email verified keeps first time", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		if err := s.users.MarkEmailVerified(ctx, u.ID); err != nil {
+			t.Fatalf("MarkEmailVerified = %v", err)
+		}
+		first, _ := s.users.GetByID(ctx, u.ID)
+		if first.EmailVerifiedAt == nil {
+			t.Fatal("EmailVerifiedAt not set")
+		}
+		_ = s.users.MarkEmailVerified(ctx, u.ID)
+		second, _ := s.users.GetByID(ctx, u.ID)
+		if !second.EmailVerifiedAt.Equal(*first.EmailVerifiedAt) {
+			t.Fatalf("EmailVerifiedAt moved from %v to %v", first.EmailVerifiedAt, second.EmailVerifiedAt)
+		}
+	}},
+	{"totp lifecycle", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		if err := s.users.EnableTOTP(ctx, u.ID); err != nil {
+			t.Fatalf("EnableTOTP = %v", err)
+		}
+		if got, _ := s.users.GetByID(ctx, u.ID); got.TOTPEnabledAt != nil {
+			t.Fatal("TOTP enabled without a secret")
+		}
+
+		_ = s.users.SetPendingTOTP(ctx, u.ID, "secret")
+		_ = s.users.EnableTOTP(ctx, u.ID)
+		if got, _ := s.users.GetByID(ctx, u.ID); got.TOTPSecret != "secret" || got.TOTPEnabledAt == nil {
+			t.Fatalf("after EnableTOTP: %+v", got)
+		}
+
+		for _, step := range []struct {
+			step int64
+			want bool
+		}{{10, true}, {10, false}, {9, false}, {11, true}} {
+			advanced, err := s.users.AdvanceTOTPStep(ctx, u.ID, step.step)
+			if err != nil || advanced != step.want {
+				t.Fatalf("AdvanceTOTPStep(%d) = %v, %v, want %v", step.step, advanced, err, step.want)
+			}
+		}
+
+		_ = s.users.DisableTOTP(ctx, u.ID)
+		if got, _ := s.users.GetByID(ctx, u.ID); got.TOTPSecret != "" || got.TOTPEnabledAt != nil || got.TOTPLastStep != 0 {
+			t.Fatalf("after DisableTOTP: %+v", got)
+		}
+	}},
+	{"create and get address", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := mustCreateAddress(t, ctx, s, u.ID, false)
+		got, getErr := s.addresses.GetByID(ctx, a.ID)
+		if getErr != nil {
+			t.Fatalf("GetByID = %v", getErr)
+		}
+		if got.UId != u.ID || got.Addr_1 != a.Addr_1 || got.City != "Berlin" || got.IsDefault {
+			t.Fatalf("GetByID = %+v", got)
+		}
+
+		us := &model.Address{UId: u.ID, Addr_1: "1 Main St", Zip: "10001", City: "New York", State: "NY", Country: "US", Type: model.AddressBilling, Label: "Office"}
+		if err := s.addresses.CreateAddress(ctx, us); err != nil {
+			t.Fatalf("CreateAddress = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, us.ID); got.State != "NY" || got.Country != "US" || got.Type != model.AddressBilling || got.Label != "Office" {
+			t.Fatalf("GetByID = %+v", got)
+		}
+	}},
+	{"missing address", func(t *testing.T, ctx context.Context, s stores) {
+		if _, err := s.addresses.GetByID(ctx, 4242); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByID = %v, want pgx.ErrNoRows", err)
+		}
+		a := &model.Address{UId: 4242, Addr_1: "Nowhere 1", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressShipping}
+		if err := s.addresses.CreateAddress(ctx, a); err == nil {
+			t.Fatal("CreateAddress for a missing user succeeded")
+		}
+	}},
+	{"patch and delete address", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := mustCreateAddress(t, ctx, s, u.ID, false)
+		city, state := "Hamburg", "HH"
+		patched, patchErr := s.addresses.Patch(ctx, a.ID, 0, model.AddressPatch{City: &city, State: &state})
+		if patchErr != nil {
+			t.Fatalf("Patch = %v", patchErr)
+		}
+		if patched.City != "Hamburg" || patched.State != "HH" || patched.Addr_1 != a.Addr_1 || patched.Zip != a.Zip || patched.UId != u.ID {
+			t.Fatalf("Patch = %+v", patched)
+		}
+		if got, _ := s.addresses.GetByID(ctx, a.ID); got.City != "Hamburg" || got.Country != a.Country {
+			t.Fatalf("after Patch: %+v", got)
+		}
+		if _, err := s.addresses.Patch(ctx, 4242, 0, model.AddressPatch{City: &city}); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Patch of missing address = %v, want pgx.ErrNoRows", err)
+		}
+		if err := s.addresses.Delete(ctx, a.ID, 0); err != nil {
+			t.Fatalf("Delete = %v", err)
+		}
+		if _, err := s.addresses.GetByID(ctx, a.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByID after Delete = %v, want pgx.ErrNoRows", err)
+		}
+	}},
+	{"versions", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := mustCreateAddress(t, ctx, s, u.ID, true)
+		if a.Version != 1 {
+			t.Fatalf("new address at version %d, want 1", a.Version)
+		}
+		city := "Hamburg"
+		patched, patchErr := s.addresses.Patch(ctx, a.ID, 1, model.AddressPatch{City: &city})
+		if patchErr != nil || patched.Version != 2 {
+			t.Fatalf("Patch at version 1 = %+v, %v", patched, patchErr)
+		}
+		if _, err := s.addresses.Patch(ctx, a.ID, 1, model.AddressPatch{City: &city}); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Patch at stale version = %v, want pgx.ErrNoRows", err)
+		}
+
+		// moving the default changes both addresses
+		other := mustCreateAddress(t, ctx, s, u.ID, false)
+		if _, err := s.addresses.SetDefault(ctx, u.ID, other.ID); err != nil {
+			t.Fatalf("SetDefault = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, a.ID); got.Version != 3 {
+			t.Fatalf("old default at version %d, want 3", got.Version)
+		}
+		if err := s.addresses.ClearDefaultForUser(ctx, u.ID, model.AddressShipping); err != nil {
+			t.Fatalf("ClearDefaultForUser = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, other.ID); got.Version != 3 {
+			t.Fatalf("cleared default at version %d, want 3", got.Version)
+		}
+
+		if err := s.addresses.Delete(ctx, a.ID, 2); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Delete at stale version = %v, want pgx.ErrNoRows", err)
+		}
+		if err := s.addresses.Delete(ctx, a.ID, 3); err != nil {
+			t.Fatalf("Delete at current version = %v", err)
+		}
+		if err := s.addresses.Delete(ctx, a.ID, 0); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Delete of deleted address = %v, want pgx.ErrNoRows", err)
+		}
+	}},
+	{"one default address per user", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		def := mustCreateAddress(t, ctx, s, u.ID, true)
+		other := mustCreateAddress(t, ctx, s, u.ID, false)
+
+		second := &model.Address{UId: u.ID, Addr_1: "Second str. 2", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressShipping, IsDefault: true}
+		if err := s.addresses.CreateAddress(ctx, second); !errors.Is(err, repo.ErrDuplicateDefault) {
+			t.Fatalf("CreateAddress = %v, want repo.ErrDuplicateDefault", err)
+		}
+		yes, city := true, "Hamburg"
+		if _, err := s.addresses.Patch(ctx, other.ID, 0, model.AddressPatch{IsDefault: &yes}); !errors.Is(err, repo.ErrDuplicateDefault) {
+			t.Fatalf("Patch = %v, want repo.ErrDuplicateDefault", err)
+		}
+		if _, err := s.addresses.Patch(ctx, def.ID, 0, model.AddressPatch{City: &city, IsDefault: &yes}); err != nil {
+			t.Fatalf("Patch of the default itself = %v", err)
+		}
+
+		// other users have their own default
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		mustCreateAddress(t, ctx, s, bob.ID, true)
+
+		if err := s.addresses.ClearDefaultForUser(ctx, u.ID, model.AddressShipping); err != nil {
+			t.Fatalf("ClearDefaultForUser = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, def.ID); got.IsDefault {
+			t.Fatal("default not cleared")
+		}
+		if _, err := s.addresses.Patch(ctx, other.ID, 0, model.AddressPatch{IsDefault: &yes}); err != nil {
+			t.Fatalf("Patch after ClearDefaultForUser = %v", err)
+		}
+	}},
+	{"one default address per type", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		shipping := mustCreateAddress(t, ctx, s, u.ID, true)
+		billing := &model.Address{UId: u.ID, Addr_1: "Billing str. 1", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressBilling, IsDefault: true}
+		if err := s.addresses.CreateAddress(ctx, billing); err != nil {
+			t.Fatalf("CreateAddress of a default billing address = %v", err)
+		}
+		nextBilling := &model.Address{UId: u.ID, Addr_1: "Billing str. 2", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressBilling}
+		if err := s.addresses.CreateAddress(ctx, nextBilling); err != nil {
+			t.Fatalf("CreateAddress = %v", err)
+		}
+
+		// moving the billing default leaves the shipping default alone
+		if _, err := s.addresses.SetDefault(ctx, u.ID, nextBilling.ID); err != nil {
+			t.Fatalf("SetDefault = %v", err)
+		}
+		if def, _ := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressBilling); def == nil || def.ID != nextBilling.ID {
+			t.Fatalf("billing default = %+v, want address %d", def, nextBilling.ID)
+		}
+		if def, _ := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressShipping); def == nil || def.ID != shipping.ID || def.Version != 1 {
+			t.Fatalf("shipping default = %+v, want address %d unchanged", def, shipping.ID)
+		}
+		if _, err := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressCustom); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("custom default = %v, want pgx.ErrNoRows", err)
+		}
+
+		// a default that changes type must not clash with the other default
+		billingType := model.AddressBilling
+		if _, err := s.addresses.Patch(ctx, shipping.ID, 0, model.AddressPatch{Type: &billingType}); !errors.Is(err, repo.ErrDuplicateDefault) {
+			t.Fatalf("Patch of type = %v, want repo.ErrDuplicateDefault", err)
+		}
+		if err := s.addresses.ClearDefaultForUser(ctx, u.ID, model.AddressBilling); err != nil {
+			t.Fatalf("ClearDefaultForUser = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, shipping.ID); !got.IsDefault {
+			t.Fatal("clearing the billing default cleared the shipping default")
+		}
+		if _, err := s.addresses.Patch(ctx, shipping.ID, 0, model.AddressPatch{Type: &billingType}); err != nil {
+			t.Fatalf("Patch of type after ClearDefaultForUser = %v", err)
+		}
+
+		q := model.AddressQuery{UId: u.ID, SortBy: "created_at", Type: model.AddressBilling, Limit: 10}
+		listed, _ := s.addresses.ListByUser(ctx, q)
+		if want := []int{shipping.ID, billing.ID, nextBilling.ID}; !equalIDs(addressIDs(listed), want) {
+			t.Fatalf("ListByUser by type = %v, want %v", addressIDs(listed), want)
+		}
+	}},
+	{"soft delete, restore and purge address", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		def := mustCreateAddress(t, ctx, s, u.ID, true)
+		kept := mustCreateAddress(t, ctx, s, u.ID, false)
+
+		if _, err := s.addresses.GetDeletedByID(ctx, def.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetDeletedByID of a live address = %v, want pgx.ErrNoRows", err)
+		}
+		if err := s.addresses.Delete(ctx, def.ID, 0); err != nil {
+			t.Fatalf("Delete = %v", err)
+		}
+		deleted, getErr := s.addresses.GetDeletedByID(ctx, def.ID)
+		if getErr != nil || deleted.DeletedAt == nil || deleted.IsDefault || deleted.Version != 2 {
+			t.Fatalf("GetDeletedByID = %+v, %v", deleted, getErr)
+		}
+
+		// a deleted address is gone for everything else
+		if _, err := s.addresses.GetByID(ctx, def.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByID of deleted = %v, want pgx.ErrNoRows", err)
+		}
+		city := "Hamburg"
+		if _, err := s.addresses.Patch(ctx, def.ID, 0, model.AddressPatch{City: &city}); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Patch of deleted = %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.addresses.SetDefault(ctx, u.ID, def.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("SetDefault of deleted = %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressShipping); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetDefaultForUser after deleting the default = %v, want pgx.ErrNoRows", err)
+		}
+		q := model.AddressQuery{UId: u.ID, SortBy: "created_at", Limit: 10}
+		if listed, _ := s.addresses.ListByUser(ctx, q); !equalIDs(addressIDs(listed), []int{kept.ID}) {
+			t.Fatalf("ListByUser = %v, want %v", addressIDs(listed), []int{kept.ID})
+		}
+		q.Deleted = true
+		listed, _ := s.addresses.ListByUser(ctx, q)
+		if !equalIDs(addressIDs(listed), []int{def.ID}) || listed[0].DeletedAt == nil {
+			t.Fatalf("ListByUser of deleted = %+v", listed)
+		}
+		if total, _ := s.addresses.CountByUser(ctx, q); total != 1 {
+			t.Fatalf("CountByUser of deleted = %d, want 1", total)
+		}
+
+		// its default flag was dropped, so another address can take it
+		if _, err := s.addresses.SetDefault(ctx, u.ID, kept.ID); err != nil {
+			t.Fatalf("SetDefault = %v", err)
+		}
+		restored, restoreErr := s.addresses.Restore(ctx, def.ID)
+		if restoreErr != nil || restored.DeletedAt != nil || restored.IsDefault || restored.Version != 3 {
+			t.Fatalf("Restore = %+v, %v", restored, restoreErr)
+		}
+		if _, err := s.addresses.GetByID(ctx, def.ID); err != nil {
+			t.Fatalf("GetByID after Restore = %v", err)
+		}
+		if _, err := s.addresses.Restore(ctx, def.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Restore of a live address = %v, want pgx.ErrNoRows", err)
+		}
+
+		// purging only removes deleted addresses from before the cutoff
+		if err := s.addresses.Delete(ctx, def.ID, 0); err != nil {
+			t.Fatalf("Delete = %v", err)
+		}
+		if purged, err := s.addresses.PurgeDeleted(ctx, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+			t.Fatalf("PurgeDeleted before the delete = %d, %v, want 0", purged, err)
+		}
+		if purged, err := s.addresses.PurgeDeleted(ctx, time.Now().Add(time.Hour)); err != nil || purged != 1 {
+			t.Fatalf("PurgeDeleted = %d, %v, want 1", purged, err)
+		}
+		if _, err := s.addresses.GetDeletedByID(ctx, def.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetDeletedByID after PurgeDeleted = %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.addresses.GetByID(ctx, kept.ID); err != nil {
+			t.Fatalf("GetByID of kept address = %v", err)
+		}
+	}},
+	{"record and list address versions", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := mustCreateAddress(t, ctx, s, u.ID, false)
+		if versions, err := s.addresses.ListVersions(ctx, a.ID); err != nil || len(versions) != 0 {
+			t.Fatalf("ListVersions without changes = %+v, %v", versions, err)
+		}
+
+		prior, _ := s.addresses.GetByID(ctx, a.ID)
+		if err := s.addresses.RecordVersion(ctx, *prior, u.ID); err != nil {
+			t.Fatalf("RecordVersion = %v", err)
+		}
+		city := "Hamburg"
+		patched, _ := s.addresses.Patch(ctx, a.ID, 0, model.AddressPatch{City: &city})
+		if err := s.addresses.RecordVersion(ctx, *patched, u.ID); err != nil {
+			t.Fatalf("RecordVersion = %v", err)
+		}
+		if err := s.addresses.RecordVersion(ctx, *patched, u.ID); err == nil {
+			t.Fatal("RecordVersion of a recorded version succeeded")
+		}
+
+		versions, listErr := s.addresses.ListVersions(ctx, a.ID)
+		if listErr != nil || len(versions) != 2 {
+			t.Fatalf("ListVersions = %+v, %v", versions, listErr)
+		}
+		newest, oldest := versions[0], versions[1]
+		if newest.Version != 2 || newest.City != "Hamburg" || oldest.Version != 1 || oldest.City != "Berlin" {
+			t.Fatalf("ListVersions = %+v", versions)
+		}
+		if oldest.ID != a.ID || oldest.UId != u.ID || oldest.Addr_1 != a.Addr_1 || oldest.Type != a.Type ||
+			oldest.ChangedBy != u.ID || oldest.ChangedAt.IsZero() {
+			t.Fatalf("recorded version = %+v", oldest)
+		}
+
+		// the history goes with the address
+		_ = s.addresses.Delete(ctx, a.ID, 0)
+		_, _ = s.addresses.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+		if versions, _ := s.addresses.ListVersions(ctx, a.ID); len(versions) != 0 {
+			t.Fatalf("ListVersions after PurgeDeleted = %+v", versions)
+		}
+	}},
+	{"list and count addresses", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		var ids []int
+		for i, country := range []string{"DE", "FR", "de", "FR"} {
+			a := &model.Address{UId: u.ID, Addr_1: "Burgemeister str. 50", Zip: "10115", City: "Berlin", Country: country, Type: model.AddressShipping, IsDefault: i == 2}
+			if err := s.addresses.CreateAddress(ctx, a); err != nil {
+				t.Fatalf("CreateAddress = %v", err)
+			}
+			ids = append(ids, a.ID)
+		}
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		mustCreateAddress(t, ctx, s, bob.ID, false)
+
+		yes := true
+		for _, tc := range []struct {
+			name  string
+			q     model.AddressQuery
+			want  []int
+			total int
+		}{
+			{"all ascending", model.AddressQuery{SortBy: "created_at", Limit: 10}, ids, 4},
+			{"all descending", model.AddressQuery{SortBy: "created_at", Desc: true, Limit: 10}, []int{ids[3], ids[2], ids[1], ids[0]}, 4},
+			{"limit", model.AddressQuery{SortBy: "created_at", Limit: 2}, ids[:2], 4},
+			{"country ignores case", model.AddressQuery{SortBy: "created_at", Country: "de", Limit: 10}, []int{ids[0], ids[2]}, 2},
+			{"default only", model.AddressQuery{SortBy: "updated_at", IsDefault: &yes, Limit: 10}, []int{ids[2]}, 1},
+			{"city", model.AddressQuery{SortBy: "created_at", City: "Hamburg", Limit: 10}, []int{}, 0},
+		} {
+			tc.q.UId = u.ID
+			got, listErr := s.addresses.ListByUser(ctx, tc.q)
+			if listErr != nil {
+				t.Fatalf("%s: ListByUser = %v", tc.name, listErr)
+			}
+			if gotIDs := addressIDs(got); !equalIDs(gotIDs, tc.want) {
+				t.Fatalf("%s: ListByUser = %v, want %v", tc.name, gotIDs, tc.want)
+			}
+			total, countErr := s.addresses.CountByUser(ctx, tc.q)
+			if countErr != nil || total != tc.total {
+				t.Fatalf("%s: CountByUser = %d, %v, want %d", tc.name, total, countErr, tc.total)
+			}
+		}
+
+		// continue behind the second address
+		first, _ := s.addresses.ListByUser(ctx, model.AddressQuery{UId: u.ID, SortBy: "created_at", Limit: 2})
+		last := first[len(first)-1]
+		q := model.AddressQuery{UId: u.ID, SortBy: "created_at", Limit: 10, After: &model.AddressCursor{SortValue: last.CreatedAt, ID: last.ID}}
+		rest, _ := s.addresses.ListByUser(ctx, q)
+		if gotIDs := addressIDs(rest); !equalIDs(gotIDs, ids[2:]) {
+			t.Fatalf("ListByUser after cursor = %v, want %v", gotIDs, ids[2:])
+		}
+	}},
+	{"set default in one step", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		if _, err := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressShipping); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetDefaultForUser without default = %v, want pgx.ErrNoRows", err)
+		}
+		old := mustCreateAddress(t, ctx, s, u.ID, true)
+		next := mustCreateAddress(t, ctx, s, u.ID, false)
+
+		got, setErr := s.addresses.SetDefault(ctx, u.ID, next.ID)
+		if setErr != nil || got.ID != next.ID || !got.IsDefault {
+			t.Fatalf("SetDefault = %+v, %v", got, setErr)
+		}
+		if def, _ := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressShipping); def == nil || def.ID != next.ID {
+			t.Fatalf("GetDefaultForUser = %+v, want address %d", def, next.ID)
+		}
+		if prev, _ := s.addresses.GetByID(ctx, old.ID); prev.IsDefault {
+			t.Fatal("previous default still set")
+		}
+		if _, err := s.addresses.SetDefault(ctx, u.ID, next.ID); err != nil {
+			t.Fatalf("SetDefault on the default = %v", err)
+		}
+
+		// another user's address is missing and changes nothing
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		if _, err := s.addresses.SetDefault(ctx, bob.ID, old.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("SetDefault of foreign address = %v, want pgx.ErrNoRows", err)
+		}
+		if def, _ := s.addresses.GetDefaultForUser(ctx, u.ID, model.AddressShipping); def == nil || def.ID != next.ID {
+			t.Fatalf("GetDefaultForUser after foreign SetDefault = %+v", def)
+		}
+	}},
+	{"addresses are found by fingerprint", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		create := func(userID int, addrType, fingerprint string) *model.Address {
+			a := &model.Address{UId: userID, Addr_1: "Burgemeister str. 50", Zip: "10115", City: "Berlin", Country: "DE", Type: addrType, Fingerprint: fingerprint}
+			if err := s.addresses.CreateAddress(ctx, a); err != nil {
+				t.Fatalf("CreateAddress = %v", err)
+			}
+			return a
+		}
+		first := create(u.ID, model.AddressShipping, "fp")
+		second := create(u.ID, model.AddressShipping, "fp")
+		billing := create(u.ID, model.AddressBilling, "fp")
+		create(bob.ID, model.AddressShipping, "fp")
+
+		if got, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "fp"); err != nil || got.ID != first.ID {
+			t.Fatalf("FindByFingerprint = %+v, %v, want the oldest address %d", got, err, first.ID)
+		}
+		if got, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressBilling, "fp"); err != nil || got.ID != billing.ID {
+			t.Fatalf("FindByFingerprint of billing = %+v, %v, want %d", got, err, billing.ID)
+		}
+		if _, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "other"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("FindByFingerprint of unknown fingerprint = %v, want pgx.ErrNoRows", err)
+		}
+
+		// deleted addresses aren't found, and Patch moves the fingerprint
+		if err := s.addresses.Delete(ctx, first.ID, 0); err != nil {
+			t.Fatalf("Delete = %v", err)
+		}
+		if got, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "fp"); err != nil || got.ID != second.ID {
+			t.Fatalf("FindByFingerprint after Delete = %+v, %v, want %d", got, err, second.ID)
+		}
+		moved := "moved"
+		if _, err := s.addresses.Patch(ctx, second.ID, 0, model.AddressPatch{Fingerprint: &moved}); err != nil {
+			t.Fatalf("Patch = %v", err)
+		}
+		if _, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "fp"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("FindByFingerprint of patched fingerprint = %v, want pgx.ErrNoRows", err)
+		}
+		if got, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "moved"); err != nil || got.ID != second.ID {
+			t.Fatalf("FindByFingerprint of new fingerprint = %+v, %v, want %d", got, err, second.ID)
+		}
+	}},
+	{"addresses without fingerprint are backfilled", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := mustCreateAddress(t, ctx, s, u.ID, false)
+		deleted := mustCreateAddress(t, ctx, s, u.ID, false)
+		if err := s.addresses.Delete(ctx, deleted.ID, 0); err != nil {
+			t.Fatalf("Delete = %v", err)
+		}
+
+		missing, err := s.addresses.ListWithoutFingerprint(ctx, 10)
+		if err != nil || !equalIDs(addressIDs(missing), []int{a.ID, deleted.ID}) {
+			t.Fatalf("ListWithoutFingerprint = %v, %v, want %d and %d", addressIDs(missing), err, a.ID, deleted.ID)
+		}
+		if limited, _ := s.addresses.ListWithoutFingerprint(ctx, 1); len(limited) != 1 {
+			t.Fatalf("ListWithoutFingerprint(1) returned %d addresses", len(limited))
+		}
+
+		if err := s.addresses.SetFingerprint(ctx, a.ID, "fp"); err != nil {
+			t.Fatalf("SetFingerprint = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, a.ID); got.Version != a.Version {
+			t.Fatalf("SetFingerprint changed the version from %d to %d", a.Version, got.Version)
+		}
+		if missing, _ := s.addresses.ListWithoutFingerprint(ctx, 10); !equalIDs(addressIDs(missing), []int{deleted.ID}) {
+			t.Fatalf("ListWithoutFingerprint after SetFingerprint = %v, want %d", addressIDs(missing), deleted.ID)
+		}
+		if got, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "fp"); err != nil || got.ID != a.ID {
+			t.Fatalf("FindByFingerprint = %+v, %v, want %d", got, err, a.ID)
+		}
+
+		// a fingerprint set by an update since the address was listed stays
+		if err := s.addresses.SetFingerprint(ctx, a.ID, "stale"); err != nil {
+			t.Fatalf("SetFingerprint = %v", err)
+		}
+		if got, err := s.addresses.FindByFingerprint(ctx, u.ID, model.AddressShipping, "fp"); err != nil || got.ID != a.ID {
+			t.Fatalf("FindByFingerprint after a second SetFingerprint = %+v, %v, want %d", got, err, a.ID)
+		}
+	}},
+	{"locations are stored for the fingerprint", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := &model.Address{UId: u.ID, Addr_1: "Burgemeister str. 50", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressShipping, Fingerprint: "fp"}
+		if err := s.addresses.CreateAddress(ctx, a); err != nil {
+			t.Fatalf("CreateAddress = %v", err)
+		}
+
+		// a stale fingerprint is ignored
+		if err := s.addresses.SetLocation(ctx, a.ID, "old", model.Location{Lat: 1, Lng: 2}); err != nil {
+			t.Fatalf("SetLocation = %v", err)
+		}
+		if got, _ := s.addresses.GetByID(ctx, a.ID); got.Lat != nil || got.Lng != nil {
+			t.Fatalf("SetLocation with stale fingerprint stored %v, %v", got.Lat, got.Lng)
+		}
+		if err := s.addresses.SetLocation(ctx, a.ID, "fp", model.Location{Lat: 52.53, Lng: 13.38, Verified: true}); err != nil {
+			t.Fatalf("SetLocation = %v", err)
+		}
+		got, _ := s.addresses.GetByID(ctx, a.ID)
+		if got.Lat == nil || *got.Lat != 52.53 || got.Lng == nil || *got.Lng != 13.38 || !got.Verified {
+			t.Fatalf("location after SetLocation = %v, %v, %v", got.Lat, got.Lng, got.Verified)
+		}
+		if got.Version != a.Version {
+			t.Fatalf("SetLocation changed the version from %d to %d", a.Version, got.Version)
+		}
+
+		// patches keep the location, unless the fingerprint changes
+		label, same, moved := "Home", "fp", "moved"
+		patched, err := s.addresses.Patch(ctx, a.ID, 0, model.AddressPatch{Label: &label, Fingerprint: &same})
+		if err != nil || patched.Lat == nil || !patched.Verified {
+			t.Fatalf("Patch with the same fingerprint = %+v, %v, want the location kept", patched, err)
+		}
+		patched, err = s.addresses.Patch(ctx, a.ID, 0, model.AddressPatch{Fingerprint: &moved})
+		if err != nil || patched.Lat != nil || patched.Lng != nil || patched.Verified {
+			t.Fatalf("Patch with a new fingerprint = %+v, %v, want the location cleared", patched, err)
+		}
+	}},
+	{"passkeys belong to their user", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		first := &model.Passkey{UId: u.ID, CredentialID: []byte("cred-1"), Name: "Laptop", Credential: []byte(`{"n":1}`)}
+		second := &model.Passkey{UId: u.ID, CredentialID: []byte("cred-2"), Name: "Phone", Credential: []byte(`{"n":2}`)}
+		for _, p := range []*model.Passkey{first, second} {
+			if err := s.passkeys.Create(ctx, p); err != nil || p.ID == 0 || p.CreatedAt.IsZero() {
+				t.Fatalf("Create = %v, %+v", err, p)
+			}
+		}
+		if err := s.passkeys.Create(ctx, &model.Passkey{UId: bob.ID, CredentialID: []byte("cred-1"), Name: "Copy", Credential: []byte(`{}`)}); err == nil {
+			t.Fatal("Create with a registered credential ID succeeded")
+		}
+
+		if err := s.passkeys.UpdateAfterLogin(ctx, first.ID, []byte(`{"n":3}`)); err != nil {
+			t.Fatalf("UpdateAfterLogin = %v", err)
+		}
+		list, err := s.passkeys.ListByUser(ctx, u.ID)
+		if err != nil || len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+			t.Fatalf("ListByUser = %+v, %v, want both passkeys, oldest first", list, err)
+		}
+		// Postgres keeps the credential as jsonb, so compare it decoded
+		var stored struct{ N int }
+		_ = json.Unmarshal(list[0].Credential, &stored)
+		if list[0].LastUsedAt == nil || list[1].LastUsedAt != nil || stored.N != 3 {
+			t.Fatalf("passkey after UpdateAfterLogin = %+v", list[0])
+		}
+
+		if ok, err := s.passkeys.Rename(ctx, first.ID, bob.ID, "Stolen"); ok || err != nil {
+			t.Fatalf("Rename by another user = %v, %v, want false", ok, err)
+		}
+		if ok, err := s.passkeys.Rename(ctx, first.ID, u.ID, "Work laptop"); !ok || err != nil {
+			t.Fatalf("Rename = %v, %v", ok, err)
+		}
+		if ok, err := s.passkeys.Delete(ctx, second.ID, bob.ID); ok || err != nil {
+			t.Fatalf("Delete by another user = %v, %v, want false", ok, err)
+		}
+		if ok, err := s.passkeys.Delete(ctx, second.ID, u.ID); !ok || err != nil {
+			t.Fatalf("Delete = %v, %v", ok, err)
+		}
+		list, _ = s.passkeys.ListByUser(ctx, u.ID)
+		if len(list) != 1 || list[0].Name != "Work laptop" {
+			t.Fatalf("ListByUser = %+v, want the renamed passkey", list)
+		}
+		if list, _ := s.passkeys.ListByUser(ctx, bob.ID); len(list) != 0 {
+			t.Fatalf("ListByUser of another user = %+v, want none", list)
+		}
+	}},
+	{"ceremonies are taken once", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		expiresAt := time.Now().Add(time.Minute)
+		if err := s.passkeys.SaveCeremony(ctx, "register", &u.ID, []byte(`{"c":1}`), expiresAt); err != nil {
+			t.Fatalf("SaveCeremony = %v", err)
+		}
+		if err := s.passkeys.SaveCeremony(ctx, "login", nil, []byte(`{"c":2}`), expiresAt); err != nil {
+			t.Fatalf("SaveCeremony = %v", err)
+		}
+		if err := s.passkeys.SaveCeremony(ctx, "expired", nil, []byte(`{"c":3}`), time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("SaveCeremony = %v", err)
+		}
+
+		owner, session, err := s.passkeys.TakeCeremony(ctx, "register")
+		if err != nil || owner == nil || *owner != u.ID || len(session) == 0 {
+			t.Fatalf("TakeCeremony = %v, %s, %v, want the registration of user %d", owner, session, err, u.ID)
+		}
+		if _, _, err := s.passkeys.TakeCeremony(ctx, "register"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("second TakeCeremony = %v, want pgx.ErrNoRows", err)
+		}
+		if owner, _, err := s.passkeys.TakeCeremony(ctx, "login"); err != nil || owner != nil {
+			t.Fatalf("TakeCeremony of a login = %v, %v, want no owner", owner, err)
+		}
+		if _, _, err := s.passkeys.TakeCeremony(ctx, "expired"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("TakeCeremony of an expired ceremony = %v, want pgx.ErrNoRows", err)
+		}
+	}},
+	{"deleting a user deletes their addresses", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		a := mustCreateAddress(t, ctx, s, u.ID, true)
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		kept := mustCreateAddress(t, ctx, s, bob.ID, true)
+
+		if err := s.users.DeleteUser(ctx, u.ID); err != nil {
+			t.Fatalf("DeleteUser = %v", err)
+		}
+		if _, err := s.users.GetByID(ctx, u.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByID = %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.addresses.GetByID(ctx, a.ID); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("address of deleted user: %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.addresses.GetByID(ctx, kept.ID); err != nil {
+			t.Fatalf("address of other user: %v", err)
+		}
+	}},
+	{"transaction commits", func(t *testing.T, ctx context.Context, s stores) {
+		txErr := s.tx.WithinTx(ctx, func(ctx context.Context) error {
+			u := mustCreateUser(t, ctx, s, "ada@example.com")
+			mustCreateAddress(t, ctx, s, u.ID, true)
+			return nil
+		})
+		if txErr != nil {
+			t.Fatalf("WithinTx = %v", txErr)
+		}
+		if _, err := s.users.GetByEmail(ctx, "ada@example.com"); err != nil {
+			t.Fatalf("GetByEmail after commit = %v", err)
+		}
+	}},
+	{"login failures count within the window", func(t *testing.T, ctx context.Context, s stores) {
+		if _, err := s.failures.Get(ctx, "email:ada@example.com"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Get of a new key = %v, want pgx.ErrNoRows", err)
+		}
+		windowStart := time.Now().Add(-time.Hour)
+		for want := 1; want <= 2; want++ {
+			f, err := s.failures.RecordFailure(ctx, "email:ada@example.com", windowStart)
+			if err != nil || f.Failures != want || f.LockedUntil != nil {
+				t.Fatalf("RecordFailure = %+v, %v, want %d failures", f, err, want)
+			}
+		}
+		// failures before the window start over
+		if f, _ := s.failures.RecordFailure(ctx, "email:ada@example.com", time.Now().Add(time.Hour)); f.Failures != 1 {
+			t.Fatalf("RecordFailure after the window = %d failures, want 1", f.Failures)
+		}
+
+		until := time.Now().Add(time.Minute)
+		if err := s.failures.Lock(ctx, "email:ada@example.com", until); err != nil {
+			t.Fatalf("Lock = %v", err)
+		}
+		f, _ := s.failures.Get(ctx, "email:ada@example.com")
+		if f.Failures != 0 || f.LockedUntil == nil || f.LockedUntil.Sub(until).Abs() > time.Millisecond {
+			t.Fatalf("locked record = %+v, want no failures and locked until %v", f, until)
+		}
+
+		// a locked key isn't stale, a cleared one is gone
+		if err := s.failures.PurgeStale(ctx, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("PurgeStale = %v", err)
+		}
+		if _, err := s.failures.Get(ctx, "email:ada@example.com"); err != nil {
+			t.Fatalf("Get after PurgeStale = %v, want the locked record kept", err)
+		}
+		if err := s.failures.Clear(ctx, "email:ada@example.com"); err != nil {
+			t.Fatalf("Clear = %v", err)
+		}
+		if _, err := s.failures.Get(ctx, "email:ada@example.com"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Get after Clear = %v, want pgx.ErrNoRows", err)
+		}
+	}},
+	{"recovery codes are used once", func(t *testing.T, ctx context.Context, s stores) {
+		ada := mustCreateUser(t, ctx, s, "ada@example.com")
+		bob := mustCreateUser(t, ctx, s, "bob@example.com")
+		if err := s.recovery.ReplaceForUser(ctx, ada.ID, []string{"a1", "a2"}); err != nil {
+			t.Fatalf("ReplaceForUser = %v", err)
+		}
+		if used, err := s.recovery.Consume(ctx, bob.ID, "a1"); err != nil || used {
+			t.Fatalf("Consume of another user's code = %v, %v, want false", used, err)
+		}
+		if used, err := s.recovery.Consume(ctx, ada.ID, "a1"); err != nil || !used {
+			t.Fatalf("Consume = %v, %v, want true", used, err)
+		}
+		if used, _ := s.recovery.Consume(ctx, ada.ID, "a1"); used {
+			t.Fatal("Consume of a used code = true")
+		}
+
+		// a replacement inside a transaction rolls back with it
+		txErr := s.tx.WithinTx(ctx, func(ctx context.Context) error {
+			if err := s.recovery.ReplaceForUser(ctx, ada.ID, []string{"b1"}); err != nil {
+				t.Fatalf("ReplaceForUser in tx = %v", err)
+			}
+			return errAbort
+		})
+		if !errors.Is(txErr, errAbort) {
+			t.Fatalf("WithinTx = %v, want the error of fn", txErr)
+		}
+		if used, _ := s.recovery.Consume(ctx, ada.ID, "b1"); used {
+			t.Fatal("code of a rolled back replacement was stored")
+		}
+		if used, _ := s.recovery.Consume(ctx, ada.ID, "a2"); !used {
+			t.Fatal("rolled back replacement dropped the old codes")
+		}
+
+		if err := s.recovery.ReplaceForUser(ctx, ada.ID, []string{"c1"}); err != nil {
+			t.Fatalf("ReplaceForUser = %v", err)
+		}
+		if err := s.recovery.DeleteForUser(ctx, ada.ID); err != nil {
+			t.Fatalf("DeleteForUser = %v", err)
+		}
+		if used, _ := s.recovery.Consume(ctx, ada.ID, "c1"); used {
+			t.Fatal("Consume after DeleteForUser = true")
+		}
+	}},
+	{"mfa challenges limit attempts", func(t *testing.T, ctx context.Context, s stores) {
+		ada := mustCreateUser(t, ctx, s, "ada@example.com")
+		if err := s.mfa.Create(ctx, "jti-1", ada.ID, time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("Create = %v", err)
+		}
+		if ok, err := s.mfa.Attempt(ctx, "jti-1", ada.ID+1, 2); err != nil || ok {
+			t.Fatalf("Attempt by another user = %v, %v, want false", ok, err)
+		}
+		for i := 0; i < 2; i++ {
+			if ok, err := s.mfa.Attempt(ctx, "jti-1", ada.ID, 2); err != nil || !ok {
+				t.Fatalf("Attempt %d = %v, %v, want true", i+1, ok, err)
+			}
+		}
+		if ok, _ := s.mfa.Attempt(ctx, "jti-1", ada.ID, 2); ok {
+			t.Fatal("Attempt past maxAttempts = true")
+		}
+		if ok, err := s.mfa.Consume(ctx, "jti-1"); err != nil || !ok {
+			t.Fatalf("Consume = %v, %v, want true", ok, err)
+		}
+		if ok, _ := s.mfa.Consume(ctx, "jti-1"); ok {
+			t.Fatal("second Consume = true")
+		}
+
+		if err := s.mfa.Create(ctx, "jti-2", ada.ID, time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("Create = %v", err)
+		}
+		if ok, _ := s.mfa.Attempt(ctx, "jti-2", ada.ID, 2); ok {
+			t.Fatal("Attempt of an expired challenge = true")
+		}
+		if err := s.mfa.PurgeExpired(ctx); err != nil {
+			t.Fatalf("PurgeExpired = %v", err)
+		}
+	}},
+	{"refresh tokens rotate once and revoke by family", func(t *testing.T, ctx context.Context, s stores) {
+		ada := mustCreateUser(t, ctx, s, "ada@example.com")
+		expiresAt := time.Now().Add(time.Hour)
+		first := &model.RefreshToken{UId: ada.ID, TokenHash: "h1", FamilyID: "f1", ExpiresAt: expiresAt}
+		second := &model.RefreshToken{UId: ada.ID, TokenHash: "h2", FamilyID: "f1", ExpiresAt: expiresAt}
+		other := &model.RefreshToken{UId: ada.ID, TokenHash: "h3", FamilyID: "f2", ExpiresAt: expiresAt}
+		for _, rt := range []*model.RefreshToken{first, second, other} {
+			if err := s.refresh.Create(ctx, rt); err != nil || rt.ID == 0 {
+				t.Fatalf("Create = %v, id %d", err, rt.ID)
+			}
+		}
+		if _, err := s.refresh.GetByHash(ctx, "unknown"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("GetByHash of an unknown hash = %v, want pgx.ErrNoRows", err)
+		}
+
+		if ok, err := s.refresh.MarkRotated(ctx, first.ID); err != nil || !ok {
+			t.Fatalf("MarkRotated = %v, %v, want true", ok, err)
+		}
+		if ok, _ := s.refresh.MarkRotated(ctx, first.ID); ok {
+			t.Fatal("second MarkRotated = true")
+		}
+		got, err := s.refresh.GetByHash(ctx, "h1")
+		if err != nil || got.RotatedAt == nil || got.FamilyID != "f1" || got.ExpiresAt.Sub(expiresAt).Abs() > time.Millisecond {
+			t.Fatalf("GetByHash = %+v, %v, want it rotated", got, err)
+		}
+
+		if err := s.refresh.RevokeFamily(ctx, "f1"); err != nil {
+			t.Fatalf("RevokeFamily = %v", err)
+		}
+		if got, _ := s.refresh.GetByHash(ctx, "h2"); got.RevokedAt == nil {
+			t.Fatal("RevokeFamily left a token of the family")
+		}
+		if ok, _ := s.refresh.MarkRotated(ctx, second.ID); ok {
+			t.Fatal("MarkRotated of a revoked token = true")
+		}
+		if got, _ := s.refresh.GetByHash(ctx, "h3"); got.RevokedAt != nil {
+			t.Fatal("RevokeFamily revoked another family")
+		}
+		if err := s.refresh.RevokeAllForUser(ctx, ada.ID); err != nil {
+			t.Fatalf("RevokeAllForUser = %v", err)
+		}
+		if got, _ := s.refresh.GetByHash(ctx, "h3"); got.RevokedAt == nil {
+			t.Fatal("RevokeAllForUser left a token")
+		}
+	}},
+	{"mailed tokens are consumed once", func(t *testing.T, ctx context.Context, s stores) {
+		ada := mustCreateUser(t, ctx, s, "ada@example.com")
+		hour := time.Now().Add(time.Hour)
+		verify := &model.UserToken{UId: ada.ID, Purpose: model.TokenPurposeVerifyEmail, TokenHash: "v1", ExpiresAt: hour}
+		change := &model.UserToken{UId: ada.ID, Purpose: model.TokenPurposeChangeEmail, TokenHash: "c1", NewEmail: "ada@example.org", ExpiresAt: hour}
+		expired := &model.UserToken{UId: ada.ID, Purpose: model.TokenPurposeResetPassword, TokenHash: "r1", ExpiresAt: time.Now().Add(-time.Second)}
+		for _, ut := range []*model.UserToken{verify, change, expired} {
+			if err := s.tokens.Create(ctx, ut); err != nil || ut.ID == 0 {
+				t.Fatalf("Create = %v, id %d", err, ut.ID)
+			}
+		}
+
+		if _, err := s.tokens.Consume(ctx, "v1", model.TokenPurposeResetPassword); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Consume for another purpose = %v, want pgx.ErrNoRows", err)
+		}
+		got, err := s.tokens.Consume(ctx, "v1", model.TokenPurposeVerifyEmail)
+		if err != nil || got.ID != verify.ID || got.UId != ada.ID || got.UsedAt == nil {
+			t.Fatalf("Consume = %+v, %v", got, err)
+		}
+		if _, err := s.tokens.Consume(ctx, "v1", model.TokenPurposeVerifyEmail); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("second Consume = %v, want pgx.ErrNoRows", err)
+		}
+		if _, err := s.tokens.Consume(ctx, "r1", model.TokenPurposeResetPassword); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Consume of an expired token = %v, want pgx.ErrNoRows", err)
+		}
+
+		if err := s.tokens.InvalidateForUser(ctx, ada.ID, model.TokenPurposeVerifyEmail); err != nil {
+			t.Fatalf("InvalidateForUser = %v", err)
+		}
+		got, err = s.tokens.Consume(ctx, "c1", model.TokenPurposeChangeEmail)
+		if err != nil || got.NewEmail != "ada@example.org" {
+			t.Fatalf("Consume of another purpose after InvalidateForUser = %+v, %v", got, err)
+		}
+		next := &model.UserToken{UId: ada.ID, Purpose: model.TokenPurposeVerifyEmail, TokenHash: "v2", ExpiresAt: hour}
+		if err := s.tokens.Create(ctx, next); err != nil {
+			t.Fatalf("Create = %v", err)
+		}
+		if err := s.tokens.InvalidateForUser(ctx, ada.ID, model.TokenPurposeVerifyEmail); err != nil {
+			t.Fatalf("InvalidateForUser = %v", err)
+		}
+		if _, err := s.tokens.Consume(ctx, "v2", model.TokenPurposeVerifyEmail); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Consume of an invalidated token = %v, want pgx.ErrNoRows", err)
+		}
+
+		pending := &model.UserToken{UId: ada.ID, Purpose: model.TokenPurposeUnlockLogin, TokenHash: "u1", ExpiresAt: hour}
+		if err := s.tokens.Create(ctx, pending); err != nil {
+			t.Fatalf("Create = %v", err)
+		}
+		if err := s.users.DeleteUser(ctx, ada.ID); err != nil {
+			t.Fatalf("DeleteUser = %v", err)
+		}
+		if _, err := s.tokens.Consume(ctx, "u1", model.TokenPurposeUnlockLogin); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("Consume of a deleted user's token = %v, want pgx.ErrNoRows", err)
+		}
+	}},
+	{"transaction rolls back", func(t *testing.T, ctx context.Context, s stores) {
+		u := mustCreateUser(t, ctx, s, "ada@example.com")
+		def := mustCreateAddress(t, ctx, s, u.ID, true)
+
+		txErr := s.tx.WithinTx(ctx, func(ctx context.Context) error {
+			_ = s.addresses.ClearDefaultForUser(ctx, u.ID, model.AddressShipping)
+			mustCreateUser(t, ctx, s, "bob@example.com")
+			return errAbort
+		})
+		if !errors.Is(txErr, errAbort) {
+			t.Fatalf("WithinTx = %v, want the error of fn", txErr)
+		}
+		if got, _ := s.addresses.GetByID(ctx, def.ID); !got.IsDefault {
+			t.Fatal("cleared default survived the rollback")
+		}
+		if _, err := s.users.GetByEmail(ctx, "bob@example.com"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("user created in rolled back tx: %v", err)
+		}
+	}},
+	{"nested transaction joins the outer one", func(t *testing.T, ctx context.Context, s stores) {
+		txErr := s.tx.WithinTx(ctx, func(ctx context.Context) error {
+			mustCreateUser(t, ctx, s, "ada@example.com")
+			innerErr := s.tx.WithinTx(ctx, func(ctx context.Context) error {
+				mustCreateUser(t, ctx, s, "bob@example.com")
+				return nil
+			})
+			if innerErr != nil {
+				t.Fatalf("inner WithinTx = %v", innerErr)
+			}
+			return errAbort
+		})
+		if !errors.Is(txErr, errAbort) {
+			t.Fatalf("WithinTx = %v, want the error of fn", txErr)
+		}
+		for _, email := range []string{"ada@example.com", "bob@example.com"} {
+			if _, err := s.users.GetByEmail(ctx, email); !errors.Is(err, pgx.ErrNoRows) {
+				t.Fatalf("%s survived the rollback: %v", email, err)
+			}
+		}
+	}},
+}
+
+func TestStoreContract(t *testing.T) {
+	for _, b := range backends(t) {
+		for _, tc := range contractTests {
+			t.Run(b.name+"/"+tc.name, func(t *testing.T) {
+				tc.run(t, context.Background(), b.open(t))
+			})
+		}
+	}
+}
+
+func mustCreateUser(t *testing.T, ctx context.Context, s stores, email string) *model.User {
+	t.Helper()
+	u := &model.User{Username: email[:len(email)-len("@example.com")], Email: email, PasswordHash: "hash"}
+	if err := s.users.CreateUser(ctx, u); err != nil {
+		t.Fatalf("CreateUser(%s) = %v", email, err)
+	}
+	return u
+}
+
+func mustCreateAddress(t *testing.T, ctx context.Context, s stores, userID int, isDefault bool) *model.Address {
+	t.Helper()
+	a := &model.Address{UId: userID, Addr_1: "Burgemeister str. 50", Zip: "10115", City: "Berlin", Country: "DE", Type: model.AddressShipping, IsDefault: isDefault}
+	if err := s.addresses.CreateAddress(ctx, a); err != nil {
+		t.Fatalf("CreateAddress = %v", err)
+	}
+	return a
+}
+
+func addressIDs(addresses []model.Address) []int {
+	ids := []int{}
+	for _, a := range addresses {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
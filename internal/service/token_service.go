@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"server/internal/model"
+	"server/internal/repo"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrInvalidRefreshToken = errors.New("service: invalid refresh token")
+var ErrRefreshTokenReused = errors.New("service: refresh token reuse detected")
+
+// TokenService manages the opaque, database-backed refresh tokens that
+// let a client renew its short-lived access token, and the revocation
+// store that lets the server reject access tokens before they expire.
+type TokenService struct {
+	refreshRepo    RefreshTokenStore
+	revocationRepo *repo.RevocationRepo
+	refreshTTL     time.Duration
+	cache          *revocationCache
+}
+
+func NewTokenService(refreshRepo RefreshTokenStore, revocationRepo *repo.RevocationRepo, refreshTTL, revocationCacheTTL time.Duration) *TokenService {
+	return &TokenService{
+		refreshRepo:    refreshRepo,
+		revocationRepo: revocationRepo,
+		refreshTTL:     refreshTTL,
+		cache:          newRevocationCache(revocationCacheTTL),
+	}
+}
+
+// IssueRefreshToken starts a new token family for a fresh login and
+// returns the raw token to hand to the client.
+func (s *TokenService) IssueRefreshToken(ctx context.Context, userID int) (string, error) {
+	familyID, famErr := randomHex(16)
+	if famErr != nil {
+		return "", fmt.Errorf("service: refresh token family: %w", famErr)
+	}
+	return s.issueRefreshToken(ctx, userID, familyID, time.Now().Add(s.refreshTTL))
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family. Presenting a token that was already rotated means it leaked, so
+// the whole family is revoked and ErrRefreshTokenReused is returned.
+// The new token expires with the one it replaces, so a family lives at
+// most refreshTTL after its login however often it is rotated. prepare runs with the owner of a valid token before it is used up, e.g. to
+// issue the access token; if it fails, the token stays valid for a retry.
+func (s *TokenService) RotateRefreshToken(ctx context.Context, raw string, prepare func(userID int) error) (string, error) {
+	current, fetchErr := s.refreshRepo.GetByHash(ctx, hashToken(raw))
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return "", ErrInvalidRefreshToken
+		}
+		return "", fmt.Errorf("service: refresh token lookup: %w", fetchErr)
+	}
+
+	if current.RevokedAt != nil || time.Now().After(current.ExpiresAt) {
+		return "", ErrInvalidRefreshToken
+	}
+	if current.RotatedAt != nil {
+		return "", s.revokeReusedFamily(ctx, current.FamilyID)
+	}
+
+	prepareErr := prepare(current.UId)
+	if prepareErr != nil {
+		return "", prepareErr
+	}
+
+	// the successor exists before the token is used up, so a failure
+	// doesn't leave the session without one
+	next, issueErr := s.issueRefreshToken(ctx, current.UId, current.FamilyID, current.ExpiresAt)
+	if issueErr != nil {
+		return "", issueErr
+	}
+	rotated, rotateErr := s.refreshRepo.MarkRotated(ctx, current.ID)
+	if rotateErr != nil {
+		return "", fmt.Errorf("service: rotate refresh token: %w", rotateErr)
+	}
+	if !rotated {
+		// a concurrent request used the same token first
+		return "", s.revokeReusedFamily(ctx, current.FamilyID)
+	}
+	return next, nil
+}
+
+// RevokeRefreshToken revokes the family of the given token, ending that
+// login on every device that shares it. Unknown tokens are ignored.
+func (s *TokenService) RevokeRefreshToken(ctx context.Context, raw string) error {
+	current, fetchErr := s.refreshRepo.GetByHash(ctx, hashToken(raw))
+	if fetchErr != nil {
+		if errors.Is(fetchErr, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("service: refresh token lookup: %w", fetchErr)
+	}
+
+	revokeErr := s.refreshRepo.RevokeFamily(ctx, current.FamilyID)
+	if revokeErr != nil {
+		return fmt.Errorf("service: revoke refresh token: %w", revokeErr)
+	}
+	return nil
+}
+
+// RevokeAccessToken rejects a single access token, identified by its jti,
+// for the rest of its lifetime.
+func (s *TokenService) RevokeAccessToken(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	revokeErr := s.revocationRepo.RevokeJTI(ctx, jti, userID, expiresAt)
+	if revokeErr != nil {
+		return fmt.Errorf("service: revoke access token: %w", revokeErr)
+	}
+	s.cache.setJTI(jti, true, expiresAt)
+
+	// opportunistic cleanup; a failure here doesn't undo the logout
+	_ = s.revocationRepo.PurgeExpired(ctx)
+	return nil
+}
+
+// RevokeAllSessions rejects every access token issued to the user so far
+// and revokes all of their refresh tokens.
+func (s *TokenService) RevokeAllSessions(ctx context.Context, userID int) error {
+	// iat and the stored cutoff have microsecond precision
+	cutoff := time.Now().Truncate(time.Microsecond)
+	revokeErr := s.revocationRepo.RevokeAllForUser(ctx, userID, cutoff)
+	if revokeErr != nil {
+		return fmt.Errorf("service: revoke sessions: %w", revokeErr)
+	}
+	s.cache.setCutoff(userID, cutoff)
+
+	refreshErr := s.refreshRepo.RevokeAllForUser(ctx, userID)
+	if refreshErr != nil {
+		return fmt.Errorf("service: revoke refresh tokens: %w", refreshErr)
+	}
+	return nil
+}
+
+// IsAccessTokenRevoked checks an access token against the revocation store.
+func (s *TokenService) IsAccessTokenRevoked(ctx context.Context, jti string, userID int, issuedAt, expiresAt time.Time) (bool, error) {
+	cutoff, cached := s.cache.cutoff(userID)
+	if !cached {
+		var cutoffErr error
+		cutoff, cutoffErr = s.revocationRepo.GetUserCutoff(ctx, userID)
+		if cutoffErr != nil {
+			return false, fmt.Errorf("service: revocation lookup: %w", cutoffErr)
+		}
+		s.cache.setCutoff(userID, cutoff)
+	}
+	// a token issued in the very microsecond of the cutoff is revoked too
+	if !issuedAt.After(cutoff) {
+		return true, nil
+	}
+
+	revoked, cached := s.cache.jti(jti)
+	if cached {
+		return revoked, nil
+	}
+	revoked, lookupErr := s.revocationRepo.IsJTIRevoked(ctx, jti)
+	if lookupErr != nil {
+		return false, fmt.Errorf("service: revocation lookup: %w", lookupErr)
+	}
+	s.cache.setJTI(jti, revoked, expiresAt)
+	return revoked, nil
+}
+
+// issueRefreshToken stores a new token of the family that expires at expiresAt
+func (s *TokenService) issueRefreshToken(ctx context.Context, userID int, familyID string, expiresAt time.Time) (string, error) {
+	raw, rawErr := randomToken()
+	if rawErr != nil {
+		return "", fmt.Errorf("service: generate refresh token: %w", rawErr)
+	}
+
+	t := &model.RefreshToken{
+		UId:       userID,
+		TokenHash: hashToken(raw),
+		FamilyID:  familyID,
+		ExpiresAt: expiresAt,
+	}
+	createErr := s.refreshRepo.Create(ctx, t)
+	if createErr != nil {
+		return "", fmt.Errorf("service: store refresh token: %w", createErr)
+	}
+	return raw, nil
+}
+
+func (s *TokenService) revokeReusedFamily(ctx context.Context, familyID string) error {
+	revokeErr := s.refreshRepo.RevokeFamily(ctx, familyID)
+	if revokeErr != nil {
+		return fmt.Errorf("service: revoke reused refresh token family: %w", revokeErr)
+	}
+	return ErrRefreshTokenReused
+}
+
+// Helpers
+// randomToken returns 32 random bytes, base64url-encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, readErr := rand.Read(b)
+	if readErr != nil {
+		return "", readErr
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// randomHex returns n random bytes, hex-encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, readErr := rand.Read(b)
+	if readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken is the lookup key for opaque tokens; the raw value is never stored
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
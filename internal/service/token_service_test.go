@@ -0,0 +1,141 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"server/internal/model"
+	"server/internal/repo/memory"
+	"server/internal/service"
+	"testing"
+	"time"
+)
+
+var errNotNow = errors.New("not now")
+
+func newTokenService(t *testing.T, refreshTTL time.Duration) (*service.TokenService, *model.User) {
+	t.Helper()
+	db := memory.New()
+	u := &model.User{Username: "ada", Email: "ada@example.com", PasswordHash: "hash"}
+	if err := memory.NewAuthRepo(db).CreateUser(context.Background(), u); err != nil {
+		t.Fatalf("CreateUser = %v", err)
+	}
+	return service.NewTokenService(memory.NewRefreshTokenRepo(db), nil, refreshTTL, time.Minute), u
+}
+
+// rotate rotates raw and checks that prepare saw the owner
+func rotate(t *testing.T, svc *service.TokenService, raw string, userID int) (string, error) {
+	t.Helper()
+	return svc.RotateRefreshToken(context.Background(), raw, func(owner int) error {
+		if owner != userID {
+			t.Fatalf("prepare got user %d, want %d", owner, userID)
+		}
+		return nil
+	})
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newTokenService(t, time.Hour)
+	first, issueErr := svc.IssueRefreshToken(ctx, u.ID)
+	if issueErr != nil {
+		t.Fatalf("IssueRefreshToken = %v", issueErr)
+	}
+
+	second, err := rotate(t, svc, first, u.ID)
+	if err != nil || second == "" || second == first {
+		t.Fatalf("RotateRefreshToken = %q, %v, want a new token", second, err)
+	}
+	third, err := rotate(t, svc, second, u.ID)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken of the successor = %v", err)
+	}
+
+	// replaying a rotated token revokes the family, the newest token too
+	if _, err := rotate(t, svc, first, u.ID); !errors.Is(err, service.ErrRefreshTokenReused) {
+		t.Fatalf("RotateRefreshToken of a rotated token = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := rotate(t, svc, third, u.ID); !errors.Is(err, service.ErrInvalidRefreshToken) {
+		t.Fatalf("RotateRefreshToken after the reuse = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	// other logins of the user are separate families
+	other, _ := svc.IssueRefreshToken(ctx, u.ID)
+	if _, err := rotate(t, svc, other, u.ID); err != nil {
+		t.Fatalf("RotateRefreshToken of another family = %v", err)
+	}
+
+	if _, err := rotate(t, svc, "unknown", u.ID); !errors.Is(err, service.ErrInvalidRefreshToken) {
+		t.Fatalf("RotateRefreshToken of an unknown token = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRotateRefreshTokenRefusesDeadTokens(t *testing.T) {
+	ctx := context.Background()
+
+	expiredSvc, u := newTokenService(t, -time.Second)
+	expired, _ := expiredSvc.IssueRefreshToken(ctx, u.ID)
+	if _, err := rotate(t, expiredSvc, expired, u.ID); !errors.Is(err, service.ErrInvalidRefreshToken) {
+		t.Fatalf("RotateRefreshToken of an expired token = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	svc, u := newTokenService(t, time.Hour)
+	revoked, _ := svc.IssueRefreshToken(ctx, u.ID)
+	if err := svc.RevokeRefreshToken(ctx, revoked); err != nil {
+		t.Fatalf("RevokeRefreshToken = %v", err)
+	}
+	if _, err := rotate(t, svc, revoked, u.ID); !errors.Is(err, service.ErrInvalidRefreshToken) {
+		t.Fatalf("RotateRefreshToken of a revoked token = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRotateRefreshTokenKeepsTheTokenWhenPrepareFails(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newTokenService(t, time.Hour)
+	raw, _ := svc.IssueRefreshToken(ctx, u.ID)
+
+	_, err := svc.RotateRefreshToken(ctx, raw, func(int) error { return errNotNow })
+	if !errors.Is(err, errNotNow) {
+		t.Fatalf("RotateRefreshToken = %v, want the error of prepare", err)
+	}
+	if _, err := rotate(t, svc, raw, u.ID); err != nil {
+		t.Fatalf("RotateRefreshToken after a failed prepare = %v", err)
+	}
+}
+
+func TestRotateRefreshTokenConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newTokenService(t, time.Hour)
+	raw, _ := svc.IssueRefreshToken(ctx, u.ID)
+
+	// another request rotates the token while this one prepares; the one
+	// that loses treats it as reuse
+	var winner string
+	_, err := svc.RotateRefreshToken(ctx, raw, func(int) error {
+		var winErr error
+		winner, winErr = rotate(t, svc, raw, u.ID)
+		return winErr
+	})
+	if !errors.Is(err, service.ErrRefreshTokenReused) {
+		t.Fatalf("RotateRefreshToken that lost the race = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := rotate(t, svc, winner, u.ID); !errors.Is(err, service.ErrInvalidRefreshToken) {
+		t.Fatalf("RotateRefreshToken of the winner's token = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRotatedRefreshTokensKeepTheFamilyExpiry(t *testing.T) {
+	ctx := context.Background()
+	svc, u := newTokenService(t, 400*time.Millisecond)
+	raw, _ := svc.IssueRefreshToken(ctx, u.ID)
+
+	time.Sleep(250 * time.Millisecond)
+	next, err := rotate(t, svc, raw, u.ID)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken before the expiry = %v", err)
+	}
+	// a fresh lifetime would last until 650ms
+	time.Sleep(250 * time.Millisecond)
+	if _, err := rotate(t, svc, next, u.ID); !errors.Is(err, service.ErrInvalidRefreshToken) {
+		t.Fatalf("RotateRefreshToken past the family expiry = %v, want ErrInvalidRefreshToken", err)
+	}
+}
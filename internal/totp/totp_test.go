@@ -0,0 +1,88 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of RFC 6238 Appendix B, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// the RFC lists 8-digit codes; 6 digits are their last six
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+		if err != nil || got != tc.want {
+			t.Errorf("Code at %d = %q, %v, want %q", tc.unix, got, err, tc.want)
+		}
+	}
+
+	// secrets are accepted in lowercase, as some apps show them
+	if got, _ := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0))); got != "287082" {
+		t.Errorf("Code with a lowercase secret = %q", got)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code with a malformed secret didn't fail")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	codeAt := func(step int64) string {
+		code, _ := Code(rfcSecret, step)
+		return code
+	}
+
+	tests := []struct {
+		name string
+		code string
+		skew int
+		step int64
+		ok   bool
+	}{
+		{"current step", codeAt(current), 1, current, true},
+		{"previous step", codeAt(current - 1), 1, current - 1, true},
+		{"next step", codeAt(current + 1), 1, current + 1, true},
+		{"two steps back", codeAt(current - 2), 1, 0, false},
+		{"two steps ahead", codeAt(current + 2), 1, 0, false},
+		{"previous step without skew", codeAt(current - 1), 0, 0, false},
+		{"surrounding spaces", " " + codeAt(current) + " ", 1, current, true},
+		{"too short", codeAt(current)[:5], 1, 0, false},
+		{"wrong code", "000000", 1, 0, false},
+	}
+	for _, tc := range tests {
+		step, ok := Validate(rfcSecret, tc.code, now, tc.skew)
+		if ok != tc.ok || step != tc.step {
+			t.Errorf("%s: Validate = %d, %v, want %d, %v", tc.name, step, ok, tc.step, tc.ok)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret = %v", err)
+	}
+	// 160 bits are 32 base32 characters
+	if len(secret) != 32 {
+		t.Fatalf("secret %q has %d characters, want 32", secret, len(secret))
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Fatalf("Code with a generated secret = %v", err)
+	}
+	if other, _ := GenerateSecret(); other == secret {
+		t.Fatal("GenerateSecret returned the same secret twice")
+	}
+}
@@ -1,6 +1,9 @@
 package validator
 
 import (
+	"reflect"
+	"server/internal/addressrules"
+
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 )
@@ -12,7 +15,9 @@ type CustomValidator struct {
 
 // New returns an echo.Validator
 func New() echo.Validator {
-    return &CustomValidator{validator: validator.New()}
+    v := validator.New()
+    registerAddressRules(v)
+    return &CustomValidator{validator: v}
 }
 
 type Normalizable interface {
@@ -26,4 +31,37 @@ func (cv *CustomValidator) Validate(i interface{}) error {
     }
 
     return cv.validator.Struct(i)
-}
\ No newline at end of file
+}
+
+// registerAddressRules adds the address tags:
+//
+//	country_code          an ISO 3166-1 alpha-2 code
+//	postal_code=Country   a postal code of the country in the sibling field
+//	state=Country         a state or province of the country in the sibling field
+//
+// The per-country tags pass when the country itself is invalid, so only
+// country_code reports it.
+func registerAddressRules(v *validator.Validate) {
+	_ = v.RegisterValidation("country_code", func(fl validator.FieldLevel) bool {
+		return addressrules.ValidCountry(fl.Field().String())
+	})
+	_ = v.RegisterValidation("postal_code", func(fl validator.FieldLevel) bool {
+		country, ok := siblingCountry(fl)
+		return !ok || addressrules.ValidPostalCode(country, fl.Field().String())
+	})
+	_ = v.RegisterValidation("state", func(fl validator.FieldLevel) bool {
+		country, ok := siblingCountry(fl)
+		return !ok || addressrules.ValidState(country, fl.Field().String())
+	})
+}
+
+// siblingCountry reads the country code from the field named by the tag
+// parameter; ok is false if it isn't a valid one
+func siblingCountry(fl validator.FieldLevel) (country string, ok bool) {
+	field := reflect.Indirect(fl.Parent()).FieldByName(fl.Param())
+	if !field.IsValid() || field.Kind() != reflect.String {
+		return "", false
+	}
+	country = field.String()
+	return country, addressrules.ValidCountry(country)
+}
@@ -0,0 +1,89 @@
+package validator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type place struct {
+	Zip     string `validate:"postal_code=Country"`
+	State   string `validate:"state=Country"`
+	Country string `validate:"country_code"`
+}
+
+// normalizedPlace normalizes its state like the address requests do
+type normalizedPlace struct {
+	State   string `validate:"state=Country"`
+	Country string `validate:"country_code"`
+}
+
+func (p *normalizedPlace) Normalize() {
+	if p.State == "new york" {
+		p.State = "NY"
+	}
+}
+
+func TestAddressRules(t *testing.T) {
+	tests := []struct {
+		name string
+		p    place
+		// failed lists the fields that fail, in order
+		failed []string
+	}{
+		{"valid DE", place{Zip: "10115", Country: "DE"}, nil},
+		{"valid US", place{Zip: "10118", State: "NY", Country: "US"}, nil},
+		{"valid GB", place{Zip: "SW1A 1AA", Country: "GB"}, nil},
+		{"no postal codes", place{Country: "AE"}, nil},
+		{"unknown country code", place{Zip: "10115", Country: "XX"}, []string{"Country"}},
+		{"country name", place{Zip: "10115", Country: "Germany"}, []string{"Country"}},
+		{"lowercase code", place{Zip: "10115", Country: "de"}, []string{"Country"}},
+		{"empty country", place{}, []string{"Country"}},
+		{"bad postal code", place{Zip: "1011", Country: "DE"}, []string{"Zip"}},
+		{"missing postal code", place{Country: "DE"}, []string{"Zip"}},
+		{"postal code without a system", place{Zip: "12345", Country: "AE"}, []string{"Zip"}},
+		{"missing state", place{Zip: "10118", Country: "US"}, []string{"State"}},
+		{"unknown state", place{Zip: "10118", State: "ZZ", Country: "US"}, []string{"State"}},
+		{"state of another country", place{Zip: "K1A 0B1", State: "NY", Country: "CA"}, []string{"State"}},
+		{"free-text state", place{Zip: "01000", State: "Ciudad de México", Country: "MX"}, nil},
+		// only country_code reports an invalid country
+		{"bad zip and country", place{Zip: "nope!", State: "nope", Country: "Atlantis"}, []string{"Country"}},
+	}
+
+	v := New()
+	for _, tc := range tests {
+		p := tc.p
+		err := v.Validate(&p)
+		var failed []string
+		var fieldErrs validator.ValidationErrors
+		if errors.As(err, &fieldErrs) {
+			for _, fieldErr := range fieldErrs {
+				failed = append(failed, fieldErr.StructField())
+			}
+		} else if err != nil {
+			t.Errorf("%s: Validate = %v", tc.name, err)
+			continue
+		}
+		if len(failed) != len(tc.failed) {
+			t.Errorf("%s: failed fields %v, want %v", tc.name, failed, tc.failed)
+			continue
+		}
+		for i := range failed {
+			if failed[i] != tc.failed[i] {
+				t.Errorf("%s: failed fields %v, want %v", tc.name, failed, tc.failed)
+				break
+			}
+		}
+	}
+}
+
+func TestValidateNormalizesFirst(t *testing.T) {
+	p := &normalizedPlace{State: "new york", Country: "US"}
+	if err := New().Validate(p); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+	if p.State != "NY" {
+		t.Fatalf("State = %q, want it normalized", p.State)
+	}
+}
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+  jti TEXT PRIMARY KEY,
+  u_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  revoked_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_at_idx ON revoked_tokens (expires_at);
+
+-- tokens issued before revoked_before are rejected ("log out all sessions")
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+  u_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  revoked_before TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,2 @@
+-- target address of a pending email change
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS new_email TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS passkey_ceremonies;
+DROP TABLE IF EXISTS passkey_credentials;
\ No newline at end of file
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS passkey_credentials (
+  id SERIAL UNIQUE PRIMARY KEY,
+  u_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  credential_id BYTEA NOT NULL UNIQUE,
+  name TEXT NOT NULL,
+  -- the WebAuthn credential (public key, sign count, flags, ...) as JSON
+  credential JSONB NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+  last_used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS passkey_credentials_u_id_idx ON passkey_credentials (u_id);
+
+-- challenge state between the begin and finish steps of a ceremony; u_id is NULL for logins
+CREATE TABLE IF NOT EXISTS passkey_ceremonies (
+  id TEXT PRIMARY KEY,
+  u_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+  session JSONB NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,10 @@
+-- failed password logins, keyed "email:<address>" or "ip:<address>";
+-- email keys are tracked whether or not an account exists
+CREATE TABLE IF NOT EXISTS login_failures (
+  key TEXT PRIMARY KEY,
+  failures INTEGER NOT NULL DEFAULT 0,
+  last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_last_failure_at_idx ON login_failures (last_failure_at);
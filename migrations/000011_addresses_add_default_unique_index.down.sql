@@ -0,0 +1 @@
+DROP INDEX IF EXISTS addresses_one_default_per_user_idx;
\ No newline at end of file
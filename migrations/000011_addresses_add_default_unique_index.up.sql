@@ -0,0 +1,14 @@
+-- keep only the most recently updated default of users that have several
+UPDATE addresses a
+   SET is_default = FALSE
+ WHERE a.is_default
+   AND EXISTS (
+         SELECT 1
+           FROM addresses b
+          WHERE b.u_id = a.u_id
+            AND b.is_default
+            AND (b.updated_at, b.id) > (a.updated_at, a.id)
+       );
+
+-- at most one default address per user
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_one_default_per_user_idx ON addresses (u_id) WHERE is_default;
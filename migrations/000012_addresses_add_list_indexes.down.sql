@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS addresses_u_id_updated_at_idx;
+DROP INDEX IF EXISTS addresses_u_id_created_at_idx;
+
+ALTER TABLE addresses ALTER COLUMN is_default DROP NOT NULL;
+ALTER TABLE addresses ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE addresses ALTER COLUMN created_at DROP NOT NULL;
\ No newline at end of file
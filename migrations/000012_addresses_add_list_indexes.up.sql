@@ -0,0 +1,12 @@
+-- keyset pagination compares (created_at, id) and (updated_at, id), which
+-- breaks on NULLs
+UPDATE addresses SET created_at = now() WHERE created_at IS NULL;
+UPDATE addresses SET updated_at = created_at WHERE updated_at IS NULL;
+UPDATE addresses SET is_default = FALSE WHERE is_default IS NULL;
+ALTER TABLE addresses ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE addresses ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE addresses ALTER COLUMN is_default SET NOT NULL;
+
+-- listing a user's addresses in either sort order
+CREATE INDEX IF NOT EXISTS addresses_u_id_created_at_idx ON addresses (u_id, created_at, id);
+CREATE INDEX IF NOT EXISTS addresses_u_id_updated_at_idx ON addresses (u_id, updated_at, id);
@@ -0,0 +1,3 @@
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS addresses_one_default_per_user;
+
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_one_default_per_user_idx ON addresses (u_id) WHERE is_default;
\ No newline at end of file
@@ -0,0 +1,9 @@
+-- a unique index is checked row by row, so a single UPDATE that moves the
+-- default from one address to another can trip over it; a deferrable
+-- constraint is checked at the end of the statement
+DROP INDEX IF EXISTS addresses_one_default_per_user_idx;
+
+ALTER TABLE addresses
+  ADD CONSTRAINT addresses_one_default_per_user
+  EXCLUDE USING btree (u_id WITH =) WHERE (is_default)
+  DEFERRABLE INITIALLY IMMEDIATE;
@@ -0,0 +1,2 @@
+-- bumped on every change; served as the ETag of the address
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+ALTER TABLE addresses DROP COLUMN IF EXISTS state;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- state or province; required by the address rules for some countries
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT '';
+
+-- country codes are stored uppercase; names are left for the next update
+-- of the address to normalize
+UPDATE addresses SET country = upper(btrim(country))
+ WHERE length(btrim(country)) = 2 AND country <> upper(btrim(country));
@@ -0,0 +1,13 @@
+DROP INDEX IF EXISTS addresses_u_id_type_idx;
+
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS addresses_one_default_per_type;
+
+-- only the shipping default stays a default
+UPDATE addresses SET is_default = FALSE WHERE is_default AND type <> 'shipping';
+ALTER TABLE addresses
+  ADD CONSTRAINT addresses_one_default_per_user
+  EXCLUDE USING btree (u_id WITH =) WHERE (is_default)
+  DEFERRABLE INITIALLY IMMEDIATE;
+
+ALTER TABLE addresses DROP COLUMN IF EXISTS label;
+ALTER TABLE addresses DROP COLUMN IF EXISTS type;
\ No newline at end of file
@@ -0,0 +1,14 @@
+-- existing addresses, and their default, become shipping addresses
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS type TEXT NOT NULL DEFAULT 'shipping'
+  CHECK (type IN ('shipping', 'billing', 'custom'));
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS label TEXT NOT NULL DEFAULT '';
+
+-- one default per user and type instead of per user
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS addresses_one_default_per_user;
+ALTER TABLE addresses
+  ADD CONSTRAINT addresses_one_default_per_type
+  EXCLUDE USING btree (u_id WITH =, type WITH =) WHERE (is_default)
+  DEFERRABLE INITIALLY IMMEDIATE;
+
+-- listing a user's addresses of one type
+CREATE INDEX IF NOT EXISTS addresses_u_id_type_idx ON addresses (u_id, type);
@@ -0,0 +1,5 @@
+-- without the column, soft-deleted addresses would come back
+DELETE FROM addresses WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS addresses_deleted_at_idx;
+ALTER TABLE addresses DROP COLUMN IF EXISTS deleted_at;
\ No newline at end of file
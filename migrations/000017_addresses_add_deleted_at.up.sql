@@ -0,0 +1,5 @@
+-- soft delete: deleted addresses are kept until the purge job removes them
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- the purge job looks for addresses deleted before the retention period
+CREATE INDEX IF NOT EXISTS addresses_deleted_at_idx ON addresses (deleted_at) WHERE deleted_at IS NOT NULL;
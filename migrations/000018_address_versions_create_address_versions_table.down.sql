@@ -0,0 +1 @@
+DROP TABLE IF EXISTS address_versions;
\ No newline at end of file
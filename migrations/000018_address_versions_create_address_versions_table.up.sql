@@ -0,0 +1,24 @@
+-- the state of an address before each update, for dispute resolution;
+-- purging the address removes its history too
+CREATE TABLE IF NOT EXISTS address_versions (
+  id SERIAL UNIQUE PRIMARY KEY,
+  address_id INTEGER NOT NULL REFERENCES addresses(id) ON DELETE CASCADE,
+  -- the version of the address this row was the state of
+  version INTEGER NOT NULL,
+  u_id INTEGER NOT NULL,
+  addr_1 TEXT NOT NULL,
+  addr_2 TEXT NOT NULL,
+  zip TEXT NOT NULL,
+  city TEXT NOT NULL,
+  state TEXT NOT NULL,
+  country TEXT NOT NULL,
+  type TEXT NOT NULL,
+  label TEXT NOT NULL,
+  is_default BOOLEAN NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  -- the user who made the change that replaced this state, and when
+  changed_by INTEGER NOT NULL,
+  changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  UNIQUE (address_id, version)
+);
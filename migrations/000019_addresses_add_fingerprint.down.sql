@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS addresses_u_id_fingerprint_idx;
+ALTER TABLE addresses DROP COLUMN IF EXISTS fingerprint;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- fingerprint of where an address is, to find duplicates on create; the
+-- service fills it in for existing addresses on startup
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS fingerprint TEXT NOT NULL DEFAULT '';
+
+-- looking up a user's address with a fingerprint
+CREATE INDEX IF NOT EXISTS addresses_u_id_fingerprint_idx ON addresses (u_id, fingerprint);
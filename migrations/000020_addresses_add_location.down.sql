@@ -0,0 +1,3 @@
+ALTER TABLE addresses DROP COLUMN IF EXISTS verified;
+ALTER TABLE addresses DROP COLUMN IF EXISTS lng;
+ALTER TABLE addresses DROP COLUMN IF EXISTS lat;
\ No newline at end of file
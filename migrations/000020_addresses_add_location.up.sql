@@ -0,0 +1,5 @@
+-- where the geocoder located an address; existing addresses are located on
+-- their next update
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS lat DOUBLE PRECISION;
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS lng DOUBLE PRECISION;
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,12 @@
+-- the second login step: each mfa_pending token (by its jti) allows a few
+-- code attempts and a single successful login
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+  jti TEXT PRIMARY KEY,
+  u_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  used_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS mfa_challenges_expires_at_idx ON mfa_challenges (expires_at);
@@ -0,0 +1,11 @@
+-- accounts created before email verification existed never got a
+-- verify_email token; count them as verified, so REQUIRE_EMAIL_VERIFICATION
+-- doesn't lock them out
+UPDATE users
+   SET email_verified_at = COALESCE(created_at, now())
+ WHERE email_verified_at IS NULL
+   AND NOT EXISTS (
+     SELECT 1 FROM user_tokens
+      WHERE user_tokens.u_id = users.id
+        AND user_tokens.purpose = 'verify_email'
+   );